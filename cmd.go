@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/blazingly-fast/auth-assistant/keys"
+)
+
+// runCommand runs one of the maintenance commands given on the command line
+func runCommand(km *keys.Manager, args []string) error {
+	switch args[0] {
+	case "rotate-keys":
+		fs := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+		compromised := fs.Bool("compromised", false, "reject tokens signed with the current key right away")
+		fs.Parse(args[1:])
+
+		return km.Rotate(*compromised)
+	}
+
+	return fmt.Errorf("unknown command %q", args[0])
+}
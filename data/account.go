@@ -4,35 +4,56 @@ import (
 	"database/sql"
 	"fmt"
 	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
 )
 
 // Account defines the structure for an API account
 type Account struct {
-	ID           int       `json:"id"`
-	FirstName    string    `json:"first_name" validate:"required,min=2,max=50,alpha"`
-	LastName     string    `json:"last_name" validate:"required,min=2,max=50,alpha"`
-	Email        string    `json:"email" validate:"required,email"`
-	Password     string    `json:"password" validate:"required,min=8,max=50,containsany=1-9,containsany=Aa-Zz,alphanumunicode"`
-	UserType     string    `json:"user_type" validate:"required,eq=ADMIN|eq=USER"`
-	Avatar       string    `json:"avatar"`
-	Uuid         string    `json:"uid" validate:"required,uuid"`
-	Token        string    `json:"token" validate:"jwt"`
-	RefreshToken string    `json:"refresh_token"`
-	CreatedOn    time.Time `json:"created_at"`
-	UpdatedOn    time.Time `json:"updated_at"`
+	ID               int       `json:"id"`
+	FirstName        string    `json:"first_name" validate:"required,min=2,max=50,alpha"`
+	LastName         string    `json:"last_name" validate:"required,min=2,max=50,alpha"`
+	Email            string    `json:"email" validate:"required,email"`
+	Password         string    `json:"password" validate:"required,min=8,max=50,containsany=1-9,containsany=Aa-Zz,alphanumunicode"`
+	UserType         string    `json:"user_type" validate:"required,eq=ADMIN|eq=USER"`
+	Avatar           string    `json:"avatar"`
+	Uuid             string    `json:"uid" validate:"required,uuid"`
+	TokenHash        string    `json:"-"`
+	RefreshTokenHash string    `json:"-"`
+	CreatedOn        time.Time `json:"created_at"`
+	UpdatedOn        time.Time `json:"updated_at"`
 }
 
+// NewAccount returns an account that keeps only hashes of its tokens
 func NewAccount(firstName, lastName, email, password, userType, avatar, uuid, token, refreshToken string) *Account {
 	return &Account{
-		FirstName:    firstName,
-		LastName:     lastName,
-		Email:        email,
-		Password:     password,
-		UserType:     userType,
-		Avatar:       avatar,
-		Uuid:         uuid,
-		Token:        token,
-		RefreshToken: refreshToken,
+		FirstName:        firstName,
+		LastName:         lastName,
+		Email:            email,
+		Password:         password,
+		UserType:         userType,
+		Avatar:           avatar,
+		Uuid:             uuid,
+		TokenHash:        util.HashToken(token),
+		RefreshTokenHash: util.HashToken(refreshToken),
+	}
+}
+
+// Profile returns the attributes of the account that may be copied into token
+// claims or served as user info, keyed by their OpenID Connect claim names.
+// The names TOKEN_CLAIMS used before are kept, so mappings written against
+// them still work.
+func (a *Account) Profile() map[string]interface{} {
+	return map[string]interface{}{
+		"name":        a.FirstName + " " + a.LastName,
+		"given_name":  a.FirstName,
+		"family_name": a.LastName,
+		"email":       a.Email,
+		"updated_at":  a.UpdatedOn.Unix(),
+		"first_name":  a.FirstName,
+		"last_name":   a.LastName,
+		"user_type":   a.UserType,
+		"avatar":      a.Avatar,
 	}
 }
 
@@ -53,29 +74,32 @@ type UpdateAccountRequest struct {
 }
 
 type LoginRequest struct {
-	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=8,max=50,containsany=1-9,containsany=Aa-Zz,alphanumunicode"`
+	Email      string `json:"email" validate:"required,email"`
+	Password   string `json:"password" validate:"required,min=8,max=50,containsany=1-9,containsany=Aa-Zz,alphanumunicode"`
+	DeviceName string `json:"device_name" validate:"max=100"`
 }
 
 type AccountResponse struct {
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Email     string `json:"email"`
-	UseryType string `json:"user_type"`
-	Avatar    string `json:"avatar"`
-	Uuid      string `json:"uuid"`
-	Token     string `json:"token"`
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	Email        string `json:"email"`
+	UseryType    string `json:"user_type"`
+	Avatar       string `json:"avatar"`
+	Uuid         string `json:"uuid"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
 }
 
-func NewAccountResponse(firstName, lastName, email, userType, avatar, uuid, token string) *AccountResponse {
+func NewAccountResponse(firstName, lastName, email, userType, avatar, uuid, token, refreshToken string) *AccountResponse {
 	return &AccountResponse{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-		UseryType: userType,
-		Avatar:    avatar,
-		Uuid:      uuid,
-		Token:     token,
+		FirstName:    firstName,
+		LastName:     lastName,
+		Email:        email,
+		UseryType:    userType,
+		Avatar:       avatar,
+		Uuid:         uuid,
+		Token:        token,
+		RefreshToken: refreshToken,
 	}
 }
 
@@ -93,7 +117,7 @@ var ErrAccountNotFound = fmt.Errorf("Account not found")
 
 func (s *PostgresStore) CreateAccout(acc *Account) error {
 	sql := `
-	insert into account(first_name, last_name, email, password, user_type, avatar, uuid, token, refresh_token)
+	insert into account(first_name, last_name, email, password, user_type, avatar, uuid, token_hash, refresh_token_hash)
 	values($1, $2, $3, $4, $5, $6, $7, $8, $9)
 `
 	_, err := s.db.Query(
@@ -104,8 +128,8 @@ func (s *PostgresStore) CreateAccout(acc *Account) error {
 		acc.UserType,
 		acc.Avatar,
 		acc.Uuid,
-		acc.Token,
-		acc.RefreshToken)
+		acc.TokenHash,
+		acc.RefreshTokenHash)
 	if err != nil {
 		return err
 	}
@@ -209,28 +233,12 @@ func (s *PostgresStore) UpdateAvatar(avatarURL, uuid string) error {
 }
 
 func (s *PostgresStore) UpdateAllTokens(token string, refreshToken string, id int) error {
-	rows, err := s.db.Query("select * from account where id=$1", id)
-	if err != nil {
-		return err
-	}
-
-	acc := &Account{}
-	for rows.Next() {
-		acc, err = scanIntoAccount(rows)
-	}
-	if err != nil {
-		return err
-	}
-
-	acc.Token = token
-	acc.RefreshToken = refreshToken
-
-	_, err = s.db.Exec("update account set token=$1, refresh_token=$2 where id=$3", acc.Token, acc.RefreshToken, id)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	_, err := s.db.Exec(
+		"update account set token_hash=$1, refresh_token_hash=$2 where id=$3",
+		util.HashToken(token),
+		util.HashToken(refreshToken),
+		id)
+	return err
 }
 
 func scanIntoAccount(rows *sql.Rows) (*Account, error) {
@@ -244,8 +252,8 @@ func scanIntoAccount(rows *sql.Rows) (*Account, error) {
 		&acc.UserType,
 		&acc.Avatar,
 		&acc.Uuid,
-		&acc.Token,
-		&acc.RefreshToken,
+		&acc.TokenHash,
+		&acc.RefreshTokenHash,
 		&acc.CreatedOn,
 		&acc.UpdatedOn,
 	)
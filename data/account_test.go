@@ -24,13 +24,7 @@ func createRandomAccount(t *testing.T) *Account {
 
 	uuid := uuid.New().String()
 
-	token, refreshToken, _ := util.GenerateAllToken(
-		req.FirstName,
-		req.LastName,
-		req.Email,
-		userType,
-		uuid,
-	)
+	token, refreshToken, _ := util.GenerateAllToken(util.NewClaimsBuilder(uuid).WithRoles(userType).Claims())
 	acc := NewAccount(
 		req.FirstName,
 		req.LastName,
@@ -63,7 +57,7 @@ func TestGetAccountByUUID(t *testing.T) {
 
 	require.Equal(t, randAcc.Email, acc.Email)
 	require.Equal(t, randAcc.Uuid, acc.Uuid)
-	require.Equal(t, randAcc.Token, acc.Token)
+	require.Equal(t, randAcc.TokenHash, acc.TokenHash)
 }
 
 func TestGetAccountByEmail(t *testing.T) {
@@ -76,7 +70,7 @@ func TestGetAccountByEmail(t *testing.T) {
 
 	require.Equal(t, randAcc.Email, acc.Email)
 	require.Equal(t, randAcc.Uuid, acc.Uuid)
-	require.Equal(t, randAcc.Token, acc.Token)
+	require.Equal(t, randAcc.TokenHash, acc.TokenHash)
 }
 
 func TestUpdateAccount(t *testing.T) {
@@ -133,3 +127,18 @@ func TestGetAccounts(t *testing.T) {
 		require.NotEmpty(t, account)
 	}
 }
+
+func TestAccountProfile(t *testing.T) {
+
+	randAcc := createRandomAccount(t)
+
+	profile := randAcc.Profile()
+
+	require.Equal(t, randAcc.FirstName, profile["given_name"])
+	require.Equal(t, randAcc.LastName, profile["family_name"])
+	// the names of the first token claims mappings still work
+	require.Equal(t, randAcc.FirstName, profile["first_name"])
+	require.Equal(t, randAcc.LastName, profile["last_name"])
+	require.Equal(t, randAcc.UserType, profile["user_type"])
+	require.Equal(t, randAcc.Avatar, profile["avatar"])
+}
@@ -0,0 +1,24 @@
+package data
+
+import "time"
+
+// UseAssertion records the JWT assertion jti of issuer as used until it
+// expires and reports whether it was used before, so each assertion is only
+// exchanged once
+func (s *PostgresStore) UseAssertion(issuer, jti string, expiresAt time.Time) (bool, error) {
+	sql := `
+	insert into used_assertion(issuer, jti, expires_at)
+	values($1, $2, $3)
+	on conflict (issuer, jti) do nothing
+	`
+	res, err := s.db.Exec(sql, issuer, jti, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 0, nil
+}
@@ -0,0 +1,28 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUseAssertion(t *testing.T) {
+	jti := uuid.New().String()
+	expiresAt := time.Now().Add(time.Minute)
+
+	used, err := testQueries.UseAssertion("https://partner.example.com", jti, expiresAt)
+	require.NoError(t, err)
+	require.False(t, used)
+
+	// every assertion is exchanged once
+	used, err = testQueries.UseAssertion("https://partner.example.com", jti, expiresAt)
+	require.NoError(t, err)
+	require.True(t, used)
+
+	// ids are only unique per issuer
+	used, err = testQueries.UseAssertion("https://other.example.com", jti, expiresAt)
+	require.NoError(t, err)
+	require.False(t, used)
+}
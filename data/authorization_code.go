@@ -0,0 +1,137 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/lib/pq"
+)
+
+// AuthorizationCode defines a code handed to a client at the end of the
+// authorization code flow, only its hash is stored. The code can be exchanged
+// for tokens once, by the client it was issued to and with the verifier of
+// CodeChallenge. It remembers how the account authenticated and the nonce of
+// the client, for the ID token.
+type AuthorizationCode struct {
+	ID            int       `json:"-"`
+	CodeHash      string    `json:"-"`
+	ClientID      string    `json:"client_id"`
+	AccountUuid   string    `json:"account_uuid"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scope         string    `json:"scope"`
+	CodeChallenge string    `json:"-"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	CreatedOn     time.Time `json:"created_at"`
+	Nonce         string    `json:"-"`
+	AuthTime      int64     `json:"auth_time"`
+	AMR           []string  `json:"amr"`
+}
+
+func NewAuthorizationCode(code string, req *AuthorizeRequest, accountUuid, scope string, authTime int64, amr []string, expiresAt time.Time) *AuthorizationCode {
+	return &AuthorizationCode{
+		CodeHash:      util.HashToken(code),
+		ClientID:      req.ClientID,
+		AccountUuid:   accountUuid,
+		RedirectURI:   req.RedirectURI,
+		Scope:         scope,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     expiresAt,
+		Nonce:         req.Nonce,
+		AuthTime:      authTime,
+		AMR:           amr,
+	}
+}
+
+// AuthorizeRequest defines the parameters of a request to the authorization
+// endpoint, for the authorization code flow with PKCE
+type AuthorizeRequest struct {
+	ResponseType        string `validate:"required,eq=code"`
+	ClientID            string `validate:"required"`
+	RedirectURI         string `validate:"required,uri"`
+	Scope               string
+	State               string
+	CodeChallenge       string `validate:"required,min=43,max=128"`
+	CodeChallengeMethod string `validate:"required,eq=S256"`
+	Nonce               string `validate:"max=255"`
+	Prompt              string `validate:"max=100"`
+}
+
+// TokenRequest defines the form parameters of a request to the token endpoint,
+// which ones are required depends on GrantType
+type TokenRequest struct {
+	GrantType          string `validate:"required"`
+	ClientID           string
+	Code               string
+	RedirectURI        string
+	CodeVerifier       string
+	RefreshToken       string
+	Scope              string
+	DeviceCode         string
+	SubjectToken       string
+	SubjectTokenType   string
+	RequestedTokenType string
+	Audience           string
+	Assertion          string
+}
+
+var ErrAuthorizationCodeNotFound = fmt.Errorf("Authorization code not found")
+
+func (s *PostgresStore) CreateAuthorizationCode(code *AuthorizationCode) error {
+	sql := `
+	insert into authorization_code(code_hash, client_id, account_uuid, redirect_uri, scope, code_challenge, expires_at, nonce, auth_time, amr)
+	values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+	_, err := s.db.Exec(sql,
+		code.CodeHash,
+		code.ClientID,
+		code.AccountUuid,
+		code.RedirectURI,
+		code.Scope,
+		code.CodeChallenge,
+		code.ExpiresAt,
+		code.Nonce,
+		code.AuthTime,
+		pq.Array(code.AMR))
+	return err
+}
+
+// ConsumeAuthorizationCode returns the code and deletes it in one statement,
+// so it can never be exchanged twice
+func (s *PostgresStore) ConsumeAuthorizationCode(code string) (*AuthorizationCode, error) {
+	rows, err := s.db.Query(`
+	delete from authorization_code
+	where code_hash=$1 and expires_at > now()
+	returning *
+	`, util.HashToken(code))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoAuthorizationCode(rows)
+	}
+
+	return nil, ErrAuthorizationCodeNotFound
+}
+
+func scanIntoAuthorizationCode(rows *sql.Rows) (*AuthorizationCode, error) {
+	code := &AuthorizationCode{}
+	err := rows.Scan(
+		&code.ID,
+		&code.CodeHash,
+		&code.ClientID,
+		&code.AccountUuid,
+		&code.RedirectURI,
+		&code.Scope,
+		&code.CodeChallenge,
+		&code.ExpiresAt,
+		&code.CreatedOn,
+		&code.Nonce,
+		&code.AuthTime,
+		pq.Array(&code.AMR),
+	)
+	return code, err
+}
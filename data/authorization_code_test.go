@@ -0,0 +1,47 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func createRandomAuthorizationCode(t *testing.T, expiresAt time.Time) string {
+	client := createRandomClient(t)
+	code := uuid.New().String()
+	req := &AuthorizeRequest{
+		ClientID:      client.ClientID,
+		RedirectURI:   client.RedirectURIs[0],
+		CodeChallenge: util.RandomString(43),
+		Nonce:         "nonce",
+	}
+
+	err := testQueries.CreateAuthorizationCode(NewAuthorizationCode(code, req, uuid.New().String(), "openid", time.Now().Unix(), []string{"pwd"}, expiresAt))
+
+	require.NoError(t, err)
+	return code
+}
+
+func TestConsumeAuthorizationCode(t *testing.T) {
+	code := createRandomAuthorizationCode(t, time.Now().Add(time.Minute))
+
+	found, err := testQueries.ConsumeAuthorizationCode(code)
+	require.NoError(t, err)
+	require.Equal(t, util.HashToken(code), found.CodeHash)
+	require.Equal(t, "nonce", found.Nonce)
+	require.Equal(t, []string{"pwd"}, found.AMR)
+
+	// a code is only exchanged once
+	_, err = testQueries.ConsumeAuthorizationCode(code)
+	require.ErrorIs(t, err, ErrAuthorizationCodeNotFound)
+}
+
+func TestConsumeExpiredAuthorizationCode(t *testing.T) {
+	code := createRandomAuthorizationCode(t, time.Now().Add(-time.Minute))
+
+	_, err := testQueries.ConsumeAuthorizationCode(code)
+	require.ErrorIs(t, err, ErrAuthorizationCodeNotFound)
+}
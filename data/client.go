@@ -0,0 +1,290 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Grant types a client can be allowed to use at the token endpoint
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+	GrantDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+	GrantTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+	GrantJWTBearer         = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// Ways a client can authenticate at the token endpoint. Public clients, such
+// as SPAs and mobile apps, can not keep a secret and use none.
+const (
+	AuthMethodNone              = "none"
+	AuthMethodClientSecretBasic = "client_secret_basic"
+	AuthMethodClientSecretPost  = "client_secret_post"
+)
+
+// Client defines an application registered to get tokens through OAuth, only
+// the hash of its secret is stored. Token lifetimes of 0 mean the defaults.
+// Users are asked to consent before any other than a first party client gets
+// access to their account.
+type Client struct {
+	ID                      int       `json:"-"`
+	ClientID                string    `json:"client_id"`
+	SecretHash              string    `json:"-"`
+	Name                    string    `json:"client_name"`
+	RedirectURIs            []string  `json:"redirect_uris"`
+	GrantTypes              []string  `json:"grant_types"`
+	Scope                   string    `json:"scope"`
+	TokenEndpointAuthMethod string    `json:"token_endpoint_auth_method"`
+	AccessTokenLifetime     int       `json:"access_token_lifetime"`
+	RefreshTokenLifetime    int       `json:"refresh_token_lifetime"`
+	FirstParty              bool      `json:"first_party"`
+	CreatedOn               time.Time `json:"created_at"`
+	UpdatedOn               time.Time `json:"updated_at"`
+}
+
+func NewClient(clientID, secretHash string, req *ClientRequest) *Client {
+	return &Client{
+		ClientID:                clientID,
+		SecretHash:              secretHash,
+		Name:                    req.Name,
+		RedirectURIs:            req.RedirectURIs,
+		GrantTypes:              req.GrantTypes,
+		Scope:                   req.Scope,
+		TokenEndpointAuthMethod: req.TokenEndpointAuthMethod,
+		AccessTokenLifetime:     req.AccessTokenLifetime,
+		RefreshTokenLifetime:    req.RefreshTokenLifetime,
+		FirstParty:              req.FirstParty,
+	}
+}
+
+// Public reports whether the client has no secret to authenticate with
+func (c *Client) Public() bool {
+	return c.TokenEndpointAuthMethod == AuthMethodNone
+}
+
+// AllowsGrant reports whether the client may use grantType
+func (c *Client) AllowsGrant(grantType string) bool {
+	for _, g := range c.GrantTypes {
+		if g == grantType {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsRedirectURI reports whether uri is registered for the client, it has
+// to match exactly
+func (c *Client) AllowsRedirectURI(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenLifetimes returns how long the access and refresh tokens issued to the
+// client are valid, falling back to access and refresh
+func (c *Client) TokenLifetimes(access, refresh time.Duration) (time.Duration, time.Duration) {
+	if c.AccessTokenLifetime > 0 {
+		access = time.Duration(c.AccessTokenLifetime) * time.Second
+	}
+	if c.RefreshTokenLifetime > 0 {
+		refresh = time.Duration(c.RefreshTokenLifetime) * time.Second
+	}
+	return access, refresh
+}
+
+// ClientRequest defines the metadata of a client, for admins and for dynamic
+// client registration. Lifetimes are in seconds and can not exceed the
+// defaults.
+type ClientRequest struct {
+	Name                    string   `json:"client_name" validate:"required,max=100"`
+	RedirectURIs            []string `json:"redirect_uris" validate:"max=10,dive,uri"`
+	GrantTypes              []string `json:"grant_types" validate:"required,min=1,dive,oneof=authorization_code refresh_token client_credentials urn:ietf:params:oauth:grant-type:device_code urn:ietf:params:oauth:grant-type:token-exchange urn:ietf:params:oauth:grant-type:jwt-bearer"`
+	Scope                   string   `json:"scope" validate:"max=500"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method" validate:"omitempty,oneof=none client_secret_basic client_secret_post"`
+	AccessTokenLifetime     int      `json:"access_token_lifetime" validate:"min=0,max=86400"`
+	RefreshTokenLifetime    int      `json:"refresh_token_lifetime" validate:"min=0,max=604800"`
+	FirstParty              bool     `json:"first_party"`
+}
+
+// ClientResponse defines a client as returned when it is registered or its
+// secret is reset, the only times the secret is shown
+type ClientResponse struct {
+	*Client
+	ClientSecret          string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt      int64  `json:"client_id_issued_at"`
+	ClientSecretExpiresAt int64  `json:"client_secret_expires_at"`
+}
+
+func NewClientResponse(client *Client, secret string) *ClientResponse {
+	return &ClientResponse{
+		Client:                client,
+		ClientSecret:          secret,
+		ClientIDIssuedAt:      client.CreatedOn.Unix(),
+		ClientSecretExpiresAt: 0,
+	}
+}
+
+var ErrClientNotFound = fmt.Errorf("Client not found")
+
+func (s *PostgresStore) CreateClient(client *Client) error {
+	sql := `
+	insert into oauth_client(client_id, secret_hash, name, redirect_uris, grant_types, scope, token_endpoint_auth_method, access_token_lifetime, refresh_token_lifetime, first_party)
+	values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	returning id, created_at, updated_at
+	`
+	return s.db.QueryRow(sql,
+		client.ClientID,
+		client.SecretHash,
+		client.Name,
+		pq.Array(client.RedirectURIs),
+		pq.Array(client.GrantTypes),
+		client.Scope,
+		client.TokenEndpointAuthMethod,
+		client.AccessTokenLifetime,
+		client.RefreshTokenLifetime,
+		client.FirstParty,
+	).Scan(&client.ID, &client.CreatedOn, &client.UpdatedOn)
+}
+
+func (s *PostgresStore) GetClients() ([]*Client, error) {
+	rows, err := s.db.Query("select * from oauth_client order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*Client{}
+	for rows.Next() {
+		client, err := scanIntoClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	return clients, rows.Err()
+}
+
+func (s *PostgresStore) GetClient(clientID string) (*Client, error) {
+	rows, err := s.db.Query("select * from oauth_client where client_id=$1", clientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoClient(rows)
+	}
+
+	return nil, ErrClientNotFound
+}
+
+// UpdateClient replaces the metadata of the client, its secret is kept
+func (s *PostgresStore) UpdateClient(client *Client) error {
+	sql := `
+	update oauth_client
+	set name=$1, redirect_uris=$2, grant_types=$3, scope=$4, token_endpoint_auth_method=$5,
+	access_token_lifetime=$6, refresh_token_lifetime=$7, first_party=$8, updated_at=now()
+	where client_id=$9
+	`
+	res, err := s.db.Exec(sql,
+		client.Name,
+		pq.Array(client.RedirectURIs),
+		pq.Array(client.GrantTypes),
+		client.Scope,
+		client.TokenEndpointAuthMethod,
+		client.AccessTokenLifetime,
+		client.RefreshTokenLifetime,
+		client.FirstParty,
+		client.ClientID)
+	if err != nil {
+		return err
+	}
+
+	count, _ := res.RowsAffected()
+	if count != 1 {
+		return ErrClientNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) UpdateClientSecret(clientID, secretHash string) error {
+	res, err := s.db.Exec(
+		"update oauth_client set secret_hash=$1, updated_at=now() where client_id=$2",
+		secretHash, clientID)
+	if err != nil {
+		return err
+	}
+
+	count, _ := res.RowsAffected()
+	if count != 1 {
+		return ErrClientNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) DeleteClient(clientID string) error {
+	res, err := s.db.Exec("delete from oauth_client where client_id=$1", clientID)
+	if err != nil {
+		return err
+	}
+
+	count, _ := res.RowsAffected()
+	if count != 1 {
+		return ErrClientNotFound
+	}
+	return nil
+}
+
+func scanIntoClient(rows *sql.Rows) (*Client, error) {
+	client := &Client{}
+	err := rows.Scan(
+		&client.ID,
+		&client.ClientID,
+		&client.SecretHash,
+		&client.Name,
+		pq.Array(&client.RedirectURIs),
+		pq.Array(&client.GrantTypes),
+		&client.Scope,
+		&client.TokenEndpointAuthMethod,
+		&client.AccessTokenLifetime,
+		&client.RefreshTokenLifetime,
+		&client.CreatedOn,
+		&client.UpdatedOn,
+		&client.FirstParty,
+	)
+	return client, err
+}
+
+var ErrConsentNotFound = fmt.Errorf("Consent not found")
+
+// GetConsent returns the scope the account consented to give the client
+func (s *PostgresStore) GetConsent(accountUuid, clientID string) (string, error) {
+	var scope string
+	err := s.db.QueryRow(
+		"select scope from oauth_consent where account_uuid=$1 and client_id=$2",
+		accountUuid, clientID).Scan(&scope)
+	if err == sql.ErrNoRows {
+		return "", ErrConsentNotFound
+	}
+	return scope, err
+}
+
+// SaveConsent records that the account consented to give the client scope,
+// replacing what it consented to before
+func (s *PostgresStore) SaveConsent(accountUuid, clientID, scope string) error {
+	sql := `
+	insert into oauth_consent(account_uuid, client_id, scope)
+	values($1, $2, $3)
+	on conflict (account_uuid, client_id) do update set scope=excluded.scope, updated_at=now()
+	`
+	_, err := s.db.Exec(sql, accountUuid, clientID, scope)
+	return err
+}
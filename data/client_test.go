@@ -0,0 +1,101 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func createRandomClient(t *testing.T) *Client {
+	req := &ClientRequest{
+		Name:                    util.RandomName(),
+		RedirectURIs:            []string{"https://app.example.com/callback"},
+		GrantTypes:              []string{GrantAuthorizationCode, GrantRefreshToken},
+		Scope:                   "openid email",
+		TokenEndpointAuthMethod: AuthMethodClientSecretBasic,
+	}
+	client := NewClient(uuid.New().String(), util.HashToken("secret"), req)
+
+	err := testQueries.CreateClient(client)
+
+	require.NoError(t, err)
+	require.NotZero(t, client.ID)
+	return client
+}
+
+func TestGetClient(t *testing.T) {
+	client := createRandomClient(t)
+
+	found, err := testQueries.GetClient(client.ClientID)
+
+	require.NoError(t, err)
+	require.Equal(t, client.RedirectURIs, found.RedirectURIs)
+	require.Equal(t, client.GrantTypes, found.GrantTypes)
+	require.Equal(t, client.SecretHash, found.SecretHash)
+
+	_, err = testQueries.GetClient(uuid.New().String())
+	require.ErrorIs(t, err, ErrClientNotFound)
+}
+
+func TestUpdateClient(t *testing.T) {
+	client := createRandomClient(t)
+	client.RedirectURIs = []string{"https://other.example.com/callback"}
+	client.AccessTokenLifetime = 600
+
+	err := testQueries.UpdateClient(client)
+	require.NoError(t, err)
+
+	found, err := testQueries.GetClient(client.ClientID)
+	require.NoError(t, err)
+	require.Equal(t, client.RedirectURIs, found.RedirectURIs)
+	require.Equal(t, 600, found.AccessTokenLifetime)
+	require.Equal(t, util.HashToken("secret"), found.SecretHash)
+}
+
+func TestDeleteClient(t *testing.T) {
+	client := createRandomClient(t)
+
+	err := testQueries.DeleteClient(client.ClientID)
+	require.NoError(t, err)
+
+	err = testQueries.DeleteClient(client.ClientID)
+	require.ErrorIs(t, err, ErrClientNotFound)
+}
+
+func TestUpdateClientFirstParty(t *testing.T) {
+	client := createRandomClient(t)
+	require.False(t, client.FirstParty)
+	client.FirstParty = true
+
+	err := testQueries.UpdateClient(client)
+	require.NoError(t, err)
+
+	found, err := testQueries.GetClient(client.ClientID)
+	require.NoError(t, err)
+	require.True(t, found.FirstParty)
+}
+
+func TestSaveConsent(t *testing.T) {
+	client := createRandomClient(t)
+	accountUuid := uuid.New().String()
+
+	_, err := testQueries.GetConsent(accountUuid, client.ClientID)
+	require.ErrorIs(t, err, ErrConsentNotFound)
+
+	err = testQueries.SaveConsent(accountUuid, client.ClientID, "openid")
+	require.NoError(t, err)
+	err = testQueries.SaveConsent(accountUuid, client.ClientID, "openid email")
+	require.NoError(t, err)
+
+	scope, err := testQueries.GetConsent(accountUuid, client.ClientID)
+	require.NoError(t, err)
+	require.Equal(t, "openid email", scope)
+
+	// consents go with their client
+	err = testQueries.DeleteClient(client.ClientID)
+	require.NoError(t, err)
+	_, err = testQueries.GetConsent(accountUuid, client.ClientID)
+	require.ErrorIs(t, err, ErrConsentNotFound)
+}
@@ -0,0 +1,189 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/lib/pq"
+)
+
+// States of a device code, the user approves or denies the pending request on
+// another device while the client polls the token endpoint
+const (
+	DeviceCodePending  = "pending"
+	DeviceCodeApproved = "approved"
+	DeviceCodeDenied   = "denied"
+)
+
+// DeviceCode defines a device authorization request of RFC 8628, only the hash
+// of the device code is stored. The user code is what the user types in on the
+// verification page, Interval is how many seconds the client has to wait
+// between polls.
+type DeviceCode struct {
+	ID             int        `json:"-"`
+	DeviceCodeHash string     `json:"-"`
+	UserCode       string     `json:"user_code"`
+	ClientID       string     `json:"client_id"`
+	Scope          string     `json:"scope"`
+	Status         string     `json:"status"`
+	AccountUuid    string     `json:"account_uuid"`
+	AuthTime       int64      `json:"auth_time"`
+	AMR            []string   `json:"amr"`
+	Interval       int        `json:"interval"`
+	PolledAt       *time.Time `json:"polled_at"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	CreatedOn      time.Time  `json:"created_at"`
+}
+
+func NewDeviceCode(deviceCode, userCode, clientID, scope string, interval time.Duration, expiresAt time.Time) *DeviceCode {
+	return &DeviceCode{
+		DeviceCodeHash: util.HashToken(deviceCode),
+		UserCode:       userCode,
+		ClientID:       clientID,
+		Scope:          scope,
+		Status:         DeviceCodePending,
+		Interval:       int(interval.Seconds()),
+		ExpiresAt:      expiresAt,
+	}
+}
+
+// Expired reports whether the user can no longer approve the request
+func (d *DeviceCode) Expired() bool {
+	return !d.ExpiresAt.After(time.Now())
+}
+
+// DeviceAuthorizationResponse defines the response of the device
+// authorization endpoint
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+var ErrDeviceCodeNotFound = fmt.Errorf("Device code not found")
+
+func (s *PostgresStore) CreateDeviceCode(code *DeviceCode) error {
+	sql := `
+	insert into device_code(device_code_hash, user_code, client_id, scope, status, interval, expires_at)
+	values($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := s.db.Exec(sql,
+		code.DeviceCodeHash,
+		code.UserCode,
+		code.ClientID,
+		code.Scope,
+		code.Status,
+		code.Interval,
+		code.ExpiresAt)
+	return err
+}
+
+// GetDeviceCode returns the request of a device code, expired or not, so the
+// client can be told its code expired
+func (s *PostgresStore) GetDeviceCode(deviceCode string) (*DeviceCode, error) {
+	rows, err := s.db.Query("select * from device_code where device_code_hash=$1", util.HashToken(deviceCode))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoDeviceCode(rows)
+	}
+
+	return nil, ErrDeviceCodeNotFound
+}
+
+// GetPendingDeviceCode returns the request a user code was issued for, as long
+// as it is still waiting for the user
+func (s *PostgresStore) GetPendingDeviceCode(userCode string) (*DeviceCode, error) {
+	rows, err := s.db.Query(`
+	select * from device_code
+	where user_code=$1 and status=$2 and expires_at > now()
+	`, userCode, DeviceCodePending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoDeviceCode(rows)
+	}
+
+	return nil, ErrDeviceCodeNotFound
+}
+
+// UpdateDeviceCode stores the decision of the user and the polling state of
+// the client. A decided request can not be decided again.
+func (s *PostgresStore) UpdateDeviceCode(code *DeviceCode) error {
+	res, err := s.db.Exec(`
+	update device_code
+	set status=$2, account_uuid=$3, auth_time=$4, amr=$5, interval=$6, polled_at=$7
+	where id=$1 and (status=$8 or status=$2)
+	`,
+		code.ID,
+		code.Status,
+		code.AccountUuid,
+		code.AuthTime,
+		pq.Array(code.AMR),
+		code.Interval,
+		code.PolledAt,
+		DeviceCodePending)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDeviceCodeNotFound
+	}
+	return nil
+}
+
+// ConsumeDeviceCode returns a decided request and deletes it in one
+// statement, so the client can only get tokens for it once
+func (s *PostgresStore) ConsumeDeviceCode(deviceCode string) (*DeviceCode, error) {
+	rows, err := s.db.Query(`
+	delete from device_code
+	where device_code_hash=$1 and status<>$2
+	returning *
+	`, util.HashToken(deviceCode), DeviceCodePending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoDeviceCode(rows)
+	}
+
+	return nil, ErrDeviceCodeNotFound
+}
+
+func scanIntoDeviceCode(rows *sql.Rows) (*DeviceCode, error) {
+	code := &DeviceCode{}
+	err := rows.Scan(
+		&code.ID,
+		&code.DeviceCodeHash,
+		&code.UserCode,
+		&code.ClientID,
+		&code.Scope,
+		&code.Status,
+		&code.AccountUuid,
+		&code.AuthTime,
+		pq.Array(&code.AMR),
+		&code.Interval,
+		&code.PolledAt,
+		&code.ExpiresAt,
+		&code.CreatedOn,
+	)
+	return code, err
+}
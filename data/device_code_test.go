@@ -0,0 +1,70 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func createRandomDeviceCode(t *testing.T) (string, *DeviceCode) {
+	deviceCode := uuid.New().String()
+	code := NewDeviceCode(deviceCode, util.RandomString(8), uuid.New().String(), "openid", 5*time.Second, time.Now().Add(time.Minute))
+
+	err := testQueries.CreateDeviceCode(code)
+	require.NoError(t, err)
+
+	found, err := testQueries.GetPendingDeviceCode(code.UserCode)
+	require.NoError(t, err)
+	require.NotZero(t, found.ID)
+	return deviceCode, found
+}
+
+func TestUpdateDeviceCode(t *testing.T) {
+	deviceCode, code := createRandomDeviceCode(t)
+
+	// polls keep the request pending
+	now := time.Now()
+	code.PolledAt, code.Interval = &now, 10
+	err := testQueries.UpdateDeviceCode(code)
+	require.NoError(t, err)
+
+	code.Status, code.AccountUuid, code.AuthTime, code.AMR = DeviceCodeApproved, uuid.New().String(), now.Unix(), []string{"pwd"}
+	err = testQueries.UpdateDeviceCode(code)
+	require.NoError(t, err)
+
+	found, err := testQueries.GetDeviceCode(deviceCode)
+	require.NoError(t, err)
+	require.Equal(t, DeviceCodeApproved, found.Status)
+	require.Equal(t, code.AccountUuid, found.AccountUuid)
+	require.Equal(t, []string{"pwd"}, found.AMR)
+	require.Equal(t, 10, found.Interval)
+	_, err = testQueries.GetPendingDeviceCode(code.UserCode)
+	require.ErrorIs(t, err, ErrDeviceCodeNotFound)
+
+	// a decided request can not be decided again
+	code.Status = DeviceCodeDenied
+	err = testQueries.UpdateDeviceCode(code)
+	require.ErrorIs(t, err, ErrDeviceCodeNotFound)
+}
+
+func TestConsumeDeviceCode(t *testing.T) {
+	deviceCode, code := createRandomDeviceCode(t)
+
+	// pending requests have no tokens to give
+	_, err := testQueries.ConsumeDeviceCode(deviceCode)
+	require.ErrorIs(t, err, ErrDeviceCodeNotFound)
+
+	code.Status = DeviceCodeApproved
+	err = testQueries.UpdateDeviceCode(code)
+	require.NoError(t, err)
+
+	found, err := testQueries.ConsumeDeviceCode(deviceCode)
+	require.NoError(t, err)
+	require.Equal(t, DeviceCodeApproved, found.Status)
+
+	_, err = testQueries.ConsumeDeviceCode(deviceCode)
+	require.ErrorIs(t, err, ErrDeviceCodeNotFound)
+}
@@ -0,0 +1,210 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// EmailOTP defines a one time code sent by email. Only the hashes of the code
+// and of the token it is verified with are stored, the token is the MFA token
+// of the login when the code is its second factor. IP is the address that
+// asked for the code, rows are kept after use for the rate limits.
+type EmailOTP struct {
+	ID          int        `json:"-"`
+	TokenHash   string     `json:"-"`
+	CodeHash    string     `json:"-"`
+	Purpose     string     `json:"purpose"`
+	Email       string     `json:"email"`
+	AccountUuid string     `json:"account_uuid"`
+	IP          string     `json:"ip"`
+	Attempts    int        `json:"attempts"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	UsedOn      *time.Time `json:"used_at"`
+	CreatedOn   time.Time  `json:"created_at"`
+}
+
+// purposes of an email OTP, the code of a magic link is the nonce of the
+// browser that asked for it
+const (
+	EmailOTPLogin     = "login"
+	EmailOTPMFA       = "mfa"
+	EmailOTPEnroll    = "enroll"
+	EmailOTPMagicLink = "magic_link"
+)
+
+func NewEmailOTP(token, code, purpose, email, accountUuid, ip string, expiresAt time.Time) *EmailOTP {
+	return &EmailOTP{
+		TokenHash:   util.HashToken(token),
+		CodeHash:    util.HashToken(code),
+		Purpose:     purpose,
+		Email:       email,
+		AccountUuid: accountUuid,
+		IP:          ip,
+		ExpiresAt:   expiresAt,
+	}
+}
+
+// EmailOTPResponse defines the answer to a request for a code, OTPToken is
+// sent back along with the code
+type EmailOTPResponse struct {
+	Message   string `json:"message"`
+	OTPToken  string `json:"otp_token,omitempty"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+type EmailLoginRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type MagicLinkRequest struct {
+	Email      string `json:"email" validate:"required,email"`
+	DeviceName string `json:"device_name" validate:"max=100"`
+}
+
+type EmailOTPRequest struct {
+	OTPToken   string `json:"otp_token" validate:"required"`
+	Code       string `json:"code" validate:"required,numeric,len=6"`
+	DeviceName string `json:"device_name"`
+}
+
+var ErrEmailOTPNotFound = fmt.Errorf("Email OTP not found")
+
+// CreateEmailOTP stores a new code, the codes sent for the same token before
+// can not be used anymore
+func (s *PostgresStore) CreateEmailOTP(o *EmailOTP) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("update email_otp set used_at=now() where token_hash=$1 and used_at is null", o.TokenHash)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(`
+	insert into email_otp(token_hash, code_hash, purpose, email, account_uuid, ip, expires_at)
+	values($1, $2, $3, $4, $5, $6, $7)
+	returning id, created_at
+	`,
+		o.TokenHash,
+		o.CodeHash,
+		o.Purpose,
+		o.Email,
+		o.AccountUuid,
+		o.IP,
+		o.ExpiresAt).Scan(&o.ID, &o.CreatedOn)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetEmailOTP returns the code sent for token last, until it is used or
+// expires
+func (s *PostgresStore) GetEmailOTP(token string) (*EmailOTP, error) {
+	rows, err := s.db.Query(`
+	select * from email_otp
+	where token_hash=$1 and used_at is null and expires_at > now()
+	order by created_at desc
+	limit 1
+	`, util.HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoEmailOTP(rows)
+	}
+
+	return nil, ErrEmailOTPNotFound
+}
+
+// FailEmailOTP counts a wrong code sent for the code id and returns how many
+// were sent so far
+func (s *PostgresStore) FailEmailOTP(id int) (int, error) {
+	var attempts int
+	err := s.db.QueryRow(`
+	update email_otp
+	set attempts=attempts+1
+	where id=$1
+	returning attempts
+	`, id).Scan(&attempts)
+	if err == sql.ErrNoRows {
+		return 0, ErrEmailOTPNotFound
+	}
+	return attempts, err
+}
+
+// UseEmailOTP marks the code id as used, it fails with ErrEmailOTPNotFound
+// when it was used before
+func (s *PostgresStore) UseEmailOTP(id int) error {
+	res, err := s.db.Exec("update email_otp set used_at=now() where id=$1 and used_at is null", id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrEmailOTPNotFound
+	}
+	return nil
+}
+
+// CountEmailOTPs returns how many codes were sent to email and how many were
+// asked for from ip since since
+func (s *PostgresStore) CountEmailOTPs(email, ip string, since time.Time) (int, int, error) {
+	var byEmail, byIP int
+	err := s.db.QueryRow(`
+	select
+	  count(*) filter (where email=$1),
+	  count(*) filter (where ip=$2)
+	from email_otp
+	where created_at > $3 and (email=$1 or ip=$2)
+	`, email, ip, since).Scan(&byEmail, &byIP)
+	return byEmail, byIP, err
+}
+
+// SetEmailMFA turns email codes as the second factor of the account on or off
+func (s *PostgresStore) SetEmailMFA(accountUuid string, enabled bool) error {
+	sql := "delete from email_mfa where account_uuid=$1"
+	if enabled {
+		sql = "insert into email_mfa(account_uuid) values($1) on conflict (account_uuid) do nothing"
+	}
+	_, err := s.db.Exec(sql, accountUuid)
+	return err
+}
+
+// GetEmailMFA reports whether email codes are a second factor of the account
+func (s *PostgresStore) GetEmailMFA(accountUuid string) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRow("select exists(select 1 from email_mfa where account_uuid=$1)", accountUuid).Scan(&enabled)
+	return enabled, err
+}
+
+func scanIntoEmailOTP(rows *sql.Rows) (*EmailOTP, error) {
+	o := &EmailOTP{}
+	err := rows.Scan(
+		&o.ID,
+		&o.TokenHash,
+		&o.CodeHash,
+		&o.Purpose,
+		&o.Email,
+		&o.AccountUuid,
+		&o.IP,
+		&o.Attempts,
+		&o.ExpiresAt,
+		&o.UsedOn,
+		&o.CreatedOn,
+	)
+	return o, err
+}
@@ -0,0 +1,98 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func createRandomEmailOTP(t *testing.T, token, code, email, ip string) *EmailOTP {
+	otp := NewEmailOTP(token, code, EmailOTPLogin, email, uuid.New().String(), ip, time.Now().Add(time.Minute))
+
+	err := testQueries.CreateEmailOTP(otp)
+
+	require.NoError(t, err)
+	require.NotZero(t, otp.ID)
+	return otp
+}
+
+func TestCreateEmailOTP(t *testing.T) {
+	token := uuid.New().String()
+	first := createRandomEmailOTP(t, token, "123456", util.RandomEmail(), "")
+
+	found, err := testQueries.GetEmailOTP(token)
+	require.NoError(t, err)
+	require.Equal(t, first.ID, found.ID)
+
+	// a new code for the token replaces the one sent before
+	second := createRandomEmailOTP(t, token, "654321", util.RandomEmail(), "")
+	found, err = testQueries.GetEmailOTP(token)
+	require.NoError(t, err)
+	require.Equal(t, second.ID, found.ID)
+	require.Equal(t, util.HashToken("654321"), found.CodeHash)
+
+	err = testQueries.UseEmailOTP(first.ID)
+	require.ErrorIs(t, err, ErrEmailOTPNotFound)
+}
+
+func TestUseEmailOTP(t *testing.T) {
+	token := uuid.New().String()
+	otp := createRandomEmailOTP(t, token, "123456", util.RandomEmail(), "")
+
+	attempts, err := testQueries.FailEmailOTP(otp.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, attempts)
+
+	err = testQueries.UseEmailOTP(otp.ID)
+	require.NoError(t, err)
+
+	// every code is used once
+	err = testQueries.UseEmailOTP(otp.ID)
+	require.ErrorIs(t, err, ErrEmailOTPNotFound)
+	_, err = testQueries.GetEmailOTP(token)
+	require.ErrorIs(t, err, ErrEmailOTPNotFound)
+}
+
+func TestCountEmailOTPs(t *testing.T) {
+	email, ip := util.RandomEmail(), uuid.New().String()
+	since := time.Now().Add(-time.Minute)
+
+	createRandomEmailOTP(t, uuid.New().String(), "123456", email, ip)
+	otp := createRandomEmailOTP(t, uuid.New().String(), "123456", email, "")
+	createRandomEmailOTP(t, uuid.New().String(), "123456", util.RandomEmail(), ip)
+
+	// used codes still count
+	err := testQueries.UseEmailOTP(otp.ID)
+	require.NoError(t, err)
+
+	byEmail, byIP, err := testQueries.CountEmailOTPs(email, ip, since)
+	require.NoError(t, err)
+	require.Equal(t, 2, byEmail)
+	require.Equal(t, 2, byIP)
+
+	byEmail, byIP, err = testQueries.CountEmailOTPs(email, ip, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Zero(t, byEmail)
+	require.Zero(t, byIP)
+}
+
+func TestSetEmailMFA(t *testing.T) {
+	accountUuid := uuid.New().String()
+
+	err := testQueries.SetEmailMFA(accountUuid, true)
+	require.NoError(t, err)
+	err = testQueries.SetEmailMFA(accountUuid, true)
+	require.NoError(t, err)
+	enabled, err := testQueries.GetEmailMFA(accountUuid)
+	require.NoError(t, err)
+	require.True(t, enabled)
+
+	err = testQueries.SetEmailMFA(accountUuid, false)
+	require.NoError(t, err)
+	enabled, err = testQueries.GetEmailMFA(accountUuid)
+	require.NoError(t, err)
+	require.False(t, enabled)
+}
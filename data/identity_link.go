@@ -0,0 +1,103 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// IdentityLink defines an identity at an upstream OpenID Connect provider that
+// can sign in to an account. An account can link any number of identities,
+// an identity only one account.
+type IdentityLink struct {
+	ID          int       `json:"-"`
+	Provider    string    `json:"provider"`
+	Subject     string    `json:"subject"`
+	AccountUuid string    `json:"account_uuid"`
+	Email       string    `json:"email"`
+	CreatedOn   time.Time `json:"created_at"`
+}
+
+func NewIdentityLink(provider, subject, accountUuid, email string) *IdentityLink {
+	return &IdentityLink{
+		Provider:    provider,
+		Subject:     subject,
+		AccountUuid: accountUuid,
+		Email:       email,
+	}
+}
+
+var ErrIdentityLinkNotFound = fmt.Errorf("Identity link not found")
+
+func (s *PostgresStore) CreateIdentityLink(link *IdentityLink) error {
+	sql := `
+	insert into identity_link(provider, subject, account_uuid, email)
+	values($1, $2, $3, $4)
+	returning id, created_at
+	`
+	return s.db.QueryRow(sql, link.Provider, link.Subject, link.AccountUuid, link.Email).Scan(&link.ID, &link.CreatedOn)
+}
+
+// GetIdentityLink returns the link of the identity subject at provider
+func (s *PostgresStore) GetIdentityLink(provider, subject string) (*IdentityLink, error) {
+	rows, err := s.db.Query("select * from identity_link where provider=$1 and subject=$2", provider, subject)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoIdentityLink(rows)
+	}
+
+	return nil, ErrIdentityLinkNotFound
+}
+
+// GetIdentityLinks returns every identity linked to the account
+func (s *PostgresStore) GetIdentityLinks(accountUuid string) ([]*IdentityLink, error) {
+	rows, err := s.db.Query("select * from identity_link where account_uuid=$1 order by created_at", accountUuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []*IdentityLink{}
+	for rows.Next() {
+		link, err := scanIntoIdentityLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+// DeleteIdentityLink unlinks an identity from the account
+func (s *PostgresStore) DeleteIdentityLink(accountUuid, provider, subject string) error {
+	res, err := s.db.Exec(
+		"delete from identity_link where account_uuid=$1 and provider=$2 and subject=$3",
+		accountUuid, provider, subject)
+	if err != nil {
+		return err
+	}
+
+	count, _ := res.RowsAffected()
+	if count != 1 {
+		return ErrIdentityLinkNotFound
+	}
+	return nil
+}
+
+func scanIntoIdentityLink(rows *sql.Rows) (*IdentityLink, error) {
+	link := &IdentityLink{}
+	err := rows.Scan(
+		&link.ID,
+		&link.Provider,
+		&link.Subject,
+		&link.AccountUuid,
+		&link.Email,
+		&link.CreatedOn,
+	)
+	return link, err
+}
@@ -0,0 +1,53 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func createRandomIdentityLink(t *testing.T, accountUuid string) *IdentityLink {
+	link := NewIdentityLink("google", uuid.New().String(), accountUuid, "john@mail.com")
+
+	err := testQueries.CreateIdentityLink(link)
+
+	require.NoError(t, err)
+	require.NotZero(t, link.ID)
+	return link
+}
+
+func TestGetIdentityLink(t *testing.T) {
+	link := createRandomIdentityLink(t, uuid.New().String())
+
+	found, err := testQueries.GetIdentityLink(link.Provider, link.Subject)
+	require.NoError(t, err)
+	require.Equal(t, link.AccountUuid, found.AccountUuid)
+
+	_, err = testQueries.GetIdentityLink("other", link.Subject)
+	require.ErrorIs(t, err, ErrIdentityLinkNotFound)
+
+	// an identity signs in to a single account
+	err = testQueries.CreateIdentityLink(NewIdentityLink(link.Provider, link.Subject, uuid.New().String(), ""))
+	require.Error(t, err)
+}
+
+func TestDeleteIdentityLink(t *testing.T) {
+	accountUuid := uuid.New().String()
+	link := createRandomIdentityLink(t, accountUuid)
+	createRandomIdentityLink(t, accountUuid)
+
+	links, err := testQueries.GetIdentityLinks(accountUuid)
+	require.NoError(t, err)
+	require.Len(t, links, 2)
+
+	// only the account the identity is linked to unlinks it
+	err = testQueries.DeleteIdentityLink(uuid.New().String(), link.Provider, link.Subject)
+	require.ErrorIs(t, err, ErrIdentityLinkNotFound)
+
+	err = testQueries.DeleteIdentityLink(accountUuid, link.Provider, link.Subject)
+	require.NoError(t, err)
+	links, err = testQueries.GetIdentityLinks(accountUuid)
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+}
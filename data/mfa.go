@@ -0,0 +1,328 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// TOTPCredential defines the TOTP authenticator of an account. Secret is
+// sealed with util.Encrypt, LastStep is the last time step a code was used for
+// so codes can not be replayed. Codes only count as a second factor once the
+// account confirmed the enrollment with a first code.
+type TOTPCredential struct {
+	AccountUuid string     `json:"-"`
+	Secret      string     `json:"-"`
+	Confirmed   bool       `json:"confirmed"`
+	LastStep    int64      `json:"-"`
+	CreatedOn   time.Time  `json:"created_at"`
+	ConfirmedOn *time.Time `json:"confirmed_at"`
+}
+
+// NewTOTPCredential seals secret for the account accountUuid
+func NewTOTPCredential(accountUuid, secret string) (*TOTPCredential, error) {
+	sealed, err := util.Encrypt([]byte(secret))
+	if err != nil {
+		return nil, err
+	}
+	return &TOTPCredential{AccountUuid: accountUuid, Secret: sealed}, nil
+}
+
+// PlainSecret returns the secret the codes are derived from
+func (c *TOTPCredential) PlainSecret() (string, error) {
+	b, err := util.Decrypt(c.Secret)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// MaxMFAAttempts is how many wrong codes a challenge takes before it is
+// dropped and the login has to start over with the first factor
+const MaxMFAAttempts = 5
+
+// MFAChallenge defines the second step of a login whose first factor was
+// checked, only the hash of the MFA token is stored. FirstFactor is the
+// authentication method of that first step, pwd or fed. Attempts counts the
+// wrong codes sent for it.
+type MFAChallenge struct {
+	ID          int       `json:"-"`
+	TokenHash   string    `json:"-"`
+	AccountUuid string    `json:"account_uuid"`
+	DeviceName  string    `json:"device_name"`
+	Attempts    int       `json:"attempts"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedOn   time.Time `json:"created_at"`
+	FirstFactor string    `json:"first_factor"`
+}
+
+func NewMFAChallenge(token, accountUuid, deviceName, firstFactor string, expiresAt time.Time) *MFAChallenge {
+	return &MFAChallenge{
+		TokenHash:   util.HashToken(token),
+		AccountUuid: accountUuid,
+		DeviceName:  deviceName,
+		FirstFactor: firstFactor,
+		ExpiresAt:   expiresAt,
+	}
+}
+
+// MFAChallengeResponse defines the answer to a correct password of an account
+// that has to complete the login with a second factor. Methods are the ways
+// to complete it, totp, webauthn, email or recovery_code. EnrollmentRequired means
+// the account has to set up TOTP first, with the MFA token.
+type MFAChallengeResponse struct {
+	Message            string   `json:"message"`
+	MFARequired        bool     `json:"mfa_required"`
+	MFAToken           string   `json:"mfa_token"`
+	ExpiresIn          int      `json:"expires_in"`
+	Methods            []string `json:"methods"`
+	EnrollmentRequired bool     `json:"enrollment_required"`
+}
+
+// TOTPEnrollmentResponse defines the secret of a new TOTP enrollment and the
+// otpauth:// URI authenticator apps import it from. RecoveryCodes are only
+// set for the first second factor of an account.
+type TOTPEnrollmentResponse struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"uri"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// MFAStatusResponse defines the second factors of an account and how many of
+// its recovery codes are left
+type MFAStatusResponse struct {
+	TOTP          bool `json:"totp"`
+	WebAuthn      bool `json:"webauthn"`
+	Email         bool `json:"email"`
+	RecoveryCodes int  `json:"recovery_codes"`
+	Required      bool `json:"required"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	Code     string `json:"code" validate:"required,numeric,len=6"`
+}
+
+type MFAEnrollRequest struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code" validate:"required,numeric,len=6"`
+}
+
+var ErrTOTPCredentialNotFound = fmt.Errorf("TOTP credential not found")
+var ErrTOTPAlreadyEnabled = fmt.Errorf("TOTP is already enabled")
+var ErrMFAChallengeNotFound = fmt.Errorf("MFA challenge not found")
+
+// SaveTOTPCredential stores a new enrollment, replacing one that was never
+// confirmed. A confirmed credential is only replaced after it is deleted.
+func (s *PostgresStore) SaveTOTPCredential(c *TOTPCredential) error {
+	sql := `
+	insert into totp_credential(account_uuid, secret)
+	values($1, $2)
+	on conflict (account_uuid) do update
+	set secret=excluded.secret, confirmed=false, last_step=0, created_at=now(), confirmed_at=null
+	where totp_credential.confirmed=false
+	`
+	res, err := s.db.Exec(sql, c.AccountUuid, c.Secret)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetTOTPCredential(accountUuid string) (*TOTPCredential, error) {
+	rows, err := s.db.Query("select * from totp_credential where account_uuid=$1", accountUuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoTOTPCredential(rows)
+	}
+
+	return nil, ErrTOTPCredentialNotFound
+}
+
+// ConfirmTOTPCredential turns the enrollment of the account on with the code
+// of step
+func (s *PostgresStore) ConfirmTOTPCredential(accountUuid string, step int64) error {
+	sql := `
+	update totp_credential
+	set confirmed=true, confirmed_at=now(), last_step=$2
+	where account_uuid=$1 and confirmed=false
+	`
+	res, err := s.db.Exec(sql, accountUuid, step)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTOTPCredentialNotFound
+	}
+	return nil
+}
+
+// UseTOTPStep records that the code of step was used and reports whether a
+// code of step or a later one was used before
+func (s *PostgresStore) UseTOTPStep(accountUuid string, step int64) (bool, error) {
+	sql := `
+	update totp_credential
+	set last_step=$2
+	where account_uuid=$1 and confirmed=true and last_step < $2
+	`
+	res, err := s.db.Exec(sql, accountUuid, step)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 0, nil
+}
+
+func (s *PostgresStore) DeleteTOTPCredential(accountUuid string) error {
+	res, err := s.db.Exec("delete from totp_credential where account_uuid=$1", accountUuid)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTOTPCredentialNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) CreateMFAChallenge(c *MFAChallenge) error {
+	sql := `
+	insert into mfa_challenge(token_hash, account_uuid, device_name, expires_at, first_factor)
+	values($1, $2, $3, $4, $5)
+	`
+	_, err := s.db.Exec(sql, c.TokenHash, c.AccountUuid, c.DeviceName, c.ExpiresAt, c.FirstFactor)
+	return err
+}
+
+// GetMFAChallenge returns the challenge of the MFA token token until it
+// expires or took MaxMFAAttempts wrong codes
+func (s *PostgresStore) GetMFAChallenge(token string) (*MFAChallenge, error) {
+	rows, err := s.db.Query(
+		"select * from mfa_challenge where token_hash=$1 and expires_at > now() and attempts < $2",
+		util.HashToken(token), MaxMFAAttempts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoMFAChallenge(rows)
+	}
+
+	return nil, ErrMFAChallengeNotFound
+}
+
+// FailMFAChallenge counts a wrong code sent for the challenge of token and
+// returns how many were sent so far
+func (s *PostgresStore) FailMFAChallenge(token string) (int, error) {
+	var attempts int
+	err := s.db.QueryRow(`
+	update mfa_challenge
+	set attempts=attempts+1
+	where token_hash=$1
+	returning attempts
+	`, util.HashToken(token)).Scan(&attempts)
+	if err == sql.ErrNoRows {
+		return 0, ErrMFAChallengeNotFound
+	}
+	return attempts, err
+}
+
+// ConsumeMFAChallenge returns the challenge of token and deletes it in one
+// statement, so a login is only completed once
+func (s *PostgresStore) ConsumeMFAChallenge(token string) (*MFAChallenge, error) {
+	rows, err := s.db.Query(`
+	delete from mfa_challenge
+	where token_hash=$1 and expires_at > now() and attempts < $2
+	returning *
+	`, util.HashToken(token), MaxMFAAttempts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoMFAChallenge(rows)
+	}
+
+	return nil, ErrMFAChallengeNotFound
+}
+
+// CountMFAAttempt records a second factor sent for the account, before it is
+// checked, and returns how many were sent since since and not cleared
+func (s *PostgresStore) CountMFAAttempt(accountUuid string, since time.Time) (int, error) {
+	if _, err := s.db.Exec("insert into mfa_attempt(account_uuid) values($1)", accountUuid); err != nil {
+		return 0, err
+	}
+
+	var attempts int
+	err := s.db.QueryRow(
+		"select count(*) from mfa_attempt where account_uuid=$1 and created_at > $2",
+		accountUuid, since).Scan(&attempts)
+	return attempts, err
+}
+
+// ClearMFAAttempts forgets the second factors sent for the account, once one
+// was right
+func (s *PostgresStore) ClearMFAAttempts(accountUuid string) error {
+	_, err := s.db.Exec("delete from mfa_attempt where account_uuid=$1", accountUuid)
+	return err
+}
+
+func scanIntoTOTPCredential(rows *sql.Rows) (*TOTPCredential, error) {
+	c := &TOTPCredential{}
+	err := rows.Scan(
+		&c.AccountUuid,
+		&c.Secret,
+		&c.Confirmed,
+		&c.LastStep,
+		&c.CreatedOn,
+		&c.ConfirmedOn,
+	)
+	return c, err
+}
+
+func scanIntoMFAChallenge(rows *sql.Rows) (*MFAChallenge, error) {
+	c := &MFAChallenge{}
+	err := rows.Scan(
+		&c.ID,
+		&c.TokenHash,
+		&c.AccountUuid,
+		&c.DeviceName,
+		&c.Attempts,
+		&c.ExpiresAt,
+		&c.CreatedOn,
+		&c.FirstFactor,
+	)
+	return c, err
+}
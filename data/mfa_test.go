@@ -0,0 +1,123 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func createRandomTOTPCredential(t *testing.T) *TOTPCredential {
+	cred, err := NewTOTPCredential(uuid.New().String(), "JBSWY3DPEHPK3PXP")
+	require.NoError(t, err)
+
+	err = testQueries.SaveTOTPCredential(cred)
+	require.NoError(t, err)
+	return cred
+}
+
+func TestConfirmTOTPCredential(t *testing.T) {
+	cred := createRandomTOTPCredential(t)
+
+	err := testQueries.ConfirmTOTPCredential(cred.AccountUuid, 100)
+	require.NoError(t, err)
+
+	found, err := testQueries.GetTOTPCredential(cred.AccountUuid)
+	require.NoError(t, err)
+	require.True(t, found.Confirmed)
+	require.Equal(t, int64(100), found.LastStep)
+
+	// a confirmed credential is only replaced once it is deleted
+	err = testQueries.SaveTOTPCredential(cred)
+	require.ErrorIs(t, err, ErrTOTPAlreadyEnabled)
+	err = testQueries.ConfirmTOTPCredential(cred.AccountUuid, 101)
+	require.ErrorIs(t, err, ErrTOTPCredentialNotFound)
+}
+
+func TestUseTOTPStep(t *testing.T) {
+	cred := createRandomTOTPCredential(t)
+
+	// codes of an unconfirmed enrollment are not second factors
+	used, err := testQueries.UseTOTPStep(cred.AccountUuid, 101)
+	require.NoError(t, err)
+	require.True(t, used)
+
+	err = testQueries.ConfirmTOTPCredential(cred.AccountUuid, 100)
+	require.NoError(t, err)
+
+	// the code of the confirmation can not be used again
+	used, err = testQueries.UseTOTPStep(cred.AccountUuid, 100)
+	require.NoError(t, err)
+	require.True(t, used)
+
+	used, err = testQueries.UseTOTPStep(cred.AccountUuid, 102)
+	require.NoError(t, err)
+	require.False(t, used)
+
+	// nor can a code of the same or an earlier step
+	used, err = testQueries.UseTOTPStep(cred.AccountUuid, 102)
+	require.NoError(t, err)
+	require.True(t, used)
+	used, err = testQueries.UseTOTPStep(cred.AccountUuid, 101)
+	require.NoError(t, err)
+	require.True(t, used)
+}
+
+func TestMFAChallengeAttempts(t *testing.T) {
+	token := uuid.New().String()
+	challenge := NewMFAChallenge(token, uuid.New().String(), "laptop", "fed", time.Now().Add(time.Minute))
+	err := testQueries.CreateMFAChallenge(challenge)
+	require.NoError(t, err)
+
+	found, err := testQueries.GetMFAChallenge(token)
+	require.NoError(t, err)
+	require.Equal(t, "fed", found.FirstFactor)
+
+	for i := 1; i <= MaxMFAAttempts; i++ {
+		attempts, err := testQueries.FailMFAChallenge(token)
+		require.NoError(t, err)
+		require.Equal(t, i, attempts)
+	}
+
+	// a challenge that took too many wrong codes can not complete a login
+	_, err = testQueries.GetMFAChallenge(token)
+	require.ErrorIs(t, err, ErrMFAChallengeNotFound)
+	_, err = testQueries.ConsumeMFAChallenge(token)
+	require.ErrorIs(t, err, ErrMFAChallengeNotFound)
+}
+
+func TestConsumeMFAChallenge(t *testing.T) {
+	token := uuid.New().String()
+	err := testQueries.CreateMFAChallenge(NewMFAChallenge(token, uuid.New().String(), "laptop", "pwd", time.Now().Add(time.Minute)))
+	require.NoError(t, err)
+
+	_, err = testQueries.ConsumeMFAChallenge(token)
+	require.NoError(t, err)
+
+	// a challenge completes a single login
+	_, err = testQueries.ConsumeMFAChallenge(token)
+	require.ErrorIs(t, err, ErrMFAChallengeNotFound)
+}
+
+func TestCountMFAAttempt(t *testing.T) {
+	accountUuid := uuid.New().String()
+	since := time.Now().Add(-time.Minute)
+
+	for i := 1; i <= 3; i++ {
+		attempts, err := testQueries.CountMFAAttempt(accountUuid, since)
+		require.NoError(t, err)
+		require.Equal(t, i, attempts)
+	}
+
+	// older attempts do not count
+	attempts, err := testQueries.CountMFAAttempt(accountUuid, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Zero(t, attempts)
+
+	err = testQueries.ClearMFAAttempts(accountUuid)
+	require.NoError(t, err)
+	attempts, err = testQueries.CountMFAAttempt(accountUuid, since)
+	require.NoError(t, err)
+	require.Equal(t, 1, attempts)
+}
@@ -0,0 +1,71 @@
+package data
+
+import (
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// RecoveryCodesResponse defines a new set of recovery codes, which are only
+// shown once
+type RecoveryCodesResponse struct {
+	Message       string   `json:"message,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+type RecoveryLoginRequest struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	Code     string `json:"code" validate:"required"`
+}
+
+// ReplaceRecoveryCodes stores the hashes of codes as the recovery codes of the
+// account, the codes it had before can not be used anymore. Without codes it
+// only deletes the old ones.
+func (s *PostgresStore) ReplaceRecoveryCodes(accountUuid string, codes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("delete from recovery_code where account_uuid=$1", accountUuid); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		_, err := tx.Exec(
+			"insert into recovery_code(account_uuid, code_hash) values($1, $2)",
+			accountUuid, util.HashToken(util.NormalizeRecoveryCode(code)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks code as used and reports whether it was a recovery
+// code of the account that was not used before
+func (s *PostgresStore) UseRecoveryCode(accountUuid, code string) (bool, error) {
+	sql := `
+	update recovery_code
+	set used_at=now()
+	where account_uuid=$1 and code_hash=$2 and used_at is null
+	`
+	res, err := s.db.Exec(sql, accountUuid, util.HashToken(util.NormalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// CountRecoveryCodes returns how many recovery codes of the account are left
+func (s *PostgresStore) CountRecoveryCodes(accountUuid string) (int, error) {
+	var count int
+	err := s.db.QueryRow(
+		"select count(*) from recovery_code where account_uuid=$1 and used_at is null",
+		accountUuid).Scan(&count)
+	return count, err
+}
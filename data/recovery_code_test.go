@@ -0,0 +1,64 @@
+package data
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func createRandomRecoveryCodes(t *testing.T, accountUuid string) []string {
+	codes := []string{}
+	for i := 0; i < 3; i++ {
+		code, err := util.NewRecoveryCode()
+		require.NoError(t, err)
+		codes = append(codes, code)
+	}
+
+	err := testQueries.ReplaceRecoveryCodes(accountUuid, codes)
+
+	require.NoError(t, err)
+	return codes
+}
+
+func TestUseRecoveryCode(t *testing.T) {
+	accountUuid := uuid.New().String()
+	codes := createRandomRecoveryCodes(t, accountUuid)
+
+	// codes are accepted the way the user types them in
+	ok, err := testQueries.UseRecoveryCode(accountUuid, strings.ToLower(strings.ReplaceAll(codes[0], "-", "")))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// every code is used once
+	ok, err = testQueries.UseRecoveryCode(accountUuid, codes[0])
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// and only by its account
+	ok, err = testQueries.UseRecoveryCode(uuid.New().String(), codes[1])
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	count, err := testQueries.CountRecoveryCodes(accountUuid)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+}
+
+func TestReplaceRecoveryCodes(t *testing.T) {
+	accountUuid := uuid.New().String()
+	old := createRandomRecoveryCodes(t, accountUuid)
+	createRandomRecoveryCodes(t, accountUuid)
+
+	ok, err := testQueries.UseRecoveryCode(accountUuid, old[0])
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	err = testQueries.ReplaceRecoveryCodes(accountUuid, nil)
+	require.NoError(t, err)
+	count, err := testQueries.CountRecoveryCodes(accountUuid)
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
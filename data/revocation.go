@@ -0,0 +1,57 @@
+package data
+
+import (
+	"time"
+)
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"omitempty,jwt"`
+}
+
+// RevokeToken puts the token id on the denylist until the token expires
+func (s *PostgresStore) RevokeToken(jti string, expiresAt time.Time) error {
+	sql := `
+	insert into revoked_token(jti, expires_at)
+	values($1, $2)
+	on conflict (jti) do nothing
+	`
+	_, err := s.db.Exec(sql, jti, expiresAt)
+	return err
+}
+
+// RevokeAccountTokens revokes every token issued to the account so far,
+// access tokens through their issue time and refresh tokens directly. It is
+// called whenever the account is deleted or its password changes, and is what
+// suspending an account would have to call too.
+func (s *PostgresStore) RevokeAccountTokens(accountUuid string) error {
+	sql := `
+	insert into account_revocation(account_uuid, revoked_at)
+	values($1, now())
+	on conflict (account_uuid) do update set revoked_at=excluded.revoked_at
+	`
+	if _, err := s.db.Exec(sql, accountUuid); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec("update session set revoked=true where account_uuid=$1", accountUuid); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec("update refresh_token set revoked=true where account_uuid=$1", accountUuid)
+	return err
+}
+
+// IsTokenRevoked reports whether the token id is on the denylist, the session
+// of the token was revoked or the token was issued before all tokens of its
+// account were revoked. Issue times are whole seconds, so tokens issued in the
+// second of the revocation are revoked too, they may have been issued before.
+func (s *PostgresStore) IsTokenRevoked(jti, accountUuid, sessionUuid string, issuedAt time.Time) (bool, error) {
+	sql := `
+	select exists(select 1 from revoked_token where jti=$1)
+	or exists(select 1 from account_revocation where account_uuid=$2 and date_trunc('second', revoked_at) >= $3)
+	or exists(select 1 from session where uuid=$4 and revoked=true)
+	`
+	var revoked bool
+	err := s.db.QueryRow(sql, jti, accountUuid, issuedAt, sessionUuid).Scan(&revoked)
+	return revoked, err
+}
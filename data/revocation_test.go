@@ -0,0 +1,52 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevokeToken(t *testing.T) {
+	jti := uuid.New().String()
+	accountUuid := uuid.New().String()
+
+	revoked, err := testQueries.IsTokenRevoked(jti, accountUuid, "", time.Now())
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	err = testQueries.RevokeToken(jti, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	revoked, err = testQueries.IsTokenRevoked(jti, accountUuid, "", time.Now())
+	require.NoError(t, err)
+	require.True(t, revoked)
+}
+
+func TestRevokeAccountTokens(t *testing.T) {
+	randRT, token := createRandomRefreshToken(t, uuid.New().String())
+	issuedAt := time.Now().Add(-time.Minute)
+	revokedAt := time.Now()
+
+	err := testQueries.RevokeAccountTokens(randRT.AccountUuid)
+	require.NoError(t, err)
+
+	revoked, err := testQueries.IsTokenRevoked(uuid.New().String(), randRT.AccountUuid, "", issuedAt)
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	// tokens carry their issue time in whole seconds, those of the second of
+	// the revocation may have been issued before it
+	revoked, err = testQueries.IsTokenRevoked(uuid.New().String(), randRT.AccountUuid, "", revokedAt.Truncate(time.Second))
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	revoked, err = testQueries.IsTokenRevoked(uuid.New().String(), randRT.AccountUuid, "", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	rt, err := testQueries.GetRefreshToken(token)
+	require.NoError(t, err)
+	require.True(t, rt.Revoked)
+}
@@ -0,0 +1,180 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// SAMLProvider defines the SAML identity provider of a tenant, such as the
+// corporate SSO of an enterprise customer. Its metadata is kept as imported.
+// Assertions can only sign in accounts with an email in one of Domains, the
+// attributes name where assertions carry the fields of the account.
+type SAMLProvider struct {
+	ID                 int       `json:"-"`
+	Tenant             string    `json:"tenant"`
+	EntityID           string    `json:"entity_id"`
+	Metadata           string    `json:"-"`
+	MetadataURL        string    `json:"metadata_url"`
+	Domains            []string  `json:"domains"`
+	EmailAttribute     string    `json:"email_attribute"`
+	FirstNameAttribute string    `json:"first_name_attribute"`
+	LastNameAttribute  string    `json:"last_name_attribute"`
+	CreatedOn          time.Time `json:"created_at"`
+	UpdatedOn          time.Time `json:"updated_at"`
+}
+
+// Default names of the attributes carrying account fields, as most identity
+// providers send them
+const (
+	DefaultEmailAttribute     = "email"
+	DefaultFirstNameAttribute = "givenName"
+	DefaultLastNameAttribute  = "sn"
+)
+
+func NewSAMLProvider(entityID, metadata string, req *SAMLProviderRequest) *SAMLProvider {
+	p := &SAMLProvider{
+		Tenant:             req.Tenant,
+		EntityID:           entityID,
+		Metadata:           metadata,
+		MetadataURL:        req.MetadataURL,
+		Domains:            []string{},
+		EmailAttribute:     req.EmailAttribute,
+		FirstNameAttribute: req.FirstNameAttribute,
+		LastNameAttribute:  req.LastNameAttribute,
+	}
+	for _, domain := range req.Domains {
+		p.Domains = append(p.Domains, strings.ToLower(domain))
+	}
+	if p.EmailAttribute == "" {
+		p.EmailAttribute = DefaultEmailAttribute
+	}
+	if p.FirstNameAttribute == "" {
+		p.FirstNameAttribute = DefaultFirstNameAttribute
+	}
+	if p.LastNameAttribute == "" {
+		p.LastNameAttribute = DefaultLastNameAttribute
+	}
+	return p
+}
+
+// AllowsEmail reports whether the provider vouches for the domain of email
+func (p *SAMLProvider) AllowsEmail(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range p.Domains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// SAMLProviderRequest defines how admins import the metadata of an identity
+// provider, either as XML or from the URL the provider publishes it at
+type SAMLProviderRequest struct {
+	Tenant             string   `json:"tenant" validate:"required,max=63,alphanum,lowercase"`
+	MetadataURL        string   `json:"metadata_url" validate:"required_without=Metadata,omitempty,url"`
+	Metadata           string   `json:"metadata" validate:"required_without=MetadataURL,max=1000000"`
+	Domains            []string `json:"domains" validate:"required,min=1,max=20,dive,fqdn"`
+	EmailAttribute     string   `json:"email_attribute" validate:"max=255"`
+	FirstNameAttribute string   `json:"first_name_attribute" validate:"max=255"`
+	LastNameAttribute  string   `json:"last_name_attribute" validate:"max=255"`
+}
+
+var ErrSAMLProviderNotFound = fmt.Errorf("SAML provider not found")
+
+// SaveSAMLProvider creates the provider of the tenant or replaces it when the
+// metadata is imported again
+func (s *PostgresStore) SaveSAMLProvider(p *SAMLProvider) error {
+	sql := `
+	insert into saml_provider(tenant, entity_id, metadata, metadata_url, domains, email_attribute, first_name_attribute, last_name_attribute)
+	values($1, $2, $3, $4, $5, $6, $7, $8)
+	on conflict (tenant) do update
+	set entity_id=excluded.entity_id, metadata=excluded.metadata, metadata_url=excluded.metadata_url,
+	domains=excluded.domains, email_attribute=excluded.email_attribute,
+	first_name_attribute=excluded.first_name_attribute, last_name_attribute=excluded.last_name_attribute, updated_at=now()
+	returning id, created_at, updated_at
+	`
+	return s.db.QueryRow(sql,
+		p.Tenant,
+		p.EntityID,
+		p.Metadata,
+		p.MetadataURL,
+		pq.Array(p.Domains),
+		p.EmailAttribute,
+		p.FirstNameAttribute,
+		p.LastNameAttribute,
+	).Scan(&p.ID, &p.CreatedOn, &p.UpdatedOn)
+}
+
+func (s *PostgresStore) GetSAMLProviders() ([]*SAMLProvider, error) {
+	rows, err := s.db.Query("select * from saml_provider order by tenant")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	providers := []*SAMLProvider{}
+	for rows.Next() {
+		p, err := scanIntoSAMLProvider(rows)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+
+	return providers, rows.Err()
+}
+
+func (s *PostgresStore) GetSAMLProvider(tenant string) (*SAMLProvider, error) {
+	rows, err := s.db.Query("select * from saml_provider where tenant=$1", tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoSAMLProvider(rows)
+	}
+
+	return nil, ErrSAMLProviderNotFound
+}
+
+func (s *PostgresStore) DeleteSAMLProvider(tenant string) error {
+	res, err := s.db.Exec("delete from saml_provider where tenant=$1", tenant)
+	if err != nil {
+		return err
+	}
+
+	count, _ := res.RowsAffected()
+	if count != 1 {
+		return ErrSAMLProviderNotFound
+	}
+	return nil
+}
+
+func scanIntoSAMLProvider(rows *sql.Rows) (*SAMLProvider, error) {
+	p := &SAMLProvider{}
+	err := rows.Scan(
+		&p.ID,
+		&p.Tenant,
+		&p.EntityID,
+		&p.Metadata,
+		&p.MetadataURL,
+		pq.Array(&p.Domains),
+		&p.EmailAttribute,
+		&p.FirstNameAttribute,
+		&p.LastNameAttribute,
+		&p.CreatedOn,
+		&p.UpdatedOn,
+	)
+	return p, err
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// Session defines a login of an account on one device. The refresh tokens of
+// a session form one token family, named by the session uuid.
+type Session struct {
+	ID          int       `json:"-"`
+	Uuid        string    `json:"uuid"`
+	AccountUuid string    `json:"account_uuid"`
+	DeviceName  string    `json:"device_name"`
+	UserAgent   string    `json:"user_agent"`
+	IP          string    `json:"ip"`
+	Revoked     bool      `json:"-"`
+	CreatedOn   time.Time `json:"created_at"`
+	LastUsedOn  time.Time `json:"last_used_at"`
+	Current     bool      `json:"current"`
+}
+
+func NewSession(uuid, accountUuid, deviceName, userAgent, ip string) *Session {
+	return &Session{
+		Uuid:        uuid,
+		AccountUuid: accountUuid,
+		DeviceName:  deviceName,
+		UserAgent:   userAgent,
+		IP:          ip,
+	}
+}
+
+var ErrSessionNotFound = fmt.Errorf("Session not found")
+
+func (s *PostgresStore) CreateSession(session *Session) error {
+	sql := `
+	insert into session(uuid, account_uuid, device_name, user_agent, ip)
+	values($1, $2, $3, $4, $5)
+	`
+	_, err := s.db.Exec(sql, session.Uuid, session.AccountUuid, session.DeviceName, session.UserAgent, session.IP)
+	return err
+}
+
+// GetSessions returns the sessions of the account that can still be refreshed
+func (s *PostgresStore) GetSessions(accountUuid string) ([]*Session, error) {
+	rows, err := s.db.Query(`
+	select * from session
+	where account_uuid=$1 and revoked=false and last_used_at > $2
+	order by last_used_at desc
+	`, accountUuid, time.Now().Add(-util.RefreshTokenLifetime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session, err := scanIntoSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// TouchSession records that the session was just used from ip and userAgent
+func (s *PostgresStore) TouchSession(uuid, userAgent, ip string) error {
+	sql := `
+	update session set last_used_at=now(), user_agent=$1, ip=$2
+	where uuid=$3
+	`
+	_, err := s.db.Exec(sql, userAgent, ip, uuid)
+	return err
+}
+
+// RevokeSession revokes a session of the account together with its refresh
+// tokens
+func (s *PostgresStore) RevokeSession(accountUuid, uuid string) error {
+	res, err := s.db.Exec(
+		"update session set revoked=true where account_uuid=$1 and uuid=$2 and revoked=false",
+		accountUuid, uuid)
+	if err != nil {
+		return err
+	}
+
+	count, _ := res.RowsAffected()
+	if count != 1 {
+		return ErrSessionNotFound
+	}
+
+	return s.RevokeTokenFamily(uuid)
+}
+
+// RevokeOtherSessions revokes every session of the account except keepUuid,
+// which may be empty to revoke them all
+func (s *PostgresStore) RevokeOtherSessions(accountUuid, keepUuid string) error {
+	_, err := s.db.Exec(
+		"update session set revoked=true where account_uuid=$1 and uuid<>$2",
+		accountUuid, keepUuid)
+	if err != nil {
+		return err
+	}
+
+	sql := `
+	update refresh_token set revoked=true
+	where account_uuid=$1 and family<>$2
+	`
+	_, err = s.db.Exec(sql, accountUuid, keepUuid)
+	return err
+}
+
+func scanIntoSession(rows *sql.Rows) (*Session, error) {
+	session := &Session{}
+	err := rows.Scan(
+		&session.ID,
+		&session.Uuid,
+		&session.AccountUuid,
+		&session.DeviceName,
+		&session.UserAgent,
+		&session.IP,
+		&session.Revoked,
+		&session.CreatedOn,
+		&session.LastUsedOn,
+	)
+	return session, err
+}
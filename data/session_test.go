@@ -0,0 +1,59 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func createRandomSession(t *testing.T, accountUuid string) *Session {
+	session := NewSession(uuid.New().String(), accountUuid, "phone", "test", "127.0.0.1")
+
+	err := testQueries.CreateSession(session)
+
+	require.NoError(t, err)
+	return session
+}
+
+func TestGetSessions(t *testing.T) {
+	acc := createRandomAccount(t)
+	first := createRandomSession(t, acc.Uuid)
+	second := createRandomSession(t, acc.Uuid)
+
+	sessions, err := testQueries.GetSessions(acc.Uuid)
+
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	require.ElementsMatch(t, []string{first.Uuid, second.Uuid}, []string{sessions[0].Uuid, sessions[1].Uuid})
+}
+
+func TestRevokeSession(t *testing.T) {
+	acc := createRandomAccount(t)
+	session := createRandomSession(t, acc.Uuid)
+
+	err := testQueries.RevokeSession(uuid.New().String(), session.Uuid)
+	require.ErrorIs(t, err, ErrSessionNotFound)
+
+	err = testQueries.RevokeSession(acc.Uuid, session.Uuid)
+	require.NoError(t, err)
+
+	revoked, err := testQueries.IsTokenRevoked(uuid.New().String(), acc.Uuid, session.Uuid, session.CreatedOn)
+	require.NoError(t, err)
+	require.True(t, revoked)
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	acc := createRandomAccount(t)
+	current := createRandomSession(t, acc.Uuid)
+	createRandomSession(t, acc.Uuid)
+	createRandomSession(t, acc.Uuid)
+
+	err := testQueries.RevokeOtherSessions(acc.Uuid, current.Uuid)
+	require.NoError(t, err)
+
+	sessions, err := testQueries.GetSessions(acc.Uuid)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, current.Uuid, sessions[0].Uuid)
+}
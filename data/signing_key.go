@@ -0,0 +1,184 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Signing key states. A next key is already published so verifiers can cache
+// it before it becomes the active key tokens are signed with. Retired keys
+// only verify tokens until they expire.
+const (
+	KeyStateNext    = "next"
+	KeyStateActive  = "active"
+	KeyStateRetired = "retired"
+)
+
+// SigningKey defines a stored token signing key, the private key is kept as
+// encrypted PEM
+type SigningKey struct {
+	ID          int        `json:"id"`
+	Kid         string     `json:"kid"`
+	Algorithm   string     `json:"algorithm"`
+	PrivateKey  string     `json:"-"`
+	PublicKey   string     `json:"public_key"`
+	State       string     `json:"state"`
+	CreatedOn   time.Time  `json:"created_at"`
+	ActivatedOn *time.Time `json:"activated_at,omitempty"`
+	RetiredOn   *time.Time `json:"retired_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+func NewSigningKey(kid, algorithm, privateKey, publicKey, state string) *SigningKey {
+	return &SigningKey{
+		Kid:        kid,
+		Algorithm:  algorithm,
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+		State:      state,
+	}
+}
+
+var ErrSigningKeyRotated = fmt.Errorf("Signing key has already been rotated")
+var ErrNoNextSigningKey = fmt.Errorf("No next signing key to activate")
+
+// GetSigningKeys returns the keys that still verify tokens
+func (s *PostgresStore) GetSigningKeys() ([]*SigningKey, error) {
+	rows, err := s.db.Query(`
+	select * from signing_key
+	where state <> $1 or expires_at > now()
+	order by id
+	`, KeyStateRetired)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*SigningKey{}
+	for rows.Next() {
+		key, err := scanIntoSigningKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// EnsureSigningKeys stores active and next for whichever of the two states
+// has no key yet. Instances starting at the same time agree on a single key
+// for each state.
+func (s *PostgresStore) EnsureSigningKeys(active, next *SigningKey) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockSigningKeys(tx); err != nil {
+		return err
+	}
+
+	for _, key := range []*SigningKey{active, next} {
+		var count int
+		err := tx.QueryRow("select count(*) from signing_key where state=$1", key.State).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if err := insertSigningKey(tx, key); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RotateSigningKeys retires the active key named by activeKid, activates the
+// next key and stores next as the new next key. The retired key verifies
+// tokens until retiredUntil. If activeKid is no longer the active key another
+// caller rotated first and ErrSigningKeyRotated is returned.
+func (s *PostgresStore) RotateSigningKeys(activeKid string, next *SigningKey, retiredUntil time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockSigningKeys(tx); err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(
+		"update signing_key set state=$1, retired_at=now(), expires_at=$2 where state=$3 and kid=$4",
+		KeyStateRetired, retiredUntil, KeyStateActive, activeKid)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return ErrSigningKeyRotated
+	}
+
+	res, err = tx.Exec(
+		"update signing_key set state=$1, activated_at=now() where state=$2",
+		KeyStateActive, KeyStateNext)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return ErrNoNextSigningKey
+	}
+
+	next.State = KeyStateNext
+	if err := insertSigningKey(tx, next); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteExpiredSigningKeys removes retired keys that no longer verify tokens
+func (s *PostgresStore) DeleteExpiredSigningKeys() error {
+	_, err := s.db.Exec("delete from signing_key where state=$1 and expires_at <= now()", KeyStateRetired)
+	return err
+}
+
+func lockSigningKeys(tx *sql.Tx) error {
+	_, err := tx.Exec("lock table signing_key in share row exclusive mode")
+	return err
+}
+
+func insertSigningKey(tx *sql.Tx, key *SigningKey) error {
+	if key.State == KeyStateActive {
+		now := time.Now().UTC()
+		key.ActivatedOn = &now
+	}
+
+	sql := `
+	insert into signing_key(kid, algorithm, private_key, public_key, state, activated_at)
+	values($1, $2, $3, $4, $5, $6)
+	`
+	_, err := tx.Exec(sql, key.Kid, key.Algorithm, key.PrivateKey, key.PublicKey, key.State, key.ActivatedOn)
+	return err
+}
+
+func scanIntoSigningKey(rows *sql.Rows) (*SigningKey, error) {
+	key := &SigningKey{}
+	err := rows.Scan(
+		&key.ID,
+		&key.Kid,
+		&key.Algorithm,
+		&key.PrivateKey,
+		&key.PublicKey,
+		&key.State,
+		&key.CreatedOn,
+		&key.ActivatedOn,
+		&key.RetiredOn,
+		&key.ExpiresAt,
+	)
+	return key, err
+}
@@ -4,7 +4,9 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/blazingly-fast/auth-assistant/util"
 	_ "github.com/lib/pq"
 )
 
@@ -27,11 +29,136 @@ type Poster interface {
 	CreateAccout(*Account) error
 }
 
+type RefreshTokenStorer interface {
+	CreateRefreshToken(*RefreshToken) error
+	GetRefreshToken(string) (*RefreshToken, error)
+	RotateRefreshToken(string) error
+	RevokeTokenFamily(string) error
+}
+
+type SigningKeyStorer interface {
+	GetSigningKeys() ([]*SigningKey, error)
+	EnsureSigningKeys(*SigningKey, *SigningKey) error
+	RotateSigningKeys(string, *SigningKey, time.Time) error
+	DeleteExpiredSigningKeys() error
+}
+
+type RevocationStorer interface {
+	RevokeToken(string, time.Time) error
+	RevokeAccountTokens(string) error
+	IsTokenRevoked(string, string, string, time.Time) (bool, error)
+}
+
+type SessionStorer interface {
+	CreateSession(*Session) error
+	GetSessions(string) ([]*Session, error)
+	TouchSession(string, string, string) error
+	RevokeSession(string, string) error
+	RevokeOtherSessions(string, string) error
+}
+
+type AuthorizationCodeStorer interface {
+	CreateAuthorizationCode(*AuthorizationCode) error
+	ConsumeAuthorizationCode(string) (*AuthorizationCode, error)
+}
+
+type DeviceCodeStorer interface {
+	CreateDeviceCode(*DeviceCode) error
+	GetDeviceCode(string) (*DeviceCode, error)
+	GetPendingDeviceCode(string) (*DeviceCode, error)
+	UpdateDeviceCode(*DeviceCode) error
+	ConsumeDeviceCode(string) (*DeviceCode, error)
+}
+
+type IdentityLinkStorer interface {
+	CreateIdentityLink(*IdentityLink) error
+	GetIdentityLink(string, string) (*IdentityLink, error)
+	GetIdentityLinks(string) ([]*IdentityLink, error)
+	DeleteIdentityLink(string, string, string) error
+}
+
+type SAMLProviderStorer interface {
+	SaveSAMLProvider(*SAMLProvider) error
+	GetSAMLProviders() ([]*SAMLProvider, error)
+	GetSAMLProvider(string) (*SAMLProvider, error)
+	DeleteSAMLProvider(string) error
+}
+
+type MFAStorer interface {
+	SaveTOTPCredential(*TOTPCredential) error
+	GetTOTPCredential(string) (*TOTPCredential, error)
+	ConfirmTOTPCredential(string, int64) error
+	UseTOTPStep(string, int64) (bool, error)
+	DeleteTOTPCredential(string) error
+	CreateMFAChallenge(*MFAChallenge) error
+	GetMFAChallenge(string) (*MFAChallenge, error)
+	FailMFAChallenge(string) (int, error)
+	ConsumeMFAChallenge(string) (*MFAChallenge, error)
+	CountMFAAttempt(string, time.Time) (int, error)
+	ClearMFAAttempts(string) error
+	ReplaceRecoveryCodes(string, []string) error
+	UseRecoveryCode(string, string) (bool, error)
+	CountRecoveryCodes(string) (int, error)
+}
+
+type EmailOTPStorer interface {
+	CreateEmailOTP(*EmailOTP) error
+	GetEmailOTP(string) (*EmailOTP, error)
+	FailEmailOTP(int) (int, error)
+	UseEmailOTP(int) error
+	CountEmailOTPs(string, string, time.Time) (int, int, error)
+	SetEmailMFA(string, bool) error
+	GetEmailMFA(string) (bool, error)
+}
+
+type WebAuthnStorer interface {
+	CreateWebAuthnCredential(*WebAuthnCredential) error
+	GetWebAuthnCredentials(string) ([]*WebAuthnCredential, error)
+	GetWebAuthnCredential(string) (*WebAuthnCredential, error)
+	UpdateWebAuthnSignCount(string, uint32) error
+	DeleteWebAuthnCredential(string, string) error
+	CreateWebAuthnSession(*WebAuthnSession) error
+	ConsumeWebAuthnSession(string) (*WebAuthnSession, error)
+}
+
+type AssertionStorer interface {
+	UseAssertion(string, string, time.Time) (bool, error)
+}
+
+type ClientStorer interface {
+	CreateClient(*Client) error
+	GetClients() ([]*Client, error)
+	GetClient(string) (*Client, error)
+	UpdateClient(*Client) error
+	UpdateClientSecret(string, string) error
+	DeleteClient(string) error
+	GetConsent(string, string) (string, error)
+	SaveConsent(string, string, string) error
+}
+
+type Pruner interface {
+	DeleteExpired() error
+}
+
 type Storer interface {
 	Getter
 	Putter
 	Deleter
 	Poster
+	RefreshTokenStorer
+	SigningKeyStorer
+	RevocationStorer
+	SessionStorer
+	AuthorizationCodeStorer
+	DeviceCodeStorer
+	ClientStorer
+	IdentityLinkStorer
+	SAMLProviderStorer
+	AssertionStorer
+	MFAStorer
+	WebAuthnStorer
+	EmailOTPStorer
+	Pruner
 }
 
 type PostgresStore struct {
@@ -73,8 +200,8 @@ func (s *PostgresStore) createAccountTable() error {
 	  user_type text,
 	  avatar text,
       uuid text,
-	  token text,
-	  refresh_token text,
+	  token_hash text,
+	  refresh_token_hash text,
 	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),	
 	  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 	  );
@@ -83,6 +210,441 @@ func (s *PostgresStore) createAccountTable() error {
 	return err
 }
 
+func (s *PostgresStore) createRefreshTokenTable() error {
+	createSql := `
+	  create table if not exists refresh_token(
+	  id SERIAL PRIMARY KEY,
+	  token_hash text UNIQUE NOT NULL,
+	  family text NOT NULL,
+	  account_uuid text NOT NULL,
+	  rotated boolean NOT NULL DEFAULT false,
+	  revoked boolean NOT NULL DEFAULT false,
+	  expires_at TIMESTAMPTZ NOT NULL,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+	  create index if not exists refresh_token_family_idx on refresh_token(family);
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createSigningKeyTable() error {
+	createSql := `
+	  create table if not exists signing_key(
+	  id SERIAL PRIMARY KEY,
+	  kid text UNIQUE NOT NULL,
+	  algorithm text NOT NULL,
+	  private_key text NOT NULL,
+	  public_key text NOT NULL,
+	  state text NOT NULL,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	  activated_at TIMESTAMPTZ,
+	  retired_at TIMESTAMPTZ,
+	  expires_at TIMESTAMPTZ
+	  );
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createRevocationTables() error {
+	createSql := `
+	  create table if not exists revoked_token(
+	  jti text PRIMARY KEY,
+	  expires_at TIMESTAMPTZ NOT NULL
+	  );
+	  create table if not exists account_revocation(
+	  account_uuid text PRIMARY KEY,
+	  revoked_at TIMESTAMPTZ NOT NULL
+	  );
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createSessionTable() error {
+	createSql := `
+	  create table if not exists session(
+	  id SERIAL PRIMARY KEY,
+	  uuid text UNIQUE NOT NULL,
+	  account_uuid text NOT NULL,
+	  device_name text NOT NULL DEFAULT '',
+	  user_agent text NOT NULL DEFAULT '',
+	  ip text NOT NULL DEFAULT '',
+	  revoked boolean NOT NULL DEFAULT false,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	  last_used_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+	  create index if not exists session_account_uuid_idx on session(account_uuid);
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createAuthorizationCodeTable() error {
+	createSql := `
+	  create table if not exists authorization_code(
+	  id SERIAL PRIMARY KEY,
+	  code_hash text UNIQUE NOT NULL,
+	  client_id text NOT NULL,
+	  account_uuid text NOT NULL,
+	  redirect_uri text NOT NULL,
+	  scope text NOT NULL DEFAULT '',
+	  code_challenge text NOT NULL,
+	  expires_at TIMESTAMPTZ NOT NULL,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+	  alter table authorization_code add column if not exists nonce text NOT NULL DEFAULT '';
+	  alter table authorization_code add column if not exists auth_time bigint NOT NULL DEFAULT 0;
+	  alter table authorization_code add column if not exists amr text[] NOT NULL DEFAULT '{}';
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createDeviceCodeTable() error {
+	createSql := `
+	  create table if not exists device_code(
+	  id SERIAL PRIMARY KEY,
+	  device_code_hash text NOT NULL UNIQUE,
+	  user_code text NOT NULL UNIQUE,
+	  client_id text NOT NULL,
+	  scope text NOT NULL DEFAULT '',
+	  status text NOT NULL,
+	  account_uuid text NOT NULL DEFAULT '',
+	  auth_time bigint NOT NULL DEFAULT 0,
+	  amr text[] NOT NULL DEFAULT '{}',
+	  interval integer NOT NULL,
+	  polled_at TIMESTAMPTZ,
+	  expires_at TIMESTAMPTZ NOT NULL,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createClientTable() error {
+	createSql := `
+	  create table if not exists oauth_client(
+	  id SERIAL PRIMARY KEY,
+	  client_id text UNIQUE NOT NULL,
+	  secret_hash text NOT NULL DEFAULT '',
+	  name text NOT NULL,
+	  redirect_uris text[] NOT NULL DEFAULT '{}',
+	  grant_types text[] NOT NULL DEFAULT '{}',
+	  scope text NOT NULL DEFAULT '',
+	  token_endpoint_auth_method text NOT NULL,
+	  access_token_lifetime integer NOT NULL DEFAULT 0,
+	  refresh_token_lifetime integer NOT NULL DEFAULT 0,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+	  alter table oauth_client add column if not exists first_party boolean NOT NULL DEFAULT false;
+
+	  create table if not exists oauth_consent(
+	  account_uuid text NOT NULL,
+	  client_id text NOT NULL REFERENCES oauth_client(client_id) ON DELETE CASCADE,
+	  scope text NOT NULL DEFAULT '',
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	  PRIMARY KEY (account_uuid, client_id)
+	  );
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createIdentityLinkTable() error {
+	createSql := `
+	  create table if not exists identity_link(
+	  id SERIAL PRIMARY KEY,
+	  provider text NOT NULL,
+	  subject text NOT NULL,
+	  account_uuid text NOT NULL,
+	  email text NOT NULL DEFAULT '',
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	  UNIQUE(provider, subject)
+	  );
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createUsedAssertionTable() error {
+	createSql := `
+	  create table if not exists used_assertion(
+	  issuer text NOT NULL,
+	  jti text NOT NULL,
+	  expires_at TIMESTAMPTZ NOT NULL,
+	  PRIMARY KEY (issuer, jti)
+	  );
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createTOTPCredentialTable() error {
+	createSql := `
+	  create table if not exists totp_credential(
+	  account_uuid text PRIMARY KEY,
+	  secret text NOT NULL,
+	  confirmed boolean NOT NULL DEFAULT false,
+	  last_step bigint NOT NULL DEFAULT 0,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	  confirmed_at TIMESTAMPTZ
+	  );
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createMFAChallengeTable() error {
+	createSql := `
+	  create table if not exists mfa_challenge(
+	  id SERIAL PRIMARY KEY,
+	  token_hash text NOT NULL UNIQUE,
+	  account_uuid text NOT NULL,
+	  device_name text NOT NULL DEFAULT '',
+	  attempts integer NOT NULL DEFAULT 0,
+	  expires_at TIMESTAMPTZ NOT NULL,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+	  alter table mfa_challenge add column if not exists first_factor text NOT NULL DEFAULT 'pwd';
+	  create table if not exists mfa_attempt(
+	  id SERIAL PRIMARY KEY,
+	  account_uuid text NOT NULL,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+	  create index if not exists mfa_attempt_account_uuid_idx on mfa_attempt(account_uuid, created_at);
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createRecoveryCodeTable() error {
+	createSql := `
+	  create table if not exists recovery_code(
+	  id SERIAL PRIMARY KEY,
+	  account_uuid text NOT NULL,
+	  code_hash text NOT NULL,
+	  used_at TIMESTAMPTZ,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	  UNIQUE (account_uuid, code_hash)
+	  );
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createEmailOTPTables() error {
+	createSql := `
+	  create table if not exists email_otp(
+	  id SERIAL PRIMARY KEY,
+	  token_hash text NOT NULL,
+	  code_hash text NOT NULL,
+	  purpose text NOT NULL,
+	  email text NOT NULL,
+	  account_uuid text NOT NULL,
+	  ip text NOT NULL DEFAULT '',
+	  attempts integer NOT NULL DEFAULT 0,
+	  expires_at TIMESTAMPTZ NOT NULL,
+	  used_at TIMESTAMPTZ,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+	  create index if not exists email_otp_token_hash_idx on email_otp(token_hash);
+	  create index if not exists email_otp_email_idx on email_otp(email, created_at);
+	  create index if not exists email_otp_ip_idx on email_otp(ip, created_at);
+	  create table if not exists email_mfa(
+	  account_uuid text PRIMARY KEY,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createWebAuthnTables() error {
+	createSql := `
+	  create table if not exists webauthn_credential(
+	  id SERIAL PRIMARY KEY,
+	  credential_id text UNIQUE NOT NULL,
+	  account_uuid text NOT NULL,
+	  name text NOT NULL DEFAULT '',
+	  public_key text NOT NULL,
+	  sign_count bigint NOT NULL DEFAULT 0,
+	  transports text[] NOT NULL DEFAULT '{}',
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	  last_used_at TIMESTAMPTZ
+	  );
+	  create index if not exists webauthn_credential_account_idx on webauthn_credential(account_uuid);
+	  create table if not exists webauthn_session(
+	  id SERIAL PRIMARY KEY,
+	  token_hash text NOT NULL UNIQUE,
+	  ceremony text NOT NULL,
+	  challenge text NOT NULL,
+	  account_uuid text NOT NULL DEFAULT '',
+	  expires_at TIMESTAMPTZ NOT NULL,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
+func (s *PostgresStore) createSAMLProviderTable() error {
+	createSql := `
+	  create table if not exists saml_provider(
+	  id SERIAL PRIMARY KEY,
+	  tenant text UNIQUE NOT NULL,
+	  entity_id text NOT NULL,
+	  metadata text NOT NULL,
+	  metadata_url text NOT NULL DEFAULT '',
+	  domains text[] NOT NULL DEFAULT '{}',
+	  email_attribute text NOT NULL,
+	  first_name_attribute text NOT NULL,
+	  last_name_attribute text NOT NULL,
+	  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	  );
+	  `
+	_, err := s.db.Exec(createSql)
+	return err
+}
+
 func (s *PostgresStore) Init() error {
-	return s.createAccountTable()
+	if err := s.createAccountTable(); err != nil {
+		return err
+	}
+	if err := s.createRefreshTokenTable(); err != nil {
+		return err
+	}
+	if err := s.createSigningKeyTable(); err != nil {
+		return err
+	}
+	if err := s.createRevocationTables(); err != nil {
+		return err
+	}
+	if err := s.createSessionTable(); err != nil {
+		return err
+	}
+	if err := s.createAuthorizationCodeTable(); err != nil {
+		return err
+	}
+	if err := s.createDeviceCodeTable(); err != nil {
+		return err
+	}
+	if err := s.createClientTable(); err != nil {
+		return err
+	}
+	if err := s.createIdentityLinkTable(); err != nil {
+		return err
+	}
+	if err := s.createSAMLProviderTable(); err != nil {
+		return err
+	}
+	if err := s.createUsedAssertionTable(); err != nil {
+		return err
+	}
+	if err := s.createTOTPCredentialTable(); err != nil {
+		return err
+	}
+	if err := s.createMFAChallengeTable(); err != nil {
+		return err
+	}
+	if err := s.createWebAuthnTables(); err != nil {
+		return err
+	}
+	if err := s.createRecoveryCodeTable(); err != nil {
+		return err
+	}
+	if err := s.createEmailOTPTables(); err != nil {
+		return err
+	}
+	return s.migrateTokenHashes()
+}
+
+// migrateTokenHashes renames the columns that used to hold raw tokens and
+// replaces every raw token left in them with its hash. Raw tokens are JWTs,
+// so unlike hashes they contain dots.
+func (s *PostgresStore) migrateTokenHashes() error {
+	renames := []struct{ table, from, to string }{
+		{"account", "token", "token_hash"},
+		{"account", "refresh_token", "refresh_token_hash"},
+		{"refresh_token", "token", "token_hash"},
+	}
+	for _, r := range renames {
+		sql := fmt.Sprintf(`
+		do $$ begin
+		  if exists(select 1 from information_schema.columns where table_name='%s' and column_name='%s') then
+		    alter table %s rename column %s to %s;
+		  end if;
+		end $$;
+		`, r.table, r.from, r.table, r.from, r.to)
+		if _, err := s.db.Exec(sql); err != nil {
+			return err
+		}
+	}
+
+	tables := []struct{ table, column string }{
+		{"account", "token_hash"},
+		{"account", "refresh_token_hash"},
+		{"refresh_token", "token_hash"},
+	}
+	for _, t := range tables {
+		rows, err := s.db.Query(fmt.Sprintf("select id, %s from %s where %s like '%%.%%'", t.column, t.table, t.column))
+		if err != nil {
+			return err
+		}
+
+		raw := map[int]string{}
+		for rows.Next() {
+			var id int
+			var token string
+			if err := rows.Scan(&id, &token); err != nil {
+				rows.Close()
+				return err
+			}
+			raw[id] = token
+		}
+		rows.Close()
+
+		for id, token := range raw {
+			sql := fmt.Sprintf("update %s set %s=$1 where id=$2", t.table, t.column)
+			if _, err := s.db.Exec(sql, util.HashToken(token), id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// DeleteExpired removes rows that only matter until the tokens they refer to
+// expire
+func (s *PostgresStore) DeleteExpired() error {
+	// nothing issued before this point is still valid
+	lifetime := fmt.Sprintf("now() - interval '%d seconds'", int(util.RefreshTokenLifetime.Seconds()))
+
+	deletes := []string{
+		"delete from refresh_token where expires_at <= now()",
+		"delete from revoked_token where expires_at <= now()",
+		"delete from authorization_code where expires_at <= now()",
+		"delete from device_code where expires_at <= now()",
+		"delete from used_assertion where expires_at <= now()",
+		"delete from mfa_challenge where expires_at <= now()",
+		"delete from mfa_attempt where created_at <= now() - interval '1 day'",
+		"delete from webauthn_session where expires_at <= now()",
+		// used and expired codes are kept a day for the rate limits
+		"delete from email_otp where created_at <= now() - interval '1 day'",
+		"delete from account_revocation where revoked_at <= " + lifetime,
+		"delete from session where last_used_at <= " + lifetime,
+	}
+
+	for _, sql := range deletes {
+		if _, err := s.db.Exec(sql); err != nil {
+			return err
+		}
+	}
+	return nil
 }
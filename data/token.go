@@ -0,0 +1,162 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// RefreshToken defines a refresh token issued to an account, only its hash
+// is stored. Every token minted by rotating a refresh token belongs to the
+// same family as the token it replaced.
+type RefreshToken struct {
+	ID          int       `json:"id"`
+	TokenHash   string    `json:"-"`
+	Family      string    `json:"family"`
+	AccountUuid string    `json:"account_uuid"`
+	Rotated     bool      `json:"rotated"`
+	Revoked     bool      `json:"revoked"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedOn   time.Time `json:"created_at"`
+}
+
+func NewRefreshToken(token, family, accountUuid string, expiresAt time.Time) *RefreshToken {
+	return &RefreshToken{
+		TokenHash:   util.HashToken(token),
+		Family:      family,
+		AccountUuid: accountUuid,
+		ExpiresAt:   expiresAt,
+	}
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required,jwt"`
+}
+
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// OAuthTokenResponse defines the response of the token endpoint
+type OAuthTokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+	RefreshToken    string `json:"refresh_token,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+	IDToken         string `json:"id_token,omitempty"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+func NewOAuthTokenResponse(token, refreshToken, scope string, expiresIn time.Duration) *OAuthTokenResponse {
+	return &OAuthTokenResponse{
+		AccessToken:  token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(expiresIn.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        scope,
+	}
+}
+
+// IntrospectionResponse defines the response of the introspection endpoint.
+// Only Active is set for tokens that are not.
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	TokenType string   `json:"token_type,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	SessionID string   `json:"sid,omitempty"`
+	Audience  string   `json:"aud,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Id        string   `json:"jti,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+}
+
+func NewIntrospectionResponse(claims *util.SignedDetails, tokenType string) *IntrospectionResponse {
+	return &IntrospectionResponse{
+		Active:    true,
+		TokenType: tokenType,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		Subject:   claims.Subject,
+		Roles:     claims.Roles,
+		SessionID: claims.SessionID,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+		Id:        claims.Id,
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+		NotBefore: claims.NotBefore,
+	}
+}
+
+var ErrRefreshTokenNotFound = fmt.Errorf("Refresh token not found")
+var ErrRefreshTokenReused = fmt.Errorf("Refresh token has already been used")
+
+func (s *PostgresStore) CreateRefreshToken(rt *RefreshToken) error {
+	sql := `
+	insert into refresh_token(token_hash, family, account_uuid, expires_at)
+	values($1, $2, $3, $4)
+	`
+	_, err := s.db.Exec(sql, rt.TokenHash, rt.Family, rt.AccountUuid, rt.ExpiresAt)
+	return err
+}
+
+func (s *PostgresStore) GetRefreshToken(token string) (*RefreshToken, error) {
+	rows, err := s.db.Query("select * from refresh_token where token_hash=$1", util.HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoRefreshToken(rows)
+	}
+
+	return nil, ErrRefreshTokenNotFound
+}
+
+// RotateRefreshToken marks the token as used. Only the first caller succeeds,
+// every later attempt gets ErrRefreshTokenReused.
+func (s *PostgresStore) RotateRefreshToken(token string) error {
+	res, err := s.db.Exec(
+		"update refresh_token set rotated=true where token_hash=$1 and rotated=false",
+		util.HashToken(token))
+	if err != nil {
+		return err
+	}
+
+	count, _ := res.RowsAffected()
+	if count != 1 {
+		return ErrRefreshTokenReused
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) RevokeTokenFamily(family string) error {
+	_, err := s.db.Exec("update refresh_token set revoked=true where family=$1", family)
+	return err
+}
+
+func scanIntoRefreshToken(rows *sql.Rows) (*RefreshToken, error) {
+	rt := &RefreshToken{}
+	err := rows.Scan(
+		&rt.ID,
+		&rt.TokenHash,
+		&rt.Family,
+		&rt.AccountUuid,
+		&rt.Rotated,
+		&rt.Revoked,
+		&rt.ExpiresAt,
+		&rt.CreatedOn,
+	)
+	return rt, err
+}
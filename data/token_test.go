@@ -0,0 +1,68 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func createRandomRefreshToken(t *testing.T, family string) (*RefreshToken, string) {
+	acc := createRandomAccount(t)
+
+	_, token, err := util.GenerateAllToken(util.NewClaimsBuilder(acc.Uuid).WithRoles(acc.UserType).Claims())
+	require.NoError(t, err)
+
+	rt := NewRefreshToken(token, family, acc.Uuid, time.Now().UTC().Add(time.Hour))
+
+	err = testQueries.CreateRefreshToken(rt)
+
+	require.NoError(t, err)
+	return rt, token
+}
+
+func TestCreateRefreshToken(t *testing.T) {
+	rt, token := createRandomRefreshToken(t, uuid.New().String())
+
+	require.NotEqual(t, token, rt.TokenHash)
+	require.Equal(t, util.HashToken(token), rt.TokenHash)
+}
+
+func TestGetRefreshToken(t *testing.T) {
+	randRT, token := createRandomRefreshToken(t, uuid.New().String())
+
+	rt, err := testQueries.GetRefreshToken(token)
+
+	require.NoError(t, err)
+	require.Equal(t, randRT.Family, rt.Family)
+	require.Equal(t, randRT.AccountUuid, rt.AccountUuid)
+	require.False(t, rt.Rotated)
+	require.False(t, rt.Revoked)
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	_, token := createRandomRefreshToken(t, uuid.New().String())
+
+	err := testQueries.RotateRefreshToken(token)
+	require.NoError(t, err)
+
+	err = testQueries.RotateRefreshToken(token)
+	require.ErrorIs(t, err, ErrRefreshTokenReused)
+}
+
+func TestRevokeTokenFamily(t *testing.T) {
+	family := uuid.New().String()
+	_, first := createRandomRefreshToken(t, family)
+	_, second := createRandomRefreshToken(t, family)
+
+	err := testQueries.RevokeTokenFamily(family)
+	require.NoError(t, err)
+
+	for _, token := range []string{first, second} {
+		rt, err := testQueries.GetRefreshToken(token)
+		require.NoError(t, err)
+		require.True(t, rt.Revoked)
+	}
+}
@@ -0,0 +1,269 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/lib/pq"
+)
+
+// WebAuthnCredential defines a passkey or security key registered on an
+// account. CredentialID is base64url encoded like in WebAuthn responses,
+// PublicKey is PEM encoded. SignCount is the signature counter of the last
+// assertion, a counter that does not go up means the authenticator was
+// cloned.
+type WebAuthnCredential struct {
+	ID           int        `json:"-"`
+	CredentialID string     `json:"id"`
+	AccountUuid  string     `json:"-"`
+	Name         string     `json:"name"`
+	PublicKey    string     `json:"-"`
+	SignCount    uint32     `json:"sign_count"`
+	Transports   []string   `json:"transports"`
+	CreatedOn    time.Time  `json:"created_at"`
+	LastUsedOn   *time.Time `json:"last_used_at"`
+}
+
+func NewWebAuthnCredential(credentialID, accountUuid, name, publicKey string, signCount uint32, transports []string) *WebAuthnCredential {
+	if transports == nil {
+		transports = []string{}
+	}
+	return &WebAuthnCredential{
+		CredentialID: credentialID,
+		AccountUuid:  accountUuid,
+		Name:         name,
+		PublicKey:    publicKey,
+		SignCount:    signCount,
+		Transports:   transports,
+	}
+}
+
+// WebAuthnSession defines a registration or authentication ceremony that was
+// started, only the hash of its token is stored. AccountUuid is empty for a
+// passwordless login, where the passkey names the account.
+type WebAuthnSession struct {
+	ID          int       `json:"-"`
+	TokenHash   string    `json:"-"`
+	Ceremony    string    `json:"ceremony"`
+	Challenge   string    `json:"-"`
+	AccountUuid string    `json:"account_uuid"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedOn   time.Time `json:"created_at"`
+}
+
+// ceremonies of a WebAuthn session
+const (
+	CeremonyRegistration   = "registration"
+	CeremonyAuthentication = "authentication"
+)
+
+func NewWebAuthnSession(token, ceremony, challenge, accountUuid string, expiresAt time.Time) *WebAuthnSession {
+	return &WebAuthnSession{
+		TokenHash:   util.HashToken(token),
+		Ceremony:    ceremony,
+		Challenge:   challenge,
+		AccountUuid: accountUuid,
+		ExpiresAt:   expiresAt,
+	}
+}
+
+// WebAuthnBeginResponse defines the options of a ceremony, which are passed
+// to the browser, and the session they are finished with
+type WebAuthnBeginResponse struct {
+	Session   string `json:"session"`
+	PublicKey any    `json:"publicKey"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// WebAuthnRegistrationResponse defines a registered credential, with the
+// recovery codes of the account when it is its first second factor
+type WebAuthnRegistrationResponse struct {
+	*WebAuthnCredential
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+type WebAuthnLoginBeginRequest struct {
+	MFAToken string `json:"mfa_token"`
+}
+
+type WebAuthnRegisterRequest struct {
+	Session    string          `json:"session" validate:"required"`
+	Name       string          `json:"name" validate:"max=64"`
+	Credential json.RawMessage `json:"credential" validate:"required"`
+}
+
+type WebAuthnLoginRequest struct {
+	Session    string          `json:"session" validate:"required"`
+	MFAToken   string          `json:"mfa_token"`
+	DeviceName string          `json:"device_name"`
+	Credential json.RawMessage `json:"credential" validate:"required"`
+}
+
+var ErrWebAuthnCredentialNotFound = fmt.Errorf("WebAuthn credential not found")
+var ErrWebAuthnCredentialExists = fmt.Errorf("WebAuthn credential is already registered")
+var ErrSignCountRegressed = fmt.Errorf("Sign count of the WebAuthn credential went backwards")
+var ErrWebAuthnSessionNotFound = fmt.Errorf("WebAuthn session not found")
+
+func (s *PostgresStore) CreateWebAuthnCredential(c *WebAuthnCredential) error {
+	err := s.db.QueryRow(`
+	insert into webauthn_credential(credential_id, account_uuid, name, public_key, sign_count, transports)
+	values($1, $2, $3, $4, $5, $6)
+	on conflict (credential_id) do nothing
+	returning id, created_at
+	`,
+		c.CredentialID,
+		c.AccountUuid,
+		c.Name,
+		c.PublicKey,
+		c.SignCount,
+		pq.Array(c.Transports)).Scan(&c.ID, &c.CreatedOn)
+	if err == sql.ErrNoRows {
+		return ErrWebAuthnCredentialExists
+	}
+	return err
+}
+
+// GetWebAuthnCredentials returns every credential registered on the account
+func (s *PostgresStore) GetWebAuthnCredentials(accountUuid string) ([]*WebAuthnCredential, error) {
+	rows, err := s.db.Query("select * from webauthn_credential where account_uuid=$1 order by created_at", accountUuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	creds := []*WebAuthnCredential{}
+	for rows.Next() {
+		c, err := scanIntoWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, c)
+	}
+
+	return creds, rows.Err()
+}
+
+func (s *PostgresStore) GetWebAuthnCredential(credentialID string) (*WebAuthnCredential, error) {
+	rows, err := s.db.Query("select * from webauthn_credential where credential_id=$1", credentialID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoWebAuthnCredential(rows)
+	}
+
+	return nil, ErrWebAuthnCredentialNotFound
+}
+
+// UpdateWebAuthnSignCount records a use of the credential that signed the
+// counter signCount. It fails with ErrSignCountRegressed unless the counter
+// went up, or the authenticator keeps no counter at all, so two logins racing
+// with a cloned key can not both pass.
+func (s *PostgresStore) UpdateWebAuthnSignCount(credentialID string, signCount uint32) error {
+	sql := `
+	update webauthn_credential
+	set sign_count=$2, last_used_at=now()
+	where credential_id=$1 and (sign_count < $2 or (sign_count=0 and $2=0))
+	`
+	res, err := s.db.Exec(sql, credentialID, signCount)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSignCountRegressed
+	}
+	return nil
+}
+
+// DeleteWebAuthnCredential removes a credential from the account
+func (s *PostgresStore) DeleteWebAuthnCredential(accountUuid, credentialID string) error {
+	res, err := s.db.Exec(
+		"delete from webauthn_credential where account_uuid=$1 and credential_id=$2",
+		accountUuid, credentialID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrWebAuthnCredentialNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) CreateWebAuthnSession(session *WebAuthnSession) error {
+	sql := `
+	insert into webauthn_session(token_hash, ceremony, challenge, account_uuid, expires_at)
+	values($1, $2, $3, $4, $5)
+	`
+	_, err := s.db.Exec(sql,
+		session.TokenHash,
+		session.Ceremony,
+		session.Challenge,
+		session.AccountUuid,
+		session.ExpiresAt)
+	return err
+}
+
+// ConsumeWebAuthnSession returns the session of token and deletes it in one
+// statement, so every challenge is answered once
+func (s *PostgresStore) ConsumeWebAuthnSession(token string) (*WebAuthnSession, error) {
+	rows, err := s.db.Query(`
+	delete from webauthn_session
+	where token_hash=$1 and expires_at > now()
+	returning *
+	`, util.HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoWebAuthnSession(rows)
+	}
+
+	return nil, ErrWebAuthnSessionNotFound
+}
+
+func scanIntoWebAuthnCredential(rows *sql.Rows) (*WebAuthnCredential, error) {
+	c := &WebAuthnCredential{}
+	err := rows.Scan(
+		&c.ID,
+		&c.CredentialID,
+		&c.AccountUuid,
+		&c.Name,
+		&c.PublicKey,
+		&c.SignCount,
+		pq.Array(&c.Transports),
+		&c.CreatedOn,
+		&c.LastUsedOn,
+	)
+	return c, err
+}
+
+func scanIntoWebAuthnSession(rows *sql.Rows) (*WebAuthnSession, error) {
+	session := &WebAuthnSession{}
+	err := rows.Scan(
+		&session.ID,
+		&session.TokenHash,
+		&session.Ceremony,
+		&session.Challenge,
+		&session.AccountUuid,
+		&session.ExpiresAt,
+		&session.CreatedOn,
+	)
+	return session, err
+}
@@ -0,0 +1,92 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func createRandomWebAuthnCredential(t *testing.T, signCount uint32) *WebAuthnCredential {
+	cred := NewWebAuthnCredential(uuid.New().String(), uuid.New().String(), "Laptop", "public key", signCount, nil)
+
+	err := testQueries.CreateWebAuthnCredential(cred)
+
+	require.NoError(t, err)
+	require.NotZero(t, cred.ID)
+	return cred
+}
+
+func TestCreateWebAuthnCredential(t *testing.T) {
+	cred := createRandomWebAuthnCredential(t, 0)
+
+	// a key is registered on a single account
+	err := testQueries.CreateWebAuthnCredential(NewWebAuthnCredential(cred.CredentialID, uuid.New().String(), "Phone", "public key", 0, nil))
+	require.ErrorIs(t, err, ErrWebAuthnCredentialExists)
+
+	creds, err := testQueries.GetWebAuthnCredentials(cred.AccountUuid)
+	require.NoError(t, err)
+	require.Len(t, creds, 1)
+	require.Equal(t, []string{}, creds[0].Transports)
+}
+
+func TestUpdateWebAuthnSignCount(t *testing.T) {
+	cred := createRandomWebAuthnCredential(t, 5)
+
+	err := testQueries.UpdateWebAuthnSignCount(cred.CredentialID, 6)
+	require.NoError(t, err)
+
+	found, err := testQueries.GetWebAuthnCredential(cred.CredentialID)
+	require.NoError(t, err)
+	require.Equal(t, uint32(6), found.SignCount)
+	require.NotNil(t, found.LastUsedOn)
+
+	// a counter that does not go up was signed by a cloned key
+	err = testQueries.UpdateWebAuthnSignCount(cred.CredentialID, 6)
+	require.ErrorIs(t, err, ErrSignCountRegressed)
+	err = testQueries.UpdateWebAuthnSignCount(cred.CredentialID, 2)
+	require.ErrorIs(t, err, ErrSignCountRegressed)
+	err = testQueries.UpdateWebAuthnSignCount(cred.CredentialID, 0)
+	require.ErrorIs(t, err, ErrSignCountRegressed)
+
+	found, err = testQueries.GetWebAuthnCredential(cred.CredentialID)
+	require.NoError(t, err)
+	require.Equal(t, uint32(6), found.SignCount)
+}
+
+func TestUpdateWebAuthnSignCountWithoutCounter(t *testing.T) {
+	cred := createRandomWebAuthnCredential(t, 0)
+
+	// authenticators without a counter always sign 0
+	err := testQueries.UpdateWebAuthnSignCount(cred.CredentialID, 0)
+	require.NoError(t, err)
+	err = testQueries.UpdateWebAuthnSignCount(cred.CredentialID, 0)
+	require.NoError(t, err)
+}
+
+func TestDeleteWebAuthnCredential(t *testing.T) {
+	cred := createRandomWebAuthnCredential(t, 0)
+
+	err := testQueries.DeleteWebAuthnCredential(uuid.New().String(), cred.CredentialID)
+	require.ErrorIs(t, err, ErrWebAuthnCredentialNotFound)
+
+	err = testQueries.DeleteWebAuthnCredential(cred.AccountUuid, cred.CredentialID)
+	require.NoError(t, err)
+	_, err = testQueries.GetWebAuthnCredential(cred.CredentialID)
+	require.ErrorIs(t, err, ErrWebAuthnCredentialNotFound)
+}
+
+func TestConsumeWebAuthnSession(t *testing.T) {
+	token := uuid.New().String()
+	err := testQueries.CreateWebAuthnSession(NewWebAuthnSession(token, CeremonyAuthentication, "challenge", "", time.Now().Add(time.Minute)))
+	require.NoError(t, err)
+
+	session, err := testQueries.ConsumeWebAuthnSession(token)
+	require.NoError(t, err)
+	require.Equal(t, "challenge", session.Challenge)
+
+	// every challenge is answered once
+	_, err = testQueries.ConsumeWebAuthnSession(token)
+	require.ErrorIs(t, err, ErrWebAuthnSessionNotFound)
+}
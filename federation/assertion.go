@@ -0,0 +1,280 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/golang-jwt/jwt"
+)
+
+// ErrAssertionRejected is wrapped by the errors of JWT assertions that are
+// not signed by their issuer or whose claims do not hold, any other error
+// means the keys of the issuer could not be found
+var ErrAssertionRejected = fmt.Errorf("JWT assertion was rejected")
+
+// maxAssertionLifetime is how far in the future an assertion may expire, used
+// assertions are remembered until they expire
+const maxAssertionLifetime = time.Hour
+
+// KeySource finds the keys an issuer signs its tokens with
+type KeySource interface {
+	Key(ctx context.Context, kid string) (*util.Key, error)
+}
+
+// StaticKeySet holds keys configured by hand, for issuers that publish no
+// JWKS or can not be reached
+type StaticKeySet struct {
+	keys []*util.Key
+}
+
+func NewStaticKeySet(keys ...*util.Key) *StaticKeySet {
+	return &StaticKeySet{keys: keys}
+}
+
+// Key returns the key with id kid, tokens without a key id are verified with
+// the only key of the set
+func (ks *StaticKeySet) Key(ctx context.Context, kid string) (*util.Key, error) {
+	if kid == "" && len(ks.keys) == 1 {
+		return ks.keys[0], nil
+	}
+	for _, key := range ks.keys {
+		if key.ID == kid {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// LoadStaticKeySet reads a JWKS or one or more PEM encoded public keys or
+// certificates from path. PEM keys are identified by their RFC 7638
+// thumbprint.
+func LoadStaticKeySet(path string) (*StaticKeySet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &StaticKeySet{}
+	if strings.HasPrefix(strings.TrimSpace(string(b)), "{") {
+		jwks := &util.JWKS{}
+		if err := json.Unmarshal(b, jwks); err != nil {
+			return nil, fmt.Errorf("parsing JWKS %s: %w", path, err)
+		}
+		for _, jwk := range jwks.Keys {
+			key, err := jwk.VerificationKey()
+			if err != nil {
+				return nil, fmt.Errorf("parsing JWKS %s: %w", path, err)
+			}
+			ks.keys = append(ks.keys, key)
+		}
+	} else {
+		for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+			public, err := util.ParsePublicKeyPEM(pem.EncodeToMemory(block))
+			if err != nil {
+				return nil, fmt.Errorf("parsing key %s: %w", path, err)
+			}
+			key, err := util.NewVerificationKey("", public)
+			if err != nil {
+				return nil, fmt.Errorf("parsing key %s: %w", path, err)
+			}
+			ks.keys = append(ks.keys, key)
+		}
+	}
+
+	if len(ks.keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", path)
+	}
+	return ks, nil
+}
+
+// Assertion defines what a verified JWT assertion vouches for
+type Assertion struct {
+	Issuer    string
+	Subject   string
+	ID        string
+	ExpiresAt time.Time
+	// Account is the value of the claim that identifies the account
+	Account string
+}
+
+// TrustedIssuer defines a partner whose JWTs are accepted at the token
+// endpoint in exchange for tokens of this service, as defined by RFC 7523.
+// AccountClaim names the claim of the assertion that identifies the account,
+// AccountField the account field it is matched against.
+type TrustedIssuer struct {
+	Name         string
+	Issuer       string
+	Audience     string
+	AccountClaim string
+	AccountField string
+	Keys         KeySource
+}
+
+func NewTrustedIssuer(name, issuer string, keys KeySource) *TrustedIssuer {
+	return &TrustedIssuer{
+		Name:         name,
+		Issuer:       issuer,
+		Audience:     util.Issuer() + "/token",
+		AccountClaim: "email",
+		AccountField: "email",
+		Keys:         keys,
+	}
+}
+
+// Verify checks the signature and claims of assertion as RFC 7523 section 3
+// requires of an authorization server
+func (ti *TrustedIssuer) Verify(ctx context.Context, assertion string) (*Assertion, error) {
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(assertion, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := ti.Keys.Key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if t.Method.Alg() != key.Algorithm || key.Symmetric() {
+			return nil, fmt.Errorf("unexpected signing method %s for key %q", t.Method.Alg(), kid)
+		}
+		return key.Public, nil
+	})
+	var validationErr *jwt.ValidationError
+	if errors.As(err, &validationErr) {
+		return nil, fmt.Errorf("%w: %v", ErrAssertionRejected, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	skew := int64(util.ClockSkew().Seconds())
+	now := time.Now().Unix()
+	switch {
+	case !claims.VerifyIssuer(ti.Issuer, true):
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrAssertionRejected)
+	case !claims.VerifyAudience(ti.Audience, true):
+		return nil, fmt.Errorf("%w: unexpected audience", ErrAssertionRejected)
+	case !claims.VerifyExpiresAt(now-skew, true):
+		return nil, fmt.Errorf("%w: assertion expired", ErrAssertionRejected)
+	case claims.VerifyExpiresAt(now+int64(maxAssertionLifetime.Seconds())+skew, false):
+		return nil, fmt.Errorf("%w: assertion expires too late", ErrAssertionRejected)
+	case !claims.VerifyNotBefore(now+skew, false):
+		return nil, fmt.Errorf("%w: assertion not valid yet", ErrAssertionRejected)
+	case !claims.VerifyIssuedAt(now+skew, false):
+		return nil, fmt.Errorf("%w: assertion issued in the future", ErrAssertionRejected)
+	}
+
+	a := &Assertion{Issuer: ti.Issuer}
+	a.Subject, _ = claims["sub"].(string)
+	a.ID, _ = claims["jti"].(string)
+	a.Account, _ = claims[ti.AccountClaim].(string)
+	exp, _ := claims["exp"].(float64)
+	a.ExpiresAt = time.Unix(int64(exp), 0).UTC()
+
+	if a.Subject == "" {
+		return nil, fmt.Errorf("%w: assertion has no subject", ErrAssertionRejected)
+	}
+	if a.Account == "" {
+		return nil, fmt.Errorf("%w: assertion has no %s claim", ErrAssertionRejected, ti.AccountClaim)
+	}
+	return a, nil
+}
+
+// AssertionIssuer returns the unverified issuer of assertion, to find the
+// keys it has to be verified with
+func AssertionIssuer(assertion string) (string, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(assertion, claims); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrAssertionRejected, err)
+	}
+	iss, _ := claims["iss"].(string)
+	return iss, nil
+}
+
+var (
+	issuersMu sync.RWMutex
+	issuers   map[string]*TrustedIssuer
+)
+
+// SetTrustedIssuers replaces the trusted issuers
+func SetTrustedIssuers(tis ...*TrustedIssuer) {
+	issuersMu.Lock()
+	defer issuersMu.Unlock()
+
+	issuers = map[string]*TrustedIssuer{}
+	for _, ti := range tis {
+		issuers[ti.Issuer] = ti
+	}
+}
+
+// LookupIssuer returns the trusted issuer with the iss claim iss, or nil when
+// it is not trusted, loading the issuers from the environment on first use
+func LookupIssuer(iss string) (*TrustedIssuer, error) {
+	issuersMu.RLock()
+	tis := issuers
+	issuersMu.RUnlock()
+
+	if tis == nil {
+		loaded, err := LoadTrustedIssuers()
+		if err != nil {
+			return nil, err
+		}
+		SetTrustedIssuers(loaded...)
+		issuersMu.RLock()
+		tis = issuers
+		issuersMu.RUnlock()
+	}
+
+	return tis[iss], nil
+}
+
+// LoadTrustedIssuers returns the issuers named in the comma separated
+// JWT_BEARER_ISSUERS. Each one is configured with JWT_BEARER_<NAME>_ISSUER and
+// either _JWKS_URL or _KEY_FILE, and optionally _AUDIENCE, _ACCOUNT_CLAIM and
+// _ACCOUNT_FIELD. Issuers without an issuer or keys are skipped.
+func LoadTrustedIssuers() ([]*TrustedIssuer, error) {
+	tis := []*TrustedIssuer{}
+	for _, name := range strings.Split(os.Getenv("JWT_BEARER_ISSUERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "JWT_BEARER_" + strings.ToUpper(name) + "_"
+		issuer := os.Getenv(prefix + "ISSUER")
+		if issuer == "" {
+			continue
+		}
+
+		var keys KeySource
+		if url := os.Getenv(prefix + "JWKS_URL"); url != "" {
+			keys = NewRemoteKeySet(url, &http.Client{Timeout: 10 * time.Second})
+		} else if path := os.Getenv(prefix + "KEY_FILE"); path != "" {
+			ks, err := LoadStaticKeySet(path)
+			if err != nil {
+				return nil, err
+			}
+			keys = ks
+		} else {
+			continue
+		}
+
+		ti := NewTrustedIssuer(name, issuer, keys)
+		ti.Audience = util.GetEnv(prefix+"AUDIENCE", ti.Audience)
+		ti.AccountClaim = util.GetEnv(prefix+"ACCOUNT_CLAIM", ti.AccountClaim)
+		ti.AccountField = util.GetEnv(prefix+"ACCOUNT_FIELD", ti.AccountField)
+		// the field ends up in a query
+		if ti.AccountField != "email" && ti.AccountField != "uuid" {
+			return nil, fmt.Errorf("%sACCOUNT_FIELD has to be email or uuid", prefix)
+		}
+		tis = append(tis, ti)
+	}
+	return tis, nil
+}
@@ -0,0 +1,143 @@
+package federation
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/federation/federationtest"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyAssertion(t *testing.T) {
+	idp := federationtest.NewIdP("client", "secret")
+	defer idp.Close()
+
+	ti := NewTrustedIssuer("partner", idp.URL, NewRemoteKeySet(idp.JWKSURL(), idp.Client()))
+	ctx := context.Background()
+
+	a, err := ti.Verify(ctx, idp.Assertion(ti.Audience, jwt.MapClaims{"jti": "id"}))
+	require.NoError(t, err)
+	require.Equal(t, idp.URL, a.Issuer)
+	require.Equal(t, "sub", a.Subject)
+	require.Equal(t, "id", a.ID)
+	require.Equal(t, "john@mail.com", a.Account)
+
+	rejected := map[string]jwt.MapClaims{
+		"audience":     {"aud": "https://other.example.com/token"},
+		"issuer":       {"iss": "https://other.example.com"},
+		"expired":      {"exp": time.Now().Add(-time.Hour).Unix()},
+		"long lived":   {"exp": time.Now().Add(24 * time.Hour).Unix()},
+		"not yet":      {"nbf": time.Now().Add(time.Hour).Unix()},
+		"no subject":   {"sub": ""},
+		"no account":   {"email": nil},
+		"issued later": {"iat": time.Now().Add(time.Hour).Unix()},
+	}
+	for name, claims := range rejected {
+		_, err := ti.Verify(ctx, idp.Assertion(ti.Audience, claims))
+		require.ErrorIs(t, err, ErrAssertionRejected, name)
+	}
+
+	// tokens signed by anyone else are not accepted
+	other := federationtest.NewIdP("client", "secret")
+	defer other.Close()
+	_, err = ti.Verify(ctx, other.Assertion(ti.Audience, jwt.MapClaims{"iss": idp.URL}))
+	require.Error(t, err)
+}
+
+func TestRemoteKeySetRefresh(t *testing.T) {
+	idp := federationtest.NewIdP("client", "secret")
+	defer idp.Close()
+
+	ks := NewRemoteKeySet(idp.JWKSURL(), idp.Client())
+	ctx := context.Background()
+	old := idp.Key
+	_, err := ks.Key(ctx, old.ID)
+	require.NoError(t, err)
+
+	// the provider rolls its key over
+	key, err := util.GenerateKey("ES256")
+	require.NoError(t, err)
+	idp.Key = key
+
+	// unknown keys are only fetched once a minute
+	_, err = ks.Key(ctx, key.ID)
+	require.Error(t, err)
+	ks.attempted = time.Now().Add(-minRefresh)
+	_, err = ks.Key(ctx, key.ID)
+	require.NoError(t, err)
+
+	// and known keys are dropped once the provider stops publishing them
+	_, err = ks.Key(ctx, old.ID)
+	require.Error(t, err)
+	ks.keys[old.ID] = old
+	_, err = ks.Key(ctx, old.ID)
+	require.NoError(t, err)
+	ks.fetched, ks.attempted = time.Now().Add(-maxKeyAge), time.Now().Add(-minRefresh)
+	_, err = ks.Key(ctx, old.ID)
+	require.Error(t, err)
+
+	// a provider that is down does not lock out the keys already known
+	idp.Close()
+	ks.fetched, ks.attempted = time.Now().Add(-maxKeyAge), time.Now().Add(-minRefresh)
+	_, err = ks.Key(ctx, key.ID)
+	require.NoError(t, err)
+}
+
+func TestLoadStaticKeySet(t *testing.T) {
+	idp := federationtest.NewIdP("client", "secret")
+	defer idp.Close()
+	dir := t.TempDir()
+
+	pemFile := filepath.Join(dir, "partner.pem")
+	b, err := util.MarshalPublicKeyPEM(idp.Key.Public)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(pemFile, b, 0600))
+
+	jwksFile := filepath.Join(dir, "partner.json")
+	res, err := idp.Client().Get(idp.JWKSURL())
+	require.NoError(t, err)
+	defer res.Body.Close()
+	f, err := os.Create(jwksFile)
+	require.NoError(t, err)
+	_, err = f.ReadFrom(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	t.Setenv("JWT_BEARER_ISSUERS", "pem, jwks")
+	t.Setenv("JWT_BEARER_PEM_ISSUER", "https://pem.example.com")
+	t.Setenv("JWT_BEARER_PEM_KEY_FILE", pemFile)
+	t.Setenv("JWT_BEARER_PEM_ACCOUNT_CLAIM", "sub")
+	t.Setenv("JWT_BEARER_PEM_ACCOUNT_FIELD", "uuid")
+	t.Setenv("JWT_BEARER_JWKS_ISSUER", idp.URL)
+	t.Setenv("JWT_BEARER_JWKS_KEY_FILE", jwksFile)
+	tis, err := LoadTrustedIssuers()
+	require.NoError(t, err)
+	require.Len(t, tis, 2)
+
+	// PEM keys have no key id, assertions without one are verified with the
+	// only key
+	token := jwt.NewWithClaims(idp.Key.SigningMethod(), jwt.MapClaims{
+		"iss": "https://pem.example.com",
+		"sub": "uuid",
+		"aud": tis[0].Audience,
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	assertion, err := token.SignedString(idp.Key.Private)
+	require.NoError(t, err)
+	a, err := tis[0].Verify(context.Background(), assertion)
+	require.NoError(t, err)
+	require.Equal(t, "uuid", a.Account)
+	require.Equal(t, "uuid", tis[0].AccountField)
+
+	_, err = tis[1].Verify(context.Background(), idp.Assertion(tis[1].Audience, nil))
+	require.NoError(t, err)
+
+	t.Setenv("JWT_BEARER_PEM_ACCOUNT_FIELD", "password")
+	_, err = LoadTrustedIssuers()
+	require.Error(t, err)
+}
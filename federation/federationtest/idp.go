@@ -0,0 +1,210 @@
+// Package federationtest runs a fake OpenID Connect provider, to test
+// federated logins without a real one
+package federationtest
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/golang-jwt/jwt"
+)
+
+// IdP is a provider that signs in whoever Claims describes without asking.
+// Its authorization endpoint sends the user straight back with a code, its
+// token endpoint checks the client secret and the PKCE verifier like a real
+// provider does.
+type IdP struct {
+	*httptest.Server
+	Key          *util.Key
+	ClientID     string
+	ClientSecret string
+
+	mu     sync.Mutex
+	claims jwt.MapClaims
+	codes  map[string]authorization
+}
+
+type authorization struct {
+	claims        jwt.MapClaims
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+}
+
+// NewIdP starts a provider for a single client, signing in sub with the
+// email john@mail.com until SetClaims says otherwise
+func NewIdP(clientID, clientSecret string) *IdP {
+	key, err := util.GenerateKey("ES256")
+	if err != nil {
+		panic(err)
+	}
+
+	idp := &IdP{
+		Key:          key,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		claims:       jwt.MapClaims{"sub": "sub", "email": "john@mail.com", "email_verified": true},
+		codes:        map[string]authorization{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+
+	return idp
+}
+
+// DiscoveryURL returns the URL of the discovery document
+func (idp *IdP) DiscoveryURL() string {
+	return idp.URL + "/.well-known/openid-configuration"
+}
+
+// JWKSURL returns the URL of the provider's keys
+func (idp *IdP) JWKSURL() string {
+	return idp.URL + "/jwks"
+}
+
+// Assertion returns a JWT of the provider for audience about sub with the
+// email john@mail.com, as a partner issues them for the JWT bearer grant. claims are added to the registered claims
+// and override them.
+func (idp *IdP) Assertion(audience string, claims jwt.MapClaims) string {
+	now := time.Now()
+	assertion := jwt.MapClaims{
+		"iss":   idp.URL,
+		"sub":   "sub",
+		"email": "john@mail.com",
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"jti":   util.RandomString(16),
+	}
+	for name, value := range claims {
+		assertion[name] = value
+	}
+
+	token, err := idp.sign(assertion)
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+func (idp *IdP) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(idp.Key.SigningMethod(), claims)
+	token.Header["kid"] = idp.Key.ID
+	return token.SignedString(idp.Key.Private)
+}
+
+// SetClaims sets the identity claims of the next users signing in
+func (idp *IdP) SetClaims(claims jwt.MapClaims) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.claims = claims
+}
+
+func (idp *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 idp.URL,
+		"authorization_endpoint": idp.URL + "/authorize",
+		"token_endpoint":         idp.URL + "/token",
+		"jwks_uri":               idp.URL + "/jwks",
+	})
+}
+
+func (idp *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	jwks, err := util.NewJWKS(util.NewKeySet(idp.Key))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, jwks)
+}
+
+func (idp *IdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != idp.ClientID || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	code := util.RandomString(32)
+	idp.mu.Lock()
+	idp.codes[code] = authorization{
+		claims:        idp.claims,
+		redirectURI:   q.Get("redirect_uri"),
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+	}
+	idp.mu.Unlock()
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (idp *IdP) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if id != idp.ClientID || subtle.ConstantTimeCompare([]byte(secret), []byte(idp.ClientSecret)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	idp.mu.Lock()
+	auth, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+
+	if !ok || auth.redirectURI != r.PostFormValue("redirect_uri") || !util.VerifyCodeChallenge(r.PostFormValue("code_verifier"), auth.codeChallenge) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   idp.URL,
+		"aud":   idp.ClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": auth.nonce,
+	}
+	for name, value := range auth.claims {
+		claims[name] = value
+	}
+
+	idToken, err := idp.sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": util.RandomString(32),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,221 @@
+package federationtest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+)
+
+// SAMLIdP is a SAML identity provider that asserts whoever Session describes
+// without asking. Unlike the identity provider it is built on, it insists on
+// AuthnRequests signed by the service provider registered with it.
+type SAMLIdP struct {
+	*httptest.Server
+	IDP *saml.IdentityProvider
+
+	mu      sync.Mutex
+	session *saml.Session
+	sp      *saml.EntityDescriptor
+}
+
+// NewSAMLIdP starts an identity provider asserting the NameID sub with the
+// email john@mail.com until SetSession says otherwise
+func NewSAMLIdP() *SAMLIdP {
+	key, cert := NewSAMLCredentials()
+	idp := &SAMLIdP{
+		IDP: &saml.IdentityProvider{
+			Key:         key,
+			Certificate: cert,
+		},
+		session: &saml.Session{
+			NameID:        "sub",
+			UserGivenName: "John",
+			UserSurname:   "Doe",
+			CustomAttributes: []saml.Attribute{{
+				Name:   "email",
+				Values: []saml.AttributeValue{{Type: "xs:string", Value: "john@mail.com"}},
+			}},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metadata", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		w.Write(idp.Metadata())
+	})
+	idp.Server = httptest.NewServer(mux)
+
+	metadataURL, _ := url.Parse(idp.URL + "/metadata")
+	ssoURL, _ := url.Parse(idp.URL + "/sso")
+	idp.IDP.MetadataURL, idp.IDP.SSOURL = *metadataURL, *ssoURL
+	idp.IDP.ServiceProviderProvider = idp
+
+	return idp
+}
+
+// Metadata returns the metadata of the identity provider
+func (idp *SAMLIdP) Metadata() []byte {
+	b, err := xml.Marshal(idp.IDP.Metadata())
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// SetSession sets the session asserted for the next users signing in
+func (idp *SAMLIdP) SetSession(session *saml.Session) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.session = session
+}
+
+// RegisterServiceProvider imports the metadata of the service provider, the
+// only one the identity provider answers
+func (idp *SAMLIdP) RegisterServiceProvider(metadata []byte) error {
+	sp, err := samlsp.ParseMetadata(metadata)
+	if err != nil {
+		return err
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.sp = sp
+	return nil
+}
+
+// GetServiceProvider returns the registered service provider
+func (idp *SAMLIdP) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	if idp.sp == nil || idp.sp.EntityID != serviceProviderID {
+		return nil, fmt.Errorf("unknown service provider %s", serviceProviderID)
+	}
+	return idp.sp, nil
+}
+
+// Respond answers the AuthnRequest the user was redirected to authnRequestURL
+// with, returning where the browser posts the response to and the form it
+// posts
+func (idp *SAMLIdP) Respond(authnRequestURL string) (string, url.Values, error) {
+	r := httptest.NewRequest(http.MethodGet, authnRequestURL, nil)
+	if err := idp.verifySignature(r.URL.RawQuery); err != nil {
+		return "", nil, err
+	}
+
+	req, err := saml.NewIdpAuthnRequest(idp.IDP, r)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := req.Validate(); err != nil {
+		return "", nil, err
+	}
+
+	idp.mu.Lock()
+	session := *idp.session
+	idp.mu.Unlock()
+	session.ID = "session"
+	session.CreateTime = time.Now()
+	session.ExpireTime = time.Now().Add(time.Hour)
+	session.Index = "1"
+
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, &session); err != nil {
+		return "", nil, err
+	}
+	form, err := req.PostBinding()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return form.URL, url.Values{"SAMLResponse": {form.SAMLResponse}, "RelayState": {form.RelayState}}, nil
+}
+
+// verifySignature checks the signature of the redirect binding, which covers
+// the query up to the signature in the order it was sent
+func (idp *SAMLIdP) verifySignature(rawQuery string) error {
+	signed, encoded, ok := strings.Cut(rawQuery, "&Signature=")
+	if !ok {
+		return fmt.Errorf("AuthnRequest is not signed")
+	}
+	encoded, err := url.QueryUnescape(encoded)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+
+	idp.mu.Lock()
+	sp := idp.sp
+	idp.mu.Unlock()
+	if sp == nil {
+		return fmt.Errorf("no service provider registered")
+	}
+
+	for _, descriptor := range sp.SPSSODescriptors {
+		for _, key := range descriptor.KeyDescriptors {
+			if key.Use != "signing" || len(key.KeyInfo.X509Data.X509Certificates) == 0 {
+				continue
+			}
+			der, err := base64.StdEncoding.DecodeString(key.KeyInfo.X509Data.X509Certificates[0].Data)
+			if err != nil {
+				return err
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return err
+			}
+			public, ok := cert.PublicKey.(*rsa.PublicKey)
+			if !ok {
+				continue
+			}
+			sum := sha256.Sum256([]byte(signed))
+			if rsa.VerifyPKCS1v15(public, crypto.SHA256, sum[:], sig) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("invalid AuthnRequest signature")
+}
+
+// NewSAMLCredentials returns a fresh RSA key with a self-signed certificate
+func NewSAMLCredentials() (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "federationtest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+
+	return key, cert
+}
@@ -0,0 +1,108 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// minRefresh is how long a key set waits before fetching the keys again for a
+// key id it does not know, so tokens with made up key ids can not make it
+// hammer the provider
+const minRefresh = time.Minute
+
+// maxKeyAge is how long fetched keys are trusted before they are fetched
+// again, so keys the provider withdrew stop being accepted
+const maxKeyAge = time.Hour
+
+// RemoteKeySet holds the keys a provider publishes at its jwks_uri. Keys are
+// fetched on first use, again when a token names a key that is not known yet,
+// which is how providers roll their keys over, and once they are older than
+// maxKeyAge. Known keys keep being used while the provider can not be reached.
+type RemoteKeySet struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*util.Key
+	fetched   time.Time
+	attempted time.Time
+}
+
+func NewRemoteKeySet(url string, client *http.Client) *RemoteKeySet {
+	return &RemoteKeySet{url: url, client: client}
+}
+
+// Key returns the key with id kid
+func (ks *RemoteKeySet) Key(ctx context.Context, kid string) (*util.Key, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	key, ok := ks.keys[kid]
+	if ok && time.Since(ks.fetched) < maxKeyAge {
+		return key, nil
+	}
+
+	if time.Since(ks.attempted) >= minRefresh {
+		ks.attempted = time.Now()
+		keys, err := ks.fetch(ctx)
+		if err != nil && !ok {
+			return nil, err
+		}
+		if err == nil {
+			ks.keys, ks.fetched = keys, time.Now()
+			key, ok = ks.keys[kid]
+		}
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (ks *RemoteKeySet) fetch(ctx context.Context) (map[string]*util.Key, error) {
+	jwks := &util.JWKS{}
+	if err := getJSON(ctx, ks.client, ks.url, jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*util.Key{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// keys of unsupported types are skipped, the provider may publish
+		// keys for other purposes
+		key, err := jwk.VerificationKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,288 @@
+// Package federation signs accounts in with upstream OpenID Connect
+// providers, such as Google or a corporate SSO. Providers are configured with
+// FEDERATION_PROVIDERS and found through their discovery documents.
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/golang-jwt/jwt"
+)
+
+// ErrLoginRejected is wrapped by the errors of logins the provider or its ID
+// token did not let through, any other error means the provider could not be
+// asked at all
+var ErrLoginRejected = fmt.Errorf("External login was rejected")
+
+// Identity defines who signed in at a provider
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+}
+
+// Metadata defines the parts of a provider's discovery document that are used
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// Provider defines an upstream OpenID Connect provider this service is a
+// client of. Its metadata and keys are fetched on first use.
+type Provider struct {
+	Name         string
+	DiscoveryURL string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+	Client       *http.Client
+
+	mu       sync.Mutex
+	metadata *Metadata
+	keys     *RemoteKeySet
+}
+
+func NewProvider(name, discoveryURL, clientID, clientSecret string) *Provider {
+	return &Provider{
+		Name:         name,
+		DiscoveryURL: discoveryURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scope:        "openid email profile",
+		Client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// RedirectURI returns where the provider sends the user back to, it has to be
+// registered with the provider
+func (p *Provider) RedirectURI() string {
+	return util.Issuer() + "/federation/" + p.Name + "/callback"
+}
+
+// Metadata returns the discovery document of the provider
+func (p *Provider) Metadata(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	m := &Metadata{}
+	if err := getJSON(ctx, p.Client, p.DiscoveryURL, m); err != nil {
+		return nil, err
+	}
+	if m.Issuer == "" || m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JwksURI == "" {
+		return nil, fmt.Errorf("incomplete discovery document at %s", p.DiscoveryURL)
+	}
+
+	p.metadata = m
+	p.keys = NewRemoteKeySet(m.JwksURI, p.Client)
+	return m, nil
+}
+
+// AuthCodeURL returns the URL of the provider the user is sent to, for the
+// authorization code flow with PKCE
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	m, err := p.Metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURI()},
+		"scope":                 {p.Scope},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {util.CodeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return m.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// Exchange trades the code the provider sent the user back with for an ID
+// token and returns the identity it vouches for
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error) {
+	m, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURI()},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body := struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding token response of %s: %w", p.Name, err)
+	}
+	if body.Error != "" {
+		return nil, fmt.Errorf("%w: %s %s", ErrLoginRejected, body.Error, body.ErrorDescription)
+	}
+	if res.StatusCode != http.StatusOK || body.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint of %s answered %s without an ID token", p.Name, res.Status)
+	}
+
+	return p.verifyIDToken(ctx, m, body.IDToken, nonce)
+}
+
+// verifyIDToken checks the signature and claims of an ID token as OpenID
+// Connect Core 3.1.3.7 requires of a client
+func (p *Provider) verifyIDToken(ctx context.Context, m *Metadata, idToken, nonce string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(idToken, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := p.keys.Key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if t.Method.Alg() != key.Algorithm || key.Symmetric() {
+			return nil, fmt.Errorf("unexpected signing method %s for key %q", t.Method.Alg(), kid)
+		}
+		return key.Public, nil
+	})
+	var validationErr *jwt.ValidationError
+	if errors.As(err, &validationErr) {
+		return nil, fmt.Errorf("%w: %v", ErrLoginRejected, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	skew := int64(util.ClockSkew().Seconds())
+	now := time.Now().Unix()
+	switch {
+	case !claims.VerifyIssuer(m.Issuer, true):
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrLoginRejected)
+	case !claims.VerifyAudience(p.ClientID, true):
+		return nil, fmt.Errorf("%w: unexpected audience", ErrLoginRejected)
+	case !claims.VerifyExpiresAt(now-skew, true):
+		return nil, fmt.Errorf("%w: ID token expired", ErrLoginRejected)
+	case !claims.VerifyIssuedAt(now+skew, false):
+		return nil, fmt.Errorf("%w: ID token issued in the future", ErrLoginRejected)
+	case claims["nonce"] != nonce:
+		return nil, fmt.Errorf("%w: nonce does not match", ErrLoginRejected)
+	}
+
+	identity := &Identity{Provider: p.Name}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.GivenName, _ = claims["given_name"].(string)
+	identity.FamilyName, _ = claims["family_name"].(string)
+	// some providers send the flag as a string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("%w: ID token has no subject", ErrLoginRejected)
+	}
+	return identity, nil
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   map[string]*Provider
+)
+
+// SetProviders replaces the configured providers
+func SetProviders(ps ...*Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	providers = map[string]*Provider{}
+	for _, p := range ps {
+		providers[p.Name] = p
+	}
+}
+
+// Lookup returns the provider named name, loading the providers from the
+// environment on first use
+func Lookup(name string) (*Provider, bool) {
+	providersMu.RLock()
+	ps := providers
+	providersMu.RUnlock()
+
+	if ps == nil {
+		SetProviders(LoadProviders()...)
+		providersMu.RLock()
+		ps = providers
+		providersMu.RUnlock()
+	}
+
+	p, ok := ps[name]
+	return p, ok
+}
+
+// LoadProviders returns the providers named in the comma separated
+// FEDERATION_PROVIDERS. Each one is configured with FEDERATION_<NAME>_DISCOVERY_URL,
+// _CLIENT_ID, _CLIENT_SECRET and optionally _SCOPE, providers without a
+// discovery URL or client id are skipped.
+func LoadProviders() []*Provider {
+	ps := []*Provider{}
+	for _, name := range strings.Split(os.Getenv("FEDERATION_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "FEDERATION_" + strings.ToUpper(name) + "_"
+		p := NewProvider(
+			name,
+			os.Getenv(prefix+"DISCOVERY_URL"),
+			os.Getenv(prefix+"CLIENT_ID"),
+			os.Getenv(prefix+"CLIENT_SECRET"))
+		if p.DiscoveryURL == "" || p.ClientID == "" {
+			continue
+		}
+		p.Scope = util.GetEnv(prefix+"SCOPE", p.Scope)
+		ps = append(ps, p)
+	}
+	return ps
+}
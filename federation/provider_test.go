@@ -0,0 +1,83 @@
+package federation
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/blazingly-fast/auth-assistant/federation/federationtest"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+// authorize runs the provider's side of the login and returns the code it
+// sends the user back with
+func authorize(t *testing.T, p *Provider, state, nonce, verifier string) string {
+	authURL, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+	require.NoError(t, err)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(authURL)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusFound, res.StatusCode)
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, state, location.Query().Get("state"))
+	return location.Query().Get("code")
+}
+
+func TestExchange(t *testing.T) {
+	idp := federationtest.NewIdP("client", "secret")
+	defer idp.Close()
+
+	p := NewProvider("corp", idp.DiscoveryURL(), "client", "secret")
+	verifier := "dBjftJeZ4CVP-mJ92K9sTGLq0lSQ8QjeWmAWCpJbJ7MO"
+
+	code := authorize(t, p, "state", "nonce", verifier)
+	identity, err := p.Exchange(context.Background(), code, verifier, "nonce")
+	require.NoError(t, err)
+	require.Equal(t, &Identity{Provider: "corp", Subject: "sub", Email: "john@mail.com", EmailVerified: true}, identity)
+
+	// codes are bound to the nonce of the login they were issued for
+	code = authorize(t, p, "state", "nonce", verifier)
+	_, err = p.Exchange(context.Background(), code, verifier, "other")
+	require.ErrorIs(t, err, ErrLoginRejected)
+
+	// and to the PKCE verifier
+	code = authorize(t, p, "state", "nonce", verifier)
+	_, err = p.Exchange(context.Background(), code, "wrong-verifier-wrong-verifier-wrong-verifier", "nonce")
+	require.ErrorIs(t, err, ErrLoginRejected)
+
+	// ID tokens for other clients are not accepted
+	idp.SetClaims(jwt.MapClaims{"sub": "sub", "aud": "other"})
+	code = authorize(t, p, "state", "nonce", verifier)
+	_, err = p.Exchange(context.Background(), code, verifier, "nonce")
+	require.ErrorIs(t, err, ErrLoginRejected)
+
+	// the client secret is checked too
+	idp.SetClaims(jwt.MapClaims{"sub": "sub"})
+	p.ClientSecret = "wrong"
+	code = authorize(t, p, "state", "nonce", verifier)
+	_, err = p.Exchange(context.Background(), code, verifier, "nonce")
+	require.ErrorIs(t, err, ErrLoginRejected)
+}
+
+func TestLoadProviders(t *testing.T) {
+	t.Setenv("FEDERATION_PROVIDERS", "Google, corp, incomplete")
+	t.Setenv("FEDERATION_GOOGLE_DISCOVERY_URL", "https://accounts.google.com/.well-known/openid-configuration")
+	t.Setenv("FEDERATION_GOOGLE_CLIENT_ID", "google-client")
+	t.Setenv("FEDERATION_CORP_DISCOVERY_URL", "https://sso.example.com/.well-known/openid-configuration")
+	t.Setenv("FEDERATION_CORP_CLIENT_ID", "corp-client")
+	t.Setenv("FEDERATION_CORP_SCOPE", "openid email")
+	t.Setenv("FEDERATION_INCOMPLETE_CLIENT_ID", "incomplete-client")
+
+	ps := LoadProviders()
+	require.Len(t, ps, 2)
+	require.Equal(t, "google", ps[0].Name)
+	require.Equal(t, "openid email profile", ps[0].Scope)
+	require.Equal(t, "corp", ps[1].Name)
+	require.Equal(t, "openid email", ps[1].Scope)
+}
@@ -0,0 +1,284 @@
+package federation
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// maxMetadataSize is the most that is read of metadata fetched from a URL
+const maxMetadataSize = 1 << 20
+
+// SAMLCredentials defines the key the service provider signs its requests
+// with, and its certificate that identity providers verify them and encrypt
+// assertions with
+type SAMLCredentials struct {
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// SAMLAttributes defines the names of the attributes carrying the fields of an
+// account, matched against the names and friendly names of the attributes
+type SAMLAttributes struct {
+	Email     string
+	FirstName string
+	LastName  string
+}
+
+// SAMLProvider is the service provider side of the SAML identity provider of
+// a tenant. Every tenant gets its own entity ID and endpoints under
+// /saml/{tenant}, so a provider can not answer for another tenant.
+type SAMLProvider struct {
+	Tenant     string
+	Attributes SAMLAttributes
+
+	sp *saml.ServiceProvider
+}
+
+// NewSAMLProvider returns the service provider of tenant for the identity
+// provider described by metadata
+func NewSAMLProvider(tenant string, metadata []byte, attributes SAMLAttributes) (*SAMLProvider, error) {
+	creds, err := CurrentSAMLCredentials()
+	if err != nil {
+		return nil, err
+	}
+	idp, err := ParseSAMLMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	base := util.Issuer() + "/saml/" + url.PathEscape(tenant)
+	metadataURL, err := url.Parse(base + "/metadata")
+	if err != nil {
+		return nil, err
+	}
+	acsURL, err := url.Parse(base + "/acs")
+	if err != nil {
+		return nil, err
+	}
+
+	return &SAMLProvider{
+		Tenant:     tenant,
+		Attributes: attributes,
+		sp: &saml.ServiceProvider{
+			EntityID:          metadataURL.String(),
+			Key:               creds.Key,
+			Certificate:       creds.Certificate,
+			MetadataURL:       *metadataURL,
+			AcsURL:            *acsURL,
+			IDPMetadata:       idp,
+			AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+			SignatureMethod:   dsig.RSASHA256SignatureMethod,
+		},
+	}, nil
+}
+
+// Name returns the provider name identities of the tenant are linked under
+func (p *SAMLProvider) Name() string {
+	return "saml:" + p.Tenant
+}
+
+// Metadata returns the metadata of the service provider, for the identity
+// provider to import
+func (p *SAMLProvider) Metadata() ([]byte, error) {
+	b, err := xml.MarshalIndent(p.sp.Metadata(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// AuthnRequestURL returns the URL of the identity provider the user is sent
+// to with a signed AuthnRequest, and the ID of the request the response has
+// to answer
+func (p *SAMLProvider) AuthnRequestURL() (string, string, error) {
+	req, err := p.sp.MakeAuthenticationRequest(
+		p.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+		saml.HTTPRedirectBinding,
+		saml.HTTPPostBinding)
+	if err != nil {
+		return "", "", err
+	}
+
+	redirect, err := req.Redirect("", p.sp)
+	if err != nil {
+		return "", "", err
+	}
+	return redirect.String(), req.ID, nil
+}
+
+// ParseResponse checks the response the identity provider posted to the ACS
+// endpoint, its signature, issuer, audience, recipient and validity period
+// and that it answers requestID, and returns the identity it asserts
+func (p *SAMLProvider) ParseResponse(r *http.Request, requestID string) (*Identity, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	assertion, err := p.sp.ParseResponse(r, []string{requestID})
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) && invalid.PrivateErr != nil {
+			err = invalid.PrivateErr
+		}
+		return nil, fmt.Errorf("%w: %v", ErrLoginRejected, err)
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return nil, fmt.Errorf("%w: assertion has no subject", ErrLoginRejected)
+	}
+
+	nameID := assertion.Subject.NameID
+	identity := &Identity{
+		Provider:   p.Name(),
+		Subject:    nameID.Value,
+		Email:      attribute(assertion, p.Attributes.Email),
+		GivenName:  attribute(assertion, p.Attributes.FirstName),
+		FamilyName: attribute(assertion, p.Attributes.LastName),
+	}
+	if identity.Email == "" && nameID.Format == string(saml.EmailAddressNameIDFormat) {
+		identity.Email = nameID.Value
+	}
+	// the identity provider of a tenant is the authority on its accounts, the
+	// caller still has to check the email is in one of the tenant's domains
+	identity.EmailVerified = identity.Email != ""
+
+	return identity, nil
+}
+
+// attribute returns the first value of the attribute called name
+func attribute(assertion *saml.Assertion, name string) string {
+	if name == "" {
+		return ""
+	}
+
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			if (attr.Name == name || attr.FriendlyName == name) && len(attr.Values) > 0 {
+				return attr.Values[0].Value
+			}
+		}
+	}
+	return ""
+}
+
+// ParseSAMLMetadata parses the metadata of an identity provider, which has to
+// offer single sign-on with the redirect binding
+func ParseSAMLMetadata(b []byte) (*saml.EntityDescriptor, error) {
+	idp, err := samlsp.ParseMetadata(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing SAML metadata: %w", err)
+	}
+	if idp.EntityID == "" || len(idp.IDPSSODescriptors) == 0 {
+		return nil, fmt.Errorf("SAML metadata describes no identity provider")
+	}
+
+	sp := &saml.ServiceProvider{IDPMetadata: idp}
+	if sp.GetSSOBindingLocation(saml.HTTPRedirectBinding) == "" {
+		return nil, fmt.Errorf("identity provider %s has no single sign-on service with the redirect binding", idp.EntityID)
+	}
+	return idp, nil
+}
+
+// FetchSAMLMetadata returns the metadata an identity provider publishes at
+// metadataURL
+func FetchSAMLMetadata(ctx context.Context, client *http.Client, metadataURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", metadataURL, res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, maxMetadataSize))
+}
+
+var (
+	samlMu          sync.RWMutex
+	samlCredentials *SAMLCredentials
+)
+
+// SetSAMLCredentials replaces the credentials of the service provider
+func SetSAMLCredentials(creds *SAMLCredentials) {
+	samlMu.Lock()
+	defer samlMu.Unlock()
+	samlCredentials = creds
+}
+
+// CurrentSAMLCredentials returns the credentials of the service provider,
+// loading them from the environment on first use
+func CurrentSAMLCredentials() (*SAMLCredentials, error) {
+	samlMu.RLock()
+	creds := samlCredentials
+	samlMu.RUnlock()
+	if creds != nil {
+		return creds, nil
+	}
+
+	creds, err := LoadSAMLCredentials()
+	if err != nil {
+		return nil, err
+	}
+	SetSAMLCredentials(creds)
+	return creds, nil
+}
+
+// LoadSAMLCredentials reads SAML_SP_KEY, the path of a PEM encoded RSA key,
+// and SAML_SP_CERTIFICATE, the path of its PEM encoded certificate
+func LoadSAMLCredentials() (*SAMLCredentials, error) {
+	keyPath, certPath := os.Getenv("SAML_SP_KEY"), os.Getenv("SAML_SP_CERTIFICATE")
+	if keyPath == "" || certPath == "" {
+		return nil, fmt.Errorf("SAML_SP_KEY and SAML_SP_CERTIFICATE are not set")
+	}
+
+	b, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	private, err := util.ParsePrivateKeyPEM(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing SAML key %s: %w", keyPath, err)
+	}
+	key, ok := private.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("SAML key %s is not an RSA key", keyPath)
+	}
+
+	b, err = os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing SAML certificate %s: %w", certPath, err)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return nil, fmt.Errorf("SAML certificate %s is not for the key %s", certPath, keyPath)
+	}
+
+	return &SAMLCredentials{Key: key, Certificate: cert}, nil
+}
@@ -0,0 +1,106 @@
+package federation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/blazingly-fast/auth-assistant/federation/federationtest"
+	"github.com/crewjam/saml"
+	"github.com/stretchr/testify/require"
+)
+
+func newSAMLProvider(t *testing.T, idp *federationtest.SAMLIdP) *SAMLProvider {
+	key, cert := federationtest.NewSAMLCredentials()
+	SetSAMLCredentials(&SAMLCredentials{Key: key, Certificate: cert})
+	t.Cleanup(func() { SetSAMLCredentials(nil) })
+
+	p, err := NewSAMLProvider("acme", idp.Metadata(), SAMLAttributes{Email: "email", FirstName: "givenName", LastName: "sn"})
+	require.NoError(t, err)
+
+	metadata, err := p.Metadata()
+	require.NoError(t, err)
+	require.NoError(t, idp.RegisterServiceProvider(metadata))
+	return p
+}
+
+// acs returns the request the browser makes to the ACS endpoint
+func acs(acsURL string, form url.Values) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, acsURL, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestSAMLLogin(t *testing.T) {
+	idp := federationtest.NewSAMLIdP()
+	defer idp.Close()
+	p := newSAMLProvider(t, idp)
+
+	authnURL, requestID, err := p.AuthnRequestURL()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(authnURL, idp.URL+"/sso?"))
+
+	acsURL, form, err := idp.Respond(authnURL)
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:8080/saml/acme/acs", acsURL)
+
+	identity, err := p.ParseResponse(acs(acsURL, form), requestID)
+	require.NoError(t, err)
+	require.Equal(t, &Identity{
+		Provider:      "saml:acme",
+		Subject:       "sub",
+		Email:         "john@mail.com",
+		EmailVerified: true,
+		GivenName:     "John",
+		FamilyName:    "Doe",
+	}, identity)
+
+	// responses only answer the request they were made for
+	_, err = p.ParseResponse(acs(acsURL, form), "other")
+	require.ErrorIs(t, err, ErrLoginRejected)
+
+	// and have to be signed by the key in the metadata, not just any key
+	impostor := federationtest.NewSAMLIdP()
+	defer impostor.Close()
+	impostor.IDP.MetadataURL, impostor.IDP.SSOURL = idp.IDP.MetadataURL, idp.IDP.SSOURL
+	metadata, err := p.Metadata()
+	require.NoError(t, err)
+	require.NoError(t, impostor.RegisterServiceProvider(metadata))
+	authnURL, requestID, err = p.AuthnRequestURL()
+	require.NoError(t, err)
+	acsURL, form, err = impostor.Respond(authnURL)
+	require.NoError(t, err)
+	_, err = p.ParseResponse(acs(acsURL, form), requestID)
+	require.ErrorIs(t, err, ErrLoginRejected)
+
+	// the email falls back to a NameID in the email format
+	idp.SetSession(&saml.Session{NameID: "jane@mail.com", NameIDFormat: string(saml.EmailAddressNameIDFormat)})
+	authnURL, requestID, err = p.AuthnRequestURL()
+	require.NoError(t, err)
+	acsURL, form, err = idp.Respond(authnURL)
+	require.NoError(t, err)
+	identity, err = p.ParseResponse(acs(acsURL, form), requestID)
+	require.NoError(t, err)
+	require.Equal(t, "jane@mail.com", identity.Email)
+}
+
+func TestParseSAMLMetadata(t *testing.T) {
+	idp := federationtest.NewSAMLIdP()
+	defer idp.Close()
+
+	descriptor, err := ParseSAMLMetadata(idp.Metadata())
+	require.NoError(t, err)
+	require.Equal(t, idp.URL+"/metadata", descriptor.EntityID)
+
+	_, err = ParseSAMLMetadata([]byte("<html></html>"))
+	require.Error(t, err)
+
+	// the metadata of a service provider describes no identity provider
+	p := newSAMLProvider(t, idp)
+	metadata, err := p.Metadata()
+	require.NoError(t, err)
+	_, err = ParseSAMLMetadata(metadata)
+	require.Error(t, err)
+}
@@ -18,7 +18,7 @@ import (
 func (s *Server) HandleGetAccountByID(w http.ResponseWriter, r *http.Request) error {
 	uuid := mux.Vars(r)["uuid"]
 
-	if err := util.MatchUserTypeToUUID(r, uuid); err != nil {
+	if err := util.MatchUserTypeToUUID(r, uuid); err != nil && util.CheckPermission(r, "ADMIN", util.ScopeAccountsRead) != nil {
 		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
 	}
 
@@ -36,7 +36,7 @@ func (s *Server) HandleGetAccountByID(w http.ResponseWriter, r *http.Request) er
 // HandleGetAccounts handles GET requests and returns all current accounts
 func (s *Server) HandleGetAccounts(w http.ResponseWriter, r *http.Request) error {
 
-	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+	if err := util.CheckPermission(r, "ADMIN", util.ScopeAccountsRead); err != nil {
 		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
 	}
 
@@ -76,13 +76,7 @@ func (s *Server) HandleCreateAccount(w http.ResponseWriter, r *http.Request) err
 	uuid := uuid.New().String()
 	userType := "USER"
 	avatar := "default.png"
-
-	token, refreshToken, err := util.GenerateAllToken(
-		req.FirstName,
-		req.LastName,
-		req.Email,
-		userType,
-		uuid)
+	sessionID := newSessionID()
 
 	account := data.NewAccount(
 		req.FirstName,
@@ -92,14 +86,31 @@ func (s *Server) HandleCreateAccount(w http.ResponseWriter, r *http.Request) err
 		userType,
 		avatar,
 		uuid,
-		token,
-		refreshToken)
+		"",
+		"")
+
+	token, refreshToken, err := util.GenerateAllToken(accessClaims(account, sessionID, "pwd"))
+	if err != nil {
+		return err
+	}
+	account.TokenHash = util.HashToken(token)
+	account.RefreshTokenHash = util.HashToken(refreshToken)
 
 	err = s.d.CreateAccout(account)
 	if err != nil {
 		return err
 	}
 
+	err = s.startSession(r, sessionID, uuid, "")
+	if err != nil {
+		return err
+	}
+
+	err = s.issueRefreshToken(refreshToken, sessionID, uuid, util.RefreshTokenLifetime)
+	if err != nil {
+		return err
+	}
+
 	res := data.NewAccountResponse(
 		account.FirstName,
 		account.LastName,
@@ -107,8 +118,10 @@ func (s *Server) HandleCreateAccount(w http.ResponseWriter, r *http.Request) err
 		userType,
 		avatar,
 		uuid,
-		token)
+		token,
+		refreshToken)
 
+	setAuthCookie(w, token)
 	return WriteJSON(w, http.StatusOK, &res)
 }
 
@@ -144,6 +157,8 @@ func (s *Server) HandleUpdateAccount(w http.ResponseWriter, r *http.Request) err
 		return WriteJSON(w, http.StatusUnprocessableEntity, &GenericError{Message: fmt.Sprintf("email %s already exists", req.Email)})
 	}
 
+	passwordChanged := util.VerifyPassword(foundAccWithUUID.Password, req.Password) != nil
+
 	hashedPassword, err := util.HashPassword(req.Password)
 	if err != nil {
 		return err
@@ -155,6 +170,13 @@ func (s *Server) HandleUpdateAccount(w http.ResponseWriter, r *http.Request) err
 		return err
 	}
 
+	// a new password logs the account out everywhere
+	if passwordChanged {
+		if err := s.d.RevokeAccountTokens(uuid); err != nil {
+			return err
+		}
+	}
+
 	return WriteJSON(w, http.StatusOK, fmt.Sprintf("account updated successfully"))
 }
 
@@ -162,7 +184,7 @@ func (s *Server) HandleUpdateAccount(w http.ResponseWriter, r *http.Request) err
 func (s *Server) HandleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
 	uuid := mux.Vars(r)["uuid"]
 
-	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+	if err := util.CheckPermission(r, "ADMIN", util.ScopeAccountsWrite); err != nil {
 		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
 	}
 
@@ -174,10 +196,17 @@ func (s *Server) HandleDeleteAccount(w http.ResponseWriter, r *http.Request) err
 		return err
 	}
 
+	err = s.d.RevokeAccountTokens(uuid)
+	if err != nil {
+		return err
+	}
+
 	return WriteJSON(w, http.StatusOK, map[string]string{"deleted": uuid})
 }
 
-// HandleLogin handles POST login requests
+// HandleLogin handles POST login requests. Accounts with a second factor, or
+// whose user type requires one, get an MFA token to complete the login with
+// at /login/mfa or with a security key instead of tokens.
 func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) error {
 	req := &data.LoginRequest{}
 
@@ -203,27 +232,54 @@ func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	token, refreshToken, _ := util.GenerateAllToken(
-		foundAccount.FirstName,
-		foundAccount.LastName,
-		foundAccount.Email,
-		foundAccount.UserType,
-		foundAccount.Uuid)
+	factors, err := s.mfaStatus(foundAccount)
+	if err != nil {
+		return err
+	}
+	if factors.required {
+		return s.startMFAChallenge(w, foundAccount, req.DeviceName, "pwd", factors)
+	}
+
+	return s.loginAccount(w, r, foundAccount, req.DeviceName, "pwd")
+}
 
-	err = s.d.UpdateAllTokens(token, refreshToken, foundAccount.ID)
+// loginAccount starts a new session of acc on the device deviceName and
+// responds with its token pair. amr are the methods the account authenticated
+// with.
+func (s *Server) loginAccount(w http.ResponseWriter, r *http.Request, acc *data.Account, deviceName string, amr ...string) error {
+	sessionID := newSessionID()
+
+	token, refreshToken, err := util.GenerateAllToken(accessClaims(acc, sessionID, amr...))
+	if err != nil {
+		return err
+	}
+
+	err = s.d.UpdateAllTokens(token, refreshToken, acc.ID)
+	if err != nil {
+		return err
+	}
+
+	err = s.startSession(r, sessionID, acc.Uuid, deviceName)
+	if err != nil {
+		return err
+	}
+
+	err = s.issueRefreshToken(refreshToken, sessionID, acc.Uuid, util.RefreshTokenLifetime)
 	if err != nil {
 		return err
 	}
 
 	res := data.NewAccountResponse(
-		foundAccount.FirstName,
-		foundAccount.LastName,
-		foundAccount.Email,
-		foundAccount.UserType,
-		foundAccount.Avatar,
-		foundAccount.Uuid,
-		token)
+		acc.FirstName,
+		acc.LastName,
+		acc.Email,
+		acc.UserType,
+		acc.Avatar,
+		acc.Uuid,
+		token,
+		refreshToken)
 
+	setAuthCookie(w, token)
 	return WriteJSON(w, http.StatusOK, &res)
 }
 
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/federation"
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// jwtBearerGrant trades a JWT a trusted partner issued for an account for an
+// access token of that account, as defined by RFC 7523. Assertions with a jti
+// are only accepted once. Like with client credentials there is no refresh
+// token, the partner issues a new assertion instead.
+func (s *Server) jwtBearerGrant(w http.ResponseWriter, r *http.Request, req *data.TokenRequest, client *data.Client) error {
+	if client.Public() {
+		return writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "public clients can not use assertions")
+	}
+	if req.Assertion == "" {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_request", "assertion is required")
+	}
+
+	iss, err := federation.AssertionIssuer(req.Assertion)
+	if err != nil {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "malformed assertion")
+	}
+	issuer, err := federation.LookupIssuer(iss)
+	if err != nil {
+		return err
+	}
+	if issuer == nil {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "issuer is not trusted")
+	}
+
+	assertion, err := issuer.Verify(r.Context(), req.Assertion)
+	if errors.Is(err, federation.ErrAssertionRejected) {
+		s.l.Printf("[ERROR] assertion of %s: %s\n", issuer.Name, err)
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid assertion")
+	}
+	if err != nil {
+		return err
+	}
+
+	if assertion.ID != "" {
+		used, err := s.d.UseAssertion(assertion.Issuer, assertion.ID, assertion.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		if used {
+			return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "assertion was already used")
+		}
+	}
+
+	acc, err := s.d.GetAccountByField(issuer.AccountField, assertion.Account)
+	if err == data.ErrAccountNotFound {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "no account matches the assertion")
+	}
+	if err != nil {
+		return err
+	}
+
+	scope, ok := util.GrantScope(req.Scope, client.Scope)
+	if !ok {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "")
+	}
+
+	claims := accountClaims(acc).
+		WithScope(scope).
+		WithClient(client.ClientID).
+		WithAuthentication(time.Now().Unix(), "fed").
+		Claims()
+	lifetime, _ := client.TokenLifetimes(util.AccessTokenLifetime, util.RefreshTokenLifetime)
+	token, err := util.GenerateAccessToken(claims, lifetime)
+	if err != nil {
+		return err
+	}
+
+	s.l.Printf("client %s exchanged an assertion of %s for a token of %s\n", client.ClientID, issuer.Name, acc.Uuid)
+	return writeTokenResponse(w, data.NewOAuthTokenResponse(token, "", scope, lifetime))
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/federation"
+	"github.com/blazingly-fast/auth-assistant/federation/federationtest"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+// assertionStore keeps the JWT assertions that were used
+type assertionStore struct {
+	// assertions holds the issuer and id of every assertion used
+	assertions map[string]bool
+}
+
+func (st *assertionStore) UseAssertion(issuer, jti string, expiresAt time.Time) (bool, error) {
+	used := st.assertions[issuer+" "+jti]
+	st.assertions[issuer+" "+jti] = true
+	return used, nil
+}
+
+func TestJWTBearerGrant(t *testing.T) {
+	store := newOAuthStore(t)
+	store.clients["partner"] = &data.Client{
+		ClientID:                "partner",
+		SecretHash:              util.HashToken("secret"),
+		GrantTypes:              []string{data.GrantJWTBearer},
+		Scope:                   "openid profile",
+		TokenEndpointAuthMethod: data.AuthMethodClientSecretPost,
+	}
+	s := newTestServer(t, store)
+
+	idp := federationtest.NewIdP("client", "secret")
+	defer idp.Close()
+	partner := federation.NewTrustedIssuer("partner", idp.URL, federation.NewRemoteKeySet(idp.JWKSURL(), idp.Client()))
+	federation.SetTrustedIssuers(partner)
+	defer federation.SetTrustedIssuers()
+
+	grant := func(assertion string) url.Values {
+		return url.Values{
+			"grant_type":    {data.GrantJWTBearer},
+			"client_id":     {"partner"},
+			"client_secret": {"secret"},
+			"assertion":     {assertion},
+			"scope":         {"profile"},
+		}
+	}
+
+	assertion := idp.Assertion(partner.Audience, nil)
+	rec := postForm(s, s.HandleToken, grant(assertion))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	res := &data.OAuthTokenResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	require.Empty(t, res.RefreshToken)
+	require.Equal(t, "profile", res.Scope)
+	claims, err := util.ValidateToken(res.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, "uuid", claims.Subject)
+	require.Equal(t, "partner", claims.ClientID)
+
+	// assertions are only exchanged once
+	rec = postForm(s, s.HandleToken, grant(assertion))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "invalid_grant")
+
+	invalid := map[string]string{
+		"unknown account": idp.Assertion(partner.Audience, jwt.MapClaims{"email": "jane@mail.com"}),
+		"other audience":  idp.Assertion("https://other.example.com/token", nil),
+		"untrusted":       idp.Assertion(partner.Audience, jwt.MapClaims{"iss": "https://other.example.com"}),
+		"malformed":       "assertion",
+	}
+	for name, assertion := range invalid {
+		rec = postForm(s, s.HandleToken, grant(assertion))
+		require.Equal(t, http.StatusBadRequest, rec.Code, name)
+		require.Contains(t, rec.Body.String(), "invalid_grant", name)
+	}
+
+	form := grant(idp.Assertion(partner.Audience, nil))
+	form.Set("scope", "email")
+	rec = postForm(s, s.HandleToken, form)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "invalid_scope")
+}
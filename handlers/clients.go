@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// HandleCreateClient handles POST requests of admins registering an OAuth client
+func (s *Server) HandleCreateClient(w http.ResponseWriter, r *http.Request) error {
+	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	req := &data.ClientRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+	if _, msg := checkClientRequest(req); msg != "" {
+		return WriteJSON(w, http.StatusUnprocessableEntity, &GenericError{Message: msg})
+	}
+
+	res, err := s.createClient(req)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusCreated, res)
+}
+
+// HandleGetClients handles GET requests of admins for all OAuth clients
+func (s *Server) HandleGetClients(w http.ResponseWriter, r *http.Request) error {
+	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	clients, err := s.d.GetClients()
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, clients)
+}
+
+// HandleGetClient handles GET requests of admins for a single OAuth client
+func (s *Server) HandleGetClient(w http.ResponseWriter, r *http.Request) error {
+	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	client, err := s.d.GetClient(mux.Vars(r)["client_id"])
+	if err == data.ErrClientNotFound {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, client)
+}
+
+// HandleUpdateClient handles PUT requests of admins replacing the metadata of
+// an OAuth client
+func (s *Server) HandleUpdateClient(w http.ResponseWriter, r *http.Request) error {
+	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	req := &data.ClientRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+	if _, msg := checkClientRequest(req); msg != "" {
+		return WriteJSON(w, http.StatusUnprocessableEntity, &GenericError{Message: msg})
+	}
+
+	clientID := mux.Vars(r)["client_id"]
+	found, err := s.d.GetClient(clientID)
+	if err == data.ErrClientNotFound {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	if req.TokenEndpointAuthMethod == "" {
+		req.TokenEndpointAuthMethod = found.TokenEndpointAuthMethod
+	}
+	// a public client has no secret to keep using when it turns confidential
+	if found.Public() != (req.TokenEndpointAuthMethod == data.AuthMethodNone) {
+		return WriteJSON(w, http.StatusUnprocessableEntity, &GenericError{Message: "token_endpoint_auth_method can not switch between public and confidential"})
+	}
+
+	client := data.NewClient(clientID, found.SecretHash, req)
+	err = s.d.UpdateClient(client)
+	if err == data.ErrClientNotFound {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	client.CreatedOn = found.CreatedOn
+	return WriteJSON(w, http.StatusOK, client)
+}
+
+// HandleResetClientSecret handles POST requests of admins replacing the secret
+// of a confidential OAuth client
+func (s *Server) HandleResetClientSecret(w http.ResponseWriter, r *http.Request) error {
+	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	client, err := s.d.GetClient(mux.Vars(r)["client_id"])
+	if err == data.ErrClientNotFound {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+	if client.Public() {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "public clients have no secret"})
+	}
+
+	secret, err := util.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	err = s.d.UpdateClientSecret(client.ClientID, util.HashToken(secret))
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, data.NewClientResponse(client, secret))
+}
+
+// HandleDeleteClient handles DELETE requests of admins removing an OAuth client
+func (s *Server) HandleDeleteClient(w http.ResponseWriter, r *http.Request) error {
+	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	clientID := mux.Vars(r)["client_id"]
+	err := s.d.DeleteClient(clientID)
+	if err == data.ErrClientNotFound {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]string{"deleted": clientID})
+}
+
+// HandleRegisterClient handles POST requests of apps registering themselves as
+// OAuth clients, as defined by RFC 7591. Requests have to carry the initial
+// access token REGISTRATION_ACCESS_TOKEN, without it registration is disabled.
+func (s *Server) HandleRegisterClient(w http.ResponseWriter, r *http.Request) error {
+	initial := os.Getenv("REGISTRATION_ACCESS_TOKEN")
+	if initial == "" {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: "client registration is disabled"})
+	}
+
+	token := ""
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		token = strings.TrimSpace(auth[7:])
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(initial)) != 1 {
+		return writeUnauthorized(w, "invalid_token", "a valid initial access token is required")
+	}
+
+	req := &data.ClientRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", "malformed request")
+	}
+
+	// registered apps only get the scopes of first party logins and the
+	// default token lifetimes, admins can grant more. They always ask users
+	// for consent.
+	req.AccessTokenLifetime, req.RefreshTokenLifetime = 0, 0
+	req.FirstParty = false
+	scope, ok := util.GrantScope(req.Scope, util.DefaultScope())
+	if !ok {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", "scope is not allowed")
+	}
+	req.Scope = scope
+	if len(req.GrantTypes) == 0 {
+		req.GrantTypes = []string{data.GrantAuthorizationCode}
+	}
+	for _, g := range req.GrantTypes {
+		if !registrableGrant(g) {
+			return writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", "grant type "+g+" can only be given by an admin")
+		}
+	}
+
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", strings.Join(errs.Errors(), "; "))
+	}
+	if code, msg := checkClientRequest(req); msg != "" {
+		return writeOAuthError(w, http.StatusBadRequest, code, msg)
+	}
+
+	res, err := s.createClient(req)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusCreated, res)
+}
+
+// createClient stores a new client and returns it with its secret, which is
+// never shown again
+func (s *Server) createClient(req *data.ClientRequest) (*data.ClientResponse, error) {
+	if req.TokenEndpointAuthMethod == "" {
+		req.TokenEndpointAuthMethod = data.AuthMethodClientSecretBasic
+	}
+
+	secret := ""
+	if req.TokenEndpointAuthMethod != data.AuthMethodNone {
+		var err error
+		secret, err = util.NewOpaqueToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client := data.NewClient(uuid.New().String(), util.HashToken(secret), req)
+	if err := s.d.CreateClient(client); err != nil {
+		return nil, err
+	}
+
+	return data.NewClientResponse(client, secret), nil
+}
+
+// checkClientRequest checks what the validation tags of the request can not
+// and returns the RFC 7591 error code and message of what is wrong with it
+func checkClientRequest(req *data.ClientRequest) (string, string) {
+	for _, g := range req.GrantTypes {
+		if g == data.GrantAuthorizationCode && len(req.RedirectURIs) == 0 {
+			return "invalid_redirect_uri", "redirect_uris are required for the authorization_code grant"
+		}
+		if machineGrant(g) && req.TokenEndpointAuthMethod == data.AuthMethodNone {
+			return "invalid_client_metadata", "public clients can not use the " + g + " grant"
+		}
+	}
+
+	for _, uri := range req.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme == "" || u.Fragment != "" {
+			return "invalid_redirect_uri", "redirect_uris must be absolute and without a fragment"
+		}
+		if u.Scheme == "http" && u.Hostname() != "localhost" && u.Hostname() != "127.0.0.1" {
+			return "invalid_redirect_uri", "redirect_uris must use https, except for localhost"
+		}
+	}
+
+	return "", ""
+}
+
+// registrableGrant reports whether apps can register themselves for grant,
+// the grants that act on behalf of users they signed in
+func registrableGrant(grant string) bool {
+	switch grant {
+	case data.GrantAuthorizationCode, data.GrantRefreshToken, data.GrantDeviceCode:
+		return true
+	}
+	return false
+}
+
+// machineGrant reports whether grant issues tokens without the user taking
+// part, which only confidential clients registered by an admin can use
+func machineGrant(grant string) bool {
+	switch grant {
+	case data.GrantClientCredentials, data.GrantTokenExchange, data.GrantJWTBearer:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/stretchr/testify/require"
+)
+
+func register(s *Server, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/oauth/register", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleRegisterClient)(rec, r)
+	return rec
+}
+
+func TestRegisterClient(t *testing.T) {
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+
+	body := `{"client_name":"Worker","redirect_uris":["https://worker.example.com/callback"],"grant_types":["authorization_code"],"scope":"openid"}`
+
+	rec := register(s, "initial", body)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	os.Setenv("REGISTRATION_ACCESS_TOKEN", "initial")
+	defer os.Unsetenv("REGISTRATION_ACCESS_TOKEN")
+
+	rec = register(s, "wrong", body)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = register(s, "initial", `{"client_name":"Worker","redirect_uris":["http://worker.example.com/callback"]}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "invalid_redirect_uri")
+
+	rec = register(s, "initial", `{"client_name":"Worker","redirect_uris":["https://worker.example.com/callback"],"scope":"admin"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// grants that do without a user are only given by admins
+	for _, grant := range []string{data.GrantClientCredentials, data.GrantTokenExchange, data.GrantJWTBearer} {
+		rec = register(s, "initial", `{"client_name":"Worker","grant_types":["`+grant+`"]}`)
+		require.Equal(t, http.StatusBadRequest, rec.Code, grant)
+		require.Contains(t, rec.Body.String(), "invalid_client_metadata")
+	}
+
+	rec = register(s, "initial", body)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	res := &data.ClientResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	require.NotEmpty(t, res.ClientID)
+	require.NotEmpty(t, res.ClientSecret)
+	require.Equal(t, data.AuthMethodClientSecretBasic, res.TokenEndpointAuthMethod)
+
+	stored := store.clients[res.ClientID]
+	require.NotEqual(t, res.ClientSecret, stored.SecretHash)
+
+	// confidential clients have to authenticate at the token endpoint
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {"unknown"}}
+	r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(res.ClientID, "wrong")
+	rec = httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleToken)(rec, r)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "invalid_client")
+
+	r = httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(res.ClientID, res.ClientSecret)
+	rec = httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleToken)(rec, r)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "invalid_grant")
+}
+
+func TestCheckClientRequest(t *testing.T) {
+	// admins can not give public clients the grants that do without a user
+	for _, grant := range []string{data.GrantClientCredentials, data.GrantTokenExchange, data.GrantJWTBearer} {
+		code, _ := checkClientRequest(&data.ClientRequest{GrantTypes: []string{grant}, TokenEndpointAuthMethod: data.AuthMethodNone})
+		require.Equal(t, "invalid_client_metadata", code, grant)
+
+		code, _ = checkClientRequest(&data.ClientRequest{GrantTypes: []string{grant}, TokenEndpointAuthMethod: data.AuthMethodClientSecretPost})
+		require.Empty(t, code, grant)
+	}
+}
@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+var deviceTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Connect a device</title></head>
+<body>
+<h1>Connect a device</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+{{if .Done}}<p>{{.Done}}</p>{{else}}
+{{if .ClientID}}<p>{{.ClientID}} is asking for access to your account{{if .Scope}} with the scope {{.Scope}}{{end}}.</p>{{end}}
+<form method="post" action="/device">
+<label>Code <input type="text" name="user_code" value="{{.UserCode}}" autocomplete="off" required></label>
+{{if not .SignedIn}}
+<label>Email <input type="email" name="email" required></label>
+<label>Password <input type="password" name="password" required></label>
+<label>Authentication or recovery code, if two-factor authentication is on <input type="text" name="otp" autocomplete="one-time-code"></label>
+{{end}}
+<button type="submit" name="action" value="approve">Allow</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// devicePage defines what the verification page shows
+type devicePage struct {
+	UserCode string
+	ClientID string
+	Scope    string
+	SignedIn bool
+	Error    string
+	Done     string
+}
+
+// HandleDeviceAuthorization handles POST requests of clients starting the
+// device authorization flow of RFC 8628, for devices that can not show a
+// browser. The user approves the returned user code on another device while
+// the client polls the token endpoint with the device code.
+func (s *Server) HandleDeviceAuthorization(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+	}
+
+	client, err := s.authenticateClient(r)
+	if err == errInvalidClient {
+		return writeInvalidClient(w, r)
+	}
+	if err != nil {
+		return err
+	}
+	if !client.AllowsGrant(data.GrantDeviceCode) {
+		return writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "grant type not allowed for the client")
+	}
+
+	scope, ok := util.GrantScope(r.PostForm.Get("scope"), client.Scope)
+	if !ok {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "")
+	}
+
+	deviceCode, err := util.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+	userCode, err := util.NewUserCode()
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().UTC().Add(util.DeviceCodeLifetime)
+	err = s.d.CreateDeviceCode(data.NewDeviceCode(deviceCode, userCode, client.ClientID, scope, util.DeviceCodeInterval, expiresAt))
+	if err != nil {
+		return err
+	}
+
+	verificationURI := util.Issuer() + "/device"
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusOK, &data.DeviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?" + url.Values{"user_code": {userCode}}.Encode(),
+		ExpiresIn:               int(util.DeviceCodeLifetime.Seconds()),
+		Interval:                int(util.DeviceCodeInterval.Seconds()),
+	})
+}
+
+// HandleDevice handles GET requests for the verification page, where the user
+// enters the user code shown on the device. Accounts that are not signed in
+// are asked for their password as well.
+func (s *Server) HandleDevice(w http.ResponseWriter, r *http.Request) error {
+	claims, err := s.signedIn(r)
+	if err != nil {
+		return err
+	}
+
+	page := &devicePage{SignedIn: claims != nil}
+	if userCode := r.URL.Query().Get("user_code"); userCode != "" {
+		page.UserCode = util.NormalizeUserCode(userCode)
+		code, err := s.d.GetPendingDeviceCode(page.UserCode)
+		if err == data.ErrDeviceCodeNotFound {
+			return renderDevice(w, http.StatusNotFound, &devicePage{SignedIn: page.SignedIn, Error: "Invalid or expired code"})
+		}
+		if err != nil {
+			return err
+		}
+		page.ClientID, page.Scope = code.ClientID, code.Scope
+	}
+
+	return renderDevice(w, http.StatusOK, page)
+}
+
+// HandleDeviceApproval handles POST requests of the verification page,
+// approving or denying the request of a user code for the signed in account
+func (s *Server) HandleDeviceApproval(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "malformed form"})
+	}
+
+	claims, err := s.signedIn(r)
+	if err != nil {
+		return err
+	}
+	page := &devicePage{UserCode: util.NormalizeUserCode(r.PostForm.Get("user_code")), SignedIn: claims != nil}
+
+	code, err := s.d.GetPendingDeviceCode(page.UserCode)
+	if err == data.ErrDeviceCodeNotFound {
+		page.Error = "Invalid or expired code"
+		return renderDevice(w, http.StatusNotFound, page)
+	}
+	if err != nil {
+		return err
+	}
+	page.ClientID, page.Scope = code.ClientID, code.Scope
+
+	if claims == nil {
+		acc, err := s.d.GetAccountByField("email", r.PostForm.Get("email"))
+		if err == data.ErrAccountNotFound {
+			page.Error = "Invalid email or password"
+			return renderDevice(w, http.StatusUnauthorized, page)
+		}
+		if err != nil {
+			return err
+		}
+		if err := util.VerifyPassword(acc.Password, r.PostForm.Get("password")); err != nil {
+			page.Error = "Invalid email or password"
+			return renderDevice(w, http.StatusUnauthorized, page)
+		}
+		amr, message, err := s.formSecondFactor(acc, r.PostForm.Get("otp"))
+		if err != nil {
+			return err
+		}
+		if message != "" {
+			page.Error = message
+			return renderDevice(w, http.StatusUnauthorized, page)
+		}
+		code.AccountUuid, code.AuthTime, code.AMR = acc.Uuid, time.Now().Unix(), amr
+	} else {
+		code.AccountUuid = claims.Subject
+		code.AuthTime, code.AMR = claims.Authenticated()
+	}
+
+	code.Status = data.DeviceCodeApproved
+	page.Done = "The device is connected, you can close this page."
+	if r.PostForm.Get("action") == "deny" {
+		code.Status = data.DeviceCodeDenied
+		page.Done = "The device was denied access, you can close this page."
+	}
+
+	err = s.d.UpdateDeviceCode(code)
+	if err == data.ErrDeviceCodeNotFound {
+		page.Error = "Invalid or expired code"
+		return renderDevice(w, http.StatusNotFound, page)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.l.Printf("account %s %s a device for client %s\n", code.AccountUuid, code.Status, code.ClientID)
+	return renderDevice(w, http.StatusOK, page)
+}
+
+// deviceCodeGrant answers a client polling for the tokens of a device code.
+// Until the user decides it is told to keep waiting, and to slow down when it
+// polls faster than the interval.
+func (s *Server) deviceCodeGrant(w http.ResponseWriter, r *http.Request, req *data.TokenRequest, client *data.Client) error {
+	code, err := s.d.GetDeviceCode(req.DeviceCode)
+	if err == data.ErrDeviceCodeNotFound {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid device code")
+	}
+	if err != nil {
+		return err
+	}
+	if code.ClientID != client.ClientID {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid device code")
+	}
+	if code.Expired() {
+		return writeOAuthError(w, http.StatusBadRequest, "expired_token", "")
+	}
+
+	if code.Status == data.DeviceCodePending {
+		now := time.Now().UTC()
+		errCode := "authorization_pending"
+		if code.PolledAt != nil && now.Sub(*code.PolledAt) < time.Duration(code.Interval)*time.Second {
+			// RFC 8628 has the interval grow by 5 seconds every time
+			code.Interval += int(util.DeviceCodeInterval.Seconds())
+			errCode = "slow_down"
+		}
+		code.PolledAt = &now
+		if err := s.d.UpdateDeviceCode(code); err != nil && err != data.ErrDeviceCodeNotFound {
+			return err
+		}
+		return writeOAuthError(w, http.StatusBadRequest, errCode, "")
+	}
+
+	code, err = s.d.ConsumeDeviceCode(req.DeviceCode)
+	if err == data.ErrDeviceCodeNotFound {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid device code")
+	}
+	if err != nil {
+		return err
+	}
+	if code.Status == data.DeviceCodeDenied {
+		return writeOAuthError(w, http.StatusBadRequest, "access_denied", "")
+	}
+
+	acc, err := s.d.GetAccountByField("uuid", code.AccountUuid)
+	if err == data.ErrAccountNotFound {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid device code")
+	}
+	if err != nil {
+		return err
+	}
+
+	claims, res, err := s.startClientSession(r, acc, client, code.Scope, code.AuthTime, code.AMR)
+	if err != nil {
+		return err
+	}
+	if err := attachIDToken(res, claims, ""); err != nil {
+		return err
+	}
+
+	return writeTokenResponse(w, res)
+}
+
+func renderDevice(w http.ResponseWriter, status int, page *devicePage) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	return deviceTemplate.Execute(w, page)
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/stretchr/testify/require"
+)
+
+// deviceStore keeps device codes in memory
+type deviceStore struct {
+	deviceCodes map[string]*data.DeviceCode
+}
+
+func (st *deviceStore) CreateDeviceCode(code *data.DeviceCode) error {
+	st.deviceCodes[code.DeviceCodeHash] = code
+	return nil
+}
+
+func (st *deviceStore) GetDeviceCode(deviceCode string) (*data.DeviceCode, error) {
+	found, ok := st.deviceCodes[util.HashToken(deviceCode)]
+	if !ok {
+		return nil, data.ErrDeviceCodeNotFound
+	}
+	copied := *found
+	return &copied, nil
+}
+
+func (st *deviceStore) GetPendingDeviceCode(userCode string) (*data.DeviceCode, error) {
+	for _, code := range st.deviceCodes {
+		if code.UserCode == userCode && code.Status == data.DeviceCodePending && !code.Expired() {
+			copied := *code
+			return &copied, nil
+		}
+	}
+	return nil, data.ErrDeviceCodeNotFound
+}
+
+func (st *deviceStore) UpdateDeviceCode(code *data.DeviceCode) error {
+	found, ok := st.deviceCodes[code.DeviceCodeHash]
+	if !ok || (found.Status != data.DeviceCodePending && found.Status != code.Status) {
+		return data.ErrDeviceCodeNotFound
+	}
+	copied := *code
+	st.deviceCodes[code.DeviceCodeHash] = &copied
+	return nil
+}
+
+func (st *deviceStore) ConsumeDeviceCode(deviceCode string) (*data.DeviceCode, error) {
+	found, ok := st.deviceCodes[util.HashToken(deviceCode)]
+	if !ok || found.Status == data.DeviceCodePending {
+		return nil, data.ErrDeviceCodeNotFound
+	}
+	delete(st.deviceCodes, util.HashToken(deviceCode))
+	return found, nil
+}
+
+func authorizeDevice(t *testing.T, s *Server) *data.DeviceAuthorizationResponse {
+	rec := postForm(s, s.HandleDeviceAuthorization, url.Values{"client_id": {"cli"}, "scope": {"openid"}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	res := &data.DeviceAuthorizationResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	return res
+}
+
+func TestDeviceAuthorizationFlow(t *testing.T) {
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+
+	device := authorizeDevice(t, s)
+	require.Regexp(t, `^[A-Z]{4}-[A-Z]{4}$`, device.UserCode)
+	require.Equal(t, 5, device.Interval)
+
+	poll := url.Values{"grant_type": {data.GrantDeviceCode}, "client_id": {"cli"}, "device_code": {device.DeviceCode}}
+	rec := postForm(s, s.HandleToken, poll)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "authorization_pending")
+
+	// polling faster than the interval makes it longer
+	rec = postForm(s, s.HandleToken, poll)
+	require.Contains(t, rec.Body.String(), "slow_down")
+	require.Equal(t, 10, store.deviceCodes[util.HashToken(device.DeviceCode)].Interval)
+
+	// the verification page shows who is asking
+	r := httptest.NewRequest(http.MethodGet, "/device?user_code="+url.QueryEscape(device.UserCode), nil)
+	rec = httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleDevice)(rec, r)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "cli is asking")
+	require.Contains(t, rec.Body.String(), `name="password"`)
+
+	approve := url.Values{"user_code": {device.UserCode}, "action": {"approve"}, "email": {"john@mail.com"}, "password": {"wrong"}}
+	rec = postForm(s, s.HandleDeviceApproval, approve)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// user codes are accepted however they are typed in
+	approve.Set("user_code", " "+device.UserCode[:4]+device.UserCode[5:]+" ")
+	approve.Set("password", "password1234")
+	rec = postForm(s, s.HandleDeviceApproval, approve)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Contains(t, rec.Body.String(), "The device is connected")
+
+	// once the interval passed the client gets its tokens
+	store.deviceCodes[util.HashToken(device.DeviceCode)].PolledAt = nil
+	rec = postForm(s, s.HandleToken, poll)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	res := &data.OAuthTokenResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	require.NotEmpty(t, res.RefreshToken)
+	require.NotEmpty(t, res.IDToken)
+
+	claims, err := util.ValidateToken(res.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, "uuid", claims.Subject)
+	require.Equal(t, "cli", claims.ClientID)
+	require.Equal(t, []string{"pwd"}, claims.AMR)
+
+	// a device code is only good once
+	rec = postForm(s, s.HandleToken, poll)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "invalid_grant")
+}
+
+func TestDeviceAuthorizationDenied(t *testing.T) {
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+
+	device := authorizeDevice(t, s)
+	rec := postForm(s, s.HandleDeviceApproval, url.Values{
+		"user_code": {device.UserCode},
+		"action":    {"deny"},
+		"email":     {"john@mail.com"},
+		"password":  {"password1234"},
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	poll := url.Values{"grant_type": {data.GrantDeviceCode}, "client_id": {"cli"}, "device_code": {device.DeviceCode}}
+	rec = postForm(s, s.HandleToken, poll)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "access_denied")
+
+	// expired codes are reported as such until they are deleted
+	device = authorizeDevice(t, s)
+	store.deviceCodes[util.HashToken(device.DeviceCode)].ExpiresAt = time.Now().Add(-time.Second)
+	poll.Set("device_code", device.DeviceCode)
+	rec = postForm(s, s.HandleToken, poll)
+	require.Contains(t, rec.Body.String(), "expired_token")
+
+	// only clients allowed the grant can start the flow
+	rec = postForm(s, s.HandleDeviceAuthorization, url.Values{"client_id": {"spa"}})
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "unauthorized_client")
+}
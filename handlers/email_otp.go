@@ -0,0 +1,413 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/mailer"
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// emailOTPLifetime is how long a code sent by email can be used
+const emailOTPLifetime = 10 * time.Minute
+
+// codes sent by email are rate limited over emailOTPWindow, per address and
+// per IP asking for them
+const (
+	emailOTPWindow         = time.Hour
+	maxEmailOTPsPerAddress = 5
+	maxEmailOTPsPerIP      = 20
+)
+
+// emailAMR are the authentication methods of a passwordless login with a code
+// sent by email
+var emailAMR = []string{"otp"}
+
+// HandleEmailLogin handles POST requests for a code to sign in with instead of
+// a password. The answer is the same whether the address belongs to an
+// account or not, only accounts without a second factor are sent a code.
+func (s *Server) HandleEmailLogin(w http.ResponseWriter, r *http.Request) error {
+	req := &data.EmailLoginRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	if limited, err := s.emailOTPLimited(w, r, req.Email); limited {
+		return err
+	}
+
+	token, err := util.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	acc, err := s.d.GetAccountByField("email", req.Email)
+	if err != nil && err != data.ErrAccountNotFound {
+		return err
+	}
+	if acc != nil {
+		factors, err := s.mfaStatus(acc)
+		if err != nil {
+			return err
+		}
+		if factors.required {
+			s.l.Printf("[ERROR] account %s has to sign in with a second factor, not sending a login code\n", acc.Uuid)
+		} else if err := s.sendEmailOTP(r, acc, token, data.EmailOTPLogin); err != nil {
+			return err
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusAccepted, &data.EmailOTPResponse{
+		Message:   "a code was sent if the address belongs to an account",
+		OTPToken:  token,
+		ExpiresIn: int(emailOTPLifetime.Seconds()),
+	})
+}
+
+// HandleVerifyEmailLogin handles POST requests signing in with a code sent by
+// email
+func (s *Server) HandleVerifyEmailLogin(w http.ResponseWriter, r *http.Request) error {
+	req := &data.EmailOTPRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	otp, ok, err := s.checkEmailOTP(req.OTPToken, req.Code, data.EmailOTPLogin)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return writeUnauthorized(w, "", "invalid or expired code")
+	}
+
+	acc, err := s.d.GetAccountByField("uuid", otp.AccountUuid)
+	if err == data.ErrAccountNotFound {
+		return writeUnauthorized(w, "", "invalid or expired code")
+	}
+	if err != nil {
+		return err
+	}
+
+	// a second factor set up since the code was sent takes the password
+	factors, err := s.mfaStatus(acc)
+	if err != nil {
+		return err
+	}
+	if factors.required {
+		return writeUnauthorized(w, "", "sign in with your password and second factor")
+	}
+
+	return s.loginAccount(w, r, acc, req.DeviceName, emailAMR...)
+}
+
+// HandleSendMFAEmail handles POST requests sending the code that completes a
+// login whose password was accepted. Accounts that have to sign in with a
+// second factor but never set one up can enroll email codes this way.
+func (s *Server) HandleSendMFAEmail(w http.ResponseWriter, r *http.Request) error {
+	req := &data.MFAEnrollRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	_, acc, err := s.mfaChallenge(req.MFAToken)
+	if err == data.ErrMFAChallengeNotFound {
+		return writeUnauthorized(w, "", "invalid or expired MFA token")
+	}
+	if err != nil {
+		return err
+	}
+
+	factors, err := s.mfaStatus(acc)
+	if err != nil {
+		return err
+	}
+	if !factors.email && len(factors.methods()) != 0 {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "email codes are not a second factor of this account"})
+	}
+
+	if limited, err := s.emailOTPLimited(w, r, acc.Email); limited {
+		return err
+	}
+	if err := s.sendEmailOTP(r, acc, req.MFAToken, data.EmailOTPMFA); err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusAccepted, &data.EmailOTPResponse{
+		Message:   "a code was sent to the address of the account",
+		ExpiresIn: int(emailOTPLifetime.Seconds()),
+	})
+}
+
+// HandleMFAEmailLogin handles POST requests completing a login whose password
+// was accepted with the code sent by email. A login that had to enroll a
+// second factor turns email codes on with it.
+func (s *Server) HandleMFAEmailLogin(w http.ResponseWriter, r *http.Request) error {
+	req := &data.MFALoginRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	challenge, acc, err := s.mfaChallenge(req.MFAToken)
+	if err == data.ErrMFAChallengeNotFound {
+		return writeUnauthorized(w, "", "invalid or expired MFA token")
+	}
+	if err != nil {
+		return err
+	}
+
+	if locked, err := s.mfaLockedOut(acc); err != nil {
+		return err
+	} else if locked {
+		return writeMFALockedOut(w)
+	}
+
+	otp, ok, err := s.checkEmailOTP(req.MFAToken, req.Code, data.EmailOTPMFA)
+	if err != nil {
+		return err
+	}
+	if !ok || otp.AccountUuid != acc.Uuid {
+		if err := s.failMFAChallenge(req.MFAToken, acc); err != nil {
+			return err
+		}
+		return writeUnauthorized(w, "", "invalid code")
+	}
+
+	factors, err := s.mfaStatus(acc)
+	if err != nil {
+		return err
+	}
+	if !factors.email {
+		if len(factors.methods()) != 0 {
+			return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "email codes are not a second factor of this account"})
+		}
+		if err := s.d.SetEmailMFA(acc.Uuid, true); err != nil {
+			return err
+		}
+		s.l.Printf("account %s turned email codes on\n", acc.Uuid)
+	}
+
+	if err := s.d.ClearMFAAttempts(acc.Uuid); err != nil {
+		return err
+	}
+
+	// the challenge completes a single login
+	if _, err := s.d.ConsumeMFAChallenge(req.MFAToken); err == data.ErrMFAChallengeNotFound {
+		return writeUnauthorized(w, "", "invalid or expired MFA token")
+	} else if err != nil {
+		return err
+	}
+
+	return s.loginAccount(w, r, acc, challenge.DeviceName, challengeAMR(challenge, mfaAMR)...)
+}
+
+// HandleEnrollEmailMFA handles POST requests of the current account turning
+// on email codes as its second factor. It sends a first code, which turns
+// them on at /mfa/email/confirm.
+func (s *Server) HandleEnrollEmailMFA(w http.ResponseWriter, r *http.Request) error {
+	acc, ok, err := s.currentAccount(w, r)
+	if !ok {
+		return err
+	}
+
+	factors, err := s.mfaStatus(acc)
+	if err != nil {
+		return err
+	}
+	if factors.email {
+		return WriteJSON(w, http.StatusConflict, &GenericError{Message: "email codes are already enabled"})
+	}
+
+	if limited, err := s.emailOTPLimited(w, r, acc.Email); limited {
+		return err
+	}
+	token, err := util.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+	if err := s.sendEmailOTP(r, acc, token, data.EmailOTPEnroll); err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusAccepted, &data.EmailOTPResponse{
+		Message:   "a code was sent to the address of the account",
+		OTPToken:  token,
+		ExpiresIn: int(emailOTPLifetime.Seconds()),
+	})
+}
+
+// HandleConfirmEmailMFA handles POST requests of the current account turning
+// on email codes with the first code. The first second factor of an account
+// comes with its recovery codes.
+func (s *Server) HandleConfirmEmailMFA(w http.ResponseWriter, r *http.Request) error {
+	acc, ok, err := s.currentAccount(w, r)
+	if !ok {
+		return err
+	}
+
+	req := &data.EmailOTPRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	otp, ok, err := s.checkEmailOTP(req.OTPToken, req.Code, data.EmailOTPEnroll)
+	if err != nil {
+		return err
+	}
+	if !ok || otp.AccountUuid != acc.Uuid {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "invalid or expired code"})
+	}
+
+	if err := s.d.SetEmailMFA(acc.Uuid, true); err != nil {
+		return err
+	}
+	s.l.Printf("account %s turned email codes on\n", acc.Uuid)
+
+	codes, err := s.firstRecoveryCodes(acc)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusOK, &data.RecoveryCodesResponse{
+		Message:       "email codes enabled successfully",
+		RecoveryCodes: codes,
+	})
+}
+
+// HandleDisableEmailMFA handles DELETE requests of the current account turning
+// email codes off, which takes a login with a second factor. Accounts of a
+// user type that requires MFA can not turn off their last second factor.
+func (s *Server) HandleDisableEmailMFA(w http.ResponseWriter, r *http.Request) error {
+	acc, ok, err := s.currentAccount(w, r)
+	if !ok {
+		return err
+	}
+
+	factors, err := s.mfaStatus(acc)
+	if err != nil {
+		return err
+	}
+	if !factors.email {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: "email codes are not enabled"})
+	}
+	claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+	if !claims.AuthenticatedWith("mfa") {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "sign in with a second factor to turn email codes off"})
+	}
+	if util.MFARequired(acc.UserType) && len(factors.methods()) == 1 {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "MFA is required for this account"})
+	}
+
+	if err := s.d.SetEmailMFA(acc.Uuid, false); err != nil {
+		return err
+	}
+	if err := s.dropRecoveryCodes(acc); err != nil {
+		return err
+	}
+
+	s.l.Printf("account %s turned email codes off\n", acc.Uuid)
+	return WriteJSON(w, http.StatusOK, "email codes disabled successfully")
+}
+
+// emailOTPLimited answers with 429 and reports true when email, or the IP the
+// request came from, asked for too many codes lately
+func (s *Server) emailOTPLimited(w http.ResponseWriter, r *http.Request, email string) (bool, error) {
+	ip := util.ClientIP(r)
+	byEmail, byIP, err := s.d.CountEmailOTPs(email, ip, time.Now().Add(-emailOTPWindow))
+	if err != nil {
+		return true, err
+	}
+	if byEmail < maxEmailOTPsPerAddress && byIP < maxEmailOTPsPerIP {
+		return false, nil
+	}
+
+	s.l.Printf("[ERROR] too many email codes for %s from %s\n", email, ip)
+	w.Header().Set("Retry-After", fmt.Sprint(int(emailOTPWindow.Seconds())))
+	return true, WriteJSON(w, http.StatusTooManyRequests, &GenericError{Message: "too many codes were requested, try again later"})
+}
+
+// sendEmailOTP emails acc a new code that is verified along with token
+func (s *Server) sendEmailOTP(r *http.Request, acc *data.Account, token, purpose string) error {
+	code, err := util.NewNumericCode(6)
+	if err != nil {
+		return err
+	}
+
+	otp := data.NewEmailOTP(token, code, purpose, acc.Email, acc.Uuid, util.ClientIP(r), time.Now().UTC().Add(emailOTPLifetime))
+	if err := s.d.CreateEmailOTP(otp); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(
+		"Your code is %s. It expires in %d minutes.\n\nIf you did not ask for it, you can ignore this email.\n",
+		code, int(emailOTPLifetime.Minutes()))
+	return mailer.Send(acc.Email, "Your sign in code", body)
+}
+
+// checkEmailOTP reports whether code is the code sent for token last, for
+// purpose, and returns it. Every code is used once and dropped after
+// maxMFAAttempts wrong codes.
+func (s *Server) checkEmailOTP(token, code, purpose string) (*data.EmailOTP, bool, error) {
+	otp, err := s.d.GetEmailOTP(token)
+	if err == data.ErrEmailOTPNotFound || (err == nil && otp.Purpose != purpose) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(util.HashToken(code)), []byte(otp.CodeHash)) != 1 {
+		attempts, err := s.d.FailEmailOTP(otp.ID)
+		if err != nil && err != data.ErrEmailOTPNotFound {
+			return nil, false, err
+		}
+		if attempts >= maxMFAAttempts {
+			s.l.Printf("[ERROR] too many wrong email codes for account %s, dropping the code\n", otp.AccountUuid)
+			if err := s.d.UseEmailOTP(otp.ID); err != nil && err != data.ErrEmailOTPNotFound {
+				return nil, false, err
+			}
+		}
+		return nil, false, nil
+	}
+
+	err = s.d.UseEmailOTP(otp.ID)
+	if err == data.ErrEmailOTPNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return otp, true, nil
+}
@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/mailer"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/stretchr/testify/require"
+)
+
+// emailOTPStore keeps the codes sent by email and the accounts that use them
+// as their second factor
+type emailOTPStore struct {
+	emailOTPs []*data.EmailOTP
+	emailMFA  map[string]bool
+}
+
+func (st *emailOTPStore) CreateEmailOTP(o *data.EmailOTP) error {
+	now := time.Now()
+	for _, old := range st.emailOTPs {
+		if old.TokenHash == o.TokenHash && old.UsedOn == nil {
+			old.UsedOn = &now
+		}
+	}
+	o.ID, o.CreatedOn = len(st.emailOTPs)+1, now
+	st.emailOTPs = append(st.emailOTPs, o)
+	return nil
+}
+
+func (st *emailOTPStore) GetEmailOTP(token string) (*data.EmailOTP, error) {
+	for i := len(st.emailOTPs) - 1; i >= 0; i-- {
+		o := st.emailOTPs[i]
+		if o.TokenHash == util.HashToken(token) && o.UsedOn == nil && o.ExpiresAt.After(time.Now()) {
+			return o, nil
+		}
+	}
+	return nil, data.ErrEmailOTPNotFound
+}
+
+func (st *emailOTPStore) FailEmailOTP(id int) (int, error) {
+	o := st.emailOTPs[id-1]
+	o.Attempts++
+	return o.Attempts, nil
+}
+
+func (st *emailOTPStore) UseEmailOTP(id int) error {
+	o := st.emailOTPs[id-1]
+	if o.UsedOn != nil {
+		return data.ErrEmailOTPNotFound
+	}
+	now := time.Now()
+	o.UsedOn = &now
+	return nil
+}
+
+func (st *emailOTPStore) CountEmailOTPs(email, ip string, since time.Time) (int, int, error) {
+	byEmail, byIP := 0, 0
+	for _, o := range st.emailOTPs {
+		if o.CreatedOn.After(since) && o.Email == email {
+			byEmail++
+		}
+		if o.CreatedOn.After(since) && o.IP == ip {
+			byIP++
+		}
+	}
+	return byEmail, byIP, nil
+}
+
+func (st *emailOTPStore) SetEmailMFA(accountUuid string, enabled bool) error {
+	st.emailMFA[accountUuid] = enabled
+	return nil
+}
+
+func (st *emailOTPStore) GetEmailMFA(accountUuid string) (bool, error) {
+	return st.emailMFA[accountUuid], nil
+}
+
+// mailbox keeps the emails sent instead of sending them
+type mailbox struct {
+	mu    sync.Mutex
+	mails []string
+}
+
+func newMailbox(t *testing.T) *mailbox {
+	m := &mailbox{}
+	mailer.Set(m)
+	t.Cleanup(func() { mailer.Set(nil) })
+	return m
+}
+
+func (m *mailbox) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mails = append(m.mails, to+"\n"+body)
+	return nil
+}
+
+var mailedCode = regexp.MustCompile(`[0-9]{6}`)
+
+// code returns the code of the last email sent
+func (m *mailbox) code(t *testing.T) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	require.NotEmpty(t, m.mails)
+	return mailedCode.FindString(m.mails[len(m.mails)-1])
+}
+
+// emailOTP asks for a code for email and returns the OTP token it is sent
+// back with
+func emailOTP(t *testing.T, s *Server, email string) string {
+	rec := postJSON(s, s.HandleEmailLogin, `{"email": "`+email+`"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	res := &data.EmailOTPResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	require.NotEmpty(t, res.OTPToken)
+	return res.OTPToken
+}
+
+func TestEmailLogin(t *testing.T) {
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+	box := newMailbox(t)
+
+	verify := func(token, code string) *httptest.ResponseRecorder {
+		return postJSON(s, s.HandleVerifyEmailLogin, `{"otp_token": "`+token+`", "code": "`+code+`"}`)
+	}
+
+	token := emailOTP(t, s, "john@mail.com")
+	require.Len(t, box.mails, 1)
+	require.True(t, strings.HasPrefix(box.mails[0], "john@mail.com\n"))
+	code := box.code(t)
+	// only the hash of the code is stored
+	require.NotEqual(t, code, store.emailOTPs[0].CodeHash)
+
+	rec := verify(token, code)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	res := &data.AccountResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	claims, err := util.ValidateToken(res.Token)
+	require.NoError(t, err)
+	_, amr := claims.Authenticated()
+	require.Equal(t, []string{"otp"}, amr)
+	// codes are single use
+	require.Equal(t, http.StatusUnauthorized, verify(token, code).Code)
+
+	// unknown addresses get the same answer but no email
+	emailOTP(t, s, "jane@mail.com")
+	require.Len(t, box.mails, 1)
+
+	// too many wrong codes drop the code
+	token = emailOTP(t, s, "john@mail.com")
+	code = box.code(t)
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	for i := 0; i < maxMFAAttempts; i++ {
+		require.Equal(t, http.StatusUnauthorized, verify(token, wrong).Code)
+	}
+	require.Equal(t, http.StatusUnauthorized, verify(token, code).Code)
+
+	// an address gets a few codes an hour
+	for i := 2; i < maxEmailOTPsPerAddress; i++ {
+		emailOTP(t, s, "john@mail.com")
+	}
+	rec = postJSON(s, s.HandleEmailLogin, `{"email": "john@mail.com"}`)
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+	// and so does an IP, whatever address it asks for
+	store.emailOTPs = nil
+	for i := 0; i < maxEmailOTPsPerIP; i++ {
+		store.emailOTPs = append(store.emailOTPs, &data.EmailOTP{Email: "other@mail.com", IP: "192.0.2.1", CreatedOn: time.Now()})
+	}
+	rec = postJSON(s, s.HandleEmailLogin, `{"email": "john@mail.com"}`)
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+}
+
+func TestEmailMFA(t *testing.T) {
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+	box := newMailbox(t)
+
+	rec := passwordLogin(s)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	res := &data.AccountResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	passwordToken := res.Token
+
+	withToken := func(method string, f apiFunc, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+res.Token)
+		rec := httptest.NewRecorder()
+		s.Authenticate(s.MakeHTTPHandleFunc(f)).ServeHTTP(rec, r)
+		return rec
+	}
+
+	// a first code sent to the account turns email codes on
+	rec = withToken(http.MethodPost, s.HandleEnrollEmailMFA, "")
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	otp := &data.EmailOTPResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(otp))
+	rec = withToken(http.MethodPost, s.HandleConfirmEmailMFA, `{"otp_token": "`+otp.OTPToken+`", "code": "`+box.code(t)+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	recovery := &data.RecoveryCodesResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(recovery))
+	require.Len(t, recovery.RecoveryCodes, recoveryCodeCount)
+	require.True(t, store.emailMFA["uuid"])
+
+	rec = passwordLogin(s)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	challenge := &data.MFAChallengeResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(challenge))
+	require.Equal(t, []string{"email", "recovery_code"}, challenge.Methods)
+
+	rec = postJSON(s, s.HandleSendMFAEmail, `{"mfa_token": "`+challenge.MFAToken+`"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	rec = postJSON(s, s.HandleMFAEmailLogin, `{"mfa_token": "`+challenge.MFAToken+`", "code": "`+box.code(t)+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	claims, err := util.ValidateToken(res.Token)
+	require.NoError(t, err)
+	_, amr := claims.Authenticated()
+	require.Equal(t, []string{"pwd", "otp", "mfa"}, amr)
+
+	// the code that completes a login does not sign in without the password
+	mails := len(box.mails)
+	emailOTP(t, s, "john@mail.com")
+	require.Len(t, box.mails, mails)
+
+	// turning them off takes a login with a second factor
+	mfaToken := res.Token
+	res.Token = passwordToken
+	rec = withToken(http.MethodDelete, s.HandleDisableEmailMFA, "")
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.True(t, store.emailMFA["uuid"])
+
+	res.Token = mfaToken
+	rec = withToken(http.MethodDelete, s.HandleDisableEmailMFA, "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.False(t, store.emailMFA["uuid"])
+	require.Empty(t, store.recoveryCodes)
+}
+
+func TestEmailMFAEnrollment(t *testing.T) {
+	t.Setenv("MFA_REQUIRED_USER_TYPES", "ADMIN")
+	store := newOAuthStore(t)
+	store.account.UserType = "ADMIN"
+	s := newTestServer(t, store)
+	box := newMailbox(t)
+
+	// accounts that have to sign in with a second factor can pick email codes
+	rec := passwordLogin(s)
+	challenge := &data.MFAChallengeResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(challenge))
+	require.True(t, challenge.EnrollmentRequired)
+
+	rec = postJSON(s, s.HandleSendMFAEmail, `{"mfa_token": "`+challenge.MFAToken+`"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	rec = postJSON(s, s.HandleMFAEmailLogin, `{"mfa_token": "`+challenge.MFAToken+`", "code": "`+box.code(t)+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.True(t, store.emailMFA["uuid"])
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/federation"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/gorilla/mux"
+)
+
+// federationCookie holds the state of a login at an upstream provider between
+// the redirect and the callback
+const federationCookie = "federation_state"
+
+// federationStateLifetime is how long the user has to sign in at the provider
+const federationStateLifetime = 10 * time.Minute
+
+// federationState defines what the callback checks the provider's answer
+// against, for SAML State is the ID of the AuthnRequest. It is sealed with
+// util.Encrypt so the browser can neither read nor change it.
+type federationState struct {
+	Provider    string    `json:"provider"`
+	State       string    `json:"state"`
+	Nonce       string    `json:"nonce"`
+	Verifier    string    `json:"verifier"`
+	LinkAccount string    `json:"link_account,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// HandleFederatedLogin handles GET requests starting a login at an upstream
+// OpenID Connect provider, the user is sent there and comes back to the
+// callback
+func (s *Server) HandleFederatedLogin(w http.ResponseWriter, r *http.Request) error {
+	return s.startFederation(w, r, "")
+}
+
+// HandleFederatedLink handles GET requests of a signed in account linking an
+// identity at an upstream provider, so it can sign in with it later on
+func (s *Server) HandleFederatedLink(w http.ResponseWriter, r *http.Request) error {
+	claims, err := s.signedIn(r)
+	if err != nil {
+		return err
+	}
+	if claims == nil {
+		return writeUnauthorized(w, "", "sign in to link an identity")
+	}
+
+	return s.startFederation(w, r, claims.Subject)
+}
+
+func (s *Server) startFederation(w http.ResponseWriter, r *http.Request, linkAccount string) error {
+	provider, ok := federation.Lookup(mux.Vars(r)["provider"])
+	if !ok {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: "unknown identity provider"})
+	}
+
+	st := &federationState{Provider: provider.Name, LinkAccount: linkAccount}
+	for _, v := range []*string{&st.State, &st.Nonce, &st.Verifier} {
+		token, err := util.NewOpaqueToken()
+		if err != nil {
+			return err
+		}
+		*v = token
+	}
+	st.ExpiresAt = time.Now().UTC().Add(federationStateLifetime)
+
+	redirect, err := provider.AuthCodeURL(r.Context(), st.State, st.Nonce, st.Verifier)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := sealState(st)
+	if err != nil {
+		return err
+	}
+
+	setStateCookie(w, federationCookie, "/federation/", sealed, int(federationStateLifetime.Seconds()), http.SameSiteLaxMode)
+	http.Redirect(w, r, redirect, http.StatusFound)
+	return nil
+}
+
+// HandleFederationCallback handles GET requests of users the provider sent
+// back. Identities are found through their link, or else through an account
+// with the same email when the provider verified it, which links them. Logins
+// end like password logins do, with a new session.
+func (s *Server) HandleFederationCallback(w http.ResponseWriter, r *http.Request) error {
+	name := mux.Vars(r)["provider"]
+	st, ok := readStateCookie(r, federationCookie)
+	setStateCookie(w, federationCookie, "/federation/", "", -1, http.SameSiteLaxMode)
+
+	q := r.URL.Query()
+	if !ok || st.Provider != name || time.Now().After(st.ExpiresAt) ||
+		subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(st.State)) != 1 {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "invalid or expired login state"})
+	}
+	if q.Get("error") != "" {
+		return WriteJSON(w, http.StatusUnauthorized, &GenericError{Message: "external login failed"})
+	}
+
+	provider, ok := federation.Lookup(name)
+	if !ok {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: "unknown identity provider"})
+	}
+
+	identity, err := provider.Exchange(r.Context(), q.Get("code"), st.Verifier, st.Nonce)
+	if errors.Is(err, federation.ErrLoginRejected) {
+		s.l.Printf("[ERROR] login at %s: %s\n", name, err)
+		return WriteJSON(w, http.StatusUnauthorized, &GenericError{Message: "external login failed"})
+	}
+	if err != nil {
+		return err
+	}
+
+	if st.LinkAccount != "" {
+		return s.linkIdentity(w, identity, st.LinkAccount)
+	}
+
+	link, err := s.d.GetIdentityLink(identity.Provider, identity.Subject)
+	if err != nil && err != data.ErrIdentityLinkNotFound {
+		return err
+	}
+
+	var acc *data.Account
+	if link != nil {
+		acc, err = s.d.GetAccountByField("uuid", link.AccountUuid)
+	} else {
+		if !identity.EmailVerified || identity.Email == "" {
+			return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "no account is linked to this identity"})
+		}
+		acc, err = s.d.GetAccountByField("email", identity.Email)
+		if err == nil {
+			err = s.d.CreateIdentityLink(data.NewIdentityLink(identity.Provider, identity.Subject, acc.Uuid, identity.Email))
+			if err == nil {
+				s.l.Printf("linked %s identity %s to account %s by its email\n", identity.Provider, identity.Subject, acc.Uuid)
+			}
+		}
+	}
+	if err == data.ErrAccountNotFound {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "no account is linked to this identity"})
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.federatedLogin(w, r, acc, provider.Name)
+}
+
+// federatedLogin signs acc in after a login at an external identity provider,
+// or asks for the second factor of an account that has to give one. The
+// provider vouches for the first factor only.
+func (s *Server) federatedLogin(w http.ResponseWriter, r *http.Request, acc *data.Account, deviceName string) error {
+	factors, err := s.mfaStatus(acc)
+	if err != nil {
+		return err
+	}
+	if factors.required {
+		return s.startMFAChallenge(w, acc, deviceName, "fed", factors)
+	}
+
+	return s.loginAccount(w, r, acc, deviceName, "fed")
+}
+
+// linkIdentity links identity to the account accountUuid, unless another
+// account linked it already
+func (s *Server) linkIdentity(w http.ResponseWriter, identity *federation.Identity, accountUuid string) error {
+	link, err := s.d.GetIdentityLink(identity.Provider, identity.Subject)
+	if err == nil {
+		if link.AccountUuid != accountUuid {
+			return WriteJSON(w, http.StatusConflict, &GenericError{Message: "identity is linked to another account"})
+		}
+		return WriteJSON(w, http.StatusOK, link)
+	}
+	if err != data.ErrIdentityLinkNotFound {
+		return err
+	}
+
+	link = data.NewIdentityLink(identity.Provider, identity.Subject, accountUuid, identity.Email)
+	if err := s.d.CreateIdentityLink(link); err != nil {
+		return err
+	}
+
+	s.l.Printf("account %s linked %s identity %s\n", accountUuid, identity.Provider, identity.Subject)
+	return WriteJSON(w, http.StatusCreated, link)
+}
+
+// HandleGetIdentities handles GET requests for the external identities linked
+// to the current account
+func (s *Server) HandleGetIdentities(w http.ResponseWriter, r *http.Request) error {
+	claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+	if claims.Service() {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	links, err := s.d.GetIdentityLinks(claims.Subject)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, links)
+}
+
+// HandleUnlinkIdentity handles DELETE requests to unlink an external identity
+// from the current account
+func (s *Server) HandleUnlinkIdentity(w http.ResponseWriter, r *http.Request) error {
+	claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+	vars := mux.Vars(r)
+
+	err := s.d.DeleteIdentityLink(claims.Subject, vars["provider"], vars["subject"])
+	if err == data.ErrIdentityLinkNotFound {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	s.l.Printf("account %s unlinked %s identity %s\n", claims.Subject, vars["provider"], vars["subject"])
+	return WriteJSON(w, http.StatusOK, "identity unlinked successfully")
+}
+
+func sealState(st *federationState) (string, error) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return "", err
+	}
+	return util.Encrypt(b)
+}
+
+func readStateCookie(r *http.Request, name string) (*federationState, bool) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return nil, false
+	}
+
+	b, err := util.Decrypt(cookie.Value)
+	if err != nil {
+		return nil, false
+	}
+
+	st := &federationState{}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, false
+	}
+	return st, true
+}
+
+// setStateCookie sets a cookie holding sealed state. It has to be sent along
+// when the provider sends the user back, which takes SameSite=Lax for
+// redirects and SameSite=None for cross site posts.
+func setStateCookie(w http.ResponseWriter, name, path, value string, maxAge int, sameSite http.SameSite) {
+	secure := util.GetEnv("AUTH_COOKIE_SECURE", "true") == "true"
+	// browsers drop SameSite=None cookies that are not secure
+	if sameSite == http.SameSiteNoneMode && !secure {
+		sameSite = http.SameSiteLaxMode
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: sameSite,
+	})
+}
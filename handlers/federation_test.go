@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/federation"
+	"github.com/blazingly-fast/auth-assistant/federation/federationtest"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// identityStore keeps the links of external identities to accounts
+type identityStore struct {
+	links []*data.IdentityLink
+}
+
+func (st *identityStore) CreateIdentityLink(link *data.IdentityLink) error {
+	st.links = append(st.links, link)
+	return nil
+}
+
+func (st *identityStore) GetIdentityLink(provider, subject string) (*data.IdentityLink, error) {
+	for _, link := range st.links {
+		if link.Provider == provider && link.Subject == subject {
+			return link, nil
+		}
+	}
+	return nil, data.ErrIdentityLinkNotFound
+}
+
+func (st *identityStore) GetIdentityLinks(accountUuid string) ([]*data.IdentityLink, error) {
+	links := []*data.IdentityLink{}
+	for _, link := range st.links {
+		if link.AccountUuid == accountUuid {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+func (st *identityStore) DeleteIdentityLink(accountUuid, provider, subject string) error {
+	for i, link := range st.links {
+		if link.AccountUuid == accountUuid && link.Provider == provider && link.Subject == subject {
+			st.links = append(st.links[:i], st.links[i+1:]...)
+			return nil
+		}
+	}
+	return data.ErrIdentityLinkNotFound
+}
+
+func newTestIdP(t *testing.T) *federationtest.IdP {
+	os.Setenv("ENCRYPTION_KEY", "encryption_key")
+	idp := federationtest.NewIdP("auth-assistant", "secret")
+	federation.SetProviders(federation.NewProvider("test", idp.DiscoveryURL(), idp.ClientID, idp.ClientSecret))
+	t.Cleanup(func() {
+		idp.Close()
+		federation.SetProviders()
+		os.Unsetenv("ENCRYPTION_KEY")
+	})
+	return idp
+}
+
+// federate runs the redirects of a login or link at the test provider and
+// returns the answer of the callback
+func federate(t *testing.T, s *Server, start apiFunc, token string) *httptest.ResponseRecorder {
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{"provider": "test"})
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(start)(rec, r)
+	require.Equal(t, http.StatusFound, rec.Code, rec.Body.String())
+	cookies := rec.Result().Cookies()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusFound, res.StatusCode)
+
+	r = mux.SetURLVars(httptest.NewRequest(http.MethodGet, res.Header.Get("Location"), nil), map[string]string{"provider": "test"})
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	rec = httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleFederationCallback)(rec, r)
+	return rec
+}
+
+func TestFederatedLogin(t *testing.T) {
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+	idp := newTestIdP(t)
+
+	// the verified email finds the account and links the identity
+	rec := federate(t, s, s.HandleFederatedLogin, "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	res := &data.AccountResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+
+	claims, err := util.ValidateToken(res.Token)
+	require.NoError(t, err)
+	require.Equal(t, "uuid", claims.Subject)
+	_, amr := claims.Authenticated()
+	require.Equal(t, []string{"fed"}, amr)
+	require.Len(t, store.links, 1)
+	require.Equal(t, "sub", store.links[0].Subject)
+
+	// the link keeps working when the email changes
+	idp.SetClaims(jwt.MapClaims{"sub": "sub", "email": "john@example.com", "email_verified": true})
+	rec = federate(t, s, s.HandleFederatedLogin, "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// unverified emails are not trusted
+	idp.SetClaims(jwt.MapClaims{"sub": "other", "email": "john@mail.com", "email_verified": false})
+	rec = federate(t, s, s.HandleFederatedLogin, "")
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	// the state has to come back in the same browser
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/?code=code&state=state", nil), map[string]string{"provider": "test"})
+	rec = httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleFederationCallback)(rec, r)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestFederatedLoginWithMFA(t *testing.T) {
+	store := newOAuthStore(t)
+	store.account.UserType = "ADMIN"
+	s := newTestServer(t, store)
+	newTestIdP(t)
+	secret := enrollTestTOTP(t, store)
+
+	// the provider only stands in for the password
+	rec := mfaLogin(t, s, federate(t, s, s.HandleFederatedLogin, ""), totpCode(t, secret, util.TOTPStep(time.Now())))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	res := &data.AccountResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+
+	claims, err := util.ValidateToken(res.Token)
+	require.NoError(t, err)
+	require.Equal(t, "uuid", claims.Subject)
+	_, amr := claims.Authenticated()
+	require.Equal(t, []string{"fed", "otp", "mfa"}, amr)
+}
+
+func TestLinkIdentities(t *testing.T) {
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+	idp := newTestIdP(t)
+	token, _, err := util.GenerateAllToken(util.NewClaimsBuilder("uuid").WithRoles("USER").WithSession("sid").Claims())
+	require.NoError(t, err)
+
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{"provider": "test"})
+	rec := httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleFederatedLink)(rec, r)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	for _, sub := range []string{"work", "home"} {
+		idp.SetClaims(jwt.MapClaims{"sub": sub})
+		rec = federate(t, s, s.HandleFederatedLink, token)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/identities", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	s.Authenticate(s.MakeHTTPHandleFunc(s.HandleGetIdentities)).ServeHTTP(rec, r)
+	require.Equal(t, http.StatusOK, rec.Code)
+	links := []*data.IdentityLink{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&links))
+	require.Len(t, links, 2)
+
+	// an identity signs in to the account that linked it, even without email
+	rec = federate(t, s, s.HandleFederatedLogin, "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// and can not be linked to another one
+	other, _, err := util.GenerateAllToken(util.NewClaimsBuilder("other").WithRoles("USER").WithSession("sid").Claims())
+	require.NoError(t, err)
+	rec = federate(t, s, s.HandleFederatedLink, other)
+	require.Equal(t, http.StatusConflict, rec.Code)
+
+	unlink := func() *httptest.ResponseRecorder {
+		r := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/", nil), map[string]string{"provider": "test", "subject": "home"})
+		r.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		s.Authenticate(s.MakeHTTPHandleFunc(s.HandleUnlinkIdentity)).ServeHTTP(rec, r)
+		return rec
+	}
+	require.Equal(t, http.StatusOK, unlink().Code)
+	require.Equal(t, http.StatusNotFound, unlink().Code)
+	require.Len(t, store.links, 1)
+
+	rec = federate(t, s, s.HandleFederatedLogin, "")
+	require.Equal(t, http.StatusForbidden, rec.Code)
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// HandleIntrospect handles POST requests of resource servers asking whether a
+// token is active, as defined by RFC 7662. Callers authenticate as
+// confidential clients. Access tokens go through the same checks as requests
+// to the API, so both always agree on a token, except that tokens exchanged
+// for a downstream service are active for it.
+func (s *Server) HandleIntrospect(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+	}
+
+	client, err := s.authenticateClient(r)
+	if err == errInvalidClient || (err == nil && client.Public()) {
+		return writeInvalidClient(w, r)
+	}
+	if err != nil {
+		return err
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+	}
+
+	res := &data.IntrospectionResponse{Active: false}
+
+	// the typ header tells the kinds of tokens apart, token_type_hint is not
+	// needed to find them. Resource servers also ask about the tokens
+	// exchanged for them, the aud of the answer tells who a token is for.
+	claims, err := s.validateTokenFor(token, append(util.Audiences(), util.ExchangeAudiences()...))
+	var tokenErr *util.TokenError
+	if err != nil && !errors.As(err, &tokenErr) {
+		return err
+	}
+	if err == nil {
+		res = data.NewIntrospectionResponse(claims, "access_token")
+	} else {
+		claims, _, err := s.activeRefreshToken(token)
+		if err != nil {
+			return err
+		}
+		// refresh tokens are only meant for the client they were issued to
+		if claims != nil && claims.ClientID == client.ClientID {
+			res = data.NewIntrospectionResponse(claims, "refresh_token")
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusOK, res)
+}
+
+// HandleRevoke handles POST requests of clients revoking one of their access
+// or refresh tokens, as defined by RFC 7009. Revoking a refresh token ends its
+// session, which revokes the access tokens issued with it as well. Unknown
+// tokens are not an error, the client only needs to know the token is gone.
+func (s *Server) HandleRevoke(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+	}
+
+	client, err := s.authenticateClient(r)
+	if err == errInvalidClient {
+		return writeInvalidClient(w, r)
+	}
+	if err != nil {
+		return err
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+	}
+
+	claims, err := s.validateTokenFor(token, append(util.Audiences(), util.ExchangeAudiences()...))
+	var tokenErr *util.TokenError
+	if err != nil && !errors.As(err, &tokenErr) {
+		return err
+	}
+	if err == nil {
+		if claims.ClientID == client.ClientID {
+			if err := s.d.RevokeToken(claims.Id, time.Unix(claims.ExpiresAt, 0)); err != nil {
+				return err
+			}
+			s.l.Printf("client %s revoked access token %s\n", client.ClientID, claims.Id)
+		}
+		return WriteJSON(w, http.StatusOK, struct{}{})
+	}
+
+	claims, rt, err := s.activeRefreshToken(token)
+	if err != nil {
+		return err
+	}
+	if claims != nil && claims.ClientID == client.ClientID {
+		err := s.d.RevokeSession(rt.AccountUuid, rt.Family)
+		if err == data.ErrSessionNotFound {
+			err = s.d.RevokeTokenFamily(rt.Family)
+		}
+		if err != nil {
+			return err
+		}
+		s.l.Printf("client %s revoked session %s of account %s\n", client.ClientID, rt.Family, rt.AccountUuid)
+	}
+
+	return WriteJSON(w, http.StatusOK, struct{}{})
+}
+
+// activeRefreshToken returns the claims and stored row of a refresh token that
+// can still be exchanged, or nil claims when it can not
+func (s *Server) activeRefreshToken(token string) (*util.SignedDetails, *data.RefreshToken, error) {
+	claims, err := util.ValidateRefreshToken(token)
+	var tokenErr *util.TokenError
+	if errors.As(err, &tokenErr) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rt, err := s.d.GetRefreshToken(token)
+	if err == data.ErrRefreshTokenNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if rt.Revoked || rt.Rotated {
+		return nil, nil, nil
+	}
+
+	return claims, rt, nil
+}
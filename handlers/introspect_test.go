@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/stretchr/testify/require"
+)
+
+func (st *tokenStore) GetRefreshToken(token string) (*data.RefreshToken, error) {
+	rt, ok := st.refreshTokens[util.HashToken(token)]
+	if !ok {
+		return nil, data.ErrRefreshTokenNotFound
+	}
+	return rt, nil
+}
+
+func (rs *revocationStore) RevokeToken(jti string, expiresAt time.Time) error {
+	rs.revoked = true
+	return nil
+}
+
+func (st *tokenStore) RevokeSession(accountUuid, uuid string) error {
+	return st.RevokeTokenFamily(uuid)
+}
+
+func (st *tokenStore) RevokeTokenFamily(family string) error {
+	for _, rt := range st.refreshTokens {
+		if rt.Family == family {
+			rt.Revoked = true
+		}
+	}
+	return nil
+}
+
+// signIn runs the authorization code flow of the spa client for the account
+// of the store
+func signIn(t *testing.T, s *Server) *data.OAuthTokenResponse {
+	login := authorizeForm()
+	login.Set("email", "john@mail.com")
+	login.Set("password", "password1234")
+	rec := postForm(s, s.HandleAuthorizeLogin, login)
+	require.Equal(t, http.StatusFound, rec.Code)
+	location, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+
+	rec = postForm(s, s.HandleToken, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"spa"},
+		"code":          {location.Query().Get("code")},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"code_verifier": {testVerifier},
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	res := &data.OAuthTokenResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	return res
+}
+
+func introspect(t *testing.T, s *Server, clientID, secret, token string) (int, *data.IntrospectionResponse) {
+	r := httptest.NewRequest(http.MethodPost, "/introspect", strings.NewReader(url.Values{"token": {token}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(clientID, secret)
+	rec := httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleIntrospect)(rec, r)
+
+	res := &data.IntrospectionResponse{}
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	}
+	return rec.Code, res
+}
+
+func TestIntrospectAndRevoke(t *testing.T) {
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+	tokens := signIn(t, s)
+
+	// only confidential clients can introspect
+	code, _ := introspect(t, s, "api", "wrong", tokens.AccessToken)
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = introspect(t, s, "spa", "", tokens.AccessToken)
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	code, res := introspect(t, s, "api", "secret", tokens.AccessToken)
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, res.Active)
+	require.Equal(t, "access_token", res.TokenType)
+	require.Equal(t, "uuid", res.Subject)
+	require.Equal(t, "spa", res.ClientID)
+	require.Equal(t, "openid email", res.Scope)
+	require.NotZero(t, res.ExpiresAt)
+
+	// refresh tokens are only active for the client they were issued to
+	_, res = introspect(t, s, "api", "secret", tokens.RefreshToken)
+	require.False(t, res.Active)
+
+	_, res = introspect(t, s, "api", "secret", "not.a.token")
+	require.Equal(t, &data.IntrospectionResponse{Active: false}, res)
+
+	rec := postForm(s, s.HandleRevoke, url.Values{"client_id": {"spa"}, "token": {tokens.RefreshToken}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	for _, rt := range store.refreshTokens {
+		require.True(t, rt.Revoked)
+	}
+
+	// other clients can not revoke the token
+	rec = postForm(s, s.HandleRevoke, url.Values{"client_id": {"cli"}, "token": {tokens.AccessToken}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	_, res = introspect(t, s, "api", "secret", tokens.AccessToken)
+	require.True(t, res.Active)
+
+	rec = postForm(s, s.HandleRevoke, url.Values{"client_id": {"spa"}, "token": {tokens.AccessToken}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	_, res = introspect(t, s, "api", "secret", tokens.AccessToken)
+	require.False(t, res.Active)
+}
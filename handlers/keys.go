@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// HandleRotateKeys handles POST requests to rotate the token signing key right
+// away. With compromised=true tokens signed with the replaced key stop
+// verifying immediately.
+func (s *Server) HandleRotateKeys(w http.ResponseWriter, r *http.Request) error {
+	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	compromised := r.URL.Query().Get("compromised") == "true"
+	if err := s.k.Rotate(compromised); err != nil {
+		return err
+	}
+
+	ks, err := util.CurrentKeySet()
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]string{"active_key": ks.SigningKey().ID})
+}
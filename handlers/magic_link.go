@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/mailer"
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// magicLinkCookie holds the nonce that binds a magic link to the browser that
+// asked for it, the link only signs in along with it
+const magicLinkCookie = "magic_link_nonce"
+
+// magicLinkLifetime is how long a magic link can be used
+const magicLinkLifetime = 15 * time.Minute
+
+// magicLink defines what a magic link carries. It is sealed with util.Encrypt
+// so links can neither be read nor forged, Token is the OTP token the nonce
+// is verified with.
+type magicLink struct {
+	Token      string    `json:"token"`
+	DeviceName string    `json:"device_name,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// HandleMagicLink handles POST requests for a link to sign in with instead of
+// a password. Like codes, links are only sent to accounts without a second
+// factor and the answer does not tell whether the address has an account.
+func (s *Server) HandleMagicLink(w http.ResponseWriter, r *http.Request) error {
+	req := &data.MagicLinkRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	if limited, err := s.emailOTPLimited(w, r, req.Email); limited {
+		return err
+	}
+
+	nonce, err := util.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	acc, err := s.d.GetAccountByField("email", req.Email)
+	if err != nil && err != data.ErrAccountNotFound {
+		return err
+	}
+	if acc != nil {
+		factors, err := s.mfaStatus(acc)
+		if err != nil {
+			return err
+		}
+		if factors.required {
+			s.l.Printf("[ERROR] account %s has to sign in with a second factor, not sending a magic link\n", acc.Uuid)
+		} else if err := s.sendMagicLink(r, acc, nonce, req.DeviceName); err != nil {
+			return err
+		}
+	}
+
+	setStateCookie(w, magicLinkCookie, "/login/magic-link", nonce, int(magicLinkLifetime.Seconds()), http.SameSiteLaxMode)
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusAccepted, &data.EmailOTPResponse{
+		Message:   "a link was sent if the address belongs to an account, open it in this browser",
+		ExpiresIn: int(magicLinkLifetime.Seconds()),
+	})
+}
+
+// HandleMagicLinkCallback handles GET requests of users opening a magic link,
+// which signs them in like a password login does. Links are used once and
+// only in the browser that asked for them, so a forwarded email does not
+// sign anyone in.
+func (s *Server) HandleMagicLinkCallback(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+
+	cookie, err := r.Cookie(magicLinkCookie)
+	if err != nil || cookie.Value == "" {
+		return writeUnauthorized(w, "", "open the link in the browser it was requested from")
+	}
+
+	link, ok := openMagicLink(r.URL.Query().Get("token"))
+	if !ok {
+		return writeUnauthorized(w, "", "invalid or expired link")
+	}
+
+	otp, ok, err := s.checkEmailOTP(link.Token, cookie.Value, data.EmailOTPMagicLink)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return writeUnauthorized(w, "", "invalid or expired link")
+	}
+	setStateCookie(w, magicLinkCookie, "/login/magic-link", "", -1, http.SameSiteLaxMode)
+
+	acc, err := s.d.GetAccountByField("uuid", otp.AccountUuid)
+	if err == data.ErrAccountNotFound {
+		return writeUnauthorized(w, "", "invalid or expired link")
+	}
+	if err != nil {
+		return err
+	}
+
+	// a second factor set up since the link was sent takes the password
+	factors, err := s.mfaStatus(acc)
+	if err != nil {
+		return err
+	}
+	if factors.required {
+		return writeUnauthorized(w, "", "sign in with your password and second factor")
+	}
+
+	return s.loginAccount(w, r, acc, link.DeviceName, emailAMR...)
+}
+
+// sendMagicLink emails acc a new link that signs in along with nonce
+func (s *Server) sendMagicLink(r *http.Request, acc *data.Account, nonce, deviceName string) error {
+	token, err := util.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().UTC().Add(magicLinkLifetime)
+	b, err := json.Marshal(&magicLink{Token: token, DeviceName: deviceName, ExpiresAt: expiresAt})
+	if err != nil {
+		return err
+	}
+	sealed, err := util.Encrypt(b)
+	if err != nil {
+		return err
+	}
+
+	otp := data.NewEmailOTP(token, nonce, data.EmailOTPMagicLink, acc.Email, acc.Uuid, util.ClientIP(r), expiresAt)
+	if err := s.d.CreateEmailOTP(otp); err != nil {
+		return err
+	}
+
+	link := util.Issuer() + "/login/magic-link/callback?" + url.Values{"token": {sealed}}.Encode()
+	body := fmt.Sprintf(
+		"Open this link to sign in: %s\n\nIt expires in %d minutes and only works in the browser you asked for it from.\n\nIf you did not ask for it, you can ignore this email.\n",
+		link, int(magicLinkLifetime.Minutes()))
+	return mailer.Send(acc.Email, "Your sign in link", body)
+}
+
+func openMagicLink(sealed string) (*magicLink, bool) {
+	b, err := util.Decrypt(sealed)
+	if err != nil {
+		return nil, false
+	}
+
+	link := &magicLink{}
+	if err := json.Unmarshal(b, link); err != nil || time.Now().After(link.ExpiresAt) {
+		return nil, false
+	}
+	return link, true
+}
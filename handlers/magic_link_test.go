@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/stretchr/testify/require"
+)
+
+var mailedLink = regexp.MustCompile(`https?://\S+`)
+
+func TestMagicLink(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", "encryption_key")
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+	box := newMailbox(t)
+
+	// requestLink asks for a link for email and returns the nonce cookie of
+	// the browser that asked
+	requestLink := func(email string) *http.Cookie {
+		rec := postJSON(s, s.HandleMagicLink, `{"email": "`+email+`", "device_name": "laptop"}`)
+		require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == magicLinkCookie {
+				require.True(t, c.HttpOnly)
+				return c
+			}
+		}
+		t.Fatal("no nonce cookie")
+		return nil
+	}
+	open := func(link string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, link, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		s.MakeHTTPHandleFunc(s.HandleMagicLinkCallback)(rec, r)
+		return rec
+	}
+
+	cookie := requestLink("john@mail.com")
+	require.Len(t, box.mails, 1)
+	link := mailedLink.FindString(box.mails[0])
+	require.NotEmpty(t, link)
+	// only the hash of the nonce is stored
+	require.NotEqual(t, cookie.Value, store.emailOTPs[0].CodeHash)
+
+	// a forwarded link does not sign in without the cookie of the browser
+	require.Equal(t, http.StatusUnauthorized, open(link, nil).Code)
+	other := requestLink("jane@mail.com")
+	require.Equal(t, http.StatusUnauthorized, open(link, other).Code)
+
+	// nor does a link that was changed
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	forged := *u
+	forged.RawQuery = url.Values{"token": {u.Query().Get("token")[1:]}}.Encode()
+	require.Equal(t, http.StatusUnauthorized, open(forged.String(), cookie).Code)
+
+	rec := open(link, cookie)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	res := &data.AccountResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	claims, err := util.ValidateToken(res.Token)
+	require.NoError(t, err)
+	_, amr := claims.Authenticated()
+	require.Equal(t, emailAMR, amr)
+
+	// links are single use
+	require.Equal(t, http.StatusUnauthorized, open(link, cookie).Code)
+
+	// accounts with a second factor are not sent links
+	store.emailMFA["uuid"] = true
+	requestLink("john@mail.com")
+	require.Len(t, box.mails, 1)
+}
@@ -0,0 +1,13 @@
+package handlers
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// stored tokens are hashed with it
+	os.Setenv("TOKEN_HASH_KEY", "test_hash_key")
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,732 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// mfaChallengeLifetime is how long the user has to send the code after the
+// password was accepted
+const mfaChallengeLifetime = 5 * time.Minute
+
+// maxMFAAttempts is how many wrong codes a challenge takes before it is
+// dropped and the login has to start over with the first factor
+const maxMFAAttempts = data.MaxMFAAttempts
+
+// maxAccountMFAAttempts is how many second factors an account can be sent
+// within mfaLockout, over all its challenges and the login forms, before it
+// is locked out. A right one starts the count over.
+const (
+	maxAccountMFAAttempts = 10
+	mfaLockout            = 15 * time.Minute
+)
+
+// recoveryCodeCount is how many recovery codes an account gets at a time
+const recoveryCodeCount = 10
+
+// mfaAMR are the authentication methods of a login completed with a code,
+// recovery codes are one time passwords too
+var mfaAMR = []string{"pwd", "otp", "mfa"}
+
+// HandleMFALogin handles POST requests completing a login whose password was
+// accepted with the code of the account's authenticator app. A login that
+// had to enroll TOTP first also confirms the enrollment with the code.
+func (s *Server) HandleMFALogin(w http.ResponseWriter, r *http.Request) error {
+	req := &data.MFALoginRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	challenge, acc, err := s.mfaChallenge(req.MFAToken)
+	if err == data.ErrMFAChallengeNotFound {
+		return writeUnauthorized(w, "", "invalid or expired MFA token")
+	}
+	if err != nil {
+		return err
+	}
+
+	if locked, err := s.mfaLockedOut(acc); err != nil {
+		return err
+	} else if locked {
+		return writeMFALockedOut(w)
+	}
+
+	cred, err := s.d.GetTOTPCredential(acc.Uuid)
+	if err == data.ErrTOTPCredentialNotFound {
+		factors, err := s.mfaStatus(acc)
+		if err != nil {
+			return err
+		}
+		if len(factors.methods()) != 0 {
+			return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "TOTP is not set up, complete the login with another second factor"})
+		}
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "enroll TOTP at /login/mfa/enroll first"})
+	}
+	if err != nil {
+		return err
+	}
+
+	ok := false
+	if cred.Confirmed {
+		ok, err = s.checkTOTP(cred, req.Code)
+	} else {
+		ok, err = s.confirmTOTP(cred, req.Code)
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := s.failMFAChallenge(req.MFAToken, acc); err != nil {
+			return err
+		}
+		return writeUnauthorized(w, "", "invalid code")
+	}
+
+	if err := s.d.ClearMFAAttempts(acc.Uuid); err != nil {
+		return err
+	}
+
+	// the challenge completes a single login
+	if _, err := s.d.ConsumeMFAChallenge(req.MFAToken); err == data.ErrMFAChallengeNotFound {
+		return writeUnauthorized(w, "", "invalid or expired MFA token")
+	} else if err != nil {
+		return err
+	}
+
+	return s.loginAccount(w, r, acc, challenge.DeviceName, challengeAMR(challenge, mfaAMR)...)
+}
+
+// HandleRecoveryLogin handles POST requests completing a login whose password
+// was accepted with one of the account's recovery codes, for accounts that
+// lost their second factor. Every code completes a single login.
+func (s *Server) HandleRecoveryLogin(w http.ResponseWriter, r *http.Request) error {
+	req := &data.RecoveryLoginRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	challenge, acc, err := s.mfaChallenge(req.MFAToken)
+	if err == data.ErrMFAChallengeNotFound {
+		return writeUnauthorized(w, "", "invalid or expired MFA token")
+	}
+	if err != nil {
+		return err
+	}
+
+	if locked, err := s.mfaLockedOut(acc); err != nil {
+		return err
+	} else if locked {
+		return writeMFALockedOut(w)
+	}
+
+	ok, err := s.useRecoveryCode(acc, req.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := s.failMFAChallenge(req.MFAToken, acc); err != nil {
+			return err
+		}
+		return writeUnauthorized(w, "", "invalid code")
+	}
+
+	if err := s.d.ClearMFAAttempts(acc.Uuid); err != nil {
+		return err
+	}
+
+	// the challenge completes a single login
+	if _, err := s.d.ConsumeMFAChallenge(req.MFAToken); err == data.ErrMFAChallengeNotFound {
+		return writeUnauthorized(w, "", "invalid or expired MFA token")
+	} else if err != nil {
+		return err
+	}
+
+	return s.loginAccount(w, r, acc, challenge.DeviceName, challengeAMR(challenge, mfaAMR)...)
+}
+
+// HandleMFAEnroll handles POST requests of accounts that have to sign in with
+// a second factor but never set one up, the MFA token of their login lets
+// them enroll TOTP. Accounts with a second factor have to complete the login
+// with it first.
+func (s *Server) HandleMFAEnroll(w http.ResponseWriter, r *http.Request) error {
+	req := &data.MFAEnrollRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	_, acc, err := s.mfaChallenge(req.MFAToken)
+	if err == data.ErrMFAChallengeNotFound {
+		return writeUnauthorized(w, "", "invalid or expired MFA token")
+	}
+	if err != nil {
+		return err
+	}
+
+	factors, err := s.mfaStatus(acc)
+	if err != nil {
+		return err
+	}
+	if len(factors.methods()) != 0 {
+		return WriteJSON(w, http.StatusConflict, &GenericError{Message: "a second factor is already set up"})
+	}
+
+	return s.enrollTOTP(w, acc)
+}
+
+// HandleGetMFA handles GET requests for the second factors of the current
+// account
+func (s *Server) HandleGetMFA(w http.ResponseWriter, r *http.Request) error {
+	acc, ok, err := s.currentAccount(w, r)
+	if !ok {
+		return err
+	}
+
+	factors, err := s.mfaStatus(acc)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, &data.MFAStatusResponse{
+		TOTP:          factors.totp != nil,
+		WebAuthn:      len(factors.webauthn) != 0,
+		Email:         factors.email,
+		RecoveryCodes: factors.recoveryCodes,
+		Required:      factors.required,
+	})
+}
+
+// HandleRegenerateRecoveryCodes handles POST requests of the current account
+// replacing its recovery codes with a new set, the old codes stop working.
+// It takes a session that signed in with a second factor, so a stolen
+// password alone does not yield codes.
+func (s *Server) HandleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	acc, ok, err := s.currentAccount(w, r)
+	if !ok {
+		return err
+	}
+
+	factors, err := s.mfaStatus(acc)
+	if err != nil {
+		return err
+	}
+	if len(factors.methods()) == 0 {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "set up a second factor first"})
+	}
+	claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+	if !claims.AuthenticatedWith("mfa") {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "sign in with a second factor to regenerate recovery codes"})
+	}
+
+	codes, err := s.newRecoveryCodes(acc)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusCreated, &data.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// HandleEnrollTOTP handles POST requests of the current account setting up
+// TOTP. It returns the secret, which is only used for logins once a first
+// code confirmed it.
+func (s *Server) HandleEnrollTOTP(w http.ResponseWriter, r *http.Request) error {
+	acc, ok, err := s.currentAccount(w, r)
+	if !ok {
+		return err
+	}
+
+	return s.enrollTOTP(w, acc)
+}
+
+// HandleConfirmTOTP handles POST requests confirming the TOTP enrollment of
+// the current account with a first code, logins need a code from then on
+func (s *Server) HandleConfirmTOTP(w http.ResponseWriter, r *http.Request) error {
+	acc, ok, err := s.currentAccount(w, r)
+	if !ok {
+		return err
+	}
+
+	req := &data.TOTPCodeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	cred, err := s.d.GetTOTPCredential(acc.Uuid)
+	if err == data.ErrTOTPCredentialNotFound {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+	if cred.Confirmed {
+		return WriteJSON(w, http.StatusConflict, &GenericError{Message: data.ErrTOTPAlreadyEnabled.Error()})
+	}
+
+	if locked, err := s.mfaLockedOut(acc); err != nil {
+		return err
+	} else if locked {
+		return writeMFALockedOut(w)
+	}
+
+	ok, err = s.confirmTOTP(cred, req.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "invalid code"})
+	}
+	if err := s.d.ClearMFAAttempts(acc.Uuid); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, "TOTP enabled successfully")
+}
+
+// HandleDisableTOTP handles DELETE requests of the current account turning
+// TOTP off, which takes a current code and a token of a second factor login.
+// Enrollments that were never confirmed can be dropped without either.
+// Accounts of a user type that requires MFA can not turn off their last
+// second factor.
+func (s *Server) HandleDisableTOTP(w http.ResponseWriter, r *http.Request) error {
+	acc, ok, err := s.currentAccount(w, r)
+	if !ok {
+		return err
+	}
+	factors, err := s.mfaStatus(acc)
+	if err != nil {
+		return err
+	}
+	if util.MFARequired(acc.UserType) && len(factors.webauthn) == 0 && !factors.email {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "MFA is required for this account"})
+	}
+
+	req := &data.TOTPCodeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	cred, err := s.d.GetTOTPCredential(acc.Uuid)
+	if err == data.ErrTOTPCredentialNotFound {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+	if cred.Confirmed {
+		claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+		if !claims.AuthenticatedWith("mfa") {
+			return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "sign in with a second factor to turn TOTP off"})
+		}
+		if locked, err := s.mfaLockedOut(acc); err != nil {
+			return err
+		} else if locked {
+			return writeMFALockedOut(w)
+		}
+
+		ok, err := s.checkTOTP(cred, req.Code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "invalid code"})
+		}
+		if err := s.d.ClearMFAAttempts(acc.Uuid); err != nil {
+			return err
+		}
+	}
+
+	if err := s.d.DeleteTOTPCredential(acc.Uuid); err != nil {
+		return err
+	}
+	if err := s.dropRecoveryCodes(acc); err != nil {
+		return err
+	}
+
+	s.l.Printf("account %s turned TOTP off\n", acc.Uuid)
+	return WriteJSON(w, http.StatusOK, "TOTP disabled successfully")
+}
+
+// currentAccount returns the account of the current token, service principals
+// have none and are answered with 403
+func (s *Server) currentAccount(w http.ResponseWriter, r *http.Request) (*data.Account, bool, error) {
+	claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+	if claims.Service() {
+		return nil, false, WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	acc, err := s.d.GetAccountByField("uuid", claims.Subject)
+	if err == data.ErrAccountNotFound {
+		return nil, false, WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return acc, true, nil
+}
+
+// mfaFactors defines the second factors of an account. totp is nil unless an
+// enrollment was confirmed, email is whether codes sent by email are one,
+// recoveryCodes is how many recovery codes are left and required whether the
+// account has to sign in with a second factor.
+type mfaFactors struct {
+	totp          *data.TOTPCredential
+	webauthn      []*data.WebAuthnCredential
+	email         bool
+	recoveryCodes int
+	required      bool
+}
+
+// methods returns the second factors a login can be completed with
+func (f *mfaFactors) methods() []string {
+	methods := []string{}
+	if f.totp != nil {
+		methods = append(methods, "totp")
+	}
+	if len(f.webauthn) != 0 {
+		methods = append(methods, "webauthn")
+	}
+	if f.email {
+		methods = append(methods, "email")
+	}
+	return methods
+}
+
+// mfaStatus returns the second factors of acc
+func (s *Server) mfaStatus(acc *data.Account) (*mfaFactors, error) {
+	cred, err := s.d.GetTOTPCredential(acc.Uuid)
+	if err == data.ErrTOTPCredentialNotFound || (err == nil && !cred.Confirmed) {
+		cred, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := s.d.GetWebAuthnCredentials(acc.Uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	email, err := s.d.GetEmailMFA(acc.Uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := s.d.CountRecoveryCodes(acc.Uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	factors := &mfaFactors{totp: cred, webauthn: creds, email: email, recoveryCodes: count}
+	factors.required = len(factors.methods()) != 0 || util.MFARequired(acc.UserType)
+	return factors, nil
+}
+
+// startMFAChallenge answers a first factor of acc, the authentication method
+// firstFactor, with an MFA token. The login is completed at /login/mfa,
+// /login/webauthn/finish, /login/mfa/email or /login/mfa/recovery. An account
+// without second factors has to enroll first.
+func (s *Server) startMFAChallenge(w http.ResponseWriter, acc *data.Account, deviceName, firstFactor string, factors *mfaFactors) error {
+	token, err := util.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	challenge := data.NewMFAChallenge(token, acc.Uuid, deviceName, firstFactor, time.Now().UTC().Add(mfaChallengeLifetime))
+	if err := s.d.CreateMFAChallenge(challenge); err != nil {
+		return err
+	}
+
+	methods := factors.methods()
+	if len(methods) != 0 && factors.recoveryCodes != 0 {
+		methods = append(methods, "recovery_code")
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusForbidden, &data.MFAChallengeResponse{
+		Message:            "a second factor is required",
+		MFARequired:        true,
+		MFAToken:           token,
+		ExpiresIn:          int(mfaChallengeLifetime.Seconds()),
+		Methods:            methods,
+		EnrollmentRequired: len(methods) == 0,
+	})
+}
+
+// mfaLockedOut counts a second factor sent for acc and reports whether acc
+// was sent too many lately. The attempt is counted before the factor is
+// checked, so parallel requests can not get around the limit.
+func (s *Server) mfaLockedOut(acc *data.Account) (bool, error) {
+	attempts, err := s.d.CountMFAAttempt(acc.Uuid, time.Now().Add(-mfaLockout))
+	if err != nil {
+		return false, err
+	}
+	if attempts <= maxAccountMFAAttempts {
+		return false, nil
+	}
+
+	s.l.Printf("[ERROR] too many second factors for account %s, locking it out\n", acc.Uuid)
+	return true, nil
+}
+
+// writeMFALockedOut answers a second factor sent for an account that is
+// locked out
+func writeMFALockedOut(w http.ResponseWriter) error {
+	w.Header().Set("Retry-After", fmt.Sprint(int(mfaLockout.Seconds())))
+	return WriteJSON(w, http.StatusTooManyRequests, &GenericError{Message: "too many wrong codes, try again later"})
+}
+
+// challengeAMR returns the authentication methods of a login completed with
+// the second factor methods amr, those of a password login, whose first step
+// was challenge
+func challengeAMR(challenge *data.MFAChallenge, amr []string) []string {
+	if challenge.FirstFactor == "" || challenge.FirstFactor == "pwd" {
+		return amr
+	}
+
+	completed := []string{challenge.FirstFactor}
+	for _, m := range amr {
+		if m != "pwd" {
+			completed = append(completed, m)
+		}
+	}
+	return completed
+}
+
+// mfaChallenge returns the pending challenge of the MFA token token and the
+// account it was issued for
+func (s *Server) mfaChallenge(token string) (*data.MFAChallenge, *data.Account, error) {
+	challenge, err := s.d.GetMFAChallenge(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	acc, err := s.d.GetAccountByField("uuid", challenge.AccountUuid)
+	if err == data.ErrAccountNotFound {
+		return nil, nil, data.ErrMFAChallengeNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return challenge, acc, nil
+}
+
+// failMFAChallenge counts a wrong second factor sent for the challenge of the
+// MFA token token of acc, the store does not return a challenge that took
+// maxMFAAttempts anymore
+func (s *Server) failMFAChallenge(token string, acc *data.Account) error {
+	attempts, err := s.d.FailMFAChallenge(token)
+	if err != nil && err != data.ErrMFAChallengeNotFound {
+		return err
+	}
+	if attempts >= maxMFAAttempts {
+		s.l.Printf("[ERROR] too many wrong second factors for account %s, dropping its MFA challenge\n", acc.Uuid)
+	}
+	return nil
+}
+
+// enrollTOTP starts a new TOTP enrollment of acc and responds with its secret
+func (s *Server) enrollTOTP(w http.ResponseWriter, acc *data.Account) error {
+	secret, err := util.NewTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	cred, err := data.NewTOTPCredential(acc.Uuid, secret)
+	if err != nil {
+		return err
+	}
+	err = s.d.SaveTOTPCredential(cred)
+	if err == data.ErrTOTPAlreadyEnabled {
+		return WriteJSON(w, http.StatusConflict, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	codes, err := s.firstRecoveryCodes(acc)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusCreated, &data.TOTPEnrollmentResponse{
+		Secret:        secret,
+		URI:           util.TOTPURI(util.TOTPIssuer(), acc.Email, secret),
+		RecoveryCodes: codes,
+	})
+}
+
+// newRecoveryCodes replaces the recovery codes of acc with a new set and
+// returns it
+func (s *Server) newRecoveryCodes(acc *data.Account) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := util.NewRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+
+	if err := s.d.ReplaceRecoveryCodes(acc.Uuid, codes); err != nil {
+		return nil, err
+	}
+
+	s.l.Printf("account %s got a new set of recovery codes\n", acc.Uuid)
+	return codes, nil
+}
+
+// firstRecoveryCodes returns a new set of recovery codes when acc enrolls a
+// second factor without any codes left, and nil when it still has some
+func (s *Server) firstRecoveryCodes(acc *data.Account) ([]string, error) {
+	count, err := s.d.CountRecoveryCodes(acc.Uuid)
+	if err != nil || count != 0 {
+		return nil, err
+	}
+	return s.newRecoveryCodes(acc)
+}
+
+// dropRecoveryCodes deletes the recovery codes of acc once it has no second
+// factor left, the next enrollment gets a new set
+func (s *Server) dropRecoveryCodes(acc *data.Account) error {
+	factors, err := s.mfaStatus(acc)
+	if err != nil || len(factors.methods()) != 0 {
+		return err
+	}
+	return s.d.ReplaceRecoveryCodes(acc.Uuid, nil)
+}
+
+// useRecoveryCode reports whether code is a recovery code of acc that was not
+// used before, and marks it as used
+func (s *Server) useRecoveryCode(acc *data.Account, code string) (bool, error) {
+	ok, err := s.d.UseRecoveryCode(acc.Uuid, code)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	left, err := s.d.CountRecoveryCodes(acc.Uuid)
+	if err != nil {
+		return false, err
+	}
+	s.l.Printf("account %s used a recovery code, %d left\n", acc.Uuid, left)
+	return true, nil
+}
+
+// checkTOTP reports whether code is a code of cred that was not used before
+func (s *Server) checkTOTP(cred *data.TOTPCredential, code string) (bool, error) {
+	secret, err := cred.PlainSecret()
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := util.VerifyTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	used, err := s.d.UseTOTPStep(cred.AccountUuid, step)
+	return !used, err
+}
+
+// confirmTOTP turns the unconfirmed enrollment cred on when code is one of
+// its codes
+func (s *Server) confirmTOTP(cred *data.TOTPCredential, code string) (bool, error) {
+	secret, err := cred.PlainSecret()
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := util.VerifyTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	err = s.d.ConfirmTOTPCredential(cred.AccountUuid, step)
+	if err == data.ErrTOTPCredentialNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	s.l.Printf("account %s turned TOTP on\n", cred.AccountUuid)
+	return true, nil
+}
+
+// formSecondFactor checks the code sent along with the password by the login
+// forms of the browser flows. It returns the authentication methods of the
+// login, or the message the form is shown again with.
+func (s *Server) formSecondFactor(acc *data.Account, code string) ([]string, string, error) {
+	factors, err := s.mfaStatus(acc)
+	if err != nil {
+		return nil, "", err
+	}
+	if !factors.required {
+		return []string{"pwd"}, "", nil
+	}
+	cred := factors.totp
+	if len(factors.methods()) == 0 {
+		return nil, "Set up two-factor authentication before signing in here", nil
+	}
+	if code == "" && cred == nil {
+		return nil, "Security keys and email codes can not be used on this page, enter a recovery code instead", nil
+	}
+	if code == "" {
+		return nil, "Enter the code of your authenticator app", nil
+	}
+	locked, err := s.mfaLockedOut(acc)
+	if err != nil {
+		return nil, "", err
+	}
+	if locked {
+		return nil, "Too many wrong codes, try again later", nil
+	}
+
+	// anything but a six digit code is taken for a recovery code
+	ok := false
+	if cred != nil && len(code) == util.TOTPDigits {
+		ok, err = s.checkTOTP(cred, code)
+	} else {
+		ok, err = s.useRecoveryCode(acc, code)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "Invalid authentication code", nil
+	}
+	if err := s.d.ClearMFAAttempts(acc.Uuid); err != nil {
+		return nil, "", err
+	}
+	return mfaAMR, "", nil
+}
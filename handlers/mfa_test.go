@@ -0,0 +1,426 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/stretchr/testify/require"
+)
+
+// mfaStore keeps TOTP credentials, MFA challenges and recovery codes in
+// memory
+type mfaStore struct {
+	totp       map[string]*data.TOTPCredential
+	challenges map[string]*data.MFAChallenge
+	// mfaAttempts holds when second factors were sent for an account
+	mfaAttempts map[string][]time.Time
+	// recoveryCodes maps the hashes of recovery codes to whether they were
+	// used
+	recoveryCodes map[string]bool
+}
+
+func (st *mfaStore) SaveTOTPCredential(c *data.TOTPCredential) error {
+	if old, ok := st.totp[c.AccountUuid]; ok && old.Confirmed {
+		return data.ErrTOTPAlreadyEnabled
+	}
+	c.CreatedOn = time.Now()
+	st.totp[c.AccountUuid] = c
+	return nil
+}
+
+func (st *mfaStore) GetTOTPCredential(accountUuid string) (*data.TOTPCredential, error) {
+	c, ok := st.totp[accountUuid]
+	if !ok {
+		return nil, data.ErrTOTPCredentialNotFound
+	}
+	return c, nil
+}
+
+func (st *mfaStore) ConfirmTOTPCredential(accountUuid string, step int64) error {
+	c, ok := st.totp[accountUuid]
+	if !ok || c.Confirmed {
+		return data.ErrTOTPCredentialNotFound
+	}
+	now := time.Now()
+	c.Confirmed, c.ConfirmedOn, c.LastStep = true, &now, step
+	return nil
+}
+
+func (st *mfaStore) UseTOTPStep(accountUuid string, step int64) (bool, error) {
+	c, ok := st.totp[accountUuid]
+	if !ok || !c.Confirmed || c.LastStep >= step {
+		return true, nil
+	}
+	c.LastStep = step
+	return false, nil
+}
+
+func (st *mfaStore) DeleteTOTPCredential(accountUuid string) error {
+	if _, ok := st.totp[accountUuid]; !ok {
+		return data.ErrTOTPCredentialNotFound
+	}
+	delete(st.totp, accountUuid)
+	return nil
+}
+
+func (st *mfaStore) CreateMFAChallenge(c *data.MFAChallenge) error {
+	st.challenges[c.TokenHash] = c
+	return nil
+}
+
+func (st *mfaStore) GetMFAChallenge(token string) (*data.MFAChallenge, error) {
+	c, ok := st.challenges[util.HashToken(token)]
+	if !ok || c.ExpiresAt.Before(time.Now()) || c.Attempts >= data.MaxMFAAttempts {
+		return nil, data.ErrMFAChallengeNotFound
+	}
+	return c, nil
+}
+
+func (st *mfaStore) FailMFAChallenge(token string) (int, error) {
+	c, ok := st.challenges[util.HashToken(token)]
+	if !ok {
+		return 0, data.ErrMFAChallengeNotFound
+	}
+	c.Attempts++
+	return c.Attempts, nil
+}
+
+func (st *mfaStore) ConsumeMFAChallenge(token string) (*data.MFAChallenge, error) {
+	c, err := st.GetMFAChallenge(token)
+	if err != nil {
+		return nil, err
+	}
+	delete(st.challenges, util.HashToken(token))
+	return c, nil
+}
+
+func (st *mfaStore) CountMFAAttempt(accountUuid string, since time.Time) (int, error) {
+	st.mfaAttempts[accountUuid] = append(st.mfaAttempts[accountUuid], time.Now())
+	attempts := 0
+	for _, at := range st.mfaAttempts[accountUuid] {
+		if at.After(since) {
+			attempts++
+		}
+	}
+	return attempts, nil
+}
+
+func (st *mfaStore) ClearMFAAttempts(accountUuid string) error {
+	delete(st.mfaAttempts, accountUuid)
+	return nil
+}
+
+func (st *mfaStore) ReplaceRecoveryCodes(accountUuid string, codes []string) error {
+	st.recoveryCodes = map[string]bool{}
+	for _, code := range codes {
+		st.recoveryCodes[util.HashToken(util.NormalizeRecoveryCode(code))] = false
+	}
+	return nil
+}
+
+func (st *mfaStore) UseRecoveryCode(accountUuid, code string) (bool, error) {
+	hash := util.HashToken(util.NormalizeRecoveryCode(code))
+	if used, ok := st.recoveryCodes[hash]; !ok || used {
+		return false, nil
+	}
+	st.recoveryCodes[hash] = true
+	return true, nil
+}
+
+func (st *mfaStore) CountRecoveryCodes(accountUuid string) (int, error) {
+	count := 0
+	for _, used := range st.recoveryCodes {
+		if !used {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func postJSON(s *Server, f apiFunc, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(f)(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	return rec
+}
+
+func passwordLogin(s *Server) *httptest.ResponseRecorder {
+	return postJSON(s, s.HandleLogin, `{"email": "john@mail.com", "password": "password1234"}`)
+}
+
+// mfaLogin completes the login of the MFA challenge rec answered with
+func mfaLogin(t *testing.T, s *Server, rec *httptest.ResponseRecorder, code string) *httptest.ResponseRecorder {
+	require.Equal(t, http.StatusForbidden, rec.Code, rec.Body.String())
+	challenge := &data.MFAChallengeResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(challenge))
+	require.True(t, challenge.MFARequired)
+	return postJSON(s, s.HandleMFALogin, `{"mfa_token": "`+challenge.MFAToken+`", "code": "`+code+`"}`)
+}
+
+// enrollTestTOTP turns TOTP on for the account of store and returns its secret
+func enrollTestTOTP(t *testing.T, store *oauthStore) string {
+	secret, err := util.NewTOTPSecret()
+	require.NoError(t, err)
+	cred, err := data.NewTOTPCredential(store.account.Uuid, secret)
+	require.NoError(t, err)
+	cred.Confirmed = true
+	store.totp[store.account.Uuid] = cred
+	return secret
+}
+
+func totpCode(t *testing.T, secret string, step int64) string {
+	code, err := util.TOTPCode(secret, step)
+	require.NoError(t, err)
+	return code
+}
+
+func TestTOTPLogin(t *testing.T) {
+	os.Setenv("ENCRYPTION_KEY", "encryption_key")
+	defer os.Unsetenv("ENCRYPTION_KEY")
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+
+	rec := passwordLogin(s)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	res := &data.AccountResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	passwordToken := res.Token
+
+	withToken := func(f apiFunc, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+res.Token)
+		rec := httptest.NewRecorder()
+		s.Authenticate(s.MakeHTTPHandleFunc(f)).ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec = withToken(s.HandleEnrollTOTP, "")
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	enrollment := &data.TOTPEnrollmentResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(enrollment))
+	require.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+	// secrets are encrypted at rest
+	require.NotContains(t, store.totp["uuid"].Secret, enrollment.Secret)
+
+	// an enrollment counts once a first code confirmed it
+	require.Equal(t, http.StatusOK, passwordLogin(s).Code)
+	rec = withToken(s.HandleConfirmTOTP, `{"code": "000000"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	step := util.TOTPStep(time.Now())
+	rec = withToken(s.HandleConfirmTOTP, `{"code": "`+totpCode(t, enrollment.Secret, step)+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, http.StatusConflict, withToken(s.HandleEnrollTOTP, "").Code)
+
+	// the code of the confirmation can not be used again
+	rec = mfaLogin(t, s, passwordLogin(s), totpCode(t, enrollment.Secret, step))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = mfaLogin(t, s, passwordLogin(s), totpCode(t, enrollment.Secret, step+1))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	claims, err := util.ValidateToken(res.Token)
+	require.NoError(t, err)
+	_, amr := claims.Authenticated()
+	require.Equal(t, []string{"pwd", "otp", "mfa"}, amr)
+	// only the challenge of the replayed code is left
+	require.Len(t, store.challenges, 1)
+
+	// too many wrong codes drop the challenge
+	rec = passwordLogin(s)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	challenge := &data.MFAChallengeResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(challenge))
+	for i := 0; i < maxMFAAttempts; i++ {
+		rec = postJSON(s, s.HandleMFALogin, `{"mfa_token": "`+challenge.MFAToken+`", "code": "000000"}`)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	rec = postJSON(s, s.HandleMFALogin, `{"mfa_token": "`+challenge.MFAToken+`", "code": "000000"}`)
+	require.Contains(t, rec.Body.String(), "invalid or expired MFA token")
+
+	// new challenges do not get around the limit of the account
+	rec = passwordLogin(s)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(challenge))
+	for i := maxMFAAttempts; i < maxAccountMFAAttempts; i++ {
+		rec = postJSON(s, s.HandleMFALogin, `{"mfa_token": "`+challenge.MFAToken+`", "code": "000000"}`)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	rec = mfaLogin(t, s, passwordLogin(s), "000000")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	// nor do the login forms of the browser flows
+	form := authorizeForm()
+	form.Set("email", "john@mail.com")
+	form.Set("password", "password1234")
+	form.Set("otp", "000000")
+	rec = postForm(s, s.HandleAuthorizeLogin, form)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "Too many wrong codes")
+	// the lockout ends once the attempts are mfaLockout old
+	store.mfaAttempts = map[string][]time.Time{}
+	rec = postForm(s, s.HandleAuthorizeLogin, form)
+	require.Contains(t, rec.Body.String(), "Invalid authentication code")
+
+	// the login form of the browser flows asks for the code too
+	login := authorizeForm()
+	login.Set("email", "john@mail.com")
+	login.Set("password", "password1234")
+	rec = postForm(s, s.HandleAuthorizeLogin, login)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "authenticator app")
+
+	// turning TOTP off takes a session that signed in with a second factor
+	// and a current code, wrong codes count towards the lockout
+	disable := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodDelete, "/", strings.NewReader(`{"code": "000000"}`))
+		r.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		s.Authenticate(s.MakeHTTPHandleFunc(s.HandleDisableTOTP)).ServeHTTP(rec, r)
+		return rec
+	}
+	require.Equal(t, http.StatusForbidden, disable(passwordToken).Code)
+	store.mfaAttempts = map[string][]time.Time{}
+	for i := 0; i < maxAccountMFAAttempts; i++ {
+		require.Equal(t, http.StatusBadRequest, disable(res.Token).Code)
+	}
+	require.Equal(t, http.StatusTooManyRequests, disable(res.Token).Code)
+	require.Contains(t, store.totp, "uuid")
+}
+
+func TestMFARequiredForUserType(t *testing.T) {
+	os.Setenv("ENCRYPTION_KEY", "encryption_key")
+	os.Setenv("MFA_REQUIRED_USER_TYPES", "ADMIN")
+	defer os.Unsetenv("ENCRYPTION_KEY")
+	defer os.Unsetenv("MFA_REQUIRED_USER_TYPES")
+	store := newOAuthStore(t)
+	store.account.UserType = "ADMIN"
+	s := newTestServer(t, store)
+
+	rec := passwordLogin(s)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	challenge := &data.MFAChallengeResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(challenge))
+	require.True(t, challenge.EnrollmentRequired)
+
+	rec = postJSON(s, s.HandleMFALogin, `{"mfa_token": "`+challenge.MFAToken+`", "code": "000000"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// the MFA token lets the account enroll and the first code completes the
+	// login
+	rec = postJSON(s, s.HandleMFAEnroll, `{"mfa_token": "`+challenge.MFAToken+`"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	enrollment := &data.TOTPEnrollmentResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(enrollment))
+
+	code := totpCode(t, enrollment.Secret, util.TOTPStep(time.Now()))
+	rec = postJSON(s, s.HandleMFALogin, `{"mfa_token": "`+challenge.MFAToken+`", "code": "`+code+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.True(t, store.totp["uuid"].Confirmed)
+	res := &data.AccountResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+
+	// and it can not be turned off again
+	r := httptest.NewRequest(http.MethodDelete, "/", strings.NewReader(`{"code": "`+code+`"}`))
+	r.Header.Set("Authorization", "Bearer "+res.Token)
+	rec = httptest.NewRecorder()
+	s.Authenticate(s.MakeHTTPHandleFunc(s.HandleDisableTOTP)).ServeHTTP(rec, r)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	// unknown MFA tokens are rejected
+	rec = postJSON(s, s.HandleMFALogin, `{"mfa_token": "token", "code": "`+code+`"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	os.Setenv("ENCRYPTION_KEY", "encryption_key")
+	defer os.Unsetenv("ENCRYPTION_KEY")
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+
+	rec := passwordLogin(s)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	res := &data.AccountResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	token := res.Token
+
+	withToken := func(method string, f apiFunc, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		s.Authenticate(s.MakeHTTPHandleFunc(f)).ServeHTTP(rec, r)
+		return rec
+	}
+
+	// the first second factor comes with the codes
+	rec = withToken(http.MethodPost, s.HandleEnrollTOTP, "")
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	enrollment := &data.TOTPEnrollmentResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(enrollment))
+	require.Len(t, enrollment.RecoveryCodes, recoveryCodeCount)
+	codes := enrollment.RecoveryCodes
+	// only their hashes are stored
+	require.NotContains(t, store.recoveryCodes, codes[0])
+
+	step := util.TOTPStep(time.Now())
+	rec = withToken(http.MethodPost, s.HandleConfirmTOTP, `{"code": "`+totpCode(t, enrollment.Secret, step)+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = passwordLogin(s)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	challenge := &data.MFAChallengeResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(challenge))
+	require.Equal(t, []string{"totp", "recovery_code"}, challenge.Methods)
+
+	// a code takes the place of the authenticator app, whatever case it is
+	// typed in
+	typed := strings.ToLower(strings.ReplaceAll(codes[0], "-", " "))
+	rec = postJSON(s, s.HandleRecoveryLogin, `{"mfa_token": "`+challenge.MFAToken+`", "code": "`+typed+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	claims, err := util.ValidateToken(res.Token)
+	require.NoError(t, err)
+	_, amr := claims.Authenticated()
+	require.Equal(t, []string{"pwd", "otp", "mfa"}, amr)
+
+	// but only once
+	rec = passwordLogin(s)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(challenge))
+	rec = postJSON(s, s.HandleRecoveryLogin, `{"mfa_token": "`+challenge.MFAToken+`", "code": "`+codes[0]+`"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = withToken(http.MethodGet, s.HandleGetMFA, "")
+	status := &data.MFAStatusResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(status))
+	require.Equal(t, recoveryCodeCount-1, status.RecoveryCodes)
+
+	// the login forms take them too
+	login := authorizeForm()
+	login.Set("email", "john@mail.com")
+	login.Set("password", "password1234")
+	login.Set("otp", codes[1])
+	require.Equal(t, http.StatusFound, postForm(s, s.HandleAuthorizeLogin, login).Code)
+
+	// regenerating takes a session that signed in with a second factor and
+	// invalidates the old set
+	require.Equal(t, http.StatusForbidden, withToken(http.MethodPost, s.HandleRegenerateRecoveryCodes, "").Code)
+	token = res.Token
+	rec = withToken(http.MethodPost, s.HandleRegenerateRecoveryCodes, "")
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	regenerated := &data.RecoveryCodesResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(regenerated))
+	require.Len(t, regenerated.RecoveryCodes, recoveryCodeCount)
+	rec = passwordLogin(s)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(challenge))
+	rec = postJSON(s, s.HandleRecoveryLogin, `{"mfa_token": "`+challenge.MFAToken+`", "code": "`+codes[2]+`"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// codes go away with the last second factor
+	rec = withToken(http.MethodDelete, s.HandleDisableTOTP, `{"code": "`+totpCode(t, enrollment.Secret, step+1)+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Empty(t, store.recoveryCodes)
+}
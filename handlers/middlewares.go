@@ -2,34 +2,112 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/blazingly-fast/auth-assistant/util"
 )
 
+// Authenticate makes sure the request carries a valid, unrevoked access token
+// and passes its claims on to the next handler
 func (s *Server) Authenticate(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		clientToken := r.Header.Get("token")
+		clientToken := requestToken(r)
 		if clientToken == "" {
 			s.l.Println("no token provided")
-			WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "no token provided"})
+			writeUnauthorized(w, "", "no token provided")
+			return
+		}
+		claims, err := s.validateAccessToken(clientToken)
+		var tokenErr *util.TokenError
+		if errors.As(err, &tokenErr) {
+			s.l.Println(err)
+			writeUnauthorized(w, "invalid_token", tokenErr.Reason.Error())
 			return
 		}
-		claims, err := util.ValidateToken(clientToken)
 		if err != nil {
 			s.l.Println(err)
 			WriteJSON(w, http.StatusInternalServerError, &GenericError{Message: "Internal Server Error!"})
 			return
 		}
-		r.Header.Set("user_type", claims.UserType)
-		r.Header.Set("email", claims.Email)
-		r.Header.Set("uuid", claims.Uuid)
-		next.ServeHTTP(w, r)
+		// every header is set, so clients can not pass their own
+		r.Header.Set("user_type", claims.UserType())
+		r.Header.Set("uuid", claims.Subject)
+		r.Header.Set("scope", claims.Scope)
+		r.Header.Set("client_id", claims.ClientID)
+
+		ctx := context.WithValue(r.Context(), ClaimsKey{}, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// validateAccessToken verifies an access token meant for this service and
+// makes sure it has not been revoked. A rejected token gives a
+// *util.TokenError.
+func (s *Server) validateAccessToken(token string) (*util.SignedDetails, error) {
+	return s.validateTokenFor(token, util.Audiences())
+}
+
+// validateTokenFor is validateAccessToken for tokens meant for any of
+// audiences. Tokens exchanged for downstream services only pass it, they are
+// never accepted by the API itself.
+func (s *Server) validateTokenFor(token string, audiences []string) (*util.SignedDetails, error) {
+	claims, err := util.ValidateTokenFor(token, audiences)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := s.d.IsTokenRevoked(claims.Id, claims.Subject, claims.SessionID, time.Unix(claims.IssuedAt, 0))
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, &util.TokenError{Reason: util.ErrTokenRevoked}
+	}
+
+	return claims, nil
+}
+
+// requestToken returns the access token of the request, taken from the
+// Authorization header, the auth cookie when AUTH_COOKIE_NAME is set or the
+// legacy token header unless LEGACY_TOKEN_HEADER is false
+func requestToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+
+	if name := os.Getenv("AUTH_COOKIE_NAME"); name != "" {
+		if cookie, err := r.Cookie(name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+
+	if util.GetEnv("LEGACY_TOKEN_HEADER", "true") == "true" {
+		return r.Header.Get("token")
+	}
+
+	return ""
+}
+
+// writeUnauthorized answers with 401 and a RFC 6750 Bearer challenge, code is
+// left out when the request carried no token at all
+func writeUnauthorized(w http.ResponseWriter, code, description string) error {
+	challenge := `Bearer realm="auth-assistant"`
+	if code != "" {
+		challenge += fmt.Sprintf(`, error="%s", error_description="%s"`, code, description)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+
+	return WriteJSON(w, http.StatusUnauthorized, &GenericError{Message: description})
+}
+
 func (s *Server) Paginate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		limitStr := r.URL.Query().Get("limit")
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/stretchr/testify/require"
+)
+
+// revocationStore answers revocation checks from memory, every other store
+// method is left unimplemented
+type revocationStore struct {
+	data.Storer
+	revoked bool
+}
+
+func (rs *revocationStore) IsTokenRevoked(jti, accountUuid, sessionUuid string, issuedAt time.Time) (bool, error) {
+	return rs.revoked, nil
+}
+
+func newTestServer(t *testing.T, d data.Storer) *Server {
+	key, err := util.GenerateKey("ES256")
+	require.NoError(t, err)
+	util.SetKeySet(util.NewKeySet(key))
+	t.Cleanup(func() { util.SetKeySet(nil) })
+
+	return NewServer(log.New(io.Discard, "", 0), data.NewValidation(), d, nil)
+}
+
+func authenticated(s *Server, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+		WriteJSON(w, http.StatusOK, claims.Subject)
+	})).ServeHTTP(rec, r)
+	return rec
+}
+
+func TestAuthenticateTokenSources(t *testing.T) {
+	s := newTestServer(t, &revocationStore{})
+	token, _, err := util.GenerateAllToken(util.NewClaimsBuilder("uuid").WithRoles("USER").WithSession("sid").Claims())
+	require.NoError(t, err)
+
+	os.Setenv("AUTH_COOKIE_NAME", "access_token")
+	defer os.Unsetenv("AUTH_COOKIE_NAME")
+
+	bearer := httptest.NewRequest(http.MethodGet, "/", nil)
+	bearer.Header.Set("Authorization", "Bearer "+token)
+
+	cookie := httptest.NewRequest(http.MethodGet, "/", nil)
+	cookie.AddCookie(&http.Cookie{Name: "access_token", Value: token})
+
+	legacy := httptest.NewRequest(http.MethodGet, "/", nil)
+	legacy.Header.Set("token", token)
+
+	for name, r := range map[string]*http.Request{"bearer": bearer, "cookie": cookie, "legacy": legacy} {
+		rec := authenticated(s, r)
+		require.Equal(t, http.StatusOK, rec.Code, name)
+		require.Equal(t, "uuid", r.Header.Get("uuid"), name)
+	}
+
+	os.Setenv("LEGACY_TOKEN_HEADER", "false")
+	defer os.Unsetenv("LEGACY_TOKEN_HEADER")
+
+	legacy = httptest.NewRequest(http.MethodGet, "/", nil)
+	legacy.Header.Set("token", token)
+	rec := authenticated(s, legacy)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestAuthenticateChallenges(t *testing.T) {
+	store := &revocationStore{}
+	s := newTestServer(t, store)
+	token, _, err := util.GenerateAllToken(util.NewClaimsBuilder("uuid").WithRoles("USER").WithSession("sid").Claims())
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := authenticated(s, r)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Equal(t, `Bearer realm="auth-assistant"`, rec.Header().Get("WWW-Authenticate"))
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer not.a.token")
+	rec = authenticated(s, r)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+
+	store.revoked = true
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	rec = authenticated(s, r)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+}
@@ -0,0 +1,739 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// OAuthError defines an error response of the OAuth endpoints
+type OAuthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) error {
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, status, &OAuthError{Error: code, ErrorDescription: description})
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in</title></head>
+<body>
+<h1>Sign in to continue to {{.Request.ClientID}}</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post" action="/authorize">
+<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+<input type="hidden" name="client_id" value="{{.Request.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+<input type="hidden" name="scope" value="{{.Request.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+<input type="hidden" name="nonce" value="{{.Request.Nonce}}">
+<input type="hidden" name="prompt" value="{{.Request.Prompt}}">
+<label>Email <input type="email" name="email" required></label>
+<label>Password <input type="password" name="password" required></label>
+<label>Authentication or recovery code, if two-factor authentication is on <input type="text" name="otp" autocomplete="one-time-code"></label>
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Allow access</title></head>
+<body>
+<h1>{{.Client}} wants to access your account</h1>
+{{if .Scopes}}<p>It asks for:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<form method="post" action="/authorize/consent">
+<input type="hidden" name="consent_ticket" value="{{.Ticket}}">
+<button type="submit" name="consent" value="deny">Deny</button>
+<button type="submit" name="consent" value="allow">Allow</button>
+</form>
+</body>
+</html>
+`))
+
+// consentLifetime is how long the user has to answer the consent page
+const consentLifetime = 10 * time.Minute
+
+// consentTicket defines a login waiting for the consent of the user. It is
+// sealed with util.Encrypt into the consent page, so the answer can only be
+// for the request and the account the page was shown for.
+type consentTicket struct {
+	Request     *data.AuthorizeRequest `json:"request"`
+	AccountUuid string                 `json:"account_uuid"`
+	AuthTime    int64                  `json:"auth_time"`
+	AMR         []string               `json:"amr"`
+	ExpiresAt   time.Time              `json:"expires_at"`
+}
+
+// HandleAuthorize handles GET requests to the authorization endpoint. An
+// account that is already signed in goes on to consent, or gets a code right
+// away when it consented before, anyone else gets the login form. prompt=login
+// always asks for the password, prompt=none never shows a page.
+func (s *Server) HandleAuthorize(w http.ResponseWriter, r *http.Request) error {
+	req := newAuthorizeRequest(r.URL.Query())
+	client, scope, ok, err := s.checkAuthorizeRequest(w, r, req)
+	if !ok {
+		return err
+	}
+
+	claims, err := s.signedIn(r)
+	if err != nil {
+		return err
+	}
+	if claims != nil && !hasPrompt(req, "login") {
+		authTime, amr := claims.Authenticated()
+		return s.authorize(w, r, req, client, claims.Subject, scope, authTime, amr)
+	}
+	if hasPrompt(req, "none") {
+		return redirectError(w, r, req, "login_required", "")
+	}
+
+	return renderLogin(w, http.StatusOK, req, "")
+}
+
+// HandleAuthorizeConsent handles POST requests of the consent page, the user
+// allowing or denying the client access to their account
+func (s *Server) HandleAuthorizeConsent(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "malformed form"})
+	}
+
+	ticket, ok := openConsentTicket(r.PostForm.Get("consent_ticket"))
+	if !ok {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "invalid or expired consent, sign in again"})
+	}
+
+	req := ticket.Request
+	client, scope, ok, err := s.checkAuthorizeRequest(w, r, req)
+	if !ok {
+		return err
+	}
+
+	if r.PostForm.Get("consent") != "allow" {
+		s.l.Printf("account %s denied client %s access\n", ticket.AccountUuid, client.ClientID)
+		return redirectError(w, r, req, "access_denied", "the user denied access")
+	}
+
+	consented, err := s.d.GetConsent(ticket.AccountUuid, client.ClientID)
+	if err != nil && err != data.ErrConsentNotFound {
+		return err
+	}
+	if err := s.d.SaveConsent(ticket.AccountUuid, client.ClientID, util.JoinScopes(consented, scope)); err != nil {
+		return err
+	}
+	s.l.Printf("account %s allowed client %s scope %q\n", ticket.AccountUuid, client.ClientID, scope)
+
+	return s.issueAuthorizationCode(w, r, req, ticket.AccountUuid, scope, ticket.AuthTime, ticket.AMR)
+}
+
+// authorize ends the request of an authenticated account, with a code for the
+// client when it is a first party client or the account consented to give it
+// scope before, and with the consent page otherwise
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, req *data.AuthorizeRequest, client *data.Client, accountUuid, scope string, authTime int64, amr []string) error {
+	consented := client.FirstParty
+	if !consented {
+		allowed, err := s.d.GetConsent(accountUuid, client.ClientID)
+		if err != nil && err != data.ErrConsentNotFound {
+			return err
+		}
+		if err == nil {
+			_, consented = util.GrantScope(scope, allowed)
+		}
+	}
+
+	if consented && !hasPrompt(req, "consent") {
+		return s.issueAuthorizationCode(w, r, req, accountUuid, scope, authTime, amr)
+	}
+	if hasPrompt(req, "none") {
+		return redirectError(w, r, req, "consent_required", "")
+	}
+
+	b, err := json.Marshal(&consentTicket{
+		Request:     req,
+		AccountUuid: accountUuid,
+		AuthTime:    authTime,
+		AMR:         amr,
+		ExpiresAt:   time.Now().Add(consentLifetime),
+	})
+	if err != nil {
+		return err
+	}
+	ticket, err := util.Encrypt(b)
+	if err != nil {
+		return err
+	}
+
+	name := client.Name
+	if name == "" {
+		name = client.ClientID
+	}
+	return renderConsent(w, name, strings.Fields(scope), ticket)
+}
+
+func openConsentTicket(sealed string) (*consentTicket, bool) {
+	b, err := util.Decrypt(sealed)
+	if err != nil {
+		return nil, false
+	}
+
+	ticket := &consentTicket{}
+	if err := json.Unmarshal(b, ticket); err != nil || ticket.Request == nil || time.Now().After(ticket.ExpiresAt) {
+		return nil, false
+	}
+	return ticket, true
+}
+
+// hasPrompt reports whether the prompt parameter of the request includes
+// prompt
+func hasPrompt(req *data.AuthorizeRequest, prompt string) bool {
+	for _, p := range strings.Fields(req.Prompt) {
+		if p == prompt {
+			return true
+		}
+	}
+	return false
+}
+
+// signedIn returns the claims of the account the request carries a valid
+// token of, or nil when it carries none
+func (s *Server) signedIn(r *http.Request) (*util.SignedDetails, error) {
+	token := requestToken(r)
+	if token == "" {
+		return nil, nil
+	}
+
+	claims, err := s.validateAccessToken(token)
+	var tokenErr *util.TokenError
+	if errors.As(err, &tokenErr) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claims.Service() {
+		return nil, nil
+	}
+	return claims, nil
+}
+
+// HandleAuthorizeLogin handles POST requests of the login form of the
+// authorization endpoint
+func (s *Server) HandleAuthorizeLogin(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "malformed form"})
+	}
+
+	req := newAuthorizeRequest(r.PostForm)
+	client, scope, ok, err := s.checkAuthorizeRequest(w, r, req)
+	if !ok {
+		return err
+	}
+
+	acc, err := s.d.GetAccountByField("email", r.PostForm.Get("email"))
+	if err == data.ErrAccountNotFound {
+		return renderLogin(w, http.StatusUnauthorized, req, "Invalid email or password")
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := util.VerifyPassword(acc.Password, r.PostForm.Get("password")); err != nil {
+		return renderLogin(w, http.StatusUnauthorized, req, "Invalid email or password")
+	}
+
+	amr, message, err := s.formSecondFactor(acc, r.PostForm.Get("otp"))
+	if err != nil {
+		return err
+	}
+	if message != "" {
+		return renderLogin(w, http.StatusUnauthorized, req, message)
+	}
+
+	return s.authorize(w, r, req, client, acc.Uuid, scope, time.Now().Unix(), amr)
+}
+
+// HandleToken handles POST requests to the token endpoint
+func (s *Server) HandleToken(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+	}
+
+	req := &data.TokenRequest{
+		GrantType:    r.PostForm.Get("grant_type"),
+		ClientID:     r.PostForm.Get("client_id"),
+		Code:         r.PostForm.Get("code"),
+		RedirectURI:  r.PostForm.Get("redirect_uri"),
+		CodeVerifier: r.PostForm.Get("code_verifier"),
+		RefreshToken: r.PostForm.Get("refresh_token"),
+		Scope:        r.PostForm.Get("scope"),
+		DeviceCode:   r.PostForm.Get("device_code"),
+
+		SubjectToken:       r.PostForm.Get("subject_token"),
+		SubjectTokenType:   r.PostForm.Get("subject_token_type"),
+		RequestedTokenType: r.PostForm.Get("requested_token_type"),
+		Audience:           r.PostForm.Get("audience"),
+		Assertion:          r.PostForm.Get("assertion"),
+	}
+
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_request", "grant_type is required")
+	}
+
+	grants := map[string]func(http.ResponseWriter, *http.Request, *data.TokenRequest, *data.Client) error{
+		data.GrantAuthorizationCode: s.authorizationCodeGrant,
+		data.GrantRefreshToken:      s.refreshTokenGrant,
+		data.GrantClientCredentials: s.clientCredentialsGrant,
+		data.GrantDeviceCode:        s.deviceCodeGrant,
+		data.GrantTokenExchange:     s.tokenExchangeGrant,
+		data.GrantJWTBearer:         s.jwtBearerGrant,
+	}
+	grant, ok := grants[req.GrantType]
+	if !ok {
+		return writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+
+	client, err := s.authenticateClient(r)
+	if err == errInvalidClient {
+		return writeInvalidClient(w, r)
+	}
+	if err != nil {
+		return err
+	}
+	if !client.AllowsGrant(req.GrantType) {
+		return writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "grant type not allowed for the client")
+	}
+	req.ClientID = client.ClientID
+
+	return grant(w, r, req, client)
+}
+
+var errInvalidClient = fmt.Errorf("client authentication failed")
+
+func writeInvalidClient(w http.ResponseWriter, r *http.Request) error {
+	if _, _, basic := r.BasicAuth(); basic {
+		w.Header().Set("WWW-Authenticate", `Basic realm="auth-assistant"`)
+	}
+	return writeOAuthError(w, http.StatusUnauthorized, "invalid_client", errInvalidClient.Error())
+}
+
+// authenticateClient returns the client a token request is made by. Clients
+// with a secret send it with HTTP Basic authentication or in the form, public
+// clients only name themselves.
+func (s *Server) authenticateClient(r *http.Request) (*data.Client, error) {
+	clientID, secret := r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	if id, password, ok := r.BasicAuth(); ok {
+		var err error
+		if clientID, err = url.QueryUnescape(id); err != nil {
+			return nil, errInvalidClient
+		}
+		if secret, err = url.QueryUnescape(password); err != nil {
+			return nil, errInvalidClient
+		}
+	}
+	if clientID == "" {
+		return nil, errInvalidClient
+	}
+
+	client, err := s.d.GetClient(clientID)
+	if err == data.ErrClientNotFound {
+		return nil, errInvalidClient
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if client.Public() {
+		return client, nil
+	}
+	if secret == "" || subtle.ConstantTimeCompare([]byte(util.HashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, errInvalidClient
+	}
+	return client, nil
+}
+
+// authorizationCodeGrant exchanges an authorization code, and the PKCE code
+// verifier it was requested with, for a token pair in a new session
+func (s *Server) authorizationCodeGrant(w http.ResponseWriter, r *http.Request, req *data.TokenRequest, client *data.Client) error {
+	code, err := s.d.ConsumeAuthorizationCode(req.Code)
+	if err == data.ErrAuthorizationCodeNotFound {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid authorization code")
+	}
+	if err != nil {
+		return err
+	}
+
+	if code.ClientID != req.ClientID || code.RedirectURI != req.RedirectURI {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid authorization code")
+	}
+	if !util.VerifyCodeChallenge(req.CodeVerifier, code.CodeChallenge) {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid code verifier")
+	}
+
+	acc, err := s.d.GetAccountByField("uuid", code.AccountUuid)
+	if err == data.ErrAccountNotFound {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid authorization code")
+	}
+	if err != nil {
+		return err
+	}
+
+	claims, res, err := s.startClientSession(r, acc, client, code.Scope, code.AuthTime, code.AMR)
+	if err != nil {
+		return err
+	}
+	if err := attachIDToken(res, claims, code.Nonce); err != nil {
+		return err
+	}
+
+	return writeTokenResponse(w, res)
+}
+
+// startClientSession issues a token pair to the client for the account in a
+// new session, as it authenticated at authTime with the methods amr
+func (s *Server) startClientSession(r *http.Request, acc *data.Account, client *data.Client, scope string, authTime int64, amr []string) (*util.SignedDetails, *data.OAuthTokenResponse, error) {
+	sessionID := newSessionID()
+	claims := accountClaims(acc).
+		WithScope(scope).
+		WithSession(sessionID).
+		WithClient(client.ClientID).
+		WithAuthentication(authTime, amr...).
+		Claims()
+	accessLifetime, refreshLifetime := client.TokenLifetimes(util.AccessTokenLifetime, util.RefreshTokenLifetime)
+	token, refreshToken, err := util.GenerateTokens(claims, accessLifetime, refreshLifetime)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.d.UpdateAllTokens(token, refreshToken, acc.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.startSession(r, sessionID, acc.Uuid, client.ClientID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.issueRefreshToken(refreshToken, sessionID, acc.Uuid, refreshLifetime)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return claims, data.NewOAuthTokenResponse(token, refreshToken, claims.Scope, accessLifetime), nil
+}
+
+// refreshTokenGrant rotates a refresh token issued to the client like the
+// refresh endpoint does
+func (s *Server) refreshTokenGrant(w http.ResponseWriter, r *http.Request, req *data.TokenRequest, client *data.Client) error {
+	claims, res, err := s.refresh(r, req.RefreshToken, client)
+	if err == errInvalidRefreshToken || err == errRefreshTokenRevoked {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	tokenRes := data.NewOAuthTokenResponse(res.Token, res.RefreshToken, claims.Scope, time.Until(time.Unix(claims.ExpiresAt, 0)).Round(time.Second))
+	if err := attachIDToken(tokenRes, claims, ""); err != nil {
+		return err
+	}
+
+	return writeTokenResponse(w, tokenRes)
+}
+
+// clientCredentialsGrant issues an access token to the client itself, as a
+// service principal with no account behind it. There is no refresh token, the
+// client can always ask for a new token.
+func (s *Server) clientCredentialsGrant(w http.ResponseWriter, r *http.Request, req *data.TokenRequest, client *data.Client) error {
+	if client.Public() {
+		return writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "public clients can not use client credentials")
+	}
+
+	scope, ok := util.GrantScope(req.Scope, client.Scope)
+	if !ok {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "")
+	}
+
+	claims := util.NewClaimsBuilder(client.ClientID).
+		WithRoles(util.ServiceRole).
+		WithScope(scope).
+		WithClient(client.ClientID).
+		Claims()
+	lifetime, _ := client.TokenLifetimes(util.AccessTokenLifetime, util.RefreshTokenLifetime)
+	token, err := util.GenerateAccessToken(claims, lifetime)
+	if err != nil {
+		return err
+	}
+
+	s.l.Printf("issued a service token to client %s with scope %q\n", client.ClientID, scope)
+	return writeTokenResponse(w, data.NewOAuthTokenResponse(token, "", scope, lifetime))
+}
+
+// tokenExchangeGrant trades the access token of a user for a short lived token
+// the client can pass on to a single downstream service, as defined by RFC
+// 8693. The new token can not outlive the one it replaces, has at most its
+// scope and names the client in its act claim.
+func (s *Server) tokenExchangeGrant(w http.ResponseWriter, r *http.Request, req *data.TokenRequest, client *data.Client) error {
+	if client.Public() {
+		return writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "public clients can not exchange tokens")
+	}
+	if req.SubjectToken == "" || req.SubjectTokenType != util.TokenTypeAccessToken {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_request", "an access token is required as subject_token")
+	}
+	if req.RequestedTokenType != "" && req.RequestedTokenType != util.TokenTypeAccessToken {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_request", "only access tokens can be requested")
+	}
+
+	// downstream services only accept tokens meant for them, and this service
+	// never accepts those
+	allowed := false
+	for _, aud := range util.ExchangeAudiences() {
+		allowed = allowed || aud == req.Audience
+	}
+	if !allowed {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_target", "audience is not known")
+	}
+
+	// exchanged tokens are not meant for this service, so they can not be
+	// exchanged again for other audiences
+	subject, err := s.validateAccessToken(req.SubjectToken)
+	var tokenErr *util.TokenError
+	if errors.As(err, &tokenErr) {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid subject token")
+	}
+	if err != nil {
+		return err
+	}
+	if subject.Service() {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "subject token has to be issued to an account")
+	}
+
+	scope, ok := util.GrantScope(req.Scope, subject.Scope)
+	if ok && scope != "" {
+		_, ok = util.GrantScope(scope, client.Scope)
+	}
+	if !ok {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "")
+	}
+
+	// subject tokens are accepted within the clock skew after they expired,
+	// but there is no time left to give the new token
+	lifetime := util.TokenExchangeLifetime
+	remaining := time.Until(time.Unix(subject.ExpiresAt, 0)).Truncate(time.Second)
+	if remaining < time.Second {
+		return writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "subject token has expired")
+	}
+	if remaining < lifetime {
+		lifetime = remaining
+	}
+
+	authTime, amr := subject.Authenticated()
+	claims := util.NewClaimsBuilder(subject.Subject).
+		WithRoles(subject.Roles...).
+		WithTenant(subject.Tenant).
+		WithScope(scope).
+		WithSession(subject.SessionID).
+		WithClient(client.ClientID).
+		WithAuthentication(authTime, amr...).
+		WithAudience(req.Audience).
+		WithActor(client.ClientID, subject.Actor).
+		Claims()
+	token, err := util.GenerateAccessToken(claims, lifetime)
+	if err != nil {
+		return err
+	}
+
+	s.l.Printf("client %s exchanged a token of %s for audience %s\n", client.ClientID, subject.Subject, req.Audience)
+	res := data.NewOAuthTokenResponse(token, "", scope, lifetime)
+	res.IssuedTokenType = util.TokenTypeAccessToken
+	return writeTokenResponse(w, res)
+}
+
+// HandleUserInfo handles GET requests of OpenID Connect clients for the claims
+// of the account their access token was issued for, limited to what its scope
+// grants
+func (s *Server) HandleUserInfo(w http.ResponseWriter, r *http.Request) error {
+	claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+	if claims.Service() || !util.HasScope(claims.Scope, util.ScopeOpenID) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="auth-assistant", error="insufficient_scope", scope="openid"`)
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "the openid scope is required"})
+	}
+
+	acc, err := s.d.GetAccountByField("uuid", claims.Subject)
+	if err == data.ErrAccountNotFound {
+		return writeUnauthorized(w, "invalid_token", "the account of the token no longer exists")
+	}
+	if err != nil {
+		return err
+	}
+
+	info := util.FilterClaims(acc.Profile(), claims.Scope)
+	info["sub"] = acc.Uuid
+
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusOK, info)
+}
+
+// attachIDToken adds an ID token to the response when the openid scope was
+// granted
+func attachIDToken(res *data.OAuthTokenResponse, claims *util.SignedDetails, nonce string) error {
+	if !util.HasScope(claims.Scope, util.ScopeOpenID) {
+		return nil
+	}
+
+	idToken, err := util.GenerateIDToken(claims, nonce)
+	if err != nil {
+		return err
+	}
+	res.IDToken = idToken
+	return nil
+}
+
+func writeTokenResponse(w http.ResponseWriter, res *data.OAuthTokenResponse) error {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	return WriteJSON(w, http.StatusOK, res)
+}
+
+func newAuthorizeRequest(values url.Values) *data.AuthorizeRequest {
+	return &data.AuthorizeRequest{
+		ResponseType:        values.Get("response_type"),
+		ClientID:            values.Get("client_id"),
+		RedirectURI:         values.Get("redirect_uri"),
+		Scope:               values.Get("scope"),
+		State:               values.Get("state"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+		Nonce:               values.Get("nonce"),
+		Prompt:              values.Get("prompt"),
+	}
+}
+
+// checkAuthorizeRequest validates a request to the authorization endpoint and
+// returns its client and the scope to grant. Errors are reported to the client through its
+// redirect URI, unless the client or redirect URI are themselves invalid; the
+// user is never sent to a URI that is not registered.
+func (s *Server) checkAuthorizeRequest(w http.ResponseWriter, r *http.Request, req *data.AuthorizeRequest) (*data.Client, string, bool, error) {
+	client, err := s.d.GetClient(req.ClientID)
+	if err == data.ErrClientNotFound {
+		return nil, "", false, writeOAuthError(w, http.StatusBadRequest, "invalid_request", "unknown client")
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	if !client.AllowsRedirectURI(req.RedirectURI) {
+		return nil, "", false, writeOAuthError(w, http.StatusBadRequest, "invalid_request", "redirect_uri is not registered for the client")
+	}
+
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return nil, "", false, redirectError(w, r, req, "invalid_request", "response_type must be code and a S256 code_challenge is required")
+	}
+	// none can not be combined with prompts that show a page
+	for _, p := range strings.Fields(req.Prompt) {
+		if (p != "none" && p != "login" && p != "consent") || (p != "none" && hasPrompt(req, "none")) {
+			return nil, "", false, redirectError(w, r, req, "invalid_request", "prompt is not supported")
+		}
+	}
+
+	if !client.AllowsGrant(data.GrantAuthorizationCode) {
+		return nil, "", false, redirectError(w, r, req, "unauthorized_client", "")
+	}
+
+	scope, ok := util.GrantScope(req.Scope, client.Scope)
+	if !ok {
+		return nil, "", false, redirectError(w, r, req, "invalid_scope", "")
+	}
+
+	return client, scope, true, nil
+}
+
+// issueAuthorizationCode sends the user back to the client with a new code for
+// the account, remembering when and how it authenticated
+func (s *Server) issueAuthorizationCode(w http.ResponseWriter, r *http.Request, req *data.AuthorizeRequest, accountUuid, scope string, authTime int64, amr []string) error {
+	code, err := util.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().UTC().Add(util.AuthorizationCodeLifetime)
+	err = s.d.CreateAuthorizationCode(data.NewAuthorizationCode(code, req, accountUuid, scope, authTime, amr, expiresAt))
+	if err != nil {
+		return err
+	}
+
+	return redirectToClient(w, r, req, url.Values{"code": {code}})
+}
+
+func redirectError(w http.ResponseWriter, r *http.Request, req *data.AuthorizeRequest, code, description string) error {
+	params := url.Values{"error": {code}}
+	if description != "" {
+		params.Set("error_description", description)
+	}
+	return redirectToClient(w, r, req, params)
+}
+
+// redirectToClient sends the user to the redirect URI of the request with
+// params and the state of the client added to its query
+func redirectToClient(w http.ResponseWriter, r *http.Request, req *data.AuthorizeRequest, params url.Values) error {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		return err
+	}
+
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	u.RawQuery = query.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+	return nil
+}
+
+func renderConsent(w http.ResponseWriter, client string, scopes []string, ticket string) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(http.StatusOK)
+
+	return consentTemplate.Execute(w, struct {
+		Client string
+		Scopes []string
+		Ticket string
+	}{client, scopes, ticket})
+}
+
+func renderLogin(w http.ResponseWriter, status int, req *data.AuthorizeRequest, message string) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+
+	return loginTemplate.Execute(w, struct {
+		Request *data.AuthorizeRequest
+		Error   string
+	}{req, message})
+}
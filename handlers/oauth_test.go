@@ -0,0 +1,610 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// oauthStore keeps one account in memory, along with the fakes of the
+// features the handlers sign it in with. Every other store method is left
+// unimplemented.
+type oauthStore struct {
+	revocationStore
+	accountStore
+	clientStore
+	tokenStore
+	deviceStore
+	identityStore
+	samlStore
+	assertionStore
+	mfaStore
+	webauthnStore
+	emailOTPStore
+}
+
+// accountStore keeps one account, and the accounts created by the handlers
+type accountStore struct {
+	account *data.Account
+	created []*data.Account
+}
+
+// clientStore keeps clients and the scopes accounts consented to give them
+type clientStore struct {
+	clients map[string]*data.Client
+	// consents maps account and client to the scope consented to
+	consents map[[2]string]string
+}
+
+// tokenStore keeps authorization codes and refresh tokens in memory
+type tokenStore struct {
+	codes         map[string]*data.AuthorizationCode
+	refreshTokens map[string]*data.RefreshToken
+}
+
+func newOAuthStore(t *testing.T) *oauthStore {
+	password, err := bcrypt.GenerateFromPassword([]byte("password1234"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	return &oauthStore{
+		accountStore: accountStore{account: &data.Account{
+			ID:       1,
+			Email:    "john@mail.com",
+			Password: string(password),
+			UserType: "USER",
+			Uuid:     "uuid",
+		}},
+		clientStore: clientStore{
+			clients: map[string]*data.Client{
+				"spa": {
+					ClientID:                "spa",
+					RedirectURIs:            []string{"https://app.example.com/callback"},
+					GrantTypes:              []string{data.GrantAuthorizationCode, data.GrantRefreshToken},
+					Scope:                   "openid profile email",
+					TokenEndpointAuthMethod: data.AuthMethodNone,
+					FirstParty:              true,
+				},
+				"api": {
+					ClientID:                "api",
+					SecretHash:              util.HashToken("secret"),
+					GrantTypes:              []string{data.GrantClientCredentials},
+					TokenEndpointAuthMethod: data.AuthMethodClientSecretBasic,
+				},
+				"cli": {
+					ClientID:                "cli",
+					GrantTypes:              []string{data.GrantDeviceCode, data.GrantRefreshToken},
+					Scope:                   "openid profile",
+					TokenEndpointAuthMethod: data.AuthMethodNone,
+				},
+			},
+			consents: map[[2]string]string{},
+		},
+		tokenStore: tokenStore{
+			codes:         map[string]*data.AuthorizationCode{},
+			refreshTokens: map[string]*data.RefreshToken{},
+		},
+		deviceStore:    deviceStore{deviceCodes: map[string]*data.DeviceCode{}},
+		samlStore:      samlStore{samlProviders: map[string]*data.SAMLProvider{}},
+		assertionStore: assertionStore{assertions: map[string]bool{}},
+		mfaStore: mfaStore{
+			totp:          map[string]*data.TOTPCredential{},
+			challenges:    map[string]*data.MFAChallenge{},
+			mfaAttempts:   map[string][]time.Time{},
+			recoveryCodes: map[string]bool{},
+		},
+		webauthnStore: webauthnStore{
+			webauthn:   map[string]*data.WebAuthnCredential{},
+			ceremonies: map[string]*data.WebAuthnSession{},
+		},
+		emailOTPStore: emailOTPStore{emailMFA: map[string]bool{}},
+	}
+}
+
+func (st *clientStore) GetClient(clientID string) (*data.Client, error) {
+	client, ok := st.clients[clientID]
+	if !ok {
+		return nil, data.ErrClientNotFound
+	}
+	return client, nil
+}
+
+func (st *clientStore) CreateClient(client *data.Client) error {
+	client.CreatedOn = time.Now()
+	st.clients[client.ClientID] = client
+	return nil
+}
+
+func (st *clientStore) GetConsent(accountUuid, clientID string) (string, error) {
+	scope, ok := st.consents[[2]string{accountUuid, clientID}]
+	if !ok {
+		return "", data.ErrConsentNotFound
+	}
+	return scope, nil
+}
+
+func (st *clientStore) SaveConsent(accountUuid, clientID, scope string) error {
+	st.consents[[2]string{accountUuid, clientID}] = scope
+	return nil
+}
+
+func (st *accountStore) GetAccountByField(field string, value any) (*data.Account, error) {
+	for _, acc := range append([]*data.Account{st.account}, st.created...) {
+		if (field == "email" && value == acc.Email) || (field == "uuid" && value == acc.Uuid) {
+			return acc, nil
+		}
+	}
+	return nil, data.ErrAccountNotFound
+}
+
+func (st *accountStore) UpdateAllTokens(token, refreshToken string, id int) error {
+	return nil
+}
+
+func (st *accountStore) CreateSession(session *data.Session) error {
+	return nil
+}
+
+func (st *tokenStore) CreateRefreshToken(rt *data.RefreshToken) error {
+	st.refreshTokens[rt.TokenHash] = rt
+	return nil
+}
+
+func (st *tokenStore) CreateAuthorizationCode(code *data.AuthorizationCode) error {
+	st.codes[code.CodeHash] = code
+	return nil
+}
+
+func (st *tokenStore) ConsumeAuthorizationCode(code string) (*data.AuthorizationCode, error) {
+	found, ok := st.codes[util.HashToken(code)]
+	if !ok || found.ExpiresAt.Before(time.Now()) {
+		return nil, data.ErrAuthorizationCodeNotFound
+	}
+	delete(st.codes, util.HashToken(code))
+	return found, nil
+}
+
+const testVerifier = "dBjftJeZ4CVP-mJ92K9sTGLq0lSQ8QjeWmAWCpJbJ7MO"
+
+func testChallenge() string {
+	sum := sha256.Sum256([]byte(testVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func authorizeForm() url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"spa"},
+		"redirect_uri":          {"https://app.example.com/callback"},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"code_challenge":        {testChallenge()},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+func postForm(s *Server, f apiFunc, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(f)(rec, r)
+	return rec
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+
+	login := authorizeForm()
+	login.Set("email", "john@mail.com")
+	login.Set("password", "password1234")
+	rec := postForm(s, s.HandleAuthorizeLogin, login)
+	require.Equal(t, http.StatusFound, rec.Code)
+
+	location, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "app.example.com", location.Host)
+	require.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	require.NotEmpty(t, code)
+
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"spa"},
+		"code":          {code},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"code_verifier": {testVerifier},
+	}
+
+	wrongVerifier := url.Values{}
+	for k, v := range exchange {
+		wrongVerifier[k] = v
+	}
+	wrongVerifier.Set("code_verifier", strings.Repeat("a", 43))
+
+	rec = postForm(s, s.HandleToken, exchange)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	res := &data.OAuthTokenResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	require.Equal(t, "Bearer", res.TokenType)
+	require.Equal(t, "openid email", res.Scope)
+	require.NotEmpty(t, res.RefreshToken)
+	require.Len(t, store.refreshTokens, 1)
+
+	claims, err := util.ValidateToken(res.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, "uuid", claims.Subject)
+	require.Equal(t, "spa", claims.ClientID)
+	require.Equal(t, "openid email", claims.Scope)
+
+	// a code is only good once
+	rec = postForm(s, s.HandleToken, exchange)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "invalid_grant")
+
+	// and only with the verifier of its challenge
+	rec = postForm(s, s.HandleAuthorizeLogin, login)
+	location, _ = url.Parse(rec.Header().Get("Location"))
+	wrongVerifier.Set("code", location.Query().Get("code"))
+	rec = postForm(s, s.HandleToken, wrongVerifier)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "invalid_grant")
+}
+
+func TestOpenIDConnect(t *testing.T) {
+	store := newOAuthStore(t)
+	store.account.FirstName, store.account.LastName = "John", "Doe"
+	s := newTestServer(t, store)
+
+	login := authorizeForm()
+	login.Set("nonce", "n-0S6_WzA2Mj")
+	login.Set("email", "john@mail.com")
+	login.Set("password", "password1234")
+	rec := postForm(s, s.HandleAuthorizeLogin, login)
+	require.Equal(t, http.StatusFound, rec.Code)
+	location, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+
+	rec = postForm(s, s.HandleToken, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"spa"},
+		"code":          {location.Query().Get("code")},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"code_verifier": {testVerifier},
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	res := &data.OAuthTokenResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	require.NotEmpty(t, res.IDToken)
+
+	idToken := &util.IDTokenClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(res.IDToken, idToken)
+	require.NoError(t, err)
+	require.Equal(t, "uuid", idToken.Subject)
+	require.Equal(t, "spa", idToken.Audience)
+	require.Equal(t, "n-0S6_WzA2Mj", idToken.Nonce)
+	require.Equal(t, []string{"pwd"}, idToken.AMR)
+	require.NotZero(t, idToken.AuthTime)
+
+	// the userinfo endpoint only serves the claims of the granted scopes
+	r := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	r.Header.Set("Authorization", "Bearer "+res.AccessToken)
+	rec = httptest.NewRecorder()
+	s.Authenticate(s.MakeHTTPHandleFunc(s.HandleUserInfo)).ServeHTTP(rec, r)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	info := map[string]interface{}{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&info))
+	require.Equal(t, map[string]interface{}{"sub": "uuid", "email": "john@mail.com"}, info)
+
+	// tokens without the openid scope can not be used there
+	token, err := util.GenerateAccessToken(util.NewClaimsBuilder("uuid").WithRoles("USER").WithScope("email").Claims(), time.Minute)
+	require.NoError(t, err)
+	r = httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	s.Authenticate(s.MakeHTTPHandleFunc(s.HandleUserInfo)).ServeHTTP(rec, r)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Contains(t, rec.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`)
+}
+
+func TestAuthorizeRejectsRequests(t *testing.T) {
+	s := newTestServer(t, newOAuthStore(t))
+
+	// never redirect to a URI the client did not register
+	form := authorizeForm()
+	form.Set("redirect_uri", "https://evil.example.com/callback")
+	r := httptest.NewRequest(http.MethodGet, "/authorize?"+form.Encode(), nil)
+	rec := httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleAuthorize)(rec, r)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Empty(t, rec.Header().Get("Location"))
+
+	// PKCE is mandatory
+	form = authorizeForm()
+	form.Del("code_challenge")
+	r = httptest.NewRequest(http.MethodGet, "/authorize?"+form.Encode(), nil)
+	rec = httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleAuthorize)(rec, r)
+	require.Equal(t, http.StatusFound, rec.Code)
+	location, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "invalid_request", location.Query().Get("error"))
+
+	// without a token the login form is shown
+	r = httptest.NewRequest(http.MethodGet, "/authorize?"+authorizeForm().Encode(), nil)
+	rec = httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleAuthorize)(rec, r)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `name="password"`)
+
+	login := authorizeForm()
+	login.Set("email", "john@mail.com")
+	login.Set("password", "wrong-password1")
+	rec = postForm(s, s.HandleAuthorizeLogin, login)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestAuthorizeConsent(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", "encryption_key")
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+	store.clients["partner"] = &data.Client{
+		ClientID:                "partner",
+		Name:                    "Partner App",
+		RedirectURIs:            []string{"https://partner.example.com/callback"},
+		GrantTypes:              []string{data.GrantAuthorizationCode},
+		Scope:                   "openid email",
+		TokenEndpointAuthMethod: data.AuthMethodNone,
+	}
+	token, _, err := util.GenerateAllToken(util.NewClaimsBuilder("uuid").WithRoles("USER").WithSession("sid").Claims())
+	require.NoError(t, err)
+
+	authorize := func(client, prompt string, signedIn bool) *httptest.ResponseRecorder {
+		form := authorizeForm()
+		form.Set("client_id", client)
+		form.Set("redirect_uri", "https://"+map[string]string{"spa": "app", "partner": "partner"}[client]+".example.com/callback")
+		if prompt != "" {
+			form.Set("prompt", prompt)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/authorize?"+form.Encode(), nil)
+		if signedIn {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		s.MakeHTTPHandleFunc(s.HandleAuthorize)(rec, r)
+		return rec
+	}
+	redirected := func(rec *httptest.ResponseRecorder) url.Values {
+		require.Equal(t, http.StatusFound, rec.Code, rec.Body.String())
+		location, err := url.Parse(rec.Header().Get("Location"))
+		require.NoError(t, err)
+		return location.Query()
+	}
+	ticket := regexp.MustCompile(`name="consent_ticket" value="([^"]+)"`)
+	answer := func(rec *httptest.ResponseRecorder, consent string) *httptest.ResponseRecorder {
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		m := ticket.FindStringSubmatch(rec.Body.String())
+		require.Len(t, m, 2)
+		return postForm(s, s.HandleAuthorizeConsent, url.Values{"consent_ticket": {html.UnescapeString(m[1])}, "consent": {consent}})
+	}
+
+	// first party clients get a code without asking
+	require.NotEmpty(t, redirected(authorize("spa", "", true)).Get("code"))
+
+	// other clients need the consent of the user, even right after the login
+	login := authorizeForm()
+	login.Set("client_id", "partner")
+	login.Set("redirect_uri", "https://partner.example.com/callback")
+	login.Set("email", "john@mail.com")
+	login.Set("password", "password1234")
+	rec := postForm(s, s.HandleAuthorizeLogin, login)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "Partner App")
+	require.Equal(t, "access_denied", redirected(answer(rec, "deny")).Get("error"))
+	require.Empty(t, store.consents)
+
+	rec = authorize("partner", "", true)
+	require.Contains(t, rec.Body.String(), "Partner App")
+	require.NotEmpty(t, redirected(answer(rec, "allow")).Get("code"))
+	require.Equal(t, "openid email", store.consents[[2]string{"uuid", "partner"}])
+
+	// a forged ticket is refused
+	rec = postForm(s, s.HandleAuthorizeConsent, url.Values{"consent_ticket": {"forged"}, "consent": {"allow"}})
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// consent is remembered, until the client asks for it again
+	require.NotEmpty(t, redirected(authorize("partner", "", true)).Get("code"))
+	require.Contains(t, authorize("partner", "consent", true).Body.String(), `name="consent_ticket"`)
+	require.Contains(t, authorize("spa", "consent", true).Body.String(), `name="consent_ticket"`)
+
+	// prompt=login asks for the password of a signed in account
+	require.Contains(t, authorize("spa", "login", true).Body.String(), `name="password"`)
+
+	// prompt=none never shows a page
+	require.Equal(t, "login_required", redirected(authorize("spa", "none", false)).Get("error"))
+	delete(store.consents, [2]string{"uuid", "partner"})
+	require.Equal(t, "consent_required", redirected(authorize("partner", "none", true)).Get("error"))
+	require.Equal(t, "invalid_request", redirected(authorize("spa", "none login", true)).Get("error"))
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	store := newOAuthStore(t)
+	store.clients["worker"] = &data.Client{
+		ClientID:                "worker",
+		SecretHash:              util.HashToken("worker-secret"),
+		GrantTypes:              []string{data.GrantClientCredentials},
+		Scope:                   util.ScopeAccountsRead,
+		TokenEndpointAuthMethod: data.AuthMethodClientSecretPost,
+		AccessTokenLifetime:     600,
+	}
+	s := newTestServer(t, store)
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {"worker"},
+		"client_secret": {"worker-secret"},
+		"scope":         {util.ScopeAccountsWrite},
+	}
+	rec := postForm(s, s.HandleToken, form)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "invalid_scope")
+
+	form.Del("scope")
+	rec = postForm(s, s.HandleToken, form)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	res := &data.OAuthTokenResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	require.Empty(t, res.RefreshToken)
+	require.Equal(t, 600, res.ExpiresIn)
+
+	claims, err := util.ValidateToken(res.AccessToken)
+	require.NoError(t, err)
+	require.True(t, claims.Service())
+	require.Equal(t, "worker", claims.Subject)
+
+	// the service principal passes permission checks for its scope only
+	for scope, status := range map[string]int{util.ScopeAccountsRead: http.StatusOK, util.ScopeAccountsWrite: http.StatusForbidden} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+res.AccessToken)
+		r.Header.Set("scope", util.ScopeAccountsWrite)
+		rec := httptest.NewRecorder()
+		s.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := util.CheckPermission(r, "ADMIN", scope); err != nil {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		})).ServeHTTP(rec, r)
+		require.Equal(t, status, rec.Code, scope)
+	}
+
+	// public clients have no credentials to use
+	form = url.Values{"grant_type": {"client_credentials"}, "client_id": {"spa"}}
+	rec = postForm(s, s.HandleToken, form)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "unauthorized_client")
+}
+
+func TestTokenExchange(t *testing.T) {
+	store := newOAuthStore(t)
+	store.clients["gateway"] = &data.Client{
+		ClientID:                "gateway",
+		SecretHash:              util.HashToken("gateway-secret"),
+		GrantTypes:              []string{data.GrantTokenExchange},
+		Scope:                   "openid email",
+		TokenEndpointAuthMethod: data.AuthMethodClientSecretPost,
+	}
+	s := newTestServer(t, store)
+
+	os.Setenv("JWT_AUDIENCE", util.Issuer()+",https://legacy.example.com")
+	defer os.Unsetenv("JWT_AUDIENCE")
+	os.Setenv("TOKEN_EXCHANGE_AUDIENCES", "orders")
+	defer os.Unsetenv("TOKEN_EXCHANGE_AUDIENCES")
+
+	tokens := signIn(t, s)
+	form := url.Values{
+		"grant_type":         {data.GrantTokenExchange},
+		"client_id":          {"gateway"},
+		"client_secret":      {"gateway-secret"},
+		"subject_token":      {tokens.AccessToken},
+		"subject_token_type": {util.TokenTypeAccessToken},
+		"audience":           {"billing"},
+		"scope":              {"email"},
+	}
+
+	rec := postForm(s, s.HandleToken, form)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "invalid_target")
+
+	// the audiences of this service are no exchange targets
+	form.Set("audience", "https://legacy.example.com")
+	rec = postForm(s, s.HandleToken, form)
+	require.Contains(t, rec.Body.String(), "invalid_target")
+
+	// the exchanged token can not have more scope than the subject token
+	form.Set("audience", "orders")
+	form.Set("scope", "email profile")
+	rec = postForm(s, s.HandleToken, form)
+	require.Contains(t, rec.Body.String(), "invalid_scope")
+
+	form.Set("scope", "email")
+	rec = postForm(s, s.HandleToken, form)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	res := &data.OAuthTokenResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	require.Equal(t, util.TokenTypeAccessToken, res.IssuedTokenType)
+	require.Equal(t, 300, res.ExpiresIn)
+	require.Empty(t, res.RefreshToken)
+
+	claims, err := util.ValidateTokenFor(res.AccessToken, util.ExchangeAudiences())
+	require.NoError(t, err)
+	require.Equal(t, "uuid", claims.Subject)
+	require.Equal(t, "orders", claims.Audience)
+	require.Equal(t, "email", claims.Scope)
+	require.Equal(t, &util.Actor{Subject: "gateway"}, claims.Actor)
+	require.False(t, claims.Service())
+
+	// the exchanged token is only good at the downstream service, not at
+	// the API of this one
+	r := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	r.Header.Set("Authorization", "Bearer "+res.AccessToken)
+	rec = authenticated(s, r)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// but resource servers can still introspect it
+	rec = postForm(s, s.HandleIntrospect, url.Values{
+		"client_id":     {"gateway"},
+		"client_secret": {"gateway-secret"},
+		"token":         {res.AccessToken},
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	introspection := &data.IntrospectionResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(introspection))
+	require.True(t, introspection.Active)
+	require.Equal(t, "orders", introspection.Audience)
+
+	// subject tokens that expired within the clock skew are still valid,
+	// but give no token that has already expired
+	expiring, err := util.GenerateAccessToken(util.NewClaimsBuilder("uuid").WithRoles("USER").WithScope("email").Claims(), -10*time.Second)
+	require.NoError(t, err)
+	_, err = util.ValidateToken(expiring)
+	require.NoError(t, err)
+	form.Set("subject_token", expiring)
+	rec = postForm(s, s.HandleToken, form)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "subject token has expired")
+
+	// and the downstream service can not exchange it again
+	store.clients["orders"] = &data.Client{
+		ClientID:                "orders",
+		SecretHash:              util.HashToken("orders-secret"),
+		GrantTypes:              []string{data.GrantTokenExchange},
+		Scope:                   "email",
+		TokenEndpointAuthMethod: data.AuthMethodClientSecretPost,
+	}
+	form.Set("client_id", "orders")
+	form.Set("client_secret", "orders-secret")
+	form.Set("subject_token", res.AccessToken)
+	form.Del("scope")
+	rec = postForm(s, s.HandleToken, form)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "invalid_grant")
+}
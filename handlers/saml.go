@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/federation"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// samlCookie holds the ID of the AuthnRequest a login waits on an answer to
+const samlCookie = "saml_state"
+
+// HandleCreateSAMLProvider handles POST requests of admins importing the
+// metadata of the SAML identity provider of a tenant
+func (s *Server) HandleCreateSAMLProvider(w http.ResponseWriter, r *http.Request) error {
+	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	req := &data.SAMLProviderRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	if _, err := s.d.GetSAMLProvider(req.Tenant); err != data.ErrSAMLProviderNotFound {
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "tenant already has a SAML provider"})
+	}
+
+	return s.saveSAMLProvider(w, r, req, http.StatusCreated)
+}
+
+// HandleUpdateSAMLProvider handles PUT requests of admins importing the
+// metadata of the SAML identity provider of a tenant again, e.g. after it
+// rolled its signing certificate over
+func (s *Server) HandleUpdateSAMLProvider(w http.ResponseWriter, r *http.Request) error {
+	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	req := &data.SAMLProviderRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	req.Tenant = mux.Vars(r)["tenant"]
+
+	_, err := s.d.GetSAMLProvider(req.Tenant)
+	if err == data.ErrSAMLProviderNotFound {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.saveSAMLProvider(w, r, req, http.StatusOK)
+}
+
+// saveSAMLProvider stores the provider req describes, once its metadata checks
+// out
+func (s *Server) saveSAMLProvider(w http.ResponseWriter, r *http.Request, req *data.SAMLProviderRequest, status int) error {
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	metadata := []byte(req.Metadata)
+	if req.Metadata == "" {
+		var err error
+		metadata, err = federation.FetchSAMLMetadata(r.Context(), &http.Client{Timeout: 10 * time.Second}, req.MetadataURL)
+		if err != nil {
+			s.l.Println("[ERROR] fetching SAML metadata", err)
+			return WriteJSON(w, http.StatusUnprocessableEntity, &GenericError{Message: "metadata could not be fetched from metadata_url"})
+		}
+	}
+
+	idp, err := federation.ParseSAMLMetadata(metadata)
+	if err != nil {
+		return WriteJSON(w, http.StatusUnprocessableEntity, &GenericError{Message: err.Error()})
+	}
+
+	p := data.NewSAMLProvider(idp.EntityID, string(metadata), req)
+	if err := s.d.SaveSAMLProvider(p); err != nil {
+		return err
+	}
+
+	s.l.Printf("imported SAML metadata of %s for tenant %s\n", p.EntityID, p.Tenant)
+	return WriteJSON(w, status, p)
+}
+
+// HandleGetSAMLProviders handles GET requests of admins for the SAML identity
+// providers of all tenants
+func (s *Server) HandleGetSAMLProviders(w http.ResponseWriter, r *http.Request) error {
+	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	providers, err := s.d.GetSAMLProviders()
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, providers)
+}
+
+// HandleGetSAMLProvider handles GET requests of admins for the SAML identity
+// provider of a tenant
+func (s *Server) HandleGetSAMLProvider(w http.ResponseWriter, r *http.Request) error {
+	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	p, err := s.d.GetSAMLProvider(mux.Vars(r)["tenant"])
+	if err == data.ErrSAMLProviderNotFound {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, p)
+}
+
+// HandleDeleteSAMLProvider handles DELETE requests of admins removing the SAML
+// identity provider of a tenant
+func (s *Server) HandleDeleteSAMLProvider(w http.ResponseWriter, r *http.Request) error {
+	if err := util.CheckUserType(r, "ADMIN"); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	tenant := mux.Vars(r)["tenant"]
+	err := s.d.DeleteSAMLProvider(tenant)
+	if err == data.ErrSAMLProviderNotFound {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]string{"deleted": tenant})
+}
+
+// HandleSAMLMetadata handles GET requests for the service provider metadata of
+// a tenant, which its identity provider imports
+func (s *Server) HandleSAMLMetadata(w http.ResponseWriter, r *http.Request) error {
+	row, p, err := s.samlProvider(mux.Vars(r)["tenant"])
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: data.ErrSAMLProviderNotFound.Error()})
+	}
+
+	metadata, err := p.Metadata()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(metadata)
+	return err
+}
+
+// HandleSAMLLogin handles GET requests starting a login at the SAML identity
+// provider of a tenant, the user is sent there with a signed AuthnRequest
+func (s *Server) HandleSAMLLogin(w http.ResponseWriter, r *http.Request) error {
+	row, p, err := s.samlProvider(mux.Vars(r)["tenant"])
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: data.ErrSAMLProviderNotFound.Error()})
+	}
+
+	redirect, requestID, err := p.AuthnRequestURL()
+	if err != nil {
+		return err
+	}
+
+	sealed, err := sealState(&federationState{
+		Provider:  p.Tenant,
+		State:     requestID,
+		ExpiresAt: time.Now().UTC().Add(federationStateLifetime),
+	})
+	if err != nil {
+		return err
+	}
+
+	// the identity provider posts its response from another site
+	setStateCookie(w, samlCookie, "/saml/", sealed, int(federationStateLifetime.Seconds()), http.SameSiteNoneMode)
+	http.Redirect(w, r, redirect, http.StatusFound)
+	return nil
+}
+
+// HandleSAMLACS handles POST requests of the identity provider of a tenant to
+// its assertion consumer service. Once the assertion checks out the identity
+// signs in the account it is linked to, or else the account with its email,
+// which is created on first login. Emails have to be in a domain of the
+// tenant, so an identity provider can not sign in accounts of others.
+func (s *Server) HandleSAMLACS(w http.ResponseWriter, r *http.Request) error {
+	tenant := mux.Vars(r)["tenant"]
+	st, ok := readStateCookie(r, samlCookie)
+	setStateCookie(w, samlCookie, "/saml/", "", -1, http.SameSiteNoneMode)
+	if !ok || st.Provider != tenant || time.Now().After(st.ExpiresAt) {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "invalid or expired login state"})
+	}
+
+	row, p, err := s.samlProvider(tenant)
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: data.ErrSAMLProviderNotFound.Error()})
+	}
+
+	identity, err := p.ParseResponse(r, st.State)
+	if errors.Is(err, federation.ErrLoginRejected) {
+		s.l.Printf("[ERROR] SAML login of tenant %s: %s\n", tenant, err)
+		return WriteJSON(w, http.StatusUnauthorized, &GenericError{Message: "external login failed"})
+	}
+	if err != nil {
+		return err
+	}
+
+	acc, err := s.samlAccount(row, identity)
+	if err == data.ErrAccountNotFound {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "email is not in a domain of the tenant"})
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.federatedLogin(w, r, acc, identity.Provider)
+}
+
+// samlAccount returns the account identity signs in to, linking or creating
+// it on first login. Its name follows the attributes of the assertion.
+func (s *Server) samlAccount(row *data.SAMLProvider, identity *federation.Identity) (*data.Account, error) {
+	link, err := s.d.GetIdentityLink(identity.Provider, identity.Subject)
+	if err != nil && err != data.ErrIdentityLinkNotFound {
+		return nil, err
+	}
+	if link != nil {
+		acc, err := s.d.GetAccountByField("uuid", link.AccountUuid)
+		if err != nil {
+			return nil, err
+		}
+		return acc, s.syncSAMLAccount(acc, identity)
+	}
+
+	if !row.AllowsEmail(identity.Email) {
+		return nil, data.ErrAccountNotFound
+	}
+
+	acc, err := s.d.GetAccountByField("email", identity.Email)
+	if err == data.ErrAccountNotFound {
+		acc, err = s.createSAMLAccount(identity)
+	} else if err == nil {
+		err = s.syncSAMLAccount(acc, identity)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.d.CreateIdentityLink(data.NewIdentityLink(identity.Provider, identity.Subject, acc.Uuid, identity.Email))
+	if err != nil {
+		return nil, err
+	}
+
+	s.l.Printf("linked %s identity %s to account %s by its email\n", identity.Provider, identity.Subject, acc.Uuid)
+	return acc, nil
+}
+
+// createSAMLAccount creates the account of an identity signing in for the
+// first time. It gets a random password, as it signs in through its tenant.
+func (s *Server) createSAMLAccount(identity *federation.Identity) (*data.Account, error) {
+	password, err := util.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	hashedPassword, err := util.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	acc := data.NewAccount(
+		identity.GivenName,
+		identity.FamilyName,
+		identity.Email,
+		hashedPassword,
+		"USER",
+		"default.png",
+		uuid.New().String(),
+		"",
+		"")
+	if err := s.d.CreateAccout(acc); err != nil {
+		return nil, err
+	}
+
+	s.l.Printf("created account %s for %s identity %s\n", acc.Uuid, identity.Provider, identity.Subject)
+	return s.d.GetAccountByField("uuid", acc.Uuid)
+}
+
+// syncSAMLAccount updates the name of acc when the assertion carries another
+func (s *Server) syncSAMLAccount(acc *data.Account, identity *federation.Identity) error {
+	firstName, lastName := acc.FirstName, acc.LastName
+	if identity.GivenName != "" {
+		firstName = identity.GivenName
+	}
+	if identity.FamilyName != "" {
+		lastName = identity.FamilyName
+	}
+	if firstName == acc.FirstName && lastName == acc.LastName {
+		return nil
+	}
+
+	err := s.d.UpdateAccount(&data.UpdateAccountRequest{
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     acc.Email,
+		Password:  acc.Password,
+		UserType:  acc.UserType,
+		UpdatedOn: time.Now().UTC(),
+	}, acc.Uuid)
+	if err != nil {
+		return err
+	}
+
+	acc.FirstName, acc.LastName = firstName, lastName
+	return nil
+}
+
+// samlProvider returns the stored provider of tenant and its service
+// provider, or nil when the tenant has none
+func (s *Server) samlProvider(tenant string) (*data.SAMLProvider, *federation.SAMLProvider, error) {
+	row, err := s.d.GetSAMLProvider(tenant)
+	if err == data.ErrSAMLProviderNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p, err := federation.NewSAMLProvider(row.Tenant, []byte(row.Metadata), federation.SAMLAttributes{
+		Email:     row.EmailAttribute,
+		FirstName: row.FirstNameAttribute,
+		LastName:  row.LastNameAttribute,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return row, p, nil
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/federation"
+	"github.com/blazingly-fast/auth-assistant/federation/federationtest"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/crewjam/saml"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// samlStore keeps the SAML identity providers of tenants
+type samlStore struct {
+	samlProviders map[string]*data.SAMLProvider
+}
+
+func (st *samlStore) SaveSAMLProvider(p *data.SAMLProvider) error {
+	p.CreatedOn, p.UpdatedOn = time.Now(), time.Now()
+	st.samlProviders[p.Tenant] = p
+	return nil
+}
+
+func (st *samlStore) GetSAMLProviders() ([]*data.SAMLProvider, error) {
+	providers := []*data.SAMLProvider{}
+	for _, p := range st.samlProviders {
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
+func (st *samlStore) GetSAMLProvider(tenant string) (*data.SAMLProvider, error) {
+	p, ok := st.samlProviders[tenant]
+	if !ok {
+		return nil, data.ErrSAMLProviderNotFound
+	}
+	return p, nil
+}
+
+func (st *samlStore) DeleteSAMLProvider(tenant string) error {
+	if _, ok := st.samlProviders[tenant]; !ok {
+		return data.ErrSAMLProviderNotFound
+	}
+	delete(st.samlProviders, tenant)
+	return nil
+}
+
+func (st *accountStore) CreateAccout(acc *data.Account) error {
+	acc.ID = len(st.created) + 2
+	st.created = append(st.created, acc)
+	return nil
+}
+
+func (st *accountStore) UpdateAccount(req *data.UpdateAccountRequest, uuid string) error {
+	acc, err := st.GetAccountByField("uuid", uuid)
+	if err != nil {
+		return err
+	}
+	acc.FirstName, acc.LastName = req.FirstName, req.LastName
+	return nil
+}
+
+func newTestSAMLIdP(t *testing.T) *federationtest.SAMLIdP {
+	os.Setenv("ENCRYPTION_KEY", "encryption_key")
+	key, cert := federationtest.NewSAMLCredentials()
+	federation.SetSAMLCredentials(&federation.SAMLCredentials{Key: key, Certificate: cert})
+	idp := federationtest.NewSAMLIdP()
+	t.Cleanup(func() {
+		idp.Close()
+		federation.SetSAMLCredentials(nil)
+		os.Unsetenv("ENCRYPTION_KEY")
+	})
+	return idp
+}
+
+func tenantRequest(method, target, tenant string) *http.Request {
+	return mux.SetURLVars(httptest.NewRequest(method, target, nil), map[string]string{"tenant": tenant})
+}
+
+// samlLogin runs a login at the identity provider of acme and returns the
+// answer of the ACS endpoint
+func samlLogin(t *testing.T, s *Server, idp *federationtest.SAMLIdP) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleSAMLLogin)(rec, tenantRequest(http.MethodGet, "/saml/acme/login", "acme"))
+	require.Equal(t, http.StatusFound, rec.Code, rec.Body.String())
+	cookies := rec.Result().Cookies()
+
+	acsURL, form, err := idp.Respond(rec.Header().Get("Location"))
+	require.NoError(t, err)
+
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodPost, acsURL, strings.NewReader(form.Encode())), map[string]string{"tenant": "acme"})
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	rec = httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleSAMLACS)(rec, r)
+	return rec
+}
+
+func TestSAMLServiceProvider(t *testing.T) {
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+	idp := newTestSAMLIdP(t)
+	admin, _, err := util.GenerateAllToken(util.NewClaimsBuilder("admin").WithRoles("ADMIN").WithSession("sid").Claims())
+	require.NoError(t, err)
+
+	importMetadata := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/admin/saml/providers", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+admin)
+		rec := httptest.NewRecorder()
+		s.Authenticate(s.MakeHTTPHandleFunc(s.HandleCreateSAMLProvider)).ServeHTTP(rec, r)
+		return rec
+	}
+	rec := importMetadata(`{"tenant": "acme", "metadata": "<html></html>", "domains": ["mail.com"]}`)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	rec = importMetadata(`{"tenant": "acme", "metadata_url": "` + idp.URL + `/metadata", "domains": ["Mail.com"]}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	require.Equal(t, idp.URL+"/metadata", store.samlProviders["acme"].EntityID)
+	require.Equal(t, []string{"mail.com"}, store.samlProviders["acme"].Domains)
+	rec = importMetadata(`{"tenant": "acme", "metadata_url": "` + idp.URL + `/metadata", "domains": ["mail.com"]}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleSAMLMetadata)(rec, tenantRequest(http.MethodGet, "/saml/acme/metadata", "acme"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/samlmetadata+xml", rec.Header().Get("Content-Type"))
+	require.NoError(t, idp.RegisterServiceProvider(rec.Body.Bytes()))
+
+	// the account with the asserted email signs in and takes its name
+	rec = samlLogin(t, s, idp)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	res := &data.AccountResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	claims, err := util.ValidateToken(res.Token)
+	require.NoError(t, err)
+	require.Equal(t, "uuid", claims.Subject)
+	require.Equal(t, "John", store.account.FirstName)
+	require.Len(t, store.links, 1)
+	require.Equal(t, "saml:acme", store.links[0].Provider)
+
+	// accounts are created on first login
+	idp.SetSession(&saml.Session{NameID: "jane", NameIDFormat: string(saml.PersistentNameIDFormat), CustomAttributes: []saml.Attribute{{
+		Name:   "email",
+		Values: []saml.AttributeValue{{Type: "xs:string", Value: "jane@mail.com"}},
+	}}})
+	rec = samlLogin(t, s, idp)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Len(t, store.created, 1)
+	require.Equal(t, "jane@mail.com", store.created[0].Email)
+	require.Equal(t, "USER", store.created[0].UserType)
+
+	// but only in the domains of the tenant
+	idp.SetSession(&saml.Session{NameID: "mallory@example.com", NameIDFormat: string(saml.EmailAddressNameIDFormat)})
+	rec = samlLogin(t, s, idp)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Len(t, store.created, 1)
+
+	// responses are only accepted for a login started in the same browser
+	r := tenantRequest(http.MethodPost, "/saml/acme/acs", "acme")
+	r.Body = http.NoBody
+	r.PostForm = url.Values{"SAMLResponse": {"response"}}
+	rec = httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleSAMLACS)(rec, r)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleSAMLLogin)(rec, tenantRequest(http.MethodGet, "/saml/other/login", "other"))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestSAMLLoginWithMFA(t *testing.T) {
+	store := newOAuthStore(t)
+	store.account.UserType = "ADMIN"
+	s := newTestServer(t, store)
+	idp := newTestSAMLIdP(t)
+	secret := enrollTestTOTP(t, store)
+
+	admin, _, err := util.GenerateAllToken(util.NewClaimsBuilder("admin").WithRoles("ADMIN").WithSession("sid").Claims())
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPost, "/admin/saml/providers", strings.NewReader(`{"tenant": "acme", "metadata_url": "`+idp.URL+`/metadata", "domains": ["mail.com"]}`))
+	r.Header.Set("Authorization", "Bearer "+admin)
+	rec := httptest.NewRecorder()
+	s.Authenticate(s.MakeHTTPHandleFunc(s.HandleCreateSAMLProvider)).ServeHTTP(rec, r)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	rec = httptest.NewRecorder()
+	s.MakeHTTPHandleFunc(s.HandleSAMLMetadata)(rec, tenantRequest(http.MethodGet, "/saml/acme/metadata", "acme"))
+	require.NoError(t, idp.RegisterServiceProvider(rec.Body.Bytes()))
+
+	// the identity provider only stands in for the password
+	rec = mfaLogin(t, s, samlLogin(t, s, idp), totpCode(t, secret, util.TOTPStep(time.Now())))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	res := &data.AccountResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+
+	claims, err := util.ValidateToken(res.Token)
+	require.NoError(t, err)
+	require.Equal(t, "uuid", claims.Subject)
+	_, amr := claims.Authenticated()
+	require.Equal(t, []string{"fed", "otp", "mfa"}, amr)
+}
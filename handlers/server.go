@@ -6,19 +6,22 @@ import (
 	"net/http"
 
 	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/keys"
 )
 
 type Server struct {
 	l *log.Logger
 	v *data.Validation
 	d data.Storer
+	k *keys.Manager
 }
 
-func NewServer(l *log.Logger, v *data.Validation, d data.Storer) *Server {
+func NewServer(l *log.Logger, v *data.Validation, d data.Storer, k *keys.Manager) *Server {
 	return &Server{
 		l: l,
 		v: v,
 		d: d,
+		k: k,
 	}
 }
 
@@ -54,3 +57,6 @@ type Pagination struct {
 }
 
 type KeyHolder struct{}
+
+// ClaimsKey holds the claims of the token a request was authenticated with
+type ClaimsKey struct{}
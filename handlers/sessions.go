@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/gorilla/mux"
+)
+
+// HandleGetSessions handles GET requests for the sessions of the current account
+func (s *Server) HandleGetSessions(w http.ResponseWriter, r *http.Request) error {
+	claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+
+	return s.writeSessions(w, claims.Subject, claims.SessionID)
+}
+
+// HandleRevokeSession handles DELETE requests to revoke one session of the
+// current account
+func (s *Server) HandleRevokeSession(w http.ResponseWriter, r *http.Request) error {
+	claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+	id := mux.Vars(r)["id"]
+
+	return s.revokeSession(w, claims.Subject, id)
+}
+
+// HandleRevokeOtherSessions handles DELETE requests to revoke every session
+// of the current account but the one the request is made with
+func (s *Server) HandleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) error {
+	claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+
+	err := s.d.RevokeOtherSessions(claims.Subject, claims.SessionID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, "other sessions revoked successfully")
+}
+
+// HandleGetAccountSessions handles GET requests for the sessions of any account
+func (s *Server) HandleGetAccountSessions(w http.ResponseWriter, r *http.Request) error {
+	uuid := mux.Vars(r)["uuid"]
+
+	if err := util.MatchUserTypeToUUID(r, uuid); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+	return s.writeSessions(w, uuid, claims.SessionID)
+}
+
+// HandleRevokeAccountSession handles DELETE requests to revoke one session of
+// any account
+func (s *Server) HandleRevokeAccountSession(w http.ResponseWriter, r *http.Request) error {
+	uuid := mux.Vars(r)["uuid"]
+	id := mux.Vars(r)["id"]
+
+	if err := util.MatchUserTypeToUUID(r, uuid); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	return s.revokeSession(w, uuid, id)
+}
+
+// HandleRevokeAccountSessions handles DELETE requests to revoke every session
+// of any account
+func (s *Server) HandleRevokeAccountSessions(w http.ResponseWriter, r *http.Request) error {
+	uuid := mux.Vars(r)["uuid"]
+
+	if err := util.MatchUserTypeToUUID(r, uuid); err != nil {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "Unauthorized to access this resource"})
+	}
+
+	err := s.d.RevokeOtherSessions(uuid, "")
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, "sessions revoked successfully")
+}
+
+func (s *Server) writeSessions(w http.ResponseWriter, accountUuid, currentID string) error {
+	sessions, err := s.d.GetSessions(accountUuid)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		session.Current = session.Uuid == currentID
+	}
+
+	return WriteJSON(w, http.StatusOK, sessions)
+}
+
+func (s *Server) revokeSession(w http.ResponseWriter, accountUuid, id string) error {
+	err := s.d.RevokeSession(accountUuid, id)
+	if err == data.ErrSessionNotFound {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]string{"revoked": id})
+}
+
+// startSession records a new login of the account from the request
+func (s *Server) startSession(r *http.Request, id, accountUuid, deviceName string) error {
+	session := data.NewSession(id, accountUuid, deviceName, r.UserAgent(), util.ClientIP(r))
+	return s.d.CreateSession(session)
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/google/uuid"
+)
+
+// HandleRefresh handles POST requests exchanging a refresh token for a new
+// token pair. The presented refresh token is rotated, and presenting it again
+// revokes every token of its family.
+func (s *Server) HandleRefresh(w http.ResponseWriter, r *http.Request) error {
+	req := &data.RefreshRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	_, res, err := s.refresh(r, req.RefreshToken, nil)
+	if err == errInvalidRefreshToken || err == errRefreshTokenRevoked {
+		return WriteJSON(w, http.StatusUnauthorized, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	setAuthCookie(w, res.Token)
+	return WriteJSON(w, http.StatusOK, res)
+}
+
+var errInvalidRefreshToken = fmt.Errorf("invalid refresh token")
+var errRefreshTokenRevoked = fmt.Errorf("refresh token has been revoked")
+
+// refresh rotates refreshToken, which has to be issued to client, or directly
+// to the account when client is nil, and returns the claims of the new access
+// token with the new token pair. Rejected refresh tokens give
+// errInvalidRefreshToken or errRefreshTokenRevoked.
+func (s *Server) refresh(r *http.Request, refreshToken string, client *data.Client) (*util.SignedDetails, *data.TokenResponse, error) {
+	clientID := ""
+	accessLifetime, refreshLifetime := util.AccessTokenLifetime, util.RefreshTokenLifetime
+	if client != nil {
+		clientID = client.ClientID
+		accessLifetime, refreshLifetime = client.TokenLifetimes(accessLifetime, refreshLifetime)
+	}
+
+	refreshClaims, err := util.ValidateRefreshToken(refreshToken)
+	var tokenErr *util.TokenError
+	if errors.As(err, &tokenErr) {
+		s.l.Println("[ERROR] validating refresh token", err)
+		return nil, nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if refreshClaims.ClientID != clientID {
+		return nil, nil, errInvalidRefreshToken
+	}
+
+	rt, err := s.d.GetRefreshToken(refreshToken)
+	if err == data.ErrRefreshTokenNotFound {
+		return nil, nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if rt.Revoked {
+		return nil, nil, errRefreshTokenRevoked
+	}
+
+	err = s.d.RotateRefreshToken(refreshToken)
+	if err == data.ErrRefreshTokenReused {
+		s.l.Printf("[WARNING] refresh token reuse detected, revoking token family %s of account %s\n", rt.Family, rt.AccountUuid)
+		if err := s.d.RevokeTokenFamily(rt.Family); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, errRefreshTokenRevoked
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	acc, err := s.d.GetAccountByField("uuid", rt.AccountUuid)
+	if err == data.ErrAccountNotFound {
+		if err := s.d.RevokeTokenFamily(rt.Family); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// tokens issued before refresh tokens carried a scope get the default one
+	scope := refreshClaims.Scope
+	if scope == "" {
+		scope = util.DefaultScope()
+	}
+
+	claims := accountClaims(acc).
+		WithScope(scope).
+		WithSession(rt.Family).
+		WithClient(clientID).
+		WithAuthentication(refreshClaims.AuthTime, refreshClaims.AMR...).
+		Claims()
+	token, newRefreshToken, err := util.GenerateTokens(claims, accessLifetime, refreshLifetime)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.d.UpdateAllTokens(token, newRefreshToken, acc.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.issueRefreshToken(newRefreshToken, rt.Family, acc.Uuid, refreshLifetime)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.d.TouchSession(rt.Family, r.UserAgent(), util.ClientIP(r))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return claims, &data.TokenResponse{Token: token, RefreshToken: newRefreshToken}, nil
+}
+
+// HandleLogout handles POST requests to revoke the access token the request
+// is made with, its session and, when it is given, the refresh token of the
+// same login
+func (s *Server) HandleLogout(w http.ResponseWriter, r *http.Request) error {
+	claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+
+	req := &data.LogoutRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return err
+	}
+
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	if req.RefreshToken != "" {
+		rt, err := s.d.GetRefreshToken(req.RefreshToken)
+		if err != nil && err != data.ErrRefreshTokenNotFound {
+			return err
+		}
+		if rt != nil && rt.AccountUuid == claims.Subject {
+			if err := s.d.RevokeTokenFamily(rt.Family); err != nil {
+				return err
+			}
+		}
+	}
+
+	// ending the session also revokes its refresh tokens
+	if claims.SessionID != "" {
+		err := s.d.RevokeSession(claims.Subject, claims.SessionID)
+		if err != nil && err != data.ErrSessionNotFound {
+			return err
+		}
+	}
+
+	err := s.d.RevokeToken(claims.Id, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		return err
+	}
+
+	clearAuthCookie(w)
+	return WriteJSON(w, http.StatusOK, "logged out successfully")
+}
+
+// accountClaims starts the claims of an access token of acc. Profile data
+// only goes in when TOKEN_CLAIMS asks for it.
+func accountClaims(acc *data.Account) *util.ClaimsBuilder {
+	return util.NewClaimsBuilder(acc.Uuid).
+		WithRoles(acc.UserType).
+		WithProfile(acc.Profile())
+}
+
+// accessClaims returns the claims of the access tokens of acc when it logs in
+// directly, in the session sessionID, having just authenticated with amr
+func accessClaims(acc *data.Account, sessionID string, amr ...string) *util.SignedDetails {
+	return accountClaims(acc).
+		WithScope(util.DefaultScope()).
+		WithSession(sessionID).
+		WithAuthentication(time.Now().Unix(), amr...).
+		Claims()
+}
+
+// issueRefreshToken stores a freshly generated refresh token, valid for
+// lifetime, so it can later be exchanged at the refresh endpoint
+func (s *Server) issueRefreshToken(refreshToken, family, accountUuid string, lifetime time.Duration) error {
+	expiresAt := time.Now().UTC().Add(lifetime)
+	return s.d.CreateRefreshToken(data.NewRefreshToken(refreshToken, family, accountUuid, expiresAt))
+}
+
+// setAuthCookie hands browser clients the access token as an HttpOnly cookie
+// when AUTH_COOKIE_NAME is set
+func setAuthCookie(w http.ResponseWriter, token string) {
+	name := os.Getenv("AUTH_COOKIE_NAME")
+	if name == "" {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(util.AccessTokenLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   util.GetEnv("AUTH_COOKIE_SECURE", "true") == "true",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearAuthCookie(w http.ResponseWriter) {
+	name := os.Getenv("AUTH_COOKIE_NAME")
+	if name == "" {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   util.GetEnv("AUTH_COOKIE_SECURE", "true") == "true",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// newSessionID returns the id of a new session, which also names the family
+// of its refresh tokens
+func newSessionID() string {
+	return uuid.New().String()
+}
@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/blazingly-fast/auth-assistant/webauthn"
+	"github.com/gorilla/mux"
+)
+
+// webauthnSessionLifetime is how long the browser has to finish a ceremony
+// once it was started
+const webauthnSessionLifetime = 5 * time.Minute
+
+// passkeyAMR are the authentication methods of a passwordless login with a
+// passkey that verified the user, webauthnAMR those of a password login
+// completed with a security key
+var (
+	passkeyAMR  = []string{"hwk", "mfa"}
+	webauthnAMR = []string{"pwd", "hwk", "mfa"}
+)
+
+// HandleBeginWebAuthnRegistration handles POST requests of the current account
+// starting to register a passkey or security key. It returns the options for
+// navigator.credentials.create() and the session to finish with.
+func (s *Server) HandleBeginWebAuthnRegistration(w http.ResponseWriter, r *http.Request) error {
+	acc, ok, err := s.currentAccount(w, r)
+	if !ok {
+		return err
+	}
+
+	creds, err := s.d.GetWebAuthnCredentials(acc.Uuid)
+	if err != nil {
+		return err
+	}
+	exclude := []webauthn.CredentialDescriptor{}
+	for _, cred := range creds {
+		exclude = append(exclude, descriptor(cred))
+	}
+
+	rp := webauthn.LoadRelyingParty()
+	return s.beginWebAuthnCeremony(w, data.CeremonyRegistration, acc.Uuid, func(challenge string) any {
+		return rp.CreationOptions(challenge, acc.Uuid, acc.Email, acc.FirstName+" "+acc.LastName, exclude)
+	})
+}
+
+// HandleFinishWebAuthnRegistration handles POST requests of the current account
+// finishing the registration of a passkey or security key with the response
+// of navigator.credentials.create(). The first second factor of an account
+// comes with its recovery codes.
+func (s *Server) HandleFinishWebAuthnRegistration(w http.ResponseWriter, r *http.Request) error {
+	acc, ok, err := s.currentAccount(w, r)
+	if !ok {
+		return err
+	}
+
+	req := &data.WebAuthnRegisterRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	session, err := s.d.ConsumeWebAuthnSession(req.Session)
+	if err == data.ErrWebAuthnSessionNotFound || (err == nil && (session.Ceremony != data.CeremonyRegistration || session.AccountUuid != acc.Uuid)) {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "invalid or expired WebAuthn session"})
+	}
+	if err != nil {
+		return err
+	}
+
+	res := &webauthn.RegistrationResponse{}
+	if err := json.Unmarshal(req.Credential, res); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "malformed credential"})
+	}
+	verified, err := webauthn.LoadRelyingParty().VerifyRegistration(res, session.Challenge, false)
+	if errors.Is(err, webauthn.ErrCeremonyRejected) {
+		s.l.Printf("[ERROR] registration of a WebAuthn credential for account %s: %s\n", acc.Uuid, err)
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	name := req.Name
+	if name == "" {
+		name = "Security key"
+	}
+	cred := data.NewWebAuthnCredential(verified.ID, acc.Uuid, name, verified.PublicKey, verified.SignCount, verified.Transports)
+	err = s.d.CreateWebAuthnCredential(cred)
+	if err == data.ErrWebAuthnCredentialExists {
+		return WriteJSON(w, http.StatusConflict, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	s.l.Printf("account %s registered WebAuthn credential %s\n", acc.Uuid, cred.CredentialID)
+
+	codes, err := s.firstRecoveryCodes(acc)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusCreated, &data.WebAuthnRegistrationResponse{WebAuthnCredential: cred, RecoveryCodes: codes})
+}
+
+// HandleGetWebAuthnCredentials handles GET requests for the passkeys and
+// security keys of the current account
+func (s *Server) HandleGetWebAuthnCredentials(w http.ResponseWriter, r *http.Request) error {
+	acc, ok, err := s.currentAccount(w, r)
+	if !ok {
+		return err
+	}
+
+	creds, err := s.d.GetWebAuthnCredentials(acc.Uuid)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, creds)
+}
+
+// HandleDeleteWebAuthnCredential handles DELETE requests of the current
+// account removing one of its passkeys or security keys, which takes a login
+// with a second factor. Accounts of a user type that requires MFA can not
+// remove their last second factor.
+func (s *Server) HandleDeleteWebAuthnCredential(w http.ResponseWriter, r *http.Request) error {
+	acc, ok, err := s.currentAccount(w, r)
+	if !ok {
+		return err
+	}
+	id := mux.Vars(r)["id"]
+	claims := r.Context().Value(ClaimsKey{}).(*util.SignedDetails)
+	if !claims.AuthenticatedWith("mfa") {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "sign in with a second factor to remove a key"})
+	}
+
+	factors, err := s.mfaStatus(acc)
+	if err != nil {
+		return err
+	}
+	left := factors.totp != nil || factors.email
+	for _, cred := range factors.webauthn {
+		left = left || cred.CredentialID != id
+	}
+	if util.MFARequired(acc.UserType) && !left {
+		return WriteJSON(w, http.StatusForbidden, &GenericError{Message: "MFA is required for this account"})
+	}
+
+	err = s.d.DeleteWebAuthnCredential(acc.Uuid, id)
+	if err == data.ErrWebAuthnCredentialNotFound {
+		return WriteJSON(w, http.StatusNotFound, &GenericError{Message: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.dropRecoveryCodes(acc); err != nil {
+		return err
+	}
+
+	s.l.Printf("account %s removed WebAuthn credential %s\n", acc.Uuid, id)
+	return WriteJSON(w, http.StatusOK, map[string]string{"deleted": id})
+}
+
+// HandleBeginWebAuthnLogin handles POST requests starting a login with a
+// passkey or security key. With the MFA token of a password login it is the
+// second factor of that account, without it a passwordless login with any
+// passkey that verifies the user.
+func (s *Server) HandleBeginWebAuthnLogin(w http.ResponseWriter, r *http.Request) error {
+	req := &data.WebAuthnLoginBeginRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil && err != io.EOF {
+		return err
+	}
+
+	rp := webauthn.LoadRelyingParty()
+	if req.MFAToken == "" {
+		return s.beginWebAuthnCeremony(w, data.CeremonyAuthentication, "", func(challenge string) any {
+			return rp.RequestOptions(challenge, nil, "required")
+		})
+	}
+
+	_, acc, err := s.mfaChallenge(req.MFAToken)
+	if err == data.ErrMFAChallengeNotFound {
+		return writeUnauthorized(w, "", "invalid or expired MFA token")
+	}
+	if err != nil {
+		return err
+	}
+
+	creds, err := s.d.GetWebAuthnCredentials(acc.Uuid)
+	if err != nil {
+		return err
+	}
+	if len(creds) == 0 {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "no security key is registered on this account"})
+	}
+	allow := []webauthn.CredentialDescriptor{}
+	for _, cred := range creds {
+		allow = append(allow, descriptor(cred))
+	}
+
+	return s.beginWebAuthnCeremony(w, data.CeremonyAuthentication, acc.Uuid, func(challenge string) any {
+		return rp.RequestOptions(challenge, allow, "preferred")
+	})
+}
+
+// HandleFinishWebAuthnLogin handles POST requests completing a login with the
+// response of navigator.credentials.get(). A login started with an MFA token
+// sends the token again.
+func (s *Server) HandleFinishWebAuthnLogin(w http.ResponseWriter, r *http.Request) error {
+	req := &data.WebAuthnLoginRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	errs := s.v.Validate(req)
+	if len(errs) != 0 {
+		s.l.Println("[ERROR] validating request", errs)
+		return WriteJSON(w, http.StatusUnprocessableEntity, &ValidationErrors{Messages: errs.Errors()})
+	}
+
+	session, err := s.d.ConsumeWebAuthnSession(req.Session)
+	if err == data.ErrWebAuthnSessionNotFound || (err == nil && session.Ceremony != data.CeremonyAuthentication) {
+		return writeUnauthorized(w, "", "invalid or expired WebAuthn session")
+	}
+	if err != nil {
+		return err
+	}
+
+	res := &webauthn.AssertionResponse{}
+	if err := json.Unmarshal(req.Credential, res); err != nil {
+		return WriteJSON(w, http.StatusBadRequest, &GenericError{Message: "malformed credential"})
+	}
+	cred, err := s.d.GetWebAuthnCredential(res.ID)
+	if err == data.ErrWebAuthnCredentialNotFound {
+		return writeUnauthorized(w, "", "unknown credential")
+	}
+	if err != nil {
+		return err
+	}
+
+	// a second factor has to be a key of the account whose password was
+	// accepted, a passkey names its account with the user handle
+	secondFactor := session.AccountUuid != ""
+	var challenge *data.MFAChallenge
+	var acc *data.Account
+	if secondFactor {
+		challenge, acc, err = s.mfaChallenge(req.MFAToken)
+		if err == data.ErrMFAChallengeNotFound || (err == nil && acc.Uuid != session.AccountUuid) {
+			return writeUnauthorized(w, "", "invalid or expired MFA token")
+		}
+		if err != nil {
+			return err
+		}
+		if locked, err := s.mfaLockedOut(acc); err != nil {
+			return err
+		} else if locked {
+			return writeMFALockedOut(w)
+		}
+	} else {
+		userHandle, err := webauthn.UserHandle(res)
+		if err != nil || userHandle != cred.AccountUuid {
+			return writeUnauthorized(w, "", "unknown credential")
+		}
+		acc, err = s.d.GetAccountByField("uuid", cred.AccountUuid)
+		if err == data.ErrAccountNotFound {
+			return writeUnauthorized(w, "", "unknown credential")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if cred.AccountUuid != acc.Uuid {
+		return writeUnauthorized(w, "", "unknown credential")
+	}
+
+	assertion, err := webauthn.LoadRelyingParty().VerifyAssertion(res, session.Challenge, &webauthn.Credential{
+		ID:        cred.CredentialID,
+		PublicKey: cred.PublicKey,
+		SignCount: cred.SignCount,
+	}, !secondFactor)
+	if err == nil {
+		err = s.d.UpdateWebAuthnSignCount(cred.CredentialID, assertion.SignCount)
+	}
+	if errors.Is(err, webauthn.ErrCeremonyRejected) || err == data.ErrSignCountRegressed {
+		s.l.Printf("[ERROR] login with WebAuthn credential %s of account %s: %s\n", cred.CredentialID, acc.Uuid, err)
+		if secondFactor {
+			if err := s.failMFAChallenge(req.MFAToken, acc); err != nil {
+				return err
+			}
+		}
+		return writeUnauthorized(w, "", "invalid credential")
+	}
+	if err != nil {
+		return err
+	}
+
+	if !secondFactor {
+		return s.loginAccount(w, r, acc, req.DeviceName, passkeyAMR...)
+	}
+
+	if err := s.d.ClearMFAAttempts(acc.Uuid); err != nil {
+		return err
+	}
+
+	// the challenge completes a single login
+	if _, err := s.d.ConsumeMFAChallenge(req.MFAToken); err == data.ErrMFAChallengeNotFound {
+		return writeUnauthorized(w, "", "invalid or expired MFA token")
+	} else if err != nil {
+		return err
+	}
+	return s.loginAccount(w, r, acc, challenge.DeviceName, challengeAMR(challenge, webauthnAMR)...)
+}
+
+// beginWebAuthnCeremony starts a ceremony of the account accountUuid and
+// responds with the options options returns for its challenge
+func (s *Server) beginWebAuthnCeremony(w http.ResponseWriter, ceremony, accountUuid string, options func(string) any) error {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return err
+	}
+	token, err := util.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	session := data.NewWebAuthnSession(token, ceremony, challenge, accountUuid, time.Now().UTC().Add(webauthnSessionLifetime))
+	if err := s.d.CreateWebAuthnSession(session); err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusOK, &data.WebAuthnBeginResponse{
+		Session:   token,
+		PublicKey: options(challenge),
+		ExpiresIn: int(webauthnSessionLifetime.Seconds()),
+	})
+}
+
+func descriptor(cred *data.WebAuthnCredential) webauthn.CredentialDescriptor {
+	return webauthn.CredentialDescriptor{Type: "public-key", ID: cred.CredentialID, Transports: cred.Transports}
+}
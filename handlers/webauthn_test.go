@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/blazingly-fast/auth-assistant/webauthn/webauthntest"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// webauthnStore keeps WebAuthn credentials and ceremonies in memory
+type webauthnStore struct {
+	webauthn   map[string]*data.WebAuthnCredential
+	ceremonies map[string]*data.WebAuthnSession
+}
+
+func (st *webauthnStore) CreateWebAuthnCredential(c *data.WebAuthnCredential) error {
+	if _, ok := st.webauthn[c.CredentialID]; ok {
+		return data.ErrWebAuthnCredentialExists
+	}
+	c.CreatedOn = time.Now()
+	st.webauthn[c.CredentialID] = c
+	return nil
+}
+
+func (st *webauthnStore) GetWebAuthnCredentials(accountUuid string) ([]*data.WebAuthnCredential, error) {
+	creds := []*data.WebAuthnCredential{}
+	for _, c := range st.webauthn {
+		if c.AccountUuid == accountUuid {
+			creds = append(creds, c)
+		}
+	}
+	return creds, nil
+}
+
+func (st *webauthnStore) GetWebAuthnCredential(credentialID string) (*data.WebAuthnCredential, error) {
+	c, ok := st.webauthn[credentialID]
+	if !ok {
+		return nil, data.ErrWebAuthnCredentialNotFound
+	}
+	return c, nil
+}
+
+func (st *webauthnStore) UpdateWebAuthnSignCount(credentialID string, signCount uint32) error {
+	c, ok := st.webauthn[credentialID]
+	if !ok || (c.SignCount >= signCount && (c.SignCount != 0 || signCount != 0)) {
+		return data.ErrSignCountRegressed
+	}
+	now := time.Now()
+	c.SignCount, c.LastUsedOn = signCount, &now
+	return nil
+}
+
+func (st *webauthnStore) DeleteWebAuthnCredential(accountUuid, credentialID string) error {
+	c, ok := st.webauthn[credentialID]
+	if !ok || c.AccountUuid != accountUuid {
+		return data.ErrWebAuthnCredentialNotFound
+	}
+	delete(st.webauthn, credentialID)
+	return nil
+}
+
+func (st *webauthnStore) CreateWebAuthnSession(session *data.WebAuthnSession) error {
+	st.ceremonies[session.TokenHash] = session
+	return nil
+}
+
+func (st *webauthnStore) ConsumeWebAuthnSession(token string) (*data.WebAuthnSession, error) {
+	session, ok := st.ceremonies[util.HashToken(token)]
+	if !ok || session.ExpiresAt.Before(time.Now()) {
+		return nil, data.ErrWebAuthnSessionNotFound
+	}
+	delete(st.ceremonies, util.HashToken(token))
+	return session, nil
+}
+
+// webauthnCeremony runs the ceremony whose options rec holds with run and
+// returns the body it is finished with, extra adds fields to it
+func webauthnCeremony(t *testing.T, rec *httptest.ResponseRecorder, run func([]byte) ([]byte, error), extra string) string {
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	begin := struct {
+		Session   string          `json:"session"`
+		PublicKey json.RawMessage `json:"publicKey"`
+	}{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&begin))
+
+	credential, err := run(begin.PublicKey)
+	require.NoError(t, err)
+	return `{"session": "` + begin.Session + `", "credential": ` + string(credential) + extra + `}`
+}
+
+func TestWebAuthn(t *testing.T) {
+	store := newOAuthStore(t)
+	s := newTestServer(t, store)
+	a := webauthntest.NewAuthenticator("http://localhost:8080")
+
+	rec := passwordLogin(s)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	res := &data.AccountResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	passwordToken := res.Token
+
+	withToken := func(method string, f apiFunc, body string, vars map[string]string) *httptest.ResponseRecorder {
+		r := mux.SetURLVars(httptest.NewRequest(method, "/", strings.NewReader(body)), vars)
+		r.Header.Set("Authorization", "Bearer "+res.Token)
+		rec := httptest.NewRecorder()
+		s.Authenticate(s.MakeHTTPHandleFunc(f)).ServeHTTP(rec, r)
+		return rec
+	}
+
+	// registration
+	rec = withToken(http.MethodPost, s.HandleBeginWebAuthnRegistration, "", nil)
+	finish := webauthnCeremony(t, rec, a.Create, `, "name": "Laptop"`)
+	rec = withToken(http.MethodPost, s.HandleFinishWebAuthnRegistration, finish, nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	registration := &data.WebAuthnRegistrationResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(registration))
+	cred := registration.WebAuthnCredential
+	require.Equal(t, "Laptop", cred.Name)
+	require.Len(t, registration.RecoveryCodes, recoveryCodeCount)
+	require.Contains(t, store.webauthn[cred.CredentialID].PublicKey, "PUBLIC KEY")
+	// sessions finish a single ceremony
+	rec = withToken(http.MethodPost, s.HandleFinishWebAuthnRegistration, finish, nil)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = withToken(http.MethodGet, s.HandleGetWebAuthnCredentials, "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), cred.CredentialID)
+
+	// the key is the second factor of password logins from now on
+	rec = passwordLogin(s)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	challenge := &data.MFAChallengeResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(challenge))
+	require.Equal(t, []string{"webauthn", "recovery_code"}, challenge.Methods)
+	require.False(t, challenge.EnrollmentRequired)
+	// and the password alone does not set up another one
+	rec = postJSON(s, s.HandleMFAEnroll, `{"mfa_token": "`+challenge.MFAToken+`"}`)
+	require.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = postJSON(s, s.HandleBeginWebAuthnLogin, `{"mfa_token": "`+challenge.MFAToken+`"}`)
+	require.Contains(t, rec.Body.String(), cred.CredentialID)
+	finish = webauthnCeremony(t, rec, a.Get, `, "mfa_token": "`+challenge.MFAToken+`"`)
+	rec = postJSON(s, s.HandleFinishWebAuthnLogin, finish)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	claims, err := util.ValidateToken(res.Token)
+	require.NoError(t, err)
+	_, amr := claims.Authenticated()
+	require.Equal(t, []string{"pwd", "hwk", "mfa"}, amr)
+	require.Empty(t, store.challenges)
+
+	// a passkey signs in without a password
+	rec = postJSON(s, s.HandleBeginWebAuthnLogin, "")
+	finish = webauthnCeremony(t, rec, a.Get, "")
+	rec = postJSON(s, s.HandleFinishWebAuthnLogin, finish)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(res))
+	claims, err = util.ValidateToken(res.Token)
+	require.NoError(t, err)
+	require.Equal(t, "uuid", claims.Subject)
+	_, amr = claims.Authenticated()
+	require.Equal(t, []string{"hwk", "mfa"}, amr)
+	require.Equal(t, uint32(2), store.webauthn[cred.CredentialID].SignCount)
+
+	// but only when it verified the user
+	a.UserVerification = false
+	finish = webauthnCeremony(t, postJSON(s, s.HandleBeginWebAuthnLogin, ""), a.Get, "")
+	require.Equal(t, http.StatusUnauthorized, postJSON(s, s.HandleFinishWebAuthnLogin, finish).Code)
+	a.UserVerification = true
+
+	// a cloned key signs a counter that was seen before
+	a.SetCounter(cred.CredentialID, 0)
+	finish = webauthnCeremony(t, postJSON(s, s.HandleBeginWebAuthnLogin, ""), a.Get, "")
+	require.Equal(t, http.StatusUnauthorized, postJSON(s, s.HandleFinishWebAuthnLogin, finish).Code)
+	require.Equal(t, uint32(2), store.webauthn[cred.CredentialID].SignCount)
+
+	// removing a key takes a login with a second factor
+	mfaToken := res.Token
+	res.Token = passwordToken
+	rec = withToken(http.MethodDelete, s.HandleDeleteWebAuthnCredential, "", map[string]string{"id": cred.CredentialID})
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Contains(t, store.webauthn, cred.CredentialID)
+
+	res.Token = mfaToken
+	rec = withToken(http.MethodDelete, s.HandleDeleteWebAuthnCredential, "", map[string]string{"id": cred.CredentialID})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Empty(t, store.webauthn)
+	require.Empty(t, store.recoveryCodes)
+	require.Equal(t, http.StatusOK, passwordLogin(s).Code)
+}
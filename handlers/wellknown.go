@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// OpenIDConfiguration defines the OpenID Connect discovery document
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	RegistrationEndpoint              string   `json:"registration_endpoint,omitempty"`
+	JwksURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// HandleJWKS handles GET requests for the public keys tokens can be verified with
+func (s *Server) HandleJWKS(w http.ResponseWriter, r *http.Request) error {
+	ks, err := util.CurrentKeySet()
+	if err != nil {
+		return err
+	}
+
+	jwks, err := util.NewJWKS(ks)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=900")
+	return WriteJSON(w, http.StatusOK, jwks)
+}
+
+// HandleOpenIDConfiguration handles GET requests for the discovery document
+func (s *Server) HandleOpenIDConfiguration(w http.ResponseWriter, r *http.Request) error {
+	ks, err := util.CurrentKeySet()
+	if err != nil {
+		return err
+	}
+
+	algs := []string{}
+	seen := map[string]bool{}
+	for _, k := range ks.Keys() {
+		if seen[k.Algorithm] {
+			continue
+		}
+		seen[k.Algorithm] = true
+		algs = append(algs, k.Algorithm)
+	}
+
+	issuer := util.Issuer()
+	cfg := &OpenIDConfiguration{
+		Issuer:                      issuer,
+		AuthorizationEndpoint:       issuer + "/authorize",
+		TokenEndpoint:               issuer + "/token",
+		DeviceAuthorizationEndpoint: issuer + "/device_authorization",
+		IntrospectionEndpoint:       issuer + "/introspect",
+		RevocationEndpoint:          issuer + "/revoke",
+		UserInfoEndpoint:            issuer + "/userinfo",
+		JwksURI:                     issuer + "/.well-known/jwks.json",
+		ScopesSupported:             strings.Fields(util.DefaultScope()),
+		ResponseTypesSupported:      []string{"code"},
+		GrantTypesSupported: []string{
+			data.GrantAuthorizationCode,
+			data.GrantRefreshToken,
+			data.GrantClientCredentials,
+			data.GrantDeviceCode,
+			data.GrantTokenExchange,
+			data.GrantJWTBearer,
+		},
+		CodeChallengeMethodsSupported: []string{"S256"},
+		TokenEndpointAuthMethodsSupported: []string{
+			data.AuthMethodClientSecretBasic,
+			data.AuthMethodClientSecretPost,
+			data.AuthMethodNone,
+		},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: algs,
+		ClaimsSupported:                  supportedClaims(),
+	}
+
+	if os.Getenv("REGISTRATION_ACCESS_TOKEN") != "" {
+		cfg.RegistrationEndpoint = issuer + "/oauth/register"
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=900")
+	return WriteJSON(w, http.StatusOK, cfg)
+}
+
+// supportedClaims lists the claims ID tokens and the userinfo endpoint can
+// carry, for the scopes that are offered
+func supportedClaims() []string {
+	claims := []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "amr", "azp"}
+	for _, scope := range strings.Fields(util.DefaultScope()) {
+		claims = append(claims, util.ScopeClaims[scope]...)
+	}
+	return claims
+}
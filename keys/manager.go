@@ -0,0 +1,240 @@
+package keys
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// Manager keeps the token signing keys in the database and rotates them.
+// Every instance reloads the keys on its own, so a rotation done by one
+// instance, the admin endpoint or the rotate-keys command reaches all of them.
+type Manager struct {
+	l         *log.Logger
+	d         data.SigningKeyStorer
+	algorithm string
+	rotation  time.Duration
+	reload    time.Duration
+}
+
+// NewManager returns a manager configured from the environment.
+// KEY_ALGORITHM picks the algorithm of new keys, KEY_ROTATION_INTERVAL how
+// long a key stays active and KEY_RELOAD_INTERVAL how often keys are reloaded.
+func NewManager(l *log.Logger, d data.SigningKeyStorer) (*Manager, error) {
+	rotation, err := util.GetEnvDuration("KEY_ROTATION_INTERVAL", 720*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	reload, err := util.GetEnvDuration("KEY_RELOAD_INTERVAL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Manager{
+		l:         l,
+		d:         d,
+		algorithm: util.GetEnv("KEY_ALGORITHM", "RS256"),
+		rotation:  rotation,
+		reload:    reload,
+	}, nil
+}
+
+// Init makes sure there is an active and a next key and loads them. The first
+// active key is imported from PRIVATE_KEY when it is set.
+func (m *Manager) Init() error {
+	var active *util.Key
+	var err error
+	if os.Getenv("PRIVATE_KEY") != "" {
+		ks, err := util.LoadKeySet()
+		if err != nil {
+			return err
+		}
+		active = ks.SigningKey()
+	} else {
+		active, err = util.GenerateKey(m.algorithm)
+		if err != nil {
+			return err
+		}
+	}
+
+	next, err := util.GenerateKey(m.algorithm)
+	if err != nil {
+		return err
+	}
+
+	activeKey, err := toSigningKey(active, data.KeyStateActive)
+	if err != nil {
+		return err
+	}
+	nextKey, err := toSigningKey(next, data.KeyStateNext)
+	if err != nil {
+		return err
+	}
+
+	if err := m.d.EnsureSigningKeys(activeKey, nextKey); err != nil {
+		return err
+	}
+
+	_, err = m.Load()
+	return err
+}
+
+// Load reads the keys from the database and hands them to util, it returns the
+// active key
+func (m *Manager) Load() (*data.SigningKey, error) {
+	stored, err := m.d.GetSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var active *data.SigningKey
+	var signing *util.Key
+	verification := []*util.Key{}
+	for _, sk := range stored {
+		if sk.State == data.KeyStateActive {
+			signing, err = fromSigningKey(sk)
+			if err != nil {
+				return nil, err
+			}
+			active = sk
+			continue
+		}
+
+		key, err := fromVerificationKey(sk)
+		if err != nil {
+			return nil, err
+		}
+		verification = append(verification, key)
+	}
+	if signing == nil {
+		return nil, fmt.Errorf("no active signing key")
+	}
+
+	util.SetKeySet(util.NewKeySet(signing, verification...))
+	return active, nil
+}
+
+// Rotate activates the next key right away. The replaced key keeps verifying
+// tokens until the last of them expires, unless it is compromised, in which
+// case tokens signed with it are rejected immediately.
+func (m *Manager) Rotate(compromised bool) error {
+	active, err := m.Load()
+	if err != nil {
+		return err
+	}
+	return m.rotate(active, compromised)
+}
+
+func (m *Manager) rotate(active *data.SigningKey, compromised bool) error {
+	key, err := util.GenerateKey(m.algorithm)
+	if err != nil {
+		return err
+	}
+	next, err := toSigningKey(key, data.KeyStateNext)
+	if err != nil {
+		return err
+	}
+
+	retiredUntil := time.Now().UTC().Add(util.RefreshTokenLifetime)
+	if compromised {
+		retiredUntil = time.Now().UTC()
+	}
+
+	err = m.d.RotateSigningKeys(active.Kid, next, retiredUntil)
+	if err == data.ErrSigningKeyRotated {
+		// another instance got there first
+		_, err = m.Load()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	m.l.Printf("rotated signing key %s, compromised: %t\n", active.Kid, compromised)
+	_, err = m.Load()
+	return err
+}
+
+// Run reloads the keys, rotates the active key once it is older than the
+// rotation interval and removes expired keys until ctx is done
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.reload)
+	defer ticker.Stop()
+
+	for {
+		if err := m.tick(); err != nil {
+			m.l.Println("[ERROR] managing signing keys", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) tick() error {
+	active, err := m.Load()
+	if err != nil {
+		return err
+	}
+
+	if active.ActivatedOn != nil && time.Since(*active.ActivatedOn) >= m.rotation {
+		if err := m.rotate(active, false); err != nil {
+			return err
+		}
+	}
+
+	return m.d.DeleteExpiredSigningKeys()
+}
+
+func toSigningKey(key *util.Key, state string) (*data.SigningKey, error) {
+	private, err := util.MarshalPrivateKeyPEM(key.Private)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := util.Encrypt(private)
+	if err != nil {
+		return nil, err
+	}
+	public, err := util.MarshalPublicKeyPEM(key.Public)
+	if err != nil {
+		return nil, err
+	}
+
+	return data.NewSigningKey(key.ID, key.Algorithm, encrypted, string(public), state), nil
+}
+
+func fromSigningKey(sk *data.SigningKey) (*util.Key, error) {
+	private, err := util.Decrypt(sk.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting signing key %s: %w", sk.Kid, err)
+	}
+	parsed, err := util.ParsePrivateKeyPEM(private)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := util.NewKey(sk.Kid, parsed)
+	if err != nil {
+		return nil, err
+	}
+	if key.Algorithm != sk.Algorithm {
+		return nil, fmt.Errorf("signing key %s is not a %s key", sk.Kid, sk.Algorithm)
+	}
+	return key, nil
+}
+
+func fromVerificationKey(sk *data.SigningKey) (*util.Key, error) {
+	public, err := util.ParsePublicKeyPEM([]byte(sk.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	return util.NewVerificationKey(sk.Kid, public)
+}
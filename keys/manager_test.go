@@ -0,0 +1,153 @@
+package keys
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryStore keeps signing keys in memory the way PostgresStore does
+type memoryStore struct {
+	keys []*data.SigningKey
+}
+
+func (m *memoryStore) GetSigningKeys() ([]*data.SigningKey, error) {
+	keys := []*data.SigningKey{}
+	for _, k := range m.keys {
+		if k.State != data.KeyStateRetired || k.ExpiresAt.After(time.Now()) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (m *memoryStore) EnsureSigningKeys(active, next *data.SigningKey) error {
+	for _, key := range []*data.SigningKey{active, next} {
+		if m.find(key.State) == nil {
+			if key.State == data.KeyStateActive {
+				now := time.Now()
+				key.ActivatedOn = &now
+			}
+			m.keys = append(m.keys, key)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) RotateSigningKeys(activeKid string, next *data.SigningKey, retiredUntil time.Time) error {
+	active := m.find(data.KeyStateActive)
+	if active == nil || active.Kid != activeKid {
+		return data.ErrSigningKeyRotated
+	}
+	now := time.Now()
+	active.State = data.KeyStateRetired
+	active.RetiredOn = &now
+	active.ExpiresAt = &retiredUntil
+
+	pending := m.find(data.KeyStateNext)
+	pending.State = data.KeyStateActive
+	pending.ActivatedOn = &now
+
+	next.State = data.KeyStateNext
+	m.keys = append(m.keys, next)
+	return nil
+}
+
+func (m *memoryStore) DeleteExpiredSigningKeys() error {
+	m.keys, _ = m.GetSigningKeys()
+	return nil
+}
+
+func (m *memoryStore) find(state string) *data.SigningKey {
+	for _, k := range m.keys {
+		if k.State == state {
+			return k
+		}
+	}
+	return nil
+}
+
+func newTestManager(t *testing.T) (*Manager, *memoryStore) {
+	os.Setenv("ENCRYPTION_KEY", "test_encryption_key")
+	os.Setenv("KEY_ALGORITHM", "ES256")
+	t.Cleanup(func() {
+		os.Unsetenv("KEY_ALGORITHM")
+		util.SetKeySet(nil)
+	})
+
+	store := &memoryStore{}
+	m, err := NewManager(log.New(io.Discard, "", 0), store)
+	require.NoError(t, err)
+	require.NoError(t, m.Init())
+
+	return m, store
+}
+
+func TestInitStoresActiveAndNextKey(t *testing.T) {
+	m, store := newTestManager(t)
+
+	active := store.find(data.KeyStateActive)
+	next := store.find(data.KeyStateNext)
+	require.NotNil(t, active)
+	require.NotNil(t, next)
+	require.NotContains(t, active.PrivateKey, "PRIVATE KEY")
+
+	ks, err := util.CurrentKeySet()
+	require.NoError(t, err)
+	require.Equal(t, active.Kid, ks.SigningKey().ID)
+	_, ok := ks.Key(next.Kid)
+	require.True(t, ok)
+
+	// a second instance keeps the keys of the first
+	require.NoError(t, m.Init())
+	require.Len(t, store.keys, 2)
+}
+
+func TestRotateKeepsRetiredKeyUntilTokensExpire(t *testing.T) {
+	m, store := newTestManager(t)
+
+	token, _, err := util.GenerateAllToken(util.NewClaimsBuilder("uuid").WithRoles("USER").WithSession("sid").Claims())
+	require.NoError(t, err)
+	next := store.find(data.KeyStateNext)
+
+	require.NoError(t, m.Rotate(false))
+
+	ks, err := util.CurrentKeySet()
+	require.NoError(t, err)
+	require.Equal(t, next.Kid, ks.SigningKey().ID)
+
+	_, err = util.ValidateToken(token)
+	require.NoError(t, err)
+}
+
+func TestRotateCompromisedKeyRejectsItsTokens(t *testing.T) {
+	m, _ := newTestManager(t)
+
+	token, _, err := util.GenerateAllToken(util.NewClaimsBuilder("uuid").WithRoles("USER").WithSession("sid").Claims())
+	require.NoError(t, err)
+
+	require.NoError(t, m.Rotate(true))
+
+	_, err = util.ValidateToken(token)
+	require.Error(t, err)
+}
+
+func TestTickRotatesOnSchedule(t *testing.T) {
+	m, store := newTestManager(t)
+
+	active := store.find(data.KeyStateActive)
+	require.NoError(t, m.tick())
+	require.Equal(t, active.Kid, store.find(data.KeyStateActive).Kid)
+
+	activated := time.Now().Add(-m.rotation)
+	active.ActivatedOn = &activated
+	require.NoError(t, m.tick())
+	require.NotEqual(t, active.Kid, store.find(data.KeyStateActive).Kid)
+	require.Equal(t, data.KeyStateRetired, active.State)
+}
@@ -0,0 +1,117 @@
+// Package mailer sends the emails of the service, such as one time codes,
+// through an SMTP server
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+)
+
+// Mailer sends plain text emails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer sends emails through the SMTP server at Addr, authenticating
+// with Auth unless it is nil
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// NewSMTPMailer returns a mailer for the server at host:port, with PLAIN
+// authentication when username is set
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	m := &SMTPMailer{Addr: net.JoinHostPort(host, port), From: from}
+	if username != "" {
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+
+	msg := strings.Join([]string{
+		"From: " + m.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg))
+}
+
+// LogMailer writes emails to a log instead of sending them, for development
+type LogMailer struct {
+	L *log.Logger
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	m.L.Printf("email to %s: %s\n%s\n", to, subject, body)
+	return nil
+}
+
+var (
+	mailerMu sync.RWMutex
+	mailer   Mailer
+)
+
+// Set replaces the mailer emails are sent with
+func Set(m Mailer) {
+	mailerMu.Lock()
+	defer mailerMu.Unlock()
+	mailer = m
+}
+
+// Send sends an email with the mailer that was set, loading it from the
+// environment on first use
+func Send(to, subject, body string) error {
+	mailerMu.RLock()
+	m := mailer
+	mailerMu.RUnlock()
+
+	if m == nil {
+		var err error
+		if m, err = Load(); err != nil {
+			return err
+		}
+		Set(m)
+	}
+	return m.Send(to, subject, body)
+}
+
+// Load returns the mailer configured with SMTP_HOST, SMTP_PORT (587),
+// SMTP_USERNAME, SMTP_PASSWORD and MAIL_FROM. Emails carry working sign in
+// codes and links, so they are only logged instead when MAIL_LOG is true, for
+// development; without either Load fails.
+func Load() (Mailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		if os.Getenv("MAIL_LOG") != "true" {
+			return nil, fmt.Errorf("SMTP_HOST is not set, set MAIL_LOG to true to log emails in development")
+		}
+		return &LogMailer{L: log.New(os.Stdout, " mailer ", log.LstdFlags)}, nil
+	}
+
+	return NewSMTPMailer(
+		host,
+		util.GetEnv("SMTP_PORT", "587"),
+		os.Getenv("SMTP_USERNAME"),
+		os.Getenv("SMTP_PASSWORD"),
+		util.GetEnv("MAIL_FROM", "no-reply@"+host)), nil
+}
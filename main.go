@@ -10,6 +10,9 @@ import (
 
 	"github.com/blazingly-fast/auth-assistant/data"
 	"github.com/blazingly-fast/auth-assistant/handlers"
+	"github.com/blazingly-fast/auth-assistant/keys"
+	"github.com/blazingly-fast/auth-assistant/mailer"
+	"github.com/blazingly-fast/auth-assistant/util"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
@@ -24,6 +27,16 @@ func main() {
 	if err != nil {
 		l.Fatal("Error loading .env file")
 	}
+	if err := util.CheckConfig(); err != nil {
+		l.Fatal(err)
+	}
+
+	// emails carry sign in codes, they are never logged by accident
+	m, err := mailer.Load()
+	if err != nil {
+		l.Fatal(err)
+	}
+	mailer.Set(m)
 
 	// create connection
 	store, err := data.NewPostgresStore()
@@ -36,8 +49,33 @@ func main() {
 		l.Fatal(err)
 	}
 
+	// load the keys tokens are signed and verified with
+	km, err := keys.NewManager(l, store)
+	if err != nil {
+		l.Fatal(err)
+	}
+	if err := km.Init(); err != nil {
+		l.Fatal(err)
+	}
+
+	// run a one-off command instead of the server
+	if len(os.Args) > 1 {
+		if err := runCommand(km, os.Args[1:]); err != nil {
+			l.Fatal(err)
+		}
+		return
+	}
+
+	// keep rotating the signing keys in the background
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go km.Run(ctx)
+
+	// remove expired tokens from the database in the background
+	go prune(ctx, l, store, time.Hour)
+
 	// create the handlers
-	h := handlers.NewServer(l, v, store)
+	h := handlers.NewServer(l, v, store, km)
 
 	// create a new serve mux and register the handlers
 	r := mux.NewRouter()
@@ -46,13 +84,68 @@ func main() {
 	postR := r.Methods(http.MethodPost).Subrouter()
 	postR.HandleFunc("/register", h.MakeHTTPHandleFunc(h.HandleCreateAccount))
 	postR.HandleFunc("/login", h.MakeHTTPHandleFunc(h.HandleLogin))
+	postR.HandleFunc("/login/mfa", h.MakeHTTPHandleFunc(h.HandleMFALogin))
+	postR.HandleFunc("/login/mfa/enroll", h.MakeHTTPHandleFunc(h.HandleMFAEnroll))
+	postR.HandleFunc("/login/mfa/recovery", h.MakeHTTPHandleFunc(h.HandleRecoveryLogin))
+	postR.HandleFunc("/login/mfa/email", h.MakeHTTPHandleFunc(h.HandleMFAEmailLogin))
+	postR.HandleFunc("/login/mfa/email/send", h.MakeHTTPHandleFunc(h.HandleSendMFAEmail))
+	postR.HandleFunc("/login/email", h.MakeHTTPHandleFunc(h.HandleEmailLogin))
+	postR.HandleFunc("/login/email/verify", h.MakeHTTPHandleFunc(h.HandleVerifyEmailLogin))
+	postR.HandleFunc("/login/magic-link", h.MakeHTTPHandleFunc(h.HandleMagicLink))
+	postR.HandleFunc("/login/webauthn/begin", h.MakeHTTPHandleFunc(h.HandleBeginWebAuthnLogin))
+	postR.HandleFunc("/login/webauthn/finish", h.MakeHTTPHandleFunc(h.HandleFinishWebAuthnLogin))
+	postR.HandleFunc("/refresh", h.MakeHTTPHandleFunc(h.HandleRefresh))
+	postR.HandleFunc("/authorize", h.MakeHTTPHandleFunc(h.HandleAuthorizeLogin))
+	postR.HandleFunc("/authorize/consent", h.MakeHTTPHandleFunc(h.HandleAuthorizeConsent))
+	postR.HandleFunc("/token", h.MakeHTTPHandleFunc(h.HandleToken))
+	postR.HandleFunc("/introspect", h.MakeHTTPHandleFunc(h.HandleIntrospect))
+	postR.HandleFunc("/revoke", h.MakeHTTPHandleFunc(h.HandleRevoke))
+	postR.HandleFunc("/device_authorization", h.MakeHTTPHandleFunc(h.HandleDeviceAuthorization))
+	postR.HandleFunc("/device", h.MakeHTTPHandleFunc(h.HandleDeviceApproval))
+	postR.HandleFunc("/oauth/register", h.MakeHTTPHandleFunc(h.HandleRegisterClient))
+	postR.HandleFunc("/saml/{tenant}/acs", h.MakeHTTPHandleFunc(h.HandleSAMLACS))
+
+	wellKnownR := r.Methods(http.MethodGet).Subrouter()
+	wellKnownR.HandleFunc("/.well-known/jwks.json", h.MakeHTTPHandleFunc(h.HandleJWKS))
+	wellKnownR.HandleFunc("/.well-known/openid-configuration", h.MakeHTTPHandleFunc(h.HandleOpenIDConfiguration))
+
+	oauthR := r.Methods(http.MethodGet).Subrouter()
+	oauthR.HandleFunc("/authorize", h.MakeHTTPHandleFunc(h.HandleAuthorize))
+	oauthR.HandleFunc("/device", h.MakeHTTPHandleFunc(h.HandleDevice))
+	oauthR.HandleFunc("/login/magic-link/callback", h.MakeHTTPHandleFunc(h.HandleMagicLinkCallback))
+	oauthR.HandleFunc("/federation/{provider}/login", h.MakeHTTPHandleFunc(h.HandleFederatedLogin))
+	oauthR.HandleFunc("/federation/{provider}/link", h.MakeHTTPHandleFunc(h.HandleFederatedLink))
+	oauthR.HandleFunc("/federation/{provider}/callback", h.MakeHTTPHandleFunc(h.HandleFederationCallback))
+	oauthR.HandleFunc("/saml/{tenant}/metadata", h.MakeHTTPHandleFunc(h.HandleSAMLMetadata))
+	oauthR.HandleFunc("/saml/{tenant}/login", h.MakeHTTPHandleFunc(h.HandleSAMLLogin))
 
 	imageR := r.Methods(http.MethodPost).Subrouter()
 	imageR.HandleFunc("/avatar", h.MakeHTTPHandleFunc(h.HandleAvatar))
 	imageR.Use(h.Authenticate)
 
+	authPostR := r.Methods(http.MethodPost).Subrouter()
+	authPostR.HandleFunc("/logout", h.MakeHTTPHandleFunc(h.HandleLogout))
+	authPostR.HandleFunc("/mfa/totp", h.MakeHTTPHandleFunc(h.HandleEnrollTOTP))
+	authPostR.HandleFunc("/mfa/totp/confirm", h.MakeHTTPHandleFunc(h.HandleConfirmTOTP))
+	authPostR.HandleFunc("/mfa/recovery-codes", h.MakeHTTPHandleFunc(h.HandleRegenerateRecoveryCodes))
+	authPostR.HandleFunc("/mfa/email", h.MakeHTTPHandleFunc(h.HandleEnrollEmailMFA))
+	authPostR.HandleFunc("/mfa/email/confirm", h.MakeHTTPHandleFunc(h.HandleConfirmEmailMFA))
+	authPostR.HandleFunc("/webauthn/register/begin", h.MakeHTTPHandleFunc(h.HandleBeginWebAuthnRegistration))
+	authPostR.HandleFunc("/webauthn/register/finish", h.MakeHTTPHandleFunc(h.HandleFinishWebAuthnRegistration))
+	authPostR.Use(h.Authenticate)
+
 	getR := r.Methods(http.MethodGet).Subrouter()
 	getR.HandleFunc("/account/{uuid}", h.MakeHTTPHandleFunc(h.HandleGetAccountByID))
+	getR.HandleFunc("/account/{uuid}/sessions", h.MakeHTTPHandleFunc(h.HandleGetAccountSessions))
+	getR.HandleFunc("/sessions", h.MakeHTTPHandleFunc(h.HandleGetSessions))
+	getR.HandleFunc("/userinfo", h.MakeHTTPHandleFunc(h.HandleUserInfo))
+	getR.HandleFunc("/identities", h.MakeHTTPHandleFunc(h.HandleGetIdentities))
+	getR.HandleFunc("/mfa", h.MakeHTTPHandleFunc(h.HandleGetMFA))
+	getR.HandleFunc("/webauthn/credentials", h.MakeHTTPHandleFunc(h.HandleGetWebAuthnCredentials))
+	getR.HandleFunc("/admin/clients", h.MakeHTTPHandleFunc(h.HandleGetClients))
+	getR.HandleFunc("/admin/clients/{client_id}", h.MakeHTTPHandleFunc(h.HandleGetClient))
+	getR.HandleFunc("/admin/saml/providers", h.MakeHTTPHandleFunc(h.HandleGetSAMLProviders))
+	getR.HandleFunc("/admin/saml/providers/{tenant}", h.MakeHTTPHandleFunc(h.HandleGetSAMLProvider))
 	getR.Use(h.Authenticate)
 
 	paginateR := r.Methods(http.MethodGet).Subrouter()
@@ -61,10 +154,29 @@ func main() {
 
 	deleteR := r.Methods(http.MethodDelete).Subrouter()
 	deleteR.HandleFunc("/account/{uuid}", h.MakeHTTPHandleFunc(h.HandleDeleteAccount))
+	deleteR.HandleFunc("/account/{uuid}/sessions", h.MakeHTTPHandleFunc(h.HandleRevokeAccountSessions))
+	deleteR.HandleFunc("/account/{uuid}/sessions/{id}", h.MakeHTTPHandleFunc(h.HandleRevokeAccountSession))
+	deleteR.HandleFunc("/sessions", h.MakeHTTPHandleFunc(h.HandleRevokeOtherSessions))
+	deleteR.HandleFunc("/sessions/{id}", h.MakeHTTPHandleFunc(h.HandleRevokeSession))
+	deleteR.HandleFunc("/identities/{provider}/{subject}", h.MakeHTTPHandleFunc(h.HandleUnlinkIdentity))
+	deleteR.HandleFunc("/mfa/totp", h.MakeHTTPHandleFunc(h.HandleDisableTOTP))
+	deleteR.HandleFunc("/mfa/email", h.MakeHTTPHandleFunc(h.HandleDisableEmailMFA))
+	deleteR.HandleFunc("/webauthn/credentials/{id}", h.MakeHTTPHandleFunc(h.HandleDeleteWebAuthnCredential))
+	deleteR.HandleFunc("/admin/clients/{client_id}", h.MakeHTTPHandleFunc(h.HandleDeleteClient))
+	deleteR.HandleFunc("/admin/saml/providers/{tenant}", h.MakeHTTPHandleFunc(h.HandleDeleteSAMLProvider))
 	deleteR.Use(h.Authenticate)
 
+	adminR := r.Methods(http.MethodPost).PathPrefix("/admin").Subrouter()
+	adminR.HandleFunc("/keys/rotate", h.MakeHTTPHandleFunc(h.HandleRotateKeys))
+	adminR.HandleFunc("/clients", h.MakeHTTPHandleFunc(h.HandleCreateClient))
+	adminR.HandleFunc("/clients/{client_id}/secret", h.MakeHTTPHandleFunc(h.HandleResetClientSecret))
+	adminR.HandleFunc("/saml/providers", h.MakeHTTPHandleFunc(h.HandleCreateSAMLProvider))
+	adminR.Use(h.Authenticate)
+
 	putR := r.Methods(http.MethodPut).Subrouter()
 	putR.HandleFunc("/account/{uuid}", h.MakeHTTPHandleFunc(h.HandleUpdateAccount))
+	putR.HandleFunc("/admin/clients/{client_id}", h.MakeHTTPHandleFunc(h.HandleUpdateClient))
+	putR.HandleFunc("/admin/saml/providers/{tenant}", h.MakeHTTPHandleFunc(h.HandleUpdateSAMLProvider))
 	putR.Use(h.Authenticate)
 
 	// create a new server
@@ -98,6 +210,7 @@ func main() {
 	log.Println("Got signal:", sig)
 
 	// gracefully shutdown the server, waiting max 30 seconds for current operations to complete
-	ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 	s.Shutdown(ctx)
 }
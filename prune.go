@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/blazingly-fast/auth-assistant/data"
+)
+
+// prune deletes expired rows every interval until ctx is done
+func prune(ctx context.Context, l *log.Logger, p data.Pruner, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		if err := p.DeleteExpired(); err != nil {
+			l.Println("[ERROR] deleting expired rows", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
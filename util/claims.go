@@ -0,0 +1,296 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// SignedDetails are the claims of an access token. They hold what services
+// need to authorize a request and no personal data, which would go stale as
+// soon as the profile changes. Extra holds the profile claims configured with
+// TOKEN_CLAIMS, they are written at the top level of the token.
+type SignedDetails struct {
+	Roles     []string               `json:"roles,omitempty"`
+	Scope     string                 `json:"scope,omitempty"`
+	Tenant    string                 `json:"tenant,omitempty"`
+	SessionID string                 `json:"sid,omitempty"`
+	ClientID  string                 `json:"client_id,omitempty"`
+	AuthTime  int64                  `json:"auth_time,omitempty"`
+	AMR       []string               `json:"amr,omitempty"`
+	Actor     *Actor                 `json:"act,omitempty"`
+	Extra     map[string]interface{} `json:"-"`
+	jwt.StandardClaims
+}
+
+// claimNames are the claims SignedDetails has fields for, an extra claim can
+// never replace one of them
+var claimNames = map[string]bool{
+	"roles": true, "scope": true, "tenant": true, "sid": true, "client_id": true, "auth_time": true, "amr": true, "act": true,
+	"aud": true, "exp": true, "jti": true, "iat": true, "iss": true, "nbf": true, "sub": true,
+}
+
+// Actor is the party acting on behalf of the subject of a token it got through
+// token exchange. A chain of delegations nests the earlier actors.
+type Actor struct {
+	Subject string `json:"sub"`
+	Actor   *Actor `json:"act,omitempty"`
+}
+
+func (c SignedDetails) MarshalJSON() ([]byte, error) {
+	type claims SignedDetails
+	b, err := json.Marshal(claims(c))
+	if err != nil || len(c.Extra) == 0 {
+		return b, err
+	}
+
+	all := map[string]interface{}{}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	for name, value := range c.Extra {
+		if !claimNames[name] {
+			all[name] = value
+		}
+	}
+	return json.Marshal(all)
+}
+
+func (c *SignedDetails) UnmarshalJSON(b []byte) error {
+	type claims SignedDetails
+	if err := json.Unmarshal(b, (*claims)(c)); err != nil {
+		return err
+	}
+
+	all := map[string]interface{}{}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return err
+	}
+	c.Extra = nil
+	for name, value := range all {
+		if claimNames[name] {
+			continue
+		}
+		if c.Extra == nil {
+			c.Extra = map[string]interface{}{}
+		}
+		c.Extra[name] = value
+	}
+	return nil
+}
+
+// HasRole reports whether role is one of the roles of the subject
+func (c *SignedDetails) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Service reports whether the token was issued to a service principal rather
+// than an account
+func (c *SignedDetails) Service() bool {
+	return c.ClientID != "" && c.Subject == c.ClientID && c.HasRole(ServiceRole)
+}
+
+// Authenticated returns when and how the subject authenticated. Tokens issued
+// before that was recorded fall back to when they were issued.
+func (c *SignedDetails) Authenticated() (int64, []string) {
+	if c.AuthTime == 0 {
+		return c.IssuedAt, c.AMR
+	}
+	return c.AuthTime, c.AMR
+}
+
+// AuthenticatedWith reports whether method is one of the methods the subject
+// authenticated with
+func (c *SignedDetails) AuthenticatedWith(method string) bool {
+	for _, m := range c.AMR {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// UserType returns the account type the roles of the subject stand for
+func (c *SignedDetails) UserType() string {
+	if c.HasRole("ADMIN") {
+		return "ADMIN"
+	}
+	if len(c.Roles) == 0 {
+		return ""
+	}
+	return c.Roles[0]
+}
+
+// ClaimsBuilder builds the claims of an access token, the registered claims
+// are added when the token is signed
+type ClaimsBuilder struct {
+	claims *SignedDetails
+}
+
+// NewClaimsBuilder starts the claims of a token for subject, in the tenant set
+// by TENANT
+func NewClaimsBuilder(subject string) *ClaimsBuilder {
+	return &ClaimsBuilder{claims: &SignedDetails{
+		Tenant:         Tenant(),
+		StandardClaims: jwt.StandardClaims{Subject: subject},
+	}}
+}
+
+func (b *ClaimsBuilder) WithRoles(roles ...string) *ClaimsBuilder {
+	b.claims.Roles = append(b.claims.Roles, roles...)
+	return b
+}
+
+// WithScope sets the space separated scopes the token grants
+func (b *ClaimsBuilder) WithScope(scope string) *ClaimsBuilder {
+	b.claims.Scope = scope
+	return b
+}
+
+func (b *ClaimsBuilder) WithTenant(tenant string) *ClaimsBuilder {
+	b.claims.Tenant = tenant
+	return b
+}
+
+// WithSession ties the token to a session, so ending the session revokes it
+func (b *ClaimsBuilder) WithSession(sessionID string) *ClaimsBuilder {
+	b.claims.SessionID = sessionID
+	return b
+}
+
+// WithAuthentication records when and with which methods, e.g. "pwd", the
+// account authenticated
+func (b *ClaimsBuilder) WithAuthentication(authTime int64, amr ...string) *ClaimsBuilder {
+	b.claims.AuthTime = authTime
+	b.claims.AMR = amr
+	return b
+}
+
+// WithClient names the OAuth client the token is issued to
+func (b *ClaimsBuilder) WithClient(clientID string) *ClaimsBuilder {
+	b.claims.ClientID = clientID
+	return b
+}
+
+// WithAudience restricts the token to a single audience instead of the first
+// of JWT_AUDIENCE
+func (b *ClaimsBuilder) WithAudience(audience string) *ClaimsBuilder {
+	b.claims.Audience = audience
+	return b
+}
+
+// WithActor names the party acting on behalf of the subject, prior is whoever
+// was acting before, if anyone
+func (b *ClaimsBuilder) WithActor(subject string, prior *Actor) *ClaimsBuilder {
+	b.claims.Actor = &Actor{Subject: subject, Actor: prior}
+	return b
+}
+
+// WithProfile adds the attributes of profile that TOKEN_CLAIMS maps to claims,
+// every other attribute is left out of the token
+func (b *ClaimsBuilder) WithProfile(profile map[string]interface{}) *ClaimsBuilder {
+	for claim, attribute := range ProfileClaims() {
+		value, ok := profile[attribute]
+		if !ok || claimNames[claim] {
+			continue
+		}
+		if b.claims.Extra == nil {
+			b.claims.Extra = map[string]interface{}{}
+		}
+		b.claims.Extra[claim] = value
+	}
+	return b
+}
+
+func (b *ClaimsBuilder) Claims() *SignedDetails {
+	return b.claims
+}
+
+var ErrTokenMalformed = fmt.Errorf("Token is malformed")
+var ErrTokenSignature = fmt.Errorf("Token signature is invalid")
+var ErrTokenType = fmt.Errorf("Token type is invalid")
+var ErrTokenExpired = fmt.Errorf("Token is expired")
+var ErrTokenNotValidYet = fmt.Errorf("Token is not valid yet")
+var ErrTokenIssuer = fmt.Errorf("Token issuer is invalid")
+var ErrTokenAudience = fmt.Errorf("Token audience is invalid")
+var ErrTokenRevoked = fmt.Errorf("Token has been revoked")
+
+// TokenError reports why a token was rejected. Reason is one of the ErrToken
+// errors above, so errors.Is can tell the failures apart.
+type TokenError struct {
+	Reason error
+	Err    error
+}
+
+func (e *TokenError) Error() string {
+	if e.Err == nil {
+		return e.Reason.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Reason, e.Err)
+}
+
+func (e *TokenError) Unwrap() error {
+	return e.Reason
+}
+
+// parseError turns an error of the jwt parser into a *TokenError, unless the
+// token could not be checked for reasons unrelated to the token itself
+func parseError(err error) error {
+	var ve *jwt.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+
+	var te *TokenError
+	if errors.As(ve.Inner, &te) {
+		return te
+	}
+
+	switch {
+	case ve.Errors&jwt.ValidationErrorMalformed != 0:
+		return &TokenError{Reason: ErrTokenMalformed, Err: ve.Inner}
+	case ve.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return &TokenError{Reason: ErrTokenSignature, Err: ve.Inner}
+	case ve.Errors&jwt.ValidationErrorUnverifiable != 0 && ve.Inner != nil:
+		return ve.Inner
+	}
+	return &TokenError{Reason: ErrTokenMalformed, Err: err}
+}
+
+// validateClaims checks the registered claims of a token meant for one of
+// audiences against now, allowing JWT_CLOCK_SKEW of difference between our
+// clock and the issuer's
+func validateClaims(c *jwt.StandardClaims, now time.Time, audiences []string) error {
+	skew := ClockSkew()
+
+	if c.ExpiresAt == 0 || c.Subject == "" || c.Id == "" {
+		return &TokenError{Reason: ErrTokenMalformed, Err: fmt.Errorf("missing exp, sub or jti")}
+	}
+	if now.Unix() > c.ExpiresAt+int64(skew.Seconds()) {
+		return &TokenError{Reason: ErrTokenExpired}
+	}
+	if c.NotBefore != 0 && now.Unix() < c.NotBefore-int64(skew.Seconds()) {
+		return &TokenError{Reason: ErrTokenNotValidYet}
+	}
+	if c.IssuedAt != 0 && now.Unix() < c.IssuedAt-int64(skew.Seconds()) {
+		return &TokenError{Reason: ErrTokenNotValidYet, Err: fmt.Errorf("issued in the future")}
+	}
+	if c.Issuer != Issuer() {
+		return &TokenError{Reason: ErrTokenIssuer, Err: fmt.Errorf("%q", c.Issuer)}
+	}
+
+	for _, aud := range audiences {
+		if c.Audience == aud {
+			return nil
+		}
+	}
+	return &TokenError{Reason: ErrTokenAudience, Err: fmt.Errorf("%q", c.Audience)}
+}
@@ -0,0 +1,176 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func signTestToken(t *testing.T, claims jwt.StandardClaims, typ string) string {
+	token, err := signToken(&SignedDetails{StandardClaims: claims}, typ)
+	require.NoError(t, err)
+	return token
+}
+
+func TestValidateTokenClaims(t *testing.T) {
+	defer SetKeySet(nil)
+	SetKeySet(NewKeySet(generateKey(t, "ES256")))
+
+	now := time.Now()
+	valid := registeredClaims("uuid", now, time.Hour)
+
+	expired := valid
+	expired.ExpiresAt = now.Add(-time.Minute).Unix()
+
+	withinSkew := valid
+	withinSkew.ExpiresAt = now.Add(-10 * time.Second).Unix()
+
+	notYetValid := valid
+	notYetValid.NotBefore = now.Add(time.Minute).Unix()
+
+	issuedInFuture := valid
+	issuedInFuture.IssuedAt = now.Add(time.Minute).Unix()
+
+	wrongIssuer := valid
+	wrongIssuer.Issuer = "https://evil.example.com"
+
+	wrongAudience := valid
+	wrongAudience.Audience = "https://other.example.com"
+
+	noSubject := valid
+	noSubject.Subject = ""
+
+	tests := []struct {
+		name   string
+		token  string
+		reason error
+	}{
+		{"valid", signTestToken(t, valid, AccessTokenType), nil},
+		{"expired within clock skew", signTestToken(t, withinSkew, AccessTokenType), nil},
+		{"expired", signTestToken(t, expired, AccessTokenType), ErrTokenExpired},
+		{"not before", signTestToken(t, notYetValid, AccessTokenType), ErrTokenNotValidYet},
+		{"issued in the future", signTestToken(t, issuedInFuture, AccessTokenType), ErrTokenNotValidYet},
+		{"issuer", signTestToken(t, wrongIssuer, AccessTokenType), ErrTokenIssuer},
+		{"audience", signTestToken(t, wrongAudience, AccessTokenType), ErrTokenAudience},
+		{"subject", signTestToken(t, noSubject, AccessTokenType), ErrTokenMalformed},
+		{"refresh token", signTestToken(t, valid, RefreshTokenType), ErrTokenType},
+		{"malformed", "not.a.token", ErrTokenMalformed},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := ValidateToken(tc.token)
+			if tc.reason == nil {
+				require.NoError(t, err)
+				require.Equal(t, "uuid", claims.Subject)
+				return
+			}
+
+			require.Nil(t, claims)
+			require.ErrorIs(t, err, tc.reason)
+
+			var tokenErr *TokenError
+			require.True(t, errors.As(err, &tokenErr))
+		})
+	}
+}
+
+func TestClockSkewConfig(t *testing.T) {
+	t.Setenv("TOKEN_HASH_KEY", "test_hash_key")
+
+	t.Setenv("JWT_CLOCK_SKEW", "1m")
+	require.NoError(t, CheckConfig())
+	require.Equal(t, time.Minute, ClockSkew())
+
+	for _, skew := range []string{"30", "-1s"} {
+		t.Setenv("JWT_CLOCK_SKEW", skew)
+		require.Error(t, CheckConfig())
+	}
+}
+
+func TestValidateTokenAudienceList(t *testing.T) {
+	defer SetKeySet(nil)
+	SetKeySet(NewKeySet(generateKey(t, "ES256")))
+
+	os.Setenv("JWT_AUDIENCE", "https://api.example.com, https://legacy.example.com")
+	defer os.Unsetenv("JWT_AUDIENCE")
+
+	claims := registeredClaims("uuid", time.Now(), time.Hour)
+	require.Equal(t, "https://api.example.com", claims.Audience)
+
+	claims.Audience = "https://legacy.example.com"
+	_, err := ValidateToken(signTestToken(t, claims, AccessTokenType))
+	require.NoError(t, err)
+}
+
+func TestExchangeAudiencesConfig(t *testing.T) {
+	defer SetKeySet(nil)
+	SetKeySet(NewKeySet(generateKey(t, "ES256")))
+	t.Setenv("TOKEN_HASH_KEY", "test_hash_key")
+	t.Setenv("JWT_AUDIENCE", "https://api.example.com")
+
+	t.Setenv("TOKEN_EXCHANGE_AUDIENCES", "orders, https://api.example.com")
+	require.Error(t, CheckConfig())
+
+	t.Setenv("TOKEN_EXCHANGE_AUDIENCES", "orders, billing")
+	require.NoError(t, CheckConfig())
+	require.Equal(t, []string{"orders", "billing"}, ExchangeAudiences())
+
+	// tokens exchanged for a downstream service are not accepted here
+	claims := registeredClaims("uuid", time.Now(), time.Hour)
+	claims.Audience = "orders"
+	token := signTestToken(t, claims, AccessTokenType)
+	_, err := ValidateToken(token)
+	require.ErrorIs(t, err, ErrTokenAudience)
+
+	_, err = ValidateTokenFor(token, ExchangeAudiences())
+	require.NoError(t, err)
+}
+
+func TestValidateRefreshToken(t *testing.T) {
+	defer SetKeySet(nil)
+	SetKeySet(NewKeySet(generateKey(t, "ES256")))
+
+	token, refreshToken, err := GenerateAllToken(NewClaimsBuilder("uuid").WithRoles("USER").WithSession("sid").Claims())
+	require.NoError(t, err)
+
+	_, err = ValidateRefreshToken(refreshToken)
+	require.NoError(t, err)
+
+	_, err = ValidateRefreshToken(token)
+	require.ErrorIs(t, err, ErrTokenType)
+}
+
+func TestAccessTokenClaims(t *testing.T) {
+	defer SetKeySet(nil)
+	SetKeySet(NewKeySet(generateKey(t, "ES256")))
+
+	profile := map[string]interface{}{"email": "john@mail.com", "first_name": "John"}
+
+	token, _, err := GenerateAllToken(NewClaimsBuilder("uuid").WithRoles("USER").WithScope("openid").WithProfile(profile).Claims())
+	require.NoError(t, err)
+
+	claims := jwt.MapClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(token, claims)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"USER"}, claims["roles"])
+	require.Equal(t, "openid", claims["scope"])
+	require.NotContains(t, claims, "email")
+	require.NotContains(t, claims, "first_name")
+
+	os.Setenv("TOKEN_CLAIMS", "email, name:first_name, sub:email")
+	defer os.Unsetenv("TOKEN_CLAIMS")
+
+	token, _, err = GenerateAllToken(NewClaimsBuilder("uuid").WithRoles("USER").WithProfile(profile).Claims())
+	require.NoError(t, err)
+
+	parsed, err := ValidateToken(token)
+	require.NoError(t, err)
+	require.Equal(t, "uuid", parsed.Subject)
+	require.Equal(t, "USER", parsed.UserType())
+	require.Equal(t, map[string]interface{}{"email": "john@mail.com", "name": "John"}, parsed.Extra)
+}
@@ -0,0 +1,147 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// CheckConfig returns an error when the environment leaves the service unable
+// to run safely, it is checked once at startup
+func CheckConfig() error {
+	if _, err := tokenHashKey(); err != nil {
+		return err
+	}
+	if skew, err := GetEnvDuration("JWT_CLOCK_SKEW", defaultClockSkew); err != nil {
+		return err
+	} else if skew < 0 {
+		return fmt.Errorf("JWT_CLOCK_SKEW can not be negative")
+	}
+	// tokens exchanged for a downstream service must never be accepted by
+	// the API of this one
+	for _, target := range ExchangeAudiences() {
+		for _, aud := range Audiences() {
+			if target == aud {
+				return fmt.Errorf("%s is in both JWT_AUDIENCE and TOKEN_EXCHANGE_AUDIENCES", aud)
+			}
+		}
+	}
+	return nil
+}
+
+// Issuer returns the public base URL of the service, used as the token
+// issuer and to build the URLs of its endpoints
+func Issuer() string {
+	return GetEnv("ISSUER", "http://localhost:8080")
+}
+
+// Audiences returns the audiences accepted in access tokens, from the comma
+// separated JWT_AUDIENCE. Tokens are issued for the first one.
+func Audiences() []string {
+	audiences := splitList(GetEnv("JWT_AUDIENCE", Issuer()))
+	if len(audiences) == 0 {
+		return []string{Issuer()}
+	}
+	return audiences
+}
+
+// ExchangeAudiences returns the downstream services tokens can be exchanged
+// for, from the comma separated TOKEN_EXCHANGE_AUDIENCES. CheckConfig makes
+// sure none of them is accepted by the service itself.
+func ExchangeAudiences() []string {
+	return splitList(os.Getenv("TOKEN_EXCHANGE_AUDIENCES"))
+}
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+const defaultClockSkew = 30 * time.Second
+
+// ClockSkew returns how far the clocks of token issuers and verifiers may
+// drift apart, from JWT_CLOCK_SKEW. CheckConfig makes sure it parses.
+func ClockSkew() time.Duration {
+	skew, err := GetEnvDuration("JWT_CLOCK_SKEW", defaultClockSkew)
+	if err != nil || skew < 0 {
+		return defaultClockSkew
+	}
+	return skew
+}
+
+// DefaultScope returns the scopes granted to the tokens accounts get when they
+// log in, from DEFAULT_SCOPE
+func DefaultScope() string {
+	return GetEnv("DEFAULT_SCOPE", "openid profile email")
+}
+
+// Tenant returns the tenant put in tokens, from TENANT. Tokens carry no tenant
+// when it is unset.
+func Tenant() string {
+	return os.Getenv("TENANT")
+}
+
+// MFARequired reports whether accounts of userType have to sign in with a
+// second factor, from the comma separated MFA_REQUIRED_USER_TYPES
+func MFARequired(userType string) bool {
+	for _, t := range strings.Split(os.Getenv("MFA_REQUIRED_USER_TYPES"), ",") {
+		if strings.TrimSpace(t) == userType {
+			return true
+		}
+	}
+	return false
+}
+
+// TOTPIssuer returns the name authenticator apps show for the service, from
+// TOTP_ISSUER
+func TOTPIssuer() string {
+	return GetEnv("TOTP_ISSUER", "auth-assistant")
+}
+
+// ProfileClaims maps the names of extra token claims to the profile attributes
+// they are taken from. TOKEN_CLAIMS is a comma separated list of attributes,
+// each optionally renamed as claim:attribute, e.g. "email,first_name:given_name".
+func ProfileClaims() map[string]string {
+	claims := map[string]string{}
+	for _, entry := range strings.Split(os.Getenv("TOKEN_CLAIMS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		claim, attribute, found := strings.Cut(entry, ":")
+		if !found {
+			attribute = claim
+		}
+		claims[strings.TrimSpace(claim)] = strings.TrimSpace(attribute)
+	}
+	return claims
+}
+
+// GetEnv returns the environment variable key, or fallback when it is unset
+func GetEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// GetEnvDuration parses the environment variable key as a duration, or returns
+// fallback when it is unset
+func GetEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", key, err)
+	}
+	return d, nil
+}
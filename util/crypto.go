@@ -0,0 +1,191 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// Encrypt seals plaintext with AES-256-GCM under ENCRYPTION_KEY, it is meant
+// for secrets that have to be stored but must not be readable from a
+// database dump
+func Encrypt(plaintext []byte) (string, error) {
+	aead, err := newAEAD()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value sealed by Encrypt
+func Decrypt(ciphertext string) ([]byte, error) {
+	aead, err := newAEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+func newAEAD() (cipher.AEAD, error) {
+	secret := os.Getenv("ENCRYPTION_KEY")
+	if secret == "" {
+		return nil, fmt.Errorf("ENCRYPTION_KEY is not set")
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// HashToken returns the keyed hash a bearer secret is stored and looked up
+// by. The key is TOKEN_HASH_KEY, or one derived from ENCRYPTION_KEY. Without
+// either it panics rather than hash with a key anyone can guess, CheckConfig
+// keeps the service from starting that way.
+func HashToken(token string) string {
+	if token == "" {
+		return ""
+	}
+
+	key, err := tokenHashKey()
+	if err != nil {
+		panic(err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func tokenHashKey() ([]byte, error) {
+	if key := os.Getenv("TOKEN_HASH_KEY"); key != "" {
+		return []byte(key), nil
+	}
+
+	secret := os.Getenv("ENCRYPTION_KEY")
+	if secret == "" {
+		return nil, fmt.Errorf("TOKEN_HASH_KEY or ENCRYPTION_KEY is not set")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("token hash"))
+	return mac.Sum(nil), nil
+}
+
+// NewOpaqueToken returns a random bearer secret, such as an authorization
+// code, that is only meaningful to this service
+func NewOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// userCodeAlphabet has no vowels, so user codes never spell words, and no
+// characters that are easily confused with each other
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// NewUserCode returns a short random code, such as XBKF-TQMZ, for users to type
+// in on another device
+func NewUserCode() (string, error) {
+	return newCode(8, 4)
+}
+
+// NormalizeUserCode returns the user code as NewUserCode formats it, whatever
+// case and separators the user typed it in with
+func NormalizeUserCode(code string) string {
+	return normalizeCode(code, 4)
+}
+
+// NewRecoveryCode returns a single use code, such as XBKFT-QMZHD, for users to
+// write down and sign in with when they lose their second factor
+func NewRecoveryCode() (string, error) {
+	return newCode(10, 5)
+}
+
+// NormalizeRecoveryCode returns the recovery code as NewRecoveryCode formats
+// it, whatever case and separators the user typed it in with
+func NormalizeRecoveryCode(code string) string {
+	return normalizeCode(code, 5)
+}
+
+// NewNumericCode returns a random code of digits digits, such as the one time
+// codes sent by email
+func NewNumericCode(digits int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", digits, n), nil
+}
+
+// newCode returns n random characters of userCodeAlphabet in groups of group
+// characters separated by dashes
+func newCode(n, group int) (string, error) {
+	// bytes past the last multiple of the alphabet size are skipped, they
+	// would make some characters more likely than others
+	limit := 256 - 256%len(userCodeAlphabet)
+
+	code := make([]byte, 0, n+n/group)
+	b := make([]byte, 1)
+	for count := 0; count < n; {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return "", err
+		}
+		if int(b[0]) >= limit {
+			continue
+		}
+		if count > 0 && count%group == 0 {
+			code = append(code, '-')
+		}
+		code = append(code, userCodeAlphabet[int(b[0])%len(userCodeAlphabet)])
+		count++
+	}
+	return string(code), nil
+}
+
+func normalizeCode(code string, group int) string {
+	var sb strings.Builder
+	count := 0
+	for _, c := range strings.ToUpper(code) {
+		if c < 'A' || c > 'Z' {
+			continue
+		}
+		if count > 0 && count%group == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteRune(c)
+		count++
+	}
+	return sb.String()
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	os.Setenv("ENCRYPTION_KEY", "test_encryption_key")
+	defer os.Unsetenv("ENCRYPTION_KEY")
+
+	sealed, err := Encrypt([]byte("secret"))
+	require.NoError(t, err)
+	require.NotContains(t, sealed, "secret")
+
+	opened, err := Decrypt(sealed)
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(opened))
+
+	os.Setenv("ENCRYPTION_KEY", "another_key")
+	_, err = Decrypt(sealed)
+	require.Error(t, err)
+}
+
+func TestHashToken(t *testing.T) {
+	os.Setenv("TOKEN_HASH_KEY", "test_hash_key")
+	defer os.Unsetenv("TOKEN_HASH_KEY")
+
+	hash := HashToken("token")
+	require.Len(t, hash, 64)
+	require.Equal(t, hash, HashToken("token"))
+	require.NotEqual(t, hash, HashToken("other token"))
+	require.Empty(t, HashToken(""))
+
+	os.Setenv("TOKEN_HASH_KEY", "another_key")
+	require.NotEqual(t, hash, HashToken("token"))
+
+	// without a key there is nothing to hash with
+	os.Unsetenv("TOKEN_HASH_KEY")
+	t.Setenv("ENCRYPTION_KEY", "")
+	require.Error(t, CheckConfig())
+	require.Panics(t, func() { HashToken("token") })
+}
+
+func TestUserCode(t *testing.T) {
+	code, err := NewUserCode()
+	require.NoError(t, err)
+	require.Regexp(t, `^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$`, code)
+
+	require.Equal(t, code, NormalizeUserCode(code))
+	require.Equal(t, "BCDF-GHJK", NormalizeUserCode(" bcdf ghjk "))
+	require.Equal(t, "BCDF-GHJK", NormalizeUserCode("bcdfghjk"))
+}
+
+func TestNumericCode(t *testing.T) {
+	code, err := NewNumericCode(6)
+	require.NoError(t, err)
+	require.Regexp(t, `^[0-9]{6}$`, code)
+}
+
+func TestRecoveryCode(t *testing.T) {
+	code, err := NewRecoveryCode()
+	require.NoError(t, err)
+	require.Regexp(t, `^[BCDFGHJKLMNPQRSTVWXZ]{5}-[BCDFGHJKLMNPQRSTVWXZ]{5}$`, code)
+
+	require.Equal(t, code, NormalizeRecoveryCode(code))
+	require.Equal(t, "BCDFG-HJKLM", NormalizeRecoveryCode("bcdfg hjklm"))
+}
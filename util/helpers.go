@@ -3,43 +3,58 @@ package util
 import (
 	"fmt"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var SECRET_KEY string = os.Getenv("SECRET_KEY")
+const (
+	AccessTokenLifetime       = 24 * time.Hour
+	RefreshTokenLifetime      = 168 * time.Hour
+	AuthorizationCodeLifetime = 5 * time.Minute
+	DeviceCodeLifetime        = 10 * time.Minute
+	DeviceCodeInterval        = 5 * time.Second
+	TokenExchangeLifetime     = 5 * time.Minute
+)
+
+// Token types, set in the typ header so one kind of token can never be used
+// in place of another
+const (
+	AccessTokenType  = "at+jwt"
+	RefreshTokenType = "rt+jwt"
+)
 
-type SignedDetails struct {
-	FirstName string
-	LastName  string
-	Email     string
-	UserType  string
-	Uuid      string
-	jwt.StandardClaims
+// GenerateAllToken signs claims as an access token and issues a refresh token
+// for the same subject, both with the default lifetimes
+func GenerateAllToken(claims *SignedDetails) (token string, refreshToken string, err error) {
+	return GenerateTokens(claims, AccessTokenLifetime, RefreshTokenLifetime)
 }
 
-func GenerateAllToken(firstName, lastName, email, userType, uuid string) (token string, refreshToken string, err error) {
-	claims := &SignedDetails{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-		UserType:  userType,
-		Uuid:      uuid,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Local().Add(time.Hour * time.Duration(24)).Unix(),
-		},
-	}
+// GenerateTokens is GenerateAllToken with the lifetimes of the tokens given,
+// they should not exceed the defaults
+func GenerateTokens(claims *SignedDetails, accessLifetime, refreshLifetime time.Duration) (token string, refreshToken string, err error) {
+	now := time.Now().Local()
+	// the id lets a single access token be revoked, the issue time all tokens
+	// of an account issued before some point
+	claims.StandardClaims = accessRegisteredClaims(claims, now, accessLifetime)
+	// the id makes every refresh token unique, so a rotated token can never
+	// be minted again with the same value. Refreshed tokens keep the scope,
+	// client and authentication of the token they replace.
 	refreshClaims := SignedDetails{
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Local().Add(time.Hour * time.Duration(168)).Unix(),
-		},
+		Scope:          claims.Scope,
+		ClientID:       claims.ClientID,
+		AuthTime:       claims.AuthTime,
+		AMR:            claims.AMR,
+		StandardClaims: registeredClaims(claims.Subject, now, refreshLifetime),
 	}
-	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(SECRET_KEY))
-	refreshToken, err = jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims).SignedString([]byte(SECRET_KEY))
-
+	token, err = signToken(claims, AccessTokenType)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err = signToken(refreshClaims, RefreshTokenType)
 	if err != nil {
 		return "", "", err
 	}
@@ -47,26 +62,114 @@ func GenerateAllToken(firstName, lastName, email, userType, uuid string) (token
 	return token, refreshToken, err
 }
 
-func ValidateToken(signedToken string) (claims *SignedDetails, err error) {
-	token, err := jwt.ParseWithClaims(
-		signedToken,
-		&SignedDetails{},
-		func(t *jwt.Token) (interface{}, error) {
-			return []byte(SECRET_KEY), nil
-		},
-	)
+// GenerateAccessToken signs claims as an access token valid for lifetime,
+// without a refresh token
+func GenerateAccessToken(claims *SignedDetails, lifetime time.Duration) (string, error) {
+	claims.StandardClaims = accessRegisteredClaims(claims, time.Now().Local(), lifetime)
+	return signToken(claims, AccessTokenType)
+}
+
+// accessRegisteredClaims returns the registered claims of an access token,
+// keeping the audience the claims were built for
+func accessRegisteredClaims(claims *SignedDetails, now time.Time, lifetime time.Duration) jwt.StandardClaims {
+	registered := registeredClaims(claims.Subject, now, lifetime)
+	if claims.Audience != "" {
+		registered.Audience = claims.Audience
+	}
+	return registered
+}
+
+// registeredClaims returns the registered claims of a token for subject that
+// is valid from now for lifetime
+func registeredClaims(subject string, now time.Time, lifetime time.Duration) jwt.StandardClaims {
+	return jwt.StandardClaims{
+		Id:        newTokenID(),
+		Issuer:    Issuer(),
+		Audience:  Audiences()[0],
+		Subject:   subject,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(lifetime).Unix(),
+	}
+}
+
+func newTokenID() string {
+	return uuid.New().String()
+}
+
+// signToken signs the claims with the current signing key, names that key in
+// the kid header and the kind of token in the typ header
+func signToken(claims jwt.Claims, typ string) (string, error) {
+	ks, err := CurrentKeySet()
+	if err != nil {
+		return "", err
+	}
+	key := ks.SigningKey()
+
+	token := jwt.NewWithClaims(key.SigningMethod(), claims)
+	token.Header["kid"] = key.ID
+	token.Header["typ"] = typ
+	return token.SignedString(key.Private)
+}
+
+// verificationKey picks the key named by the kid header of the token and makes
+// sure the token was signed with the algorithm of that key
+func verificationKey(t *jwt.Token) (interface{}, error) {
+	ks, err := CurrentKeySet()
 	if err != nil {
 		return nil, err
 	}
-	claims, ok := token.Claims.(*SignedDetails)
+
+	kid, _ := t.Header["kid"].(string)
+	key, ok := ks.Key(kid)
 	if !ok {
-		return nil, err
+		return nil, &TokenError{Reason: ErrTokenSignature, Err: fmt.Errorf("unknown signing key %q", kid)}
+	}
+	if t.Method.Alg() != key.Algorithm {
+		return nil, &TokenError{Reason: ErrTokenSignature, Err: fmt.Errorf("unexpected signing method %s for key %q", t.Method.Alg(), kid)}
+	}
+
+	return key.Public, nil
+}
+
+// ValidateToken verifies an access token meant for one of the audiences of
+// this service and its registered claims. Rejected tokens give a *TokenError, any other error
+// means the token could not be checked at all.
+func ValidateToken(signedToken string) (claims *SignedDetails, err error) {
+	return parseToken(signedToken, AccessTokenType, Audiences())
+}
+
+// ValidateTokenFor verifies an access token like ValidateToken does, but for
+// any of audiences, such as the downstream services tokens are exchanged for
+func ValidateTokenFor(signedToken string, audiences []string) (claims *SignedDetails, err error) {
+	return parseToken(signedToken, AccessTokenType, audiences)
+}
+
+// ValidateRefreshToken verifies a refresh token like ValidateToken does an
+// access token
+func ValidateRefreshToken(signedToken string) (claims *SignedDetails, err error) {
+	return parseToken(signedToken, RefreshTokenType, Audiences())
+}
+
+func parseToken(signedToken, typ string, audiences []string) (*SignedDetails, error) {
+	// the registered claims are checked below, with clock skew
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+
+	claims := &SignedDetails{}
+	token, err := parser.ParseWithClaims(signedToken, claims, verificationKey)
+	if err != nil {
+		return nil, parseError(err)
+	}
+
+	if t, _ := token.Header["typ"].(string); !strings.EqualFold(t, typ) {
+		return nil, &TokenError{Reason: ErrTokenType, Err: fmt.Errorf("got %q, want %q", t, typ)}
 	}
-	if claims.ExpiresAt < time.Now().Local().Unix() {
+
+	if err := validateClaims(&claims.StandardClaims, time.Now(), audiences); err != nil {
 		return nil, err
 	}
 
-	return claims, err
+	return claims, nil
 }
 
 func HashPassword(password string) (string, error) {
@@ -85,6 +188,19 @@ func VerifyPassword(hashedPass string, pass string) error {
 	return nil
 }
 
+// CheckPermission makes sure the request is made by an account of type role,
+// or by a service principal granted scope
+func CheckPermission(r *http.Request, role, scope string) error {
+	if r.Header.Get("user_type") == role {
+		return nil
+	}
+	if r.Header.Get("user_type") == ServiceRole && HasScope(r.Header.Get("scope"), scope) {
+		return nil
+	}
+
+	return fmt.Errorf("Unauthorized to access this resource")
+}
+
 func CheckUserType(r *http.Request, role string) error {
 	userType := r.Header.Get("user_type")
 
@@ -0,0 +1,156 @@
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+)
+
+// JWK defines the RFC 7517 representation of a public key
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKS defines a JSON Web Key Set
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// NewJWK returns the public half of a key as a signature verification JWK
+func NewJWK(k *Key) (*JWK, error) {
+	if k.Symmetric() {
+		return nil, fmt.Errorf("key %q is a shared secret", k.ID)
+	}
+
+	jwk, err := publicJWK(k.Public)
+	if err != nil {
+		return nil, err
+	}
+	jwk.Use = "sig"
+	jwk.Kid = k.ID
+	jwk.Alg = k.Algorithm
+
+	return jwk, nil
+}
+
+// NewJWKS returns the public keys of the set, shared secrets are left out
+func NewJWKS(ks *KeySet) (*JWKS, error) {
+	jwks := &JWKS{Keys: []*JWK{}}
+	for _, k := range ks.Keys() {
+		if k.Symmetric() {
+			continue
+		}
+
+		jwk, err := NewJWK(k)
+		if err != nil {
+			return nil, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks, nil
+}
+
+func publicJWK(public crypto.PublicKey) (*JWK, error) {
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		return &JWK{
+			Kty: "RSA",
+			N:   b64(pub.N.Bytes()),
+			E:   b64(big.NewInt(int64(pub.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return &JWK{
+			Kty: "EC",
+			Crv: pub.Curve.Params().Name,
+			X:   b64(pub.X.FillBytes(make([]byte, size))),
+			Y:   b64(pub.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return &JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   b64(pub),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", public)
+}
+
+// VerificationKey returns the key the JWK stands for, to verify tokens of
+// other issuers with. The alg member, when present, overrides the algorithm
+// the key type implies.
+func (k *JWK) VerificationKey() (*Key, error) {
+	public, err := k.publicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := NewVerificationKey(k.Kid, public)
+	if err != nil {
+		return nil, err
+	}
+	if k.Alg != "" {
+		key.Algorithm = k.Alg
+	}
+	return key, nil
+}
+
+func (k *JWK) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported elliptic curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size %d", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,347 @@
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Key defines a key used to sign or verify tokens. Verification-only keys
+// have no private half.
+type Key struct {
+	ID        string
+	Algorithm string
+	Private   crypto.PrivateKey
+	Public    crypto.PublicKey
+}
+
+// NewKey returns a signing key for an RSA, ECDSA or Ed25519 private key.
+// When id is empty the RFC 7638 thumbprint of the public key is used.
+func NewKey(id string, private crypto.PrivateKey) (*Key, error) {
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", private)
+	}
+
+	key, err := NewVerificationKey(id, signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	key.Private = private
+
+	return key, nil
+}
+
+// NewVerificationKey returns a key that can only verify tokens
+func NewVerificationKey(id string, public crypto.PublicKey) (*Key, error) {
+	alg, err := algorithmFor(public)
+	if err != nil {
+		return nil, err
+	}
+
+	if id == "" {
+		id, err = Thumbprint(public)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Key{
+		ID:        id,
+		Algorithm: alg,
+		Public:    public,
+	}, nil
+}
+
+// NewSecretKey returns a HS256 key for a shared secret
+func NewSecretKey(id, secret string) *Key {
+	return &Key{
+		ID:        id,
+		Algorithm: jwt.SigningMethodHS256.Alg(),
+		Private:   []byte(secret),
+		Public:    []byte(secret),
+	}
+}
+
+func (k *Key) SigningMethod() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// Symmetric reports whether the key is a shared secret that must never be
+// published
+func (k *Key) Symmetric() bool {
+	_, ok := k.Public.([]byte)
+	return ok
+}
+
+func algorithmFor(public crypto.PublicKey) (string, error) {
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256.Alg(), nil
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256.Alg(), nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384.Alg(), nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512.Alg(), nil
+		}
+		return "", fmt.Errorf("unsupported elliptic curve %s", pub.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA.Alg(), nil
+	}
+	return "", fmt.Errorf("unsupported public key type %T", public)
+}
+
+// Thumbprint returns the RFC 7638 JWK thumbprint of a public key
+func Thumbprint(public crypto.PublicKey) (string, error) {
+	jwk, err := publicJWK(public)
+	if err != nil {
+		return "", err
+	}
+
+	// only the required members, in lexicographic order
+	var members string
+	switch jwk.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Crv, jwk.X, jwk.Y)
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, jwk.Crv, jwk.X)
+	}
+
+	sum := sha256.Sum256([]byte(members))
+	return b64(sum[:]), nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// GenerateKey returns a new signing key for one of RS256, ES256 or EdDSA
+func GenerateKey(alg string) (*Key, error) {
+	var private crypto.PrivateKey
+	var err error
+
+	switch alg {
+	case jwt.SigningMethodRS256.Alg():
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKey("", private)
+}
+
+// MarshalPrivateKeyPEM encodes a private key as PKCS #8 PEM
+func MarshalPrivateKeyPEM(private crypto.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// MarshalPublicKeyPEM encodes a public key as PKIX PEM
+func MarshalPublicKeyPEM(public crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// ParsePrivateKeyPEM parses a PKCS #8, PKCS #1 or SEC 1 private key
+func ParsePrivateKeyPEM(b []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// ParsePublicKeyPEM parses a PKIX public key or the public key of a certificate
+func ParsePublicKeyPEM(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// KeySet holds the key tokens are signed with and every key tokens are
+// verified with, indexed by key id
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+	order   []string
+}
+
+func NewKeySet(signing *Key, verification ...*Key) *KeySet {
+	ks := &KeySet{
+		signing: signing,
+		keys:    map[string]*Key{},
+	}
+	for _, k := range append([]*Key{signing}, verification...) {
+		if _, ok := ks.keys[k.ID]; ok {
+			continue
+		}
+		ks.keys[k.ID] = k
+		ks.order = append(ks.order, k.ID)
+	}
+	return ks
+}
+
+func (ks *KeySet) SigningKey() *Key {
+	return ks.signing
+}
+
+func (ks *KeySet) Key(kid string) (*Key, bool) {
+	k, ok := ks.keys[kid]
+	return k, ok
+}
+
+// Keys returns every key of the set, the signing key first
+func (ks *KeySet) Keys() []*Key {
+	keys := make([]*Key, 0, len(ks.order))
+	for _, kid := range ks.order {
+		keys = append(keys, ks.keys[kid])
+	}
+	return keys
+}
+
+var (
+	keySetMu sync.RWMutex
+	keySet   *KeySet
+)
+
+// SetKeySet replaces the keys used by GenerateAllToken and ValidateToken
+func SetKeySet(ks *KeySet) {
+	keySetMu.Lock()
+	defer keySetMu.Unlock()
+	keySet = ks
+}
+
+// CurrentKeySet returns the keys in use, loading them from the environment
+// on first use
+func CurrentKeySet() (*KeySet, error) {
+	keySetMu.RLock()
+	ks := keySet
+	keySetMu.RUnlock()
+	if ks != nil {
+		return ks, nil
+	}
+
+	ks, err := LoadKeySet()
+	if err != nil {
+		return nil, err
+	}
+	SetKeySet(ks)
+	return ks, nil
+}
+
+// LoadKeySet builds the key set from the environment. PRIVATE_KEY is the path
+// of the PEM encoded signing key and PUBLIC_KEY a comma separated list of PEM
+// encoded public keys that are only accepted for verification. Without
+// PRIVATE_KEY tokens are signed with SECRET_KEY using HS256.
+func LoadKeySet() (*KeySet, error) {
+	signing, err := loadSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	verification := []*Key{}
+	for _, path := range strings.Split(os.Getenv("PUBLIC_KEY"), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := ParsePublicKeyPEM(b)
+		if err != nil {
+			return nil, fmt.Errorf("parsing public key %s: %w", path, err)
+		}
+		key, err := NewVerificationKey("", pub)
+		if err != nil {
+			return nil, err
+		}
+		verification = append(verification, key)
+	}
+
+	return NewKeySet(signing, verification...), nil
+}
+
+func loadSigningKey() (*Key, error) {
+	kid := os.Getenv("KEY_ID")
+
+	path := os.Getenv("PRIVATE_KEY")
+	if path == "" {
+		secret := os.Getenv("SECRET_KEY")
+		if secret == "" {
+			return nil, fmt.Errorf("neither PRIVATE_KEY nor SECRET_KEY is set")
+		}
+		if kid == "" {
+			kid = "secret"
+		}
+		return NewSecretKey(kid, secret), nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	private, err := ParsePrivateKeyPEM(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key %s: %w", path, err)
+	}
+
+	return NewKey(kid, private)
+}
@@ -0,0 +1,96 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func generateKey(t *testing.T, alg string) *Key {
+	key, err := GenerateKey(alg)
+	require.NoError(t, err)
+	require.Equal(t, alg, key.Algorithm)
+	require.NotEmpty(t, key.ID)
+
+	return key
+}
+
+func TestAsymmetricTokens(t *testing.T) {
+	defer SetKeySet(nil)
+
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		t.Run(alg, func(t *testing.T) {
+			key := generateKey(t, alg)
+			SetKeySet(NewKeySet(key))
+
+			token, refreshToken, err := GenerateAllToken(NewClaimsBuilder("uuid").WithRoles("USER").WithSession("sid").Claims())
+			require.NoError(t, err)
+
+			claims, err := ValidateToken(token)
+			require.NoError(t, err)
+			require.Equal(t, "uuid", claims.Subject)
+
+			_, err = ValidateRefreshToken(refreshToken)
+			require.NoError(t, err)
+
+			parsed, _, err := new(jwt.Parser).ParseUnverified(token, &SignedDetails{})
+			require.NoError(t, err)
+			require.Equal(t, key.ID, parsed.Header["kid"])
+		})
+	}
+}
+
+func TestValidateTokenPicksKeyByID(t *testing.T) {
+	defer SetKeySet(nil)
+
+	retired := generateKey(t, "ES256")
+	active := generateKey(t, "EdDSA")
+
+	SetKeySet(NewKeySet(retired))
+	token, _, err := GenerateAllToken(NewClaimsBuilder("uuid").WithRoles("USER").WithSession("sid").Claims())
+	require.NoError(t, err)
+
+	verifyOnly, err := NewVerificationKey(retired.ID, retired.Public)
+	require.NoError(t, err)
+
+	SetKeySet(NewKeySet(active, verifyOnly))
+	_, err = ValidateToken(token)
+	require.NoError(t, err)
+
+	SetKeySet(NewKeySet(active))
+	_, err = ValidateToken(token)
+	require.Error(t, err)
+}
+
+func TestValidateTokenRejectsAlgorithmMismatch(t *testing.T) {
+	defer SetKeySet(nil)
+
+	key := generateKey(t, "RS256")
+	SetKeySet(NewKeySet(key))
+
+	// a HS256 token naming an RSA key must never reach HMAC verification
+	claims := NewClaimsBuilder("uuid").Claims()
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	forged.Header["kid"] = key.ID
+	signed, err := forged.SignedString([]byte(key.ID))
+	require.NoError(t, err)
+
+	_, err = ValidateToken(signed)
+	require.Error(t, err)
+}
+
+func TestJWKSLeavesOutSharedSecrets(t *testing.T) {
+	key := generateKey(t, "ES256")
+	ks := NewKeySet(NewSecretKey("secret", "secret_key"), key)
+
+	jwks, err := NewJWKS(ks)
+	require.NoError(t, err)
+	require.Len(t, jwks.Keys, 1)
+
+	jwk := jwks.Keys[0]
+	require.Equal(t, key.ID, jwk.Kid)
+	require.Equal(t, "EC", jwk.Kty)
+	require.Equal(t, "P-256", jwk.Crv)
+	require.Equal(t, "ES256", jwk.Alg)
+}
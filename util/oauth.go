@@ -0,0 +1,93 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+)
+
+// ServiceRole is the role of service principals, the OAuth clients that get
+// tokens of their own through the client credentials grant
+const ServiceRole = "SERVICE"
+
+// ScopeOpenID is the scope of OpenID Connect requests, tokens granted it come
+// with an ID token and can be used at the userinfo endpoint
+const ScopeOpenID = "openid"
+
+// TokenTypeAccessToken identifies access tokens in token exchange requests
+// and responses
+const TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+// Scopes service principals can be granted to call the account endpoints
+const (
+	ScopeAccountsRead  = "accounts:read"
+	ScopeAccountsWrite = "accounts:write"
+)
+
+// HasScope reports whether the space separated scopes include scope
+func HasScope(scopes, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyCodeChallenge reports whether verifier is the PKCE code verifier of
+// the S256 challenge, the only method accepted
+func VerifyCodeChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(CodeChallenge(verifier)), []byte(challenge)) == 1
+}
+
+// CodeChallenge returns the S256 PKCE code challenge of verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// GrantScope returns the scope a token is granted when requested is asked for
+// and allowed is the most it may get, both space separated. An empty request
+// is granted allowed in full, ok is false if anything else is asked for.
+func GrantScope(requested, allowed string) (scope string, ok bool) {
+	if strings.TrimSpace(requested) == "" {
+		return strings.Join(strings.Fields(allowed), " "), true
+	}
+
+	permitted := map[string]bool{}
+	for _, s := range strings.Fields(allowed) {
+		permitted[s] = true
+	}
+
+	granted := []string{}
+	seen := map[string]bool{}
+	for _, s := range strings.Fields(requested) {
+		if !permitted[s] {
+			return "", false
+		}
+		if !seen[s] {
+			seen[s] = true
+			granted = append(granted, s)
+		}
+	}
+	return strings.Join(granted, " "), true
+}
+
+// JoinScopes returns the space separated scopes that are in any of scopes,
+// each once
+func JoinScopes(scopes ...string) string {
+	joined := []string{}
+	seen := map[string]bool{}
+	for _, s := range strings.Fields(strings.Join(scopes, " ")) {
+		if !seen[s] {
+			seen[s] = true
+			joined = append(joined, s)
+		}
+	}
+	return strings.Join(joined, " ")
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	verifier := RandomString(64)
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	require.True(t, VerifyCodeChallenge(verifier, challenge))
+	require.False(t, VerifyCodeChallenge(verifier+"x", challenge))
+	require.False(t, VerifyCodeChallenge("short", challenge))
+}
+
+func TestGrantScope(t *testing.T) {
+	scope, ok := GrantScope("", "openid  profile email")
+	require.True(t, ok)
+	require.Equal(t, "openid profile email", scope)
+
+	scope, ok = GrantScope("email openid email", "openid profile email")
+	require.True(t, ok)
+	require.Equal(t, "email openid", scope)
+
+	_, ok = GrantScope("openid admin", "openid profile email")
+	require.False(t, ok)
+}
+
+func TestJoinScopes(t *testing.T) {
+	require.Equal(t, "openid email profile", JoinScopes("openid email", "email  profile"))
+	require.Equal(t, "openid", JoinScopes("", "openid"))
+	require.Equal(t, "", JoinScopes())
+}
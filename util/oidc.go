@@ -0,0 +1,63 @@
+package util
+
+import (
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const IDTokenLifetime = time.Hour
+
+// IDTokenType is the typ header of ID tokens, which OpenID Connect clients
+// expect to be a plain JWT
+const IDTokenType = "JWT"
+
+// ScopeClaims lists the standard OpenID Connect claims each scope grants
+// access to
+var ScopeClaims = map[string][]string{
+	"profile": {"name", "given_name", "family_name", "middle_name", "nickname", "preferred_username", "picture", "updated_at"},
+	"email":   {"email", "email_verified"},
+}
+
+// IDTokenClaims are the claims of an OpenID Connect ID token. It is issued to
+// the client, which is its audience, and tells it who authenticated, when and
+// how.
+type IDTokenClaims struct {
+	Nonce    string   `json:"nonce,omitempty"`
+	AuthTime int64    `json:"auth_time,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
+	AZP      string   `json:"azp,omitempty"`
+	jwt.StandardClaims
+}
+
+// GenerateIDToken signs an ID token of the subject of claims for the client
+// it was issued to, echoing the nonce of the authentication request
+func GenerateIDToken(claims *SignedDetails, nonce string) (string, error) {
+	now := time.Now().Local()
+
+	registered := registeredClaims(claims.Subject, now, IDTokenLifetime)
+	registered.Audience = claims.ClientID
+
+	authTime, amr := claims.Authenticated()
+	return signToken(&IDTokenClaims{
+		Nonce:          nonce,
+		AuthTime:       authTime,
+		AMR:            amr,
+		AZP:            claims.ClientID,
+		StandardClaims: registered,
+	}, IDTokenType)
+}
+
+// FilterClaims returns the claims of profile that scope grants access to
+func FilterClaims(profile map[string]interface{}, scope string) map[string]interface{} {
+	filtered := map[string]interface{}{}
+	for _, s := range strings.Fields(scope) {
+		for _, claim := range ScopeClaims[s] {
+			if value, ok := profile[claim]; ok {
+				filtered[claim] = value
+			}
+		}
+	}
+	return filtered
+}
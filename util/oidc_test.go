@@ -0,0 +1,40 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateIDToken(t *testing.T) {
+	defer SetKeySet(nil)
+	SetKeySet(NewKeySet(generateKey(t, "ES256")))
+
+	claims := NewClaimsBuilder("uuid").WithScope("openid").WithClient("spa").WithAuthentication(1700000000, "pwd").Claims()
+	token, err := GenerateIDToken(claims, "nonce")
+	require.NoError(t, err)
+
+	parsed, err := new(jwt.Parser).ParseWithClaims(token, &IDTokenClaims{}, verificationKey)
+	require.NoError(t, err)
+	require.Equal(t, IDTokenType, parsed.Header["typ"])
+
+	idToken := parsed.Claims.(*IDTokenClaims)
+	require.Equal(t, "uuid", idToken.Subject)
+	require.Equal(t, "spa", idToken.Audience)
+	require.Equal(t, "nonce", idToken.Nonce)
+	require.Equal(t, int64(1700000000), idToken.AuthTime)
+	require.Equal(t, []string{"pwd"}, idToken.AMR)
+
+	// ID tokens are no access tokens
+	_, err = ValidateToken(token)
+	require.ErrorIs(t, err, ErrTokenType)
+}
+
+func TestFilterClaims(t *testing.T) {
+	profile := map[string]interface{}{"name": "John Doe", "given_name": "John", "email": "john@mail.com"}
+
+	require.Empty(t, FilterClaims(profile, "openid"))
+	require.Equal(t, map[string]interface{}{"email": "john@mail.com"}, FilterClaims(profile, "openid email"))
+	require.Equal(t, map[string]interface{}{"name": "John Doe", "given_name": "John"}, FilterClaims(profile, "openid profile"))
+}
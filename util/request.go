@@ -0,0 +1,23 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP returns the address the request came from. X-Forwarded-For is
+// only trusted when TRUST_PROXY_HEADERS is true, i.e. behind a proxy that sets it.
+func ClientIP(r *http.Request) string {
+	if GetEnv("TRUST_PROXY_HEADERS", "false") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// the SHA1 vectors of RFC 6238 appendix B, cut to six digits
+func TestTOTPCode(t *testing.T) {
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for unix, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		got, err := TOTPCode(secret, TOTPStep(time.Unix(unix, 0)))
+		require.NoError(t, err)
+		require.Equal(t, code, got, unix)
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	require.NoError(t, err)
+	now := time.Now()
+
+	code, err := TOTPCode(secret, TOTPStep(now.Add(-TOTPPeriod)))
+	require.NoError(t, err)
+	step, ok := VerifyTOTP(secret, code, now)
+	require.True(t, ok)
+	require.Equal(t, TOTPStep(now)-1, step)
+
+	code, err = TOTPCode(secret, TOTPStep(now.Add(-3*TOTPPeriod)))
+	require.NoError(t, err)
+	_, ok = VerifyTOTP(secret, code, now)
+	require.False(t, ok)
+
+	uri, err := url.Parse(TOTPURI("auth-assistant", "john@mail.com", secret))
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", uri.Scheme)
+	require.Equal(t, "/auth-assistant:john@mail.com", uri.Path)
+	require.Equal(t, secret, uri.Query().Get("secret"))
+}
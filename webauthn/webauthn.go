@@ -0,0 +1,492 @@
+// Package webauthn verifies the registration and authentication ceremonies of
+// WebAuthn, so accounts can sign in with passkeys and security keys.
+// Attestation is not asked for, the relying party trusts any authenticator
+// the user registers.
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/blazingly-fast/auth-assistant/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ErrCeremonyRejected is wrapped by the errors of ceremonies whose response
+// does not hold up, such as a wrong challenge, origin or signature
+var ErrCeremonyRejected = fmt.Errorf("WebAuthn ceremony was rejected")
+
+// COSE algorithms of the public keys accepted, in order of preference
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// flags of the authenticator data
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// Encoding is how binary values are encoded in the JSON of options and
+// responses, like PublicKeyCredential.toJSON() does
+var Encoding = base64.RawURLEncoding
+
+// RelyingParty defines this service as a relying party. ID is the domain
+// credentials are scoped to, Origins the origins of the pages allowed to run
+// ceremonies.
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+func NewRelyingParty(id, name string, origins ...string) *RelyingParty {
+	return &RelyingParty{ID: id, Name: name, Origins: origins}
+}
+
+// LoadRelyingParty returns the relying party configured with WEBAUTHN_RP_ID,
+// WEBAUTHN_RP_NAME and the comma separated WEBAUTHN_ORIGINS, which default to
+// the host and origin of the issuer
+func LoadRelyingParty() *RelyingParty {
+	issuer, _ := url.Parse(util.Issuer())
+	rp := NewRelyingParty(
+		util.GetEnv("WEBAUTHN_RP_ID", issuer.Hostname()),
+		util.GetEnv("WEBAUTHN_RP_NAME", "auth-assistant"))
+
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			rp.Origins = append(rp.Origins, origin)
+		}
+	}
+	if len(rp.Origins) == 0 {
+		rp.Origins = []string{issuer.Scheme + "://" + issuer.Host}
+	}
+	return rp
+}
+
+// CredentialDescriptor names a credential in options
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type RPEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions defines the options of navigator.credentials.create(), in
+// the JSON form PublicKeyCredential.parseCreationOptionsFromJSON() reads
+type CreationOptions struct {
+	RP                     RPEntity               `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Challenge              string                 `json:"challenge"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions defines the options of navigator.credentials.get(), in the
+// JSON form PublicKeyCredential.parseRequestOptionsFromJSON() reads. Without
+// AllowCredentials the authenticator offers the passkeys it holds for the
+// relying party.
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int                    `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// RegistrationResponse defines the JSON of the PublicKeyCredential
+// navigator.credentials.create() returns
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+// AssertionResponse defines the JSON of the PublicKeyCredential
+// navigator.credentials.get() returns
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// Credential defines a credential that was registered, PublicKey is PEM
+// encoded
+type Credential struct {
+	ID           string
+	PublicKey    string
+	SignCount    uint32
+	Transports   []string
+	UserVerified bool
+}
+
+// Assertion defines what a verified authentication ceremony proved
+type Assertion struct {
+	CredentialID string
+	UserHandle   string
+	SignCount    uint32
+	UserVerified bool
+}
+
+// NewChallenge returns a random challenge for a ceremony
+func NewChallenge() (string, error) {
+	return util.NewOpaqueToken()
+}
+
+// CreationOptions returns the options of a registration for the user with
+// the handle userID, which is never shown to the user. exclude are the
+// credentials the user registered before.
+func (rp *RelyingParty) CreationOptions(challenge, userID, name, displayName string, exclude []CredentialDescriptor) *CreationOptions {
+	if exclude == nil {
+		exclude = []CredentialDescriptor{}
+	}
+	return &CreationOptions{
+		RP:        RPEntity{ID: rp.ID, Name: rp.Name},
+		User:      UserEntity{ID: Encoding.EncodeToString([]byte(userID)), Name: name, DisplayName: displayName},
+		Challenge: challenge,
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Alg: AlgES256},
+			{Type: "public-key", Alg: AlgEdDSA},
+			{Type: "public-key", Alg: AlgRS256},
+		},
+		Timeout:            300000,
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: "preferred",
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions returns the options of an authentication, limited to allow
+// unless it is empty
+func (rp *RelyingParty) RequestOptions(challenge string, allow []CredentialDescriptor, userVerification string) *RequestOptions {
+	if allow == nil {
+		allow = []CredentialDescriptor{}
+	}
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          300000,
+		RPID:             rp.ID,
+		AllowCredentials: allow,
+		UserVerification: userVerification,
+	}
+}
+
+// VerifyRegistration checks a registration response against the challenge it
+// was created for, as section 7.1 of WebAuthn level 2 requires, and returns
+// the new credential
+func (rp *RelyingParty) VerifyRegistration(res *RegistrationResponse, challenge string, requireUserVerification bool) (*Credential, error) {
+	if res.Type != "public-key" {
+		return nil, fmt.Errorf("%w: unexpected credential type %q", ErrCeremonyRejected, res.Type)
+	}
+	if err := rp.verifyClientData(res.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	attestationObject, err := Encoding.DecodeString(res.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed attestation object", ErrCeremonyRejected)
+	}
+	// the statement is not checked, no attestation is asked for
+	var attestation struct {
+		Fmt      string `cbor:"fmt"`
+		AuthData []byte `cbor:"authData"`
+	}
+	if err := cbor.Unmarshal(attestationObject, &attestation); err != nil {
+		return nil, fmt.Errorf("%w: malformed attestation object: %v", ErrCeremonyRejected, err)
+	}
+
+	authData, err := rp.parseAuthenticatorData(attestation.AuthData, requireUserVerification)
+	if err != nil {
+		return nil, err
+	}
+	if authData.flags&flagAttested == 0 || authData.credentialID == nil {
+		return nil, fmt.Errorf("%w: no attested credential data", ErrCeremonyRejected)
+	}
+	if Encoding.EncodeToString(authData.credentialID) != res.ID {
+		return nil, fmt.Errorf("%w: credential id does not match", ErrCeremonyRejected)
+	}
+
+	public, err := parseCOSEKey(authData.publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCeremonyRejected, err)
+	}
+	pemKey, err := util.MarshalPublicKeyPEM(public)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:           res.ID,
+		PublicKey:    string(pemKey),
+		SignCount:    authData.signCount,
+		Transports:   res.Response.Transports,
+		UserVerified: authData.flags&flagUserVerified != 0,
+	}, nil
+}
+
+// VerifyAssertion checks an authentication response of cred against the
+// challenge it was created for, as section 7.2 of WebAuthn level 2 requires.
+// A sign count that does not go up means the authenticator was cloned,
+// unless the authenticator keeps no count at all.
+func (rp *RelyingParty) VerifyAssertion(res *AssertionResponse, challenge string, cred *Credential, requireUserVerification bool) (*Assertion, error) {
+	if res.Type != "public-key" {
+		return nil, fmt.Errorf("%w: unexpected credential type %q", ErrCeremonyRejected, res.Type)
+	}
+	if res.ID != cred.ID {
+		return nil, fmt.Errorf("%w: credential id does not match", ErrCeremonyRejected)
+	}
+	if err := rp.verifyClientData(res.Response.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return nil, err
+	}
+
+	rawAuthData, err := Encoding.DecodeString(res.Response.AuthenticatorData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed authenticator data", ErrCeremonyRejected)
+	}
+	authData, err := rp.parseAuthenticatorData(rawAuthData, requireUserVerification)
+	if err != nil {
+		return nil, err
+	}
+
+	clientData, _ := Encoding.DecodeString(res.Response.ClientDataJSON)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	sig, err := Encoding.DecodeString(res.Response.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrCeremonyRejected)
+	}
+	public, err := util.ParsePublicKeyPEM([]byte(cred.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	if !verifySignature(public, signed, sig) {
+		return nil, fmt.Errorf("%w: invalid signature", ErrCeremonyRejected)
+	}
+
+	if (authData.signCount != 0 || cred.SignCount != 0) && authData.signCount <= cred.SignCount {
+		return nil, fmt.Errorf("%w: sign count went backwards from %d to %d", ErrCeremonyRejected, cred.SignCount, authData.signCount)
+	}
+
+	userHandle, err := Encoding.DecodeString(res.Response.UserHandle)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed user handle", ErrCeremonyRejected)
+	}
+	return &Assertion{
+		CredentialID: cred.ID,
+		UserHandle:   string(userHandle),
+		SignCount:    authData.signCount,
+		UserVerified: authData.flags&flagUserVerified != 0,
+	}, nil
+}
+
+// UserHandle returns the user handle of an authentication response, which
+// names the account of a passkey before its credential is known
+func UserHandle(res *AssertionResponse) (string, error) {
+	userHandle, err := Encoding.DecodeString(res.Response.UserHandle)
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed user handle", ErrCeremonyRejected)
+	}
+	return string(userHandle), nil
+}
+
+func (rp *RelyingParty) verifyClientData(encoded, ceremony, challenge string) error {
+	b, err := Encoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("%w: malformed client data", ErrCeremonyRejected)
+	}
+
+	clientData := struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}{}
+	if err := json.Unmarshal(b, &clientData); err != nil {
+		return fmt.Errorf("%w: malformed client data", ErrCeremonyRejected)
+	}
+
+	switch {
+	case clientData.Type != ceremony:
+		return fmt.Errorf("%w: unexpected ceremony %q", ErrCeremonyRejected, clientData.Type)
+	case subtle.ConstantTimeCompare([]byte(clientData.Challenge), []byte(challenge)) != 1:
+		return fmt.Errorf("%w: challenge does not match", ErrCeremonyRejected)
+	case !rp.allowsOrigin(clientData.Origin):
+		return fmt.Errorf("%w: unexpected origin %q", ErrCeremonyRejected, clientData.Origin)
+	case clientData.CrossOrigin:
+		return fmt.Errorf("%w: cross origin ceremonies are not allowed", ErrCeremonyRejected)
+	}
+	return nil
+}
+
+func (rp *RelyingParty) allowsOrigin(origin string) bool {
+	for _, allowed := range rp.Origins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+type authenticatorData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthenticatorData parses the authenticator data of section 6.1 and
+// checks the relying party and the user flags
+func (rp *RelyingParty) parseAuthenticatorData(b []byte, requireUserVerification bool) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrCeremonyRejected)
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(b[:32], rpIDHash[:]) {
+		return nil, fmt.Errorf("%w: credential is scoped to another relying party", ErrCeremonyRejected)
+	}
+
+	data := &authenticatorData{flags: b[32], signCount: binary.BigEndian.Uint32(b[33:37])}
+	if data.flags&flagUserPresent == 0 {
+		return nil, fmt.Errorf("%w: user was not present", ErrCeremonyRejected)
+	}
+	if requireUserVerification && data.flags&flagUserVerified == 0 {
+		return nil, fmt.Errorf("%w: user was not verified", ErrCeremonyRejected)
+	}
+
+	if data.flags&flagAttested != 0 {
+		// AAGUID, credential id length and credential id
+		rest := b[37:]
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrCeremonyRejected)
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < n {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrCeremonyRejected)
+		}
+		data.credentialID, rest = rest[:n], rest[n:]
+
+		var key cbor.RawMessage
+		if _, err := cbor.UnmarshalFirst(rest, &key); err != nil {
+			return nil, fmt.Errorf("%w: malformed credential public key", ErrCeremonyRejected)
+		}
+		data.publicKey = key
+	}
+	return data, nil
+}
+
+// parseCOSEKey parses the COSE_Key of a credential with one of the accepted
+// algorithms
+func parseCOSEKey(b []byte) (crypto.PublicKey, error) {
+	params := map[int]interface{}{}
+	if err := cbor.Unmarshal(b, &params); err != nil {
+		return nil, fmt.Errorf("malformed credential public key")
+	}
+
+	alg, _ := coseInt(params[3])
+	switch alg {
+	case AlgES256:
+		x, _ := params[-2].([]byte)
+		y, _ := params[-3].([]byte)
+		if crv, _ := coseInt(params[-1]); crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("invalid ES256 key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("invalid ES256 key")
+		}
+		return key, nil
+	case AlgEdDSA:
+		x, _ := params[-2].([]byte)
+		if crv, _ := coseInt(params[-1]); crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid EdDSA key")
+		}
+		return ed25519.PublicKey(x), nil
+	case AlgRS256:
+		n, _ := params[-1].([]byte)
+		e, _ := params[-2].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RS256 key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %d", alg)
+}
+
+func coseInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case uint64:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// verifySignature checks sig over signed with the algorithm of the key type,
+// as a credential is only registered with one algorithm per key type
+func verifySignature(public crypto.PublicKey, signed, sig []byte) bool {
+	sum := sha256.Sum256(signed)
+	switch key := public.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, sum[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signed, sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil
+	}
+	return false
+}
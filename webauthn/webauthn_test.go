@@ -0,0 +1,97 @@
+package webauthn
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/blazingly-fast/auth-assistant/webauthn/webauthntest"
+	"github.com/stretchr/testify/require"
+)
+
+func register(t *testing.T, rp *RelyingParty, a *webauthntest.Authenticator, challenge string) *RegistrationResponse {
+	options, err := json.Marshal(rp.CreationOptions(challenge, "uuid", "john@mail.com", "John", nil))
+	require.NoError(t, err)
+	b, err := a.Create(options)
+	require.NoError(t, err)
+
+	res := &RegistrationResponse{}
+	require.NoError(t, json.Unmarshal(b, res))
+	return res
+}
+
+func authenticate(t *testing.T, rp *RelyingParty, a *webauthntest.Authenticator, challenge string, allow ...CredentialDescriptor) *AssertionResponse {
+	options, err := json.Marshal(rp.RequestOptions(challenge, allow, "preferred"))
+	require.NoError(t, err)
+	b, err := a.Get(options)
+	require.NoError(t, err)
+
+	res := &AssertionResponse{}
+	require.NoError(t, json.Unmarshal(b, res))
+	return res
+}
+
+func TestCeremonies(t *testing.T) {
+	rp := NewRelyingParty("localhost", "auth-assistant", "http://localhost:3000")
+	a := webauthntest.NewAuthenticator("http://localhost:3000")
+
+	res := register(t, rp, a, "challenge")
+	_, err := rp.VerifyRegistration(res, "other", false)
+	require.ErrorIs(t, err, ErrCeremonyRejected)
+	cred, err := rp.VerifyRegistration(res, "challenge", true)
+	require.NoError(t, err)
+	require.Equal(t, res.ID, cred.ID)
+	require.Contains(t, cred.PublicKey, "PUBLIC KEY")
+	require.True(t, cred.UserVerified)
+	require.Equal(t, []string{"internal"}, cred.Transports)
+
+	allow := []CredentialDescriptor{{Type: "public-key", ID: cred.ID}}
+	assertion, err := rp.VerifyAssertion(authenticate(t, rp, a, "login", allow...), "login", cred, true)
+	require.NoError(t, err)
+	require.Equal(t, "uuid", assertion.UserHandle)
+	require.Equal(t, uint32(1), assertion.SignCount)
+	cred.SignCount = assertion.SignCount
+
+	// passkeys are offered without naming the credential
+	res2 := authenticate(t, rp, a, "login")
+	userHandle, err := UserHandle(res2)
+	require.NoError(t, err)
+	require.Equal(t, "uuid", userHandle)
+	_, err = rp.VerifyAssertion(res2, "login", cred, true)
+	require.NoError(t, err)
+
+	// a cloned authenticator signs a count that was seen before
+	a.SetCounter(cred.ID, 0)
+	cred.SignCount = 2
+	_, err = rp.VerifyAssertion(authenticate(t, rp, a, "login", allow...), "login", cred, false)
+	require.ErrorIs(t, err, ErrCeremonyRejected)
+	require.Contains(t, err.Error(), "sign count")
+
+	// the response of another page or ceremony is not accepted
+	_, err = rp.VerifyAssertion(authenticate(t, rp, a, "login", allow...), "other", cred, false)
+	require.ErrorIs(t, err, ErrCeremonyRejected)
+	other := NewRelyingParty("localhost", "auth-assistant", "https://evil.example.com")
+	a.SetCounter(cred.ID, 10)
+	_, err = other.VerifyAssertion(authenticate(t, rp, a, "login", allow...), "login", cred, false)
+	require.ErrorIs(t, err, ErrCeremonyRejected)
+	_, err = rp.VerifyRegistration(res, "challenge", false)
+	require.NoError(t, err)
+
+	// user verification is only enforced when asked for
+	a.UserVerification = false
+	_, err = rp.VerifyAssertion(authenticate(t, rp, a, "login", allow...), "login", cred, true)
+	require.ErrorIs(t, err, ErrCeremonyRejected)
+	_, err = rp.VerifyAssertion(authenticate(t, rp, a, "login", allow...), "login", cred, false)
+	require.NoError(t, err)
+
+	// signatures are checked against the registered key
+	tampered := authenticate(t, rp, a, "login", allow...)
+	tampered.Response.Signature = res2.Response.Signature
+	_, err = rp.VerifyAssertion(tampered, "login", cred, false)
+	require.ErrorIs(t, err, ErrCeremonyRejected)
+
+	// registered credentials are excluded from another registration
+	options, err := json.Marshal(rp.CreationOptions("challenge", "uuid", "john@mail.com", "John", allow))
+	require.NoError(t, err)
+	_, err = a.Create(options)
+	require.Error(t, err)
+}
@@ -0,0 +1,226 @@
+// Package webauthntest provides a software authenticator, to test WebAuthn
+// ceremonies without a browser or a security key
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+var encoding = base64.RawURLEncoding
+
+// Authenticator is a platform authenticator holding ES256 passkeys. It plays
+// the part of the browser too, taking the JSON options of a ceremony and
+// returning the JSON of the PublicKeyCredential for the page at Origin.
+// UserVerification is whether it reports the user as verified.
+type Authenticator struct {
+	Origin           string
+	UserVerification bool
+
+	mu          sync.Mutex
+	credentials []*credential
+}
+
+type credential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	counter    uint32
+}
+
+func NewAuthenticator(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, UserVerification: true}
+}
+
+// Create runs navigator.credentials.create() with the options options and
+// returns the registration response. It fails when the authenticator holds
+// one of the excluded credentials.
+func (a *Authenticator) Create(options []byte) ([]byte, error) {
+	opts := struct {
+		RP struct {
+			ID string `json:"id"`
+		} `json:"rp"`
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+		Challenge          string `json:"challenge"`
+		ExcludeCredentials []struct {
+			ID string `json:"id"`
+		} `json:"excludeCredentials"`
+	}{}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, excluded := range opts.ExcludeCredentials {
+		if a.find(opts.RP.ID, excluded.ID) != nil {
+			return nil, fmt.Errorf("credential %s is already registered", excluded.ID)
+		}
+	}
+
+	userHandle, err := encoding.DecodeString(opts.User.ID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	cred := &credential{id: id, rpID: opts.RP.ID, userHandle: userHandle, key: key}
+	a.credentials = append(a.credentials, cred)
+
+	publicKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,  // EC2
+		3:  -7, // ES256
+		-1: 1,  // P-256
+		-2: key.X.FillBytes(make([]byte, 32)),
+		-3: key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// AAGUID, which is all zeros without attestation, and the credential
+	attested := make([]byte, 18)
+	binary.BigEndian.PutUint16(attested[16:], uint16(len(id)))
+	attested = append(append(attested, id...), publicKey...)
+
+	attestationObject, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": append(a.authenticatorData(cred, 0x40), attested...),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]interface{}{
+		"id":    encoding.EncodeToString(id),
+		"rawId": encoding.EncodeToString(id),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    a.clientData("webauthn.create", opts.Challenge),
+			"attestationObject": encoding.EncodeToString(attestationObject),
+			"transports":        []string{"internal"},
+		},
+	}
+	return json.Marshal(res)
+}
+
+// Get runs navigator.credentials.get() with the options options and returns
+// the authentication response of the first credential that is allowed, or of
+// the first passkey of the relying party when any is allowed
+func (a *Authenticator) Get(options []byte) ([]byte, error) {
+	opts := struct {
+		Challenge        string `json:"challenge"`
+		RPID             string `json:"rpId"`
+		AllowCredentials []struct {
+			ID string `json:"id"`
+		} `json:"allowCredentials"`
+	}{}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var cred *credential
+	if len(opts.AllowCredentials) == 0 {
+		cred = a.find(opts.RPID, "")
+	}
+	for _, allowed := range opts.AllowCredentials {
+		if cred = a.find(opts.RPID, allowed.ID); cred != nil {
+			break
+		}
+	}
+	if cred == nil {
+		return nil, fmt.Errorf("no credential for %s", opts.RPID)
+	}
+
+	cred.counter++
+	authData := a.authenticatorData(cred, 0)
+	clientData := a.clientData("webauthn.get", opts.Challenge)
+	rawClientData, _ := encoding.DecodeString(clientData)
+	clientDataHash := sha256.Sum256(rawClientData)
+	sum := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, cred.key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]interface{}{
+		"id":    encoding.EncodeToString(cred.id),
+		"rawId": encoding.EncodeToString(cred.id),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    clientData,
+			"authenticatorData": encoding.EncodeToString(authData),
+			"signature":         encoding.EncodeToString(sig),
+			"userHandle":        encoding.EncodeToString(cred.userHandle),
+		},
+	}
+	return json.Marshal(res)
+}
+
+// SetCounter sets the sign count of the credential id, the next assertion
+// signs the count after it. A count lower than the last one acts like a
+// cloned authenticator.
+func (a *Authenticator) SetCounter(id string, counter uint32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, cred := range a.credentials {
+		if encoding.EncodeToString(cred.id) == id {
+			cred.counter = counter
+		}
+	}
+}
+
+func (a *Authenticator) find(rpID, id string) *credential {
+	for _, cred := range a.credentials {
+		if cred.rpID == rpID && (id == "" || encoding.EncodeToString(cred.id) == id) {
+			return cred
+		}
+	}
+	return nil
+}
+
+func (a *Authenticator) authenticatorData(cred *credential, flags byte) []byte {
+	flags |= 0x01
+	if a.UserVerification {
+		flags |= 0x04
+	}
+
+	rpIDHash := sha256.Sum256([]byte(cred.rpID))
+	b := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], cred.counter)
+	return b
+}
+
+func (a *Authenticator) clientData(ceremony, challenge string) string {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   challenge,
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+	return encoding.EncodeToString(b)
+}